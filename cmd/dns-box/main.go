@@ -2,12 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
@@ -18,18 +19,37 @@ import (
 	"github.com/crazytypewriter/dns-box/internal/config"
 	"github.com/crazytypewriter/dns-box/internal/dns"
 	"github.com/crazytypewriter/dns-box/internal/ipset"
+	"github.com/crazytypewriter/dns-box/internal/netlist"
+	"github.com/crazytypewriter/dns-box/internal/route"
 	log "github.com/sirupsen/logrus"
 )
 
-var configPath string
+var (
+	configPath           string
+	printEffectiveConfig bool
+	// overrides задают поля конфига из переменных окружения DNS_BOX_* и флагов вида -server.log.
+	overrides = config.NewOverrides(os.Environ())
+)
 
 func init() {
-	flag.StringVar(&configPath, "config", "config.json", "path to config file")
+	flag.StringVar(&configPath, "config", "config.json", "path to config file (.json, .yaml/.yml or .toml)")
+	flag.BoolVar(&printEffectiveConfig, "print-effective-config", false, "print the config with environment and flag overrides applied, secrets redacted, and exit")
+	overrides.RegisterFlags(flag.CommandLine)
 }
 
 func main() {
 	flag.Parse()
 
+	if flag.Arg(0) == "check-config" {
+		os.Exit(checkConfig(os.Stdout, flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "migrate-config" {
+		os.Exit(migrateConfig(os.Stdout, flag.Args()[1:]))
+	}
+	if printEffectiveConfig {
+		os.Exit(printConfig(os.Stdout, configPath))
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -53,7 +73,7 @@ func main() {
 }
 
 func run(ctx context.Context, configPath string, logOutput io.Writer) error {
-	cfg, err := config.LoadConfig(configPath)
+	cfg, err := config.LoadConfigWithOverrides(configPath, overrides)
 	if err != nil {
 		return err
 	}
@@ -75,6 +95,10 @@ func run(ctx context.Context, configPath string, logOutput io.Writer) error {
 		ForceColors: true,
 	})
 
+	for _, issue := range config.Warnings(cfg.Validate()) {
+		l.Warnf("Config %s: %s", issue.Path, issue.Message)
+	}
+
 	dnsCache := C.NewDNSCache(1024*1024*8, l) // 8MB
 	domainCache := cache.NewDomainCache(1024 * 1024 * 8)
 
@@ -86,94 +110,46 @@ func run(ctx context.Context, configPath string, logOutput io.Writer) error {
 	}
 
 	l.Debugf("Initializing ipset...")
-	ipSet := ipset.New()
+	ipSet, err := ipset.NewBackend(cfg.IPSet)
+	if err != nil {
+		l.Errorf("Error initializing ipset backend: %v (set ipset.backend to %q to run without ipset)", err, ipset.BackendDryRun)
+		return err
+	}
+	if cfg.IPSet.Backend == ipset.BackendDryRun {
+		l.Warnf("ipset dry-run mode: addresses are kept in memory only, see GET /ipset/dry_run")
+	}
 	l.Debugf("IPSet initialized.")
 
 	// Initialize per-list domain caches
-	listDomainCaches := make(map[int]*cache.DomainCache)
+	listDomainCaches := cache.NewListCaches()
 	ipSetLists := cfg.GetIPSetLists()
-	for i, listCfg := range ipSetLists {
-		listCache := cache.NewDomainCache(1024 * 1024 * 2) // 2MB per list
-		for _, domain := range listCfg.Rules.Domains {
-			listCache.Add(domain)
-		}
-		for _, suffix := range listCfg.Rules.DomainSuffix {
-			listCache.AddSuffix(suffix)
-		}
-		listDomainCaches[i] = listCache
-		l.Debugf("Initialized domain cache for ipset list %d: %s (%d domains, %d suffixes)",
-			i, listCfg.Name, len(listCfg.Rules.Domains), len(listCfg.Rules.DomainSuffix))
-	}
-
 	for _, listCfg := range ipSetLists {
-		timeout := listCfg.Timeout
-		if timeout == 0 {
-			timeout = 7200 // default timeout
-		}
-
-		l.Debugf("Creating IPv4 set: %s", listCfg.Name)
-		if err := ipSet.CreateIPv4Set(listCfg.Name, timeout); err != nil {
-			l.Errorf("Error creating IPv4 set %s: %v", listCfg.Name, err)
-			return err
-		}
-		l.Debugf("IPv4 set %s created successfully.", listCfg.Name)
-
-		if listCfg.EnableIPv6 {
-			ipv6Name := listCfg.Name + "6"
-			l.Debugf("Creating IPv6 set: %s", ipv6Name)
-			if err := ipSet.CreateIPv6Set(ipv6Name, timeout); err != nil {
-				l.Errorf("Error creating IPv6 set %s: %v", ipv6Name, err)
-				return err
-			}
-			l.Debugf("IPv6 set %s created successfully.", ipv6Name)
-		}
+		listDomainCaches.Build(listCfg.Name, listCfg.Rules.Domains, listCfg.Rules.DomainSuffix)
+		listDomainCaches.Exclude(listCfg.Name, listCfg.Rules.ExcludeDomains, listCfg.Rules.ExcludeDomainSuffix)
+		l.Debugf("Initialized domain cache for ipset list %s (%d domains, %d suffixes)",
+			listCfg.Name, len(listCfg.Rules.Domains), len(listCfg.Rules.DomainSuffix))
 	}
 
-	// Initialize net lists (hash:net sets with static CIDRs)
-	for _, netListCfg := range cfg.IPSet.NetLists {
-		timeout := netListCfg.Timeout
-		if timeout == 0 {
-			timeout = 7200
-		}
+	if err := reconcileSets(cfg, ipSet, l); err != nil {
+		return err
+	}
 
-		l.Debugf("Creating IPv4 net set: %s", netListCfg.Name)
-		if err := ipSet.CreateIPv4NetSet(netListCfg.Name, timeout); err != nil {
-			l.Errorf("Error creating IPv4 net set %s: %v", netListCfg.Name, err)
+	// fwmark и маршруты списков с параметром route; в dry_run ядро не трогаем
+	var routes *route.Manager
+	if cfg.IPSet.Backend != ipset.BackendDryRun {
+		routes = route.NewManager(cfg, ipSet, l)
+		if err := routes.Apply(); err != nil {
+			l.Errorf("Failed to set up policy routing: %v", err)
+			routes.Cleanup()
 			return err
 		}
-		l.Debugf("IPv4 net set %s created successfully.", netListCfg.Name)
-
-		if netListCfg.EnableIPv6 {
-			ipv6Name := netListCfg.Name + "6"
-			l.Debugf("Creating IPv6 net set: %s", ipv6Name)
-			if err := ipSet.CreateIPv6NetSet(ipv6Name, timeout); err != nil {
-				l.Errorf("Error creating IPv6 net set %s: %v", ipv6Name, err)
-				return err
-			}
-			l.Debugf("IPv6 net set %s created successfully.", ipv6Name)
-		}
-
-		for _, cidr := range netListCfg.CIDRs {
-			_, ipNet, err := net.ParseCIDR(cidr)
-			if err != nil {
-				l.Warnf("Invalid CIDR %s in net list %s: %v", cidr, netListCfg.Name, err)
-				continue
-			}
-			if ipNet.IP.To4() != nil {
-				if addErr := ipSet.AddElement(netListCfg.Name, cidr, timeout); addErr != nil {
-					l.Errorf("Error adding CIDR %s to net set %s: %v", cidr, netListCfg.Name, addErr)
-				}
-			} else {
-				if netListCfg.EnableIPv6 {
-					ipv6Name := netListCfg.Name + "6"
-					if addErr := ipSet.AddElement(ipv6Name, cidr, timeout); addErr != nil {
-						l.Errorf("Error adding CIDR %s to net set %s: %v", cidr, ipv6Name, addErr)
-					}
-				}
-			}
-		}
 	}
 
+	// Статические CIDR, подсети ASN, стран и подписок загружаются в net-множества, static_ips — в множества
+	// списков; всё это поддерживается в фоне
+	netLists := netlist.NewManager(cfg, ipSet, l)
+	netLists.Start(ctx)
+
 	// Инициализация и запуск BlockList
 	var blockList *blocklist.BlockList
 	if cfg.BlockList.Enabled {
@@ -181,13 +157,21 @@ func run(ctx context.Context, configPath string, logOutput io.Writer) error {
 		go blockList.Start(ctx)
 	}
 
-	dnsHandler := dns.NewDnsHandler(cfg, dnsCache, domainCache, ipSet, blockList, listDomainCaches, l)
+	// Адреса из DNS-ответов пишутся в ipset в фоне, пачками
+	writer := ipset.NewWriter(ipSet, l)
+	writer.Start(ctx)
+
+	dnsHandler := dns.NewDnsHandler(cfg, dnsCache, domainCache, writer, blockList, listDomainCaches, l)
 	dnsServer := dns.NewServer(cfg, dnsHandler)
 	go dnsServer.Start(ctx)
 	l.Infof("DNS server started on %s", cfg.Server.Address[0])
 
-	apiServer := api.NewServer(cfg, dnsCache, domainCache, blockList, listDomainCaches, ipSet, l)
-	go apiServer.Start(ctx, ":8090")
+	// Изменения из API пишутся на диск сразу, копия в GitHub отправляется в фоне
+	persister := config.NewPersister(cfg)
+	persister.Start(ctx)
+
+	apiServer := api.NewServer(cfg, dnsCache, domainCache, blockList, listDomainCaches, writer, dnsHandler.Provenance(), dnsHandler.Claims(), persister, netLists, l)
+	go apiServer.Start(ctx, cfg.Server.GetAPIAddress())
 
 	<-ctx.Done()
 
@@ -196,9 +180,9 @@ func run(ctx context.Context, configPath string, logOutput io.Writer) error {
 
 	l.Infof("Shutting down DNS server...")
 
-	// Сохраняем конфиг в GitHub ПЕРЕД остановкой DNS сервера
+	// Сохраняем конфиг и неотправленные изменения в GitHub ПЕРЕД остановкой DNS сервера
 	l.Info("Saving config to disk and GitHub...")
-	if err := cfg.SaveConfig(); err != nil {
+	if err := persister.Flush(shutdownCtx); err != nil {
 		l.Errorf("Failed to save config: %v", err)
 	} else {
 		l.Info("Config saved successfully")
@@ -209,5 +193,188 @@ func run(ctx context.Context, configPath string, logOutput io.Writer) error {
 	l.Info("Stopping API server...")
 	apiServer.Stop(shutdownCtx)
 
+	if routes != nil {
+		l.Info("Removing policy routing...")
+		if err := routes.Cleanup(); err != nil {
+			l.Errorf("Failed to remove policy routing: %v", err)
+		}
+	}
+
 	return ctx.Err()
 }
+
+// checkConfig проверяет конфиг, печатает ошибки и предупреждения и возвращает
+// код выхода: 1, если dns-box с таким конфигом не запустится.
+func checkConfig(w io.Writer, args []string) int {
+	fs := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	fs.SetOutput(w)
+	path := fs.String("config", configPath, "path to config file (.json, .yaml/.yml or .toml)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	// check-config ничего не пишет, поэтому старый конфиг обновляется только в памяти.
+	// Переопределения из окружения проверяются вместе с файлом.
+	cfg, m, err := config.ReadConfigWithOverrides(*path, overrides)
+	var invalid *config.ValidationError
+	switch {
+	case errors.As(err, &invalid):
+		for _, issue := range invalid.Issues {
+			fmt.Fprintln(w, issue)
+		}
+		return 1
+	case err != nil:
+		fmt.Fprintf(w, "error: %s: %v\n", *path, err)
+		return 1
+	}
+
+	if m != nil {
+		fmt.Fprintln(w, config.Issue{Path: "version", Warning: true,
+			Message: fmt.Sprintf("config version %d will be migrated to %d on start, run migrate-config to see the changes", m.From, m.To)})
+	}
+	for _, issue := range cfg.Validate() {
+		fmt.Fprintln(w, issue)
+	}
+	// Маршруты проверяются вместе: fwmark и таблицы не должны пересекаться между списками.
+	if _, err := route.Policies(cfg); err != nil {
+		fmt.Fprintln(w, config.Issue{Path: "ipset", Message: err.Error()})
+		return 1
+	}
+	fmt.Fprintf(w, "%s: ok\n", *path)
+	return 0
+}
+
+// migrateConfig обновляет конфиг до текущей версии схемы и печатает разницу.
+// С -dry-run файл не меняется.
+func migrateConfig(w io.Writer, args []string) int {
+	fs := flag.NewFlagSet("migrate-config", flag.ContinueOnError)
+	fs.SetOutput(w)
+	path := fs.String("config", configPath, "path to config file (.json, .yaml/.yml or .toml)")
+	dryRun := fs.Bool("dry-run", false, "print the changes without writing the config")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	_, m, err := config.ReadConfigWithOverrides(*path, overrides)
+	var invalid *config.ValidationError
+	switch {
+	case errors.As(err, &invalid):
+		for _, issue := range invalid.Issues {
+			fmt.Fprintln(w, issue)
+		}
+		return 1
+	case err != nil:
+		fmt.Fprintf(w, "error: %s: %v\n", *path, err)
+		return 1
+	case m == nil:
+		fmt.Fprintf(w, "%s: already at version %d\n", *path, config.CurrentVersion)
+		return 0
+	}
+
+	for _, note := range m.Notes {
+		fmt.Fprintf(w, "note: %s\n", note)
+	}
+	fmt.Fprint(w, m.Diff())
+	if *dryRun {
+		fmt.Fprintf(w, "%s: version %d can be migrated to %d (dry run, nothing written)\n", *path, m.From, m.To)
+		return 0
+	}
+	if err := m.WriteFile(*path); err != nil {
+		fmt.Fprintf(w, "error: %s: %v\n", *path, err)
+		return 1
+	}
+	fmt.Fprintf(w, "%s: migrated from version %d to %d, backup saved to %s\n", *path, m.From, m.To, m.BackupPath(*path))
+	return 0
+}
+
+// printConfig печатает конфиг с переопределениями из окружения и флагов,
+// как его увидит dns-box при запуске. Секреты скрыты.
+func printConfig(w io.Writer, path string) int {
+	cfg, _, err := config.ReadConfigWithOverrides(path, overrides)
+	if err != nil {
+		fmt.Fprintf(w, "error: %s: %v\n", path, err)
+		return 1
+	}
+	data, err := cfg.EffectiveConfig()
+	if err != nil {
+		fmt.Fprintf(w, "error: %s: %v\n", path, err)
+		return 1
+	}
+	w.Write(data)
+	return 0
+}
+
+// reconcileSets приводит множества в ядре к конфигу и запоминает, какие
+// множества созданы dns-box, чтобы при следующем запуске найти множества
+// удалённых списков.
+func reconcileSets(cfg *config.Config, ipSet ipset.Backend, l *log.Logger) error {
+	desired := ipset.DesiredSets(cfg.GetIPSetLists(), cfg.GetNetLists())
+
+	// В режиме dry_run множества живут в памяти, файл состояния не нужен.
+	statePath := ""
+	if cfg.IPSet.Backend != ipset.BackendDryRun {
+		statePath = managedSetsPath(cfg)
+	}
+
+	var orphaned, destroy []string
+	if statePath != "" {
+		previous, err := ipset.LoadManagedSets(statePath)
+		if err != nil {
+			l.Warnf("Failed to read managed sets: %v", err)
+		}
+		orphaned = ipset.RemovedSets(previous, desired)
+		if cfg.IPSet.DestroyRemovedSets {
+			destroy = orphaned
+		} else if len(orphaned) > 0 {
+			l.Warnf("Sets of removed lists are kept: %v (set ipset.destroy_removed_sets to destroy them)", orphaned)
+		}
+	}
+
+	report := ipset.Reconcile(ipSet, desired, destroy)
+	destroyed := make(map[string]bool)
+	for _, change := range report.Changes {
+		if change.Action == ipset.ActionDestroyed {
+			destroyed[change.Set] = true
+		}
+		switch change.Action {
+		case ipset.ActionUnchanged:
+			l.Debugf("Set %s is up to date", change.Set)
+		case ipset.ActionFailed:
+			l.Errorf("Set %s: %s", change.Set, change.Detail)
+		default:
+			l.Infof("Set %s %s %s", change.Set, change.Action, change.Detail)
+		}
+	}
+
+	if len(report.Unusable) > 0 {
+		return fmt.Errorf("failed to create or update ipset sets: %v", report.Unusable)
+	}
+
+	if statePath != "" {
+		names := make([]string, 0, len(desired)+len(orphaned))
+		for _, set := range desired {
+			names = append(names, set.Name)
+		}
+		// Неудалённые множества остаются в файле до следующей попытки.
+		for _, name := range orphaned {
+			if !destroyed[name] {
+				names = append(names, name)
+			}
+		}
+		if err := ipset.SaveManagedSets(statePath, names); err != nil {
+			l.Warnf("Failed to save managed sets to %s: %v", statePath, err)
+		}
+	}
+	return nil
+}
+
+// managedSetsPath — ipset.state_file или файл рядом с конфигом.
+func managedSetsPath(cfg *config.Config) string {
+	if cfg.IPSet.StateFile != "" {
+		return cfg.IPSet.StateFile
+	}
+	if cfg.Path == "" {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(cfg.Path), "dns-box-sets.json")
+}
@@ -38,7 +38,9 @@ func TestBlocklistE2E(t *testing.T) {
 			UpstreamServers: []string{"8.8.8.8:53"},
 		},
 		BlockList: config.BlockListConfig{
-			URLs: []string{"https://blocklistproject.github.io/Lists/tracking.txt"},
+			Groups: []config.BlockListGroupConfig{
+				{Name: config.DefaultBlockListGroup, Enabled: true, URLs: []string{"https://blocklistproject.github.io/Lists/tracking.txt"}},
+			},
 		},
 	}
 	configPath := filepath.Join(tmpDir, "test_config.json")
@@ -99,3 +101,109 @@ func TestBlocklistE2E(t *testing.T) {
 		t.Fatal("сервер не остановился вовремя")
 	}
 }
+
+func TestCheckConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		code   int
+		output []string
+	}{
+		{
+			name:   "valid",
+			config: `{"server": {"address": ["127.0.0.1:53"]}, "dns": {"upstream_servers": ["tls://1.1.1.1"]}, "ipset": {"lists": [{"name": "vpn", "enable_ipv6": true}]}}`,
+			code:   0,
+			output: []string{": ok"},
+		},
+		{
+			name: "invalid",
+			config: `{"server": {"address": []}, "dns": {"upstream_servers": ["quic://dns.example"]},
+				"ipset": {"lists": [{"name": "vpn"}, {"name": "vpn"}, {"name": "very_long_list_name_for_the_kernel", "enable_ipv6": true}],
+				"net_lists": [{"name": "corp", "cidr": ["10.0.0.0/33"]}]}}`,
+			code: 1,
+			output: []string{
+				"error: server.address: at least one listen address is required",
+				"error: dns.upstream_servers[0]: unsupported upstream scheme",
+				"error: ipset.lists[1].name: set vpn is already used by ipset.lists[0].name",
+				"error: ipset.lists[2].name:",
+				"error: ipset.net_lists[0].cidr[0]: invalid CIDR",
+			},
+		},
+		{
+			name:   "conflicting routes",
+			config: `{"server": {"address": [":53"]}, "dns": {"upstream_servers": ["8.8.8.8"]}, "ipset": {"lists": [{"name": "vpn", "route": {"interface": "wg0", "table": 100}}]}}`,
+			code:   1,
+			output: []string{"error: ipset: list vpn: route.fwmark"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			require.NoError(t, os.WriteFile(path, []byte(tt.config), 0600))
+
+			var out strings.Builder
+			code := checkConfig(&out, []string{"-config", path})
+			require.Equal(t, tt.code, code, out.String())
+			for _, want := range tt.output {
+				require.Contains(t, out.String(), want)
+			}
+		})
+	}
+}
+
+func TestMigrateConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	legacy := `{"server": {"address": [":53"]}, "dns": {"upstream_servers": ["8.8.8.8"]}, "ipset": {"ipv4name": "vpn"}, "rules": {"domain": ["example.com"]}}`
+	require.NoError(t, os.WriteFile(path, []byte(legacy), 0600))
+
+	var out strings.Builder
+	require.Equal(t, 0, migrateConfig(&out, []string{"-config", path, "-dry-run"}), out.String())
+	require.Contains(t, out.String(), "note: ipset.ipv4name vpn and the global rules are moved")
+	require.Contains(t, out.String(), `-    "ipv4name": "vpn"`)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, legacy, string(data))
+
+	out.Reset()
+	require.Equal(t, 0, checkConfig(&out, []string{"-config", path}), out.String())
+	require.Contains(t, out.String(), "warning: version: config version 1 will be migrated")
+
+	out.Reset()
+	require.Equal(t, 0, migrateConfig(&out, []string{"-config", path}), out.String())
+	require.Contains(t, out.String(), "backup saved to "+path+".v1.bak")
+	backup, err := os.ReadFile(path + ".v1.bak")
+	require.NoError(t, err)
+	require.Equal(t, legacy, string(backup))
+
+	out.Reset()
+	require.Equal(t, 0, migrateConfig(&out, []string{"-config", path}), out.String())
+	require.Contains(t, out.String(), "already at version 2")
+}
+
+func TestPrintEffectiveConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`version: 2
+server:
+  address: [":53"]
+dns:
+  upstream_servers: [8.8.8.8]
+github_backup:
+  token: file-token
+`), 0600))
+
+	saved := overrides
+	t.Cleanup(func() { overrides = saved })
+	overrides = config.NewOverrides([]string{"DNS_BOX_SERVER_API_ADDRESS=127.0.0.1:9090", "DNS_BOX_DNS_TIMEOUT=3"})
+
+	var out strings.Builder
+	require.Equal(t, 0, printConfig(&out, path), out.String())
+	require.Contains(t, out.String(), "api_address: 127.0.0.1:9090")
+	require.Contains(t, out.String(), "timeout: 3")
+	require.Contains(t, out.String(), "token: <redacted>")
+	require.NotContains(t, out.String(), "file-token")
+
+	overrides = config.NewOverrides([]string{"DNS_BOX_DNS_TIMEOUT=soon"})
+	out.Reset()
+	require.Equal(t, 1, printConfig(&out, path))
+	require.Contains(t, out.String(), `DNS_BOX_DNS_TIMEOUT: invalid integer "soon"`)
+}
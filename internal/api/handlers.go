@@ -2,15 +2,20 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/netip"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/crazytypewriter/dns-box/internal/blocklist"
 	"github.com/crazytypewriter/dns-box/internal/cache"
 	"github.com/crazytypewriter/dns-box/internal/config"
 	"github.com/crazytypewriter/dns-box/internal/ipset"
+	"github.com/crazytypewriter/dns-box/internal/netlist"
 	"net"
 )
 
@@ -19,11 +24,15 @@ type Handlers struct {
 	dnsCache         *cache.DNSCache
 	domainCache      *cache.DomainCache
 	blockList        *blocklist.BlockList
-	listDomainCaches map[int]*cache.DomainCache
-	ipSet            *ipset.IPSet
+	listDomainCaches *cache.ListCaches
+	ipSet            *ipset.Writer
+	provenance       *ipset.Provenance
+	claims           *ipset.Claims
+	persist          *config.Persister
+	netLists         *netlist.Manager
 }
 
-func NewHandlers(cfg *config.Config, dnsCache *cache.DNSCache, domainCache *cache.DomainCache, blockList *blocklist.BlockList, listDomainCaches map[int]*cache.DomainCache, ipSet *ipset.IPSet) *Handlers {
+func NewHandlers(cfg *config.Config, dnsCache *cache.DNSCache, domainCache *cache.DomainCache, blockList *blocklist.BlockList, listDomainCaches *cache.ListCaches, ipSet *ipset.Writer, provenance *ipset.Provenance, claims *ipset.Claims, persist *config.Persister, netLists *netlist.Manager) *Handlers {
 	return &Handlers{
 		cfg:              cfg,
 		dnsCache:         dnsCache,
@@ -31,6 +40,10 @@ func NewHandlers(cfg *config.Config, dnsCache *cache.DNSCache, domainCache *cach
 		blockList:        blockList,
 		listDomainCaches: listDomainCaches,
 		ipSet:            ipSet,
+		provenance:       provenance,
+		claims:           claims,
+		persist:          persist,
+		netLists:         netLists,
 	}
 }
 
@@ -39,10 +52,17 @@ func (h *Handlers) Routes() *http.ServeMux {
 	mux.HandleFunc("/domains", h.handleDomains)
 	mux.HandleFunc("/suffixes", h.handleSuffixes)
 	mux.HandleFunc("/blocklist/urls", h.handleBlocklistURLs)
+	mux.HandleFunc("/blocklist/status", h.handleBlocklistStatus)
+	mux.HandleFunc("/blocklist/groups", h.handleBlocklistGroups)
+	mux.HandleFunc("/blocklist/groups/", h.handleBlocklistGroup)
+	mux.HandleFunc("/blocklist/pause", h.handleBlocklistPause)
 	mux.HandleFunc("/ipset/lists", h.handleIPSetLists)
+	mux.HandleFunc("/ipset/dry_run", h.handleIPSetDryRun)
+	mux.HandleFunc("/ipset/writer", h.handleIPSetWriter)
 	mux.HandleFunc("/ipset/net_lists", h.handleNetLists)
 	mux.HandleFunc("/ipset/net/", h.handleNetList)
 	mux.HandleFunc("/ipset/", h.handleIPSetList)
+	mux.HandleFunc("/config/status", h.handleConfigStatus)
 	return mux
 }
 
@@ -97,25 +117,174 @@ func (h *Handlers) addDomains(w http.ResponseWriter, r *http.Request) {
 			h.cfg.AddDomain(domain)
 		}
 	}
-	if err := h.cfg.SaveConfig(); err != nil {
+	if err := h.persist.Save(); err != nil {
 		http.Error(w, "Failed to save config", http.StatusInternalServerError)
 		return
 	}
 	w.Write([]byte("ok"))
 }
 
-// handleNetLists returns the list of all net list configurations.
+// handleNetLists manages net lists at runtime.
+// Routes:
+//
+//	GET    /ipset/net_lists  - get all net lists
+//	POST   /ipset/net_lists  - create a net list, body is a NetListConfig; CIDRs are loaded immediately,
+//	                           ASN, country and source prefixes right after in the background
+//	PATCH  /ipset/net_lists  - body {"name": "tg", "enable_ipv6": true, "timeout": 3600}; fields are optional
+//	DELETE /ipset/net_lists  - body {"name": "tg"}; destroys the kernel sets
 func (h *Handlers) handleNetLists(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	switch r.Method {
+	case http.MethodGet:
+		lists := h.cfg.GetNetLists()
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(lists); err != nil {
+			http.Error(w, "failed to encode net lists", http.StatusInternalServerError)
+		}
+	case http.MethodPost:
+		h.createNetList(w, r)
+	case http.MethodPatch:
+		h.updateNetList(w, r)
+	case http.MethodDelete:
+		h.deleteNetList(w, r)
+	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handlers) createNetList(w http.ResponseWriter, r *http.Request) {
+	var list config.NetListConfig
+	if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	if err := config.CheckSetName(list.Name, list.EnableIPv6); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid list name: name %v", err), http.StatusBadRequest)
+		return
+	}
+	for _, cidr := range list.CIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			http.Error(w, fmt.Sprintf("invalid cidr %s: %v", cidr, err), http.StatusBadRequest)
+			return
+		}
+	}
 
-	lists := h.cfg.GetNetLists()
+	if err := h.cfg.AddNetList(list); err != nil {
+		http.Error(w, err.Error(), listErrorStatus(err))
+		return
+	}
+	if err := h.createSets(ipset.DesiredSets(nil, []config.NetListConfig{list})); err != nil {
+		h.cfg.RemoveNetList(list.Name)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := netListResult{NetListConfig: list, Errors: h.loadNetListCIDRs(list, true, true)}
+	// ASN, страны и подписки заполняет netlist.Manager.
+	h.netLists.SyncList(list.Name)
+
+	if err := h.persist.Save(); err != nil {
+		http.Error(w, "Failed to save config", http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(lists); err != nil {
-		http.Error(w, "failed to encode net lists", http.StatusInternalServerError)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *Handlers) updateNetList(w http.ResponseWriter, r *http.Request) {
+	var patch listPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || patch.Name == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
 	}
+	// Имя списка, созданного без IPv6, может не оставить места для суффикса 6.
+	if patch.EnableIPv6 != nil && *patch.EnableIPv6 {
+		if err := config.CheckSetName(patch.Name, true); err != nil {
+			http.Error(w, fmt.Sprintf("Cannot enable IPv6: name %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	before, after, err := h.cfg.UpdateNetList(patch.Name, patch.EnableIPv6, patch.Timeout)
+	if err != nil {
+		http.Error(w, err.Error(), listErrorStatus(err))
+		return
+	}
+	if err := h.toggleIPv6Set(after.Name, ipset.DesiredSets(nil, []config.NetListConfig{after}), before.EnableIPv6, after.EnableIPv6); err != nil {
+		h.cfg.UpdateNetList(before.Name, &before.EnableIPv6, &before.Timeout)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// CIDR добавляются со своим таймаутом, поэтому при его изменении
+	// перезаписываем их; для новой IPv6-пары загружаем IPv6-подсети.
+	timeoutChanged := before.Timeout != after.Timeout
+	result := netListResult{NetListConfig: after, Errors: h.loadNetListCIDRs(after, timeoutChanged, timeoutChanged || !before.EnableIPv6)}
+	h.netLists.SyncList(after.Name)
+
+	if err := h.persist.Save(); err != nil {
+		http.Error(w, "Failed to save config", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func (h *Handlers) deleteNetList(w http.ResponseWriter, r *http.Request) {
+	var patch listPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || patch.Name == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	list, err := h.cfg.RemoveNetList(patch.Name)
+	if err != nil {
+		http.Error(w, err.Error(), listErrorStatus(err))
+		return
+	}
+	if err := h.destroySets(list.Name, list.EnableIPv6); err != nil {
+		h.cfg.AddNetList(list)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if err := h.persist.Save(); err != nil {
+		http.Error(w, "Failed to save config", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// netListResult is a net list with the CIDRs that could not be loaded into the set.
+type netListResult struct {
+	config.NetListConfig
+	Errors []string `json:"errors,omitempty"`
+}
+
+// loadNetListCIDRs adds the net list CIDRs to its IPv4 and/or IPv6 set.
+func (h *Handlers) loadNetListCIDRs(list config.NetListConfig, ipv4, ipv6 bool) []string {
+	timeout := list.Timeout
+	if timeout == 0 {
+		timeout = 7200
+	}
+	var errs []string
+	for _, cidr := range list.CIDRs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		setName := list.Name
+		if ipNet.IP.To4() == nil {
+			if !ipv6 || !list.EnableIPv6 {
+				continue
+			}
+			setName += "6"
+		} else if !ipv4 {
+			continue
+		}
+		if err := h.ipSet.AddElement(setName, cidr, timeout); err != nil {
+			errs = append(errs, fmt.Sprintf("error adding cidr %s to ipset %s: %v", cidr, setName, err))
+		}
+	}
+	return errs
 }
 
 // handleNetList handles per-list CIDR management.
@@ -124,51 +293,51 @@ func (h *Handlers) handleNetLists(w http.ResponseWriter, r *http.Request) {
 //	GET    /ipset/net/{name}/cidrs  - get CIDRs for net list
 //	POST   /ipset/net/{name}/cidrs  - add CIDRs to net list
 //	DELETE /ipset/net/{name}/cidrs  - remove CIDRs from net list
+//	GET    /ipset/net/{name}/entries - live set contents with remaining timeouts
 func (h *Handlers) handleNetList(w http.ResponseWriter, r *http.Request) {
 	path := strings.TrimPrefix(r.URL.Path, "/ipset/net/")
 	parts := strings.Split(path, "/")
 	if len(parts) != 2 {
-		http.Error(w, "Invalid path. Expected /ipset/net/{name}/cidrs", http.StatusBadRequest)
+		http.Error(w, "Invalid path. Expected /ipset/net/{name}/{cidrs|entries}", http.StatusBadRequest)
 		return
 	}
 
 	listName := parts[0]
 	resource := parts[1]
-	if resource != "cidrs" {
-		http.Error(w, "Invalid resource. Expected 'cidrs'", http.StatusBadRequest)
+	if resource != "cidrs" && resource != "entries" {
+		http.Error(w, "Invalid resource. Expected 'cidrs' or 'entries'", http.StatusBadRequest)
 		return
 	}
 
-	listIndex := h.findNetListIndex(listName)
-	if listIndex == -1 {
+	list, ok := h.cfg.GetNetList(listName)
+	if !ok {
 		http.Error(w, fmt.Sprintf("Net list '%s' not found", listName), http.StatusNotFound)
 		return
 	}
 
+	if resource == "entries" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.writeSetEntries(w, list.Name, list.EnableIPv6)
+		return
+	}
+
 	switch r.Method {
 	case http.MethodGet:
-		h.getNetListCIDRs(w, r, listIndex)
+		h.getNetListCIDRs(w, r, listName)
 	case http.MethodPost:
-		h.addNetListCIDRs(w, r, listIndex)
+		h.addNetListCIDRs(w, r, listName)
 	case http.MethodDelete:
-		h.removeNetListCIDRs(w, r, listIndex)
+		h.removeNetListCIDRs(w, r, listName)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
 
-func (h *Handlers) findNetListIndex(name string) int {
-	lists := h.cfg.GetNetLists()
-	for i, list := range lists {
-		if list.Name == name {
-			return i
-		}
-	}
-	return -1
-}
-
-func (h *Handlers) getNetListCIDRs(w http.ResponseWriter, r *http.Request, listIndex int) {
-	cidrs := h.cfg.GetNetListCIDRs(listIndex)
+func (h *Handlers) getNetListCIDRs(w http.ResponseWriter, r *http.Request, listName string) {
+	cidrs := h.cfg.GetNetListCIDRs(listName)
 	if cidrs == nil {
 		http.Error(w, "Net list not found", http.StatusNotFound)
 		return
@@ -180,19 +349,18 @@ func (h *Handlers) getNetListCIDRs(w http.ResponseWriter, r *http.Request, listI
 	}
 }
 
-func (h *Handlers) addNetListCIDRs(w http.ResponseWriter, r *http.Request, listIndex int) {
+func (h *Handlers) addNetListCIDRs(w http.ResponseWriter, r *http.Request, listName string) {
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "failed to read body", http.StatusBadRequest)
 		return
 	}
 
-	lists := h.cfg.GetNetLists()
-	if listIndex < 0 || listIndex >= len(lists) {
+	listCfg, ok := h.cfg.GetNetList(listName)
+	if !ok {
 		http.Error(w, "Net list not found", http.StatusNotFound)
 		return
 	}
-	listCfg := lists[listIndex]
 	timeout := listCfg.Timeout
 	if timeout == 0 {
 		timeout = 7200
@@ -212,29 +380,28 @@ func (h *Handlers) addNetListCIDRs(w http.ResponseWriter, r *http.Request, listI
 			w.Write([]byte(fmt.Sprintf("error adding cidr %s to ipset: %v\n", cidr, addErr)))
 			continue
 		}
-		h.cfg.AddCIDRToNetList(listIndex, cidr)
+		h.cfg.AddCIDRToNetList(listName, cidr)
 	}
 
-	if err := h.cfg.SaveConfig(); err != nil {
+	if err := h.persist.Save(); err != nil {
 		http.Error(w, "Failed to save config", http.StatusInternalServerError)
 		return
 	}
 	w.Write([]byte("ok"))
 }
 
-func (h *Handlers) removeNetListCIDRs(w http.ResponseWriter, r *http.Request, listIndex int) {
+func (h *Handlers) removeNetListCIDRs(w http.ResponseWriter, r *http.Request, listName string) {
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "failed to read body", http.StatusBadRequest)
 		return
 	}
 
-	lists := h.cfg.GetNetLists()
-	if listIndex < 0 || listIndex >= len(lists) {
+	listCfg, ok := h.cfg.GetNetList(listName)
+	if !ok {
 		http.Error(w, "Net list not found", http.StatusNotFound)
 		return
 	}
-	listCfg := lists[listIndex]
 
 	lines := strings.Split(string(bodyBytes), "\n")
 	for _, line := range lines {
@@ -246,10 +413,10 @@ func (h *Handlers) removeNetListCIDRs(w http.ResponseWriter, r *http.Request, li
 			w.Write([]byte(fmt.Sprintf("error removing cidr %s from ipset: %v\n", cidr, delErr)))
 			continue
 		}
-		h.cfg.RemoveCIDRFromNetList(listIndex, cidr)
+		h.cfg.RemoveCIDRFromNetList(listName, cidr)
 	}
 
-	if err := h.cfg.SaveConfig(); err != nil {
+	if err := h.persist.Save(); err != nil {
 		http.Error(w, "Failed to save config", http.StatusInternalServerError)
 		return
 	}
@@ -274,7 +441,7 @@ func (h *Handlers) removeDomains(w http.ResponseWriter, r *http.Request) {
 			h.cfg.RemoveDomain(domain)
 		}
 	}
-	if err := h.cfg.SaveConfig(); err != nil {
+	if err := h.persist.Save(); err != nil {
 		http.Error(w, "Failed to save config", http.StatusInternalServerError)
 		return
 	}
@@ -306,7 +473,7 @@ func (h *Handlers) addSuffixes(w http.ResponseWriter, r *http.Request) {
 			h.cfg.AddSuffix(suffix)
 		}
 	}
-	if err := h.cfg.SaveConfig(); err != nil {
+	if err := h.persist.Save(); err != nil {
 		http.Error(w, "Failed to save config", http.StatusInternalServerError)
 		return
 	}
@@ -328,7 +495,7 @@ func (h *Handlers) handleBlocklistURLs(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handlers) getBlocklistURLs(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(h.cfg.BlockList.URLs); err != nil {
+	if err := json.NewEncoder(w).Encode(h.cfg.GetBlockListURLs()); err != nil {
 		http.Error(w, "failed to encode URLs", http.StatusInternalServerError)
 	}
 }
@@ -344,11 +511,11 @@ func (h *Handlers) addBlocklistURL(w http.ResponseWriter, r *http.Request) {
 
 	h.cfg.AddBlockListURL(payload.URL)
 	if h.blockList != nil {
-		h.blockList.UpdateURLs(h.cfg.BlockList.URLs)
+		h.blockList.UpdateURLs(h.cfg.GetBlockListURLs())
 		h.blockList.ForceRefresh()
 	}
 
-	if err := h.cfg.SaveConfig(); err != nil {
+	if err := h.persist.Save(); err != nil {
 		http.Error(w, "Failed to save config", http.StatusInternalServerError)
 		return
 	}
@@ -366,17 +533,157 @@ func (h *Handlers) removeBlocklistURL(w http.ResponseWriter, r *http.Request) {
 
 	h.cfg.RemoveBlockListURL(payload.URL)
 	if h.blockList != nil {
-		h.blockList.UpdateURLs(h.cfg.BlockList.URLs)
+		h.blockList.UpdateURLs(h.cfg.GetBlockListURLs())
 		h.blockList.ForceRefresh()
 	}
 
-	if err := h.cfg.SaveConfig(); err != nil {
+	if err := h.persist.Save(); err != nil {
 		http.Error(w, "Failed to save config", http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// handleBlocklistStatus returns the last refresh time and per-source fetch results.
+func (h *Handlers) handleBlocklistStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.blockList == nil {
+		http.Error(w, "Blocklist is disabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.blockList.GetStatus()); err != nil {
+		http.Error(w, "failed to encode blocklist status", http.StatusInternalServerError)
+	}
+}
+
+// handleBlocklistGroups returns the state of every blocklist group.
+func (h *Handlers) handleBlocklistGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.blockList == nil {
+		http.Error(w, "Blocklist is disabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.blockList.GetStatus().Groups); err != nil {
+		http.Error(w, "failed to encode blocklist groups", http.StatusInternalServerError)
+	}
+}
+
+// handleBlocklistGroup toggles a single group without refetching its lists.
+// Routes:
+//
+//	PATCH /blocklist/groups/{name}  - body {"enabled": bool}
+func (h *Handlers) handleBlocklistGroup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.blockList == nil {
+		http.Error(w, "Blocklist is disabled", http.StatusNotFound)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/blocklist/groups/")
+	var payload struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.Enabled == nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if !h.blockList.SetGroupEnabled(name, *payload.Enabled) {
+		http.Error(w, fmt.Sprintf("Blocklist group '%s' not found", name), http.StatusNotFound)
+		return
+	}
+
+	// Состояние, которое нельзя сохранить, после перезапуска молча
+	// вернулось бы, поэтому изменение откатывается.
+	if !h.cfg.SetBlockListGroupEnabled(name, *payload.Enabled) {
+		h.blockList.SetGroupEnabled(name, !*payload.Enabled)
+		http.Error(w, fmt.Sprintf("Blocklist group '%s' is not in the config, its state cannot be saved", name), http.StatusBadRequest)
+		return
+	}
+	if err := h.persist.Save(); err != nil {
+		http.Error(w, "Failed to save config", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleBlocklistPause temporarily disables blocking globally or for one group.
+// Routes:
+//
+//	POST   /blocklist/pause  - body {"duration": "5m", "group": "ads"}; group is optional
+//	DELETE /blocklist/pause  - body {"group": "ads"}; resumes blocking early
+func (h *Handlers) handleBlocklistPause(w http.ResponseWriter, r *http.Request) {
+	if h.blockList == nil {
+		http.Error(w, "Blocklist is disabled", http.StatusNotFound)
+		return
+	}
+
+	var payload struct {
+		Duration string `json:"duration"`
+		Group    string `json:"group"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var until *time.Time
+	switch r.Method {
+	case http.MethodPost:
+		d, err := time.ParseDuration(payload.Duration)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid duration", http.StatusBadRequest)
+			return
+		}
+		t := time.Now().Add(d)
+		until = &t
+		if !h.blockList.PauseUntil(payload.Group, t) {
+			http.Error(w, fmt.Sprintf("Blocklist group '%s' not found", payload.Group), http.StatusNotFound)
+			return
+		}
+	case http.MethodDelete:
+		if !h.blockList.Resume(payload.Group) {
+			http.Error(w, fmt.Sprintf("Blocklist group '%s' not found", payload.Group), http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Срок паузы сохраняется в конфиг, чтобы пережить перезапуск. Пауза,
+	// которую нельзя сохранить, после перезапуска молча пропала бы, поэтому
+	// она отменяется.
+	if !h.cfg.SetBlockListPause(payload.Group, until) {
+		if until != nil {
+			h.blockList.Resume(payload.Group)
+			http.Error(w, fmt.Sprintf("Blocklist group '%s' is not in the config, its pause cannot be saved", payload.Group), http.StatusBadRequest)
+			return
+		}
+	} else if err := h.persist.Save(); err != nil {
+		http.Error(w, "Failed to save config", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.blockList.GetStatus()); err != nil {
+		http.Error(w, "failed to encode blocklist status", http.StatusInternalServerError)
+	}
+}
+
 func (h *Handlers) removeSuffixes(w http.ResponseWriter, r *http.Request) {
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -395,24 +702,252 @@ func (h *Handlers) removeSuffixes(w http.ResponseWriter, r *http.Request) {
 			h.cfg.RemoveSuffix(suffix)
 		}
 	}
-	if err := h.cfg.SaveConfig(); err != nil {
+	if err := h.persist.Save(); err != nil {
 		http.Error(w, "Failed to save config", http.StatusInternalServerError)
 		return
 	}
 	w.Write([]byte("ok"))
 }
 
-// handleIPSetLists returns the list of all ipset configurations.
+// handleIPSetLists manages ipset lists at runtime.
+// Routes:
+//
+//	GET    /ipset/lists  - get all lists
+//	POST   /ipset/lists  - create a list, body is an IPSetListConfig
+//	PATCH  /ipset/lists  - body {"name": "vpn", "enable_ipv6": true, "timeout": 3600}; fields are optional
+//	DELETE /ipset/lists  - body {"name": "vpn"}; destroys the kernel sets
 func (h *Handlers) handleIPSetLists(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		lists := h.cfg.GetIPSetLists()
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(lists); err != nil {
+			http.Error(w, "failed to encode ipset lists", http.StatusInternalServerError)
+		}
+	case http.MethodPost:
+		h.createIPSetList(w, r)
+	case http.MethodPatch:
+		h.updateIPSetList(w, r)
+	case http.MethodDelete:
+		h.deleteIPSetList(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listPatch is the body of PATCH and DELETE on /ipset/lists and /ipset/net_lists.
+type listPatch struct {
+	Name       string  `json:"name"`
+	EnableIPv6 *bool   `json:"enable_ipv6"`
+	Timeout    *uint32 `json:"timeout"`
+}
+
+func (h *Handlers) createIPSetList(w http.ResponseWriter, r *http.Request) {
+	var list config.IPSetListConfig
+	if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := config.CheckSetName(list.Name, list.EnableIPv6); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid list name: name %v", err), http.StatusBadRequest)
+		return
+	}
+	for _, ip := range list.StaticIPs {
+		if _, err := netip.ParseAddr(ip); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid static ip %s", ip), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := h.cfg.AddIPSetList(list); err != nil {
+		http.Error(w, err.Error(), listErrorStatus(err))
+		return
+	}
+	if err := h.createSets(ipset.DesiredSets([]config.IPSetListConfig{list}, nil)); err != nil {
+		h.cfg.RemoveIPSetList(list.Name)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.listDomainCaches.Build(list.Name, list.Rules.Domains, list.Rules.DomainSuffix)
+	h.listDomainCaches.Exclude(list.Name, list.Rules.ExcludeDomains, list.Rules.ExcludeDomainSuffix)
+	h.addStaticIPs(list)
+
+	if err := h.persist.Save(); err != nil {
+		http.Error(w, "Failed to save config", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(list)
+}
+
+func (h *Handlers) updateIPSetList(w http.ResponseWriter, r *http.Request) {
+	var patch listPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || patch.Name == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	// Имя списка, созданного без IPv6, может не оставить места для суффикса 6.
+	if patch.EnableIPv6 != nil && *patch.EnableIPv6 {
+		if err := config.CheckSetName(patch.Name, true); err != nil {
+			http.Error(w, fmt.Sprintf("Cannot enable IPv6: name %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	before, after, err := h.cfg.UpdateIPSetList(patch.Name, patch.EnableIPv6, patch.Timeout)
+	if err != nil {
+		http.Error(w, err.Error(), listErrorStatus(err))
+		return
+	}
+	// Таймаут элементов задаётся при каждом добавлении (TTL ответа), поэтому
+	// менять существующие множества нужно только при переключении IPv6.
+	if err := h.toggleIPv6Set(after.Name, ipset.DesiredSets([]config.IPSetListConfig{after}, nil), before.EnableIPv6, after.EnableIPv6); err != nil {
+		h.cfg.UpdateIPSetList(before.Name, &before.EnableIPv6, &before.Timeout)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.persist.Save(); err != nil {
+		http.Error(w, "Failed to save config", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(after)
+}
+
+func (h *Handlers) deleteIPSetList(w http.ResponseWriter, r *http.Request) {
+	var patch listPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || patch.Name == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	list, err := h.cfg.RemoveIPSetList(patch.Name)
+	if err != nil {
+		http.Error(w, err.Error(), listErrorStatus(err))
+		return
+	}
+	h.listDomainCaches.Delete(list.Name)
+
+	// Множество может быть занято правилом iptables — тогда возвращаем список обратно.
+	if err := h.destroySets(list.Name, list.EnableIPv6); err != nil {
+		h.cfg.AddIPSetList(list)
+		h.listDomainCaches.Build(list.Name, list.Rules.Domains, list.Rules.DomainSuffix)
+		h.listDomainCaches.Exclude(list.Name, list.Rules.ExcludeDomains, list.Rules.ExcludeDomainSuffix)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if err := h.persist.Save(); err != nil {
+		http.Error(w, "Failed to save config", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listErrorStatus maps config list errors to HTTP status codes.
+func listErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, config.ErrListNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, config.ErrListExists), errors.Is(err, config.ErrLegacyIPSet):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// createSets creates the sets of a list (see ipset.DesiredSets) with the list's
+// options, destroying the already created ones on error.
+func (h *Handlers) createSets(sets []ipset.DesiredSet) error {
+	for i, set := range sets {
+		if err := h.ipSet.CreateSet(set.Name, set.Options); err != nil {
+			for _, created := range sets[:i] {
+				h.ipSet.DestroySet(created.Name)
+			}
+			return fmt.Errorf("error creating set %s: %w", set.Name, err)
+		}
+	}
+	return nil
+}
+
+// destroySets destroys the IPv4 set and its IPv6 pair.
+func (h *Handlers) destroySets(name string, withIPv6 bool) error {
+	if withIPv6 {
+		if err := h.ipSet.DestroySet(name + "6"); err != nil {
+			return fmt.Errorf("error destroying set %s: %w", name+"6", err)
+		}
+	}
+	if err := h.ipSet.DestroySet(name); err != nil {
+		return fmt.Errorf("error destroying set %s: %w", name, err)
+	}
+	return nil
+}
+
+// toggleIPv6Set creates or destroys the IPv6 pair when enable_ipv6 changes;
+// sets are the sets of the list after the change.
+func (h *Handlers) toggleIPv6Set(name string, sets []ipset.DesiredSet, before, after bool) error {
+	switch {
+	case !before && after:
+		for _, set := range sets {
+			if set.Name != name+"6" {
+				continue
+			}
+			if err := h.ipSet.CreateSet(set.Name, set.Options); err != nil {
+				return fmt.Errorf("error creating set %s: %w", set.Name, err)
+			}
+		}
+	case before && !after:
+		if err := h.ipSet.DestroySet(name + "6"); err != nil {
+			return fmt.Errorf("error destroying set %s: %w", name+"6", err)
+		}
+	}
+	return nil
+}
+
+// handleIPSetDryRun returns the in-memory sets when ipset.backend is "dry_run".
+func (h *Handlers) handleIPSetDryRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	memory, ok := h.ipSet.Backend.(*ipset.Memory)
+	if !ok {
+		http.Error(w, "ipset dry-run mode is disabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(memory.Dump()); err != nil {
+		http.Error(w, "failed to encode ipset sets", http.StatusInternalServerError)
+	}
+}
+
+// handleIPSetWriter returns the counters of the background ipset writer.
+func (h *Handlers) handleIPSetWriter(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	lists := h.cfg.GetIPSetLists()
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(lists); err != nil {
-		http.Error(w, "failed to encode ipset lists", http.StatusInternalServerError)
+	if err := json.NewEncoder(w).Encode(h.ipSet.Stats()); err != nil {
+		http.Error(w, "failed to encode ipset writer stats", http.StatusInternalServerError)
+	}
+}
+
+// handleConfigStatus returns the state of config persistence: the last disk
+// write and the pending, last successful and failed GitHub backups.
+func (h *Handlers) handleConfigStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.persist.Status()); err != nil {
+		http.Error(w, "failed to encode config status", http.StatusInternalServerError)
 	}
 }
 
@@ -425,69 +960,128 @@ func (h *Handlers) handleIPSetLists(w http.ResponseWriter, r *http.Request) {
 //	GET    /ipset/{name}/suffixes  - get suffixes for list
 //	POST   /ipset/{name}/suffixes  - add suffixes to list
 //	DELETE /ipset/{name}/suffixes  - remove suffixes from list
+//	GET    /ipset/{name}/entries   - live set contents with the domain that added each IP
 func (h *Handlers) handleIPSetList(w http.ResponseWriter, r *http.Request) {
 	// Extract list name and resource type from path
-	// Path format: /ipset/{name}/{domains|suffixes}
+	// Path format: /ipset/{name}/{domains|suffixes|exclude_domains|exclude_suffixes|static_ips|entries}
 	path := strings.TrimPrefix(r.URL.Path, "/ipset/")
 	parts := strings.Split(path, "/")
 	if len(parts) != 2 {
-		http.Error(w, "Invalid path. Expected /ipset/{name}/{domains|suffixes}", http.StatusBadRequest)
+		http.Error(w, "Invalid path. Expected /ipset/{name}/{domains|suffixes|exclude_domains|exclude_suffixes|static_ips|entries}", http.StatusBadRequest)
 		return
 	}
 
 	listName := parts[0]
 	resource := parts[1]
-	if resource != "domains" && resource != "suffixes" {
-		http.Error(w, "Invalid resource. Expected 'domains' or 'suffixes'", http.StatusBadRequest)
+	switch resource {
+	case "domains", "suffixes", "exclude_domains", "exclude_suffixes", "static_ips", "entries":
+	default:
+		http.Error(w, "Invalid resource. Expected 'domains', 'suffixes', 'exclude_domains', 'exclude_suffixes', 'static_ips' or 'entries'", http.StatusBadRequest)
 		return
 	}
 
-	// Find list index by name
-	listIndex := h.findListIndex(listName)
-	if listIndex == -1 {
+	list, ok := h.cfg.GetIPSetList(listName)
+	if !ok {
 		http.Error(w, fmt.Sprintf("List '%s' not found", listName), http.StatusNotFound)
 		return
 	}
 
 	switch resource {
+	case "entries":
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.writeSetEntries(w, list.Name, list.EnableIPv6)
 	case "domains":
 		switch r.Method {
 		case http.MethodGet:
-			h.getListDomains(w, r, listIndex)
+			h.getListDomains(w, r, listName)
 		case http.MethodPost:
-			h.addListDomains(w, r, listIndex)
+			h.addListDomains(w, r, listName)
 		case http.MethodDelete:
-			h.removeListDomains(w, r, listIndex)
+			h.removeListDomains(w, r, listName)
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	case "suffixes":
 		switch r.Method {
 		case http.MethodGet:
-			h.getListSuffixes(w, r, listIndex)
+			h.getListSuffixes(w, r, listName)
+		case http.MethodPost:
+			h.addListSuffixes(w, r, listName)
+		case http.MethodDelete:
+			h.removeListSuffixes(w, r, listName)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "exclude_domains", "exclude_suffixes":
+		suffix := resource == "exclude_suffixes"
+		switch r.Method {
+		case http.MethodGet:
+			h.getListExclusions(w, listName, suffix)
+		case http.MethodPost, http.MethodDelete:
+			h.changeListExclusions(w, r, listName, suffix)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	case "static_ips":
+		switch r.Method {
+		case http.MethodGet:
+			h.getListStaticIPs(w, listName)
 		case http.MethodPost:
-			h.addListSuffixes(w, r, listIndex)
+			h.addListStaticIPs(w, r, listName)
 		case http.MethodDelete:
-			h.removeListSuffixes(w, r, listIndex)
+			h.removeListStaticIPs(w, r, listName)
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	}
 }
 
-// findListIndex returns the index of the list with the given name, or -1 if not found.
-func (h *Handlers) findListIndex(name string) int {
-	lists := h.cfg.GetIPSetLists()
-	for i, list := range lists {
-		if list.Name == name {
-			return i
+// setEntry is a live set element. Domain and AddedAt are filled for addresses
+// added from DNS answers while they are still in the provenance index.
+type setEntry struct {
+	Set string `json:"set"`
+	ipset.Entry
+	Domain  string     `json:"domain,omitempty"`
+	AddedAt *time.Time `json:"added_at,omitempty"`
+}
+
+// writeSetEntries reads the IPv4 set and, if enabled, its IPv6 pair (name + "6").
+func (h *Handlers) writeSetEntries(w http.ResponseWriter, name string, withIPv6 bool) {
+	setNames := []string{name}
+	if withIPv6 {
+		setNames = append(setNames, name+"6")
+	}
+
+	result := []setEntry{}
+	for _, setName := range setNames {
+		entries, err := h.ipSet.List(setName)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to list set %s: %v", setName, err), http.StatusInternalServerError)
+			return
+		}
+		for _, entry := range entries {
+			item := setEntry{Set: setName, Entry: entry}
+			if h.provenance != nil {
+				if origin, ok := h.provenance.Lookup(setName, entry.Value); ok {
+					item.Domain = origin.Domain
+					item.AddedAt = &origin.AddedAt
+				}
+			}
+			result = append(result, item)
 		}
 	}
-	return -1
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, "failed to encode set entries", http.StatusInternalServerError)
+	}
 }
 
-func (h *Handlers) getListDomains(w http.ResponseWriter, r *http.Request, listIndex int) {
-	rules := h.cfg.GetListRules(listIndex)
+func (h *Handlers) getListDomains(w http.ResponseWriter, r *http.Request, listName string) {
+	rules := h.cfg.GetListRules(listName)
 	if rules == nil {
 		http.Error(w, "List not found", http.StatusNotFound)
 		return
@@ -499,7 +1093,7 @@ func (h *Handlers) getListDomains(w http.ResponseWriter, r *http.Request, listIn
 	}
 }
 
-func (h *Handlers) addListDomains(w http.ResponseWriter, r *http.Request, listIndex int) {
+func (h *Handlers) addListDomains(w http.ResponseWriter, r *http.Request, listName string) {
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "failed to read body", http.StatusBadRequest)
@@ -507,13 +1101,13 @@ func (h *Handlers) addListDomains(w http.ResponseWriter, r *http.Request, listIn
 	}
 
 	lines := strings.Split(string(bodyBytes), "\n")
-	listCache := h.listDomainCaches[listIndex]
+	listCache := h.listDomainCaches.Get(listName)
 
 	for _, line := range lines {
 		domain := strings.TrimSpace(line)
 		if domain != "" {
 			// Add to list config
-			h.cfg.AddDomainToList(listIndex, domain)
+			h.cfg.AddDomainToList(listName, domain)
 			// Add to per-list cache if available
 			if listCache != nil && !listCache.Contains(domain) {
 				listCache.Add(domain)
@@ -521,14 +1115,14 @@ func (h *Handlers) addListDomains(w http.ResponseWriter, r *http.Request, listIn
 		}
 	}
 
-	if err := h.cfg.SaveConfig(); err != nil {
+	if err := h.persist.Save(); err != nil {
 		http.Error(w, "Failed to save config", http.StatusInternalServerError)
 		return
 	}
 	w.Write([]byte("ok"))
 }
 
-func (h *Handlers) removeListDomains(w http.ResponseWriter, r *http.Request, listIndex int) {
+func (h *Handlers) removeListDomains(w http.ResponseWriter, r *http.Request, listName string) {
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "failed to read body", http.StatusBadRequest)
@@ -536,29 +1130,48 @@ func (h *Handlers) removeListDomains(w http.ResponseWriter, r *http.Request, lis
 	}
 
 	lines := strings.Split(string(bodyBytes), "\n")
-	listCache := h.listDomainCaches[listIndex]
+	listCache := h.listDomainCaches.Get(listName)
 
 	for _, line := range lines {
 		domain := strings.TrimSpace(line)
 		if domain != "" {
 			// Remove from list config
-			h.cfg.RemoveDomainFromList(listIndex, domain)
+			h.cfg.RemoveDomainFromList(listName, domain)
 			// Remove from per-list cache if available
 			if listCache != nil {
 				listCache.Remove(domain)
 			}
+			h.releaseRule(w, listName, domain)
 		}
 	}
 
-	if err := h.cfg.SaveConfig(); err != nil {
+	if err := h.persist.Save(); err != nil {
 		http.Error(w, "Failed to save config", http.StatusInternalServerError)
 		return
 	}
 	w.Write([]byte("ok"))
 }
 
-func (h *Handlers) getListSuffixes(w http.ResponseWriter, r *http.Request, listIndex int) {
-	rules := h.cfg.GetListRules(listIndex)
+// releaseRule removes IPs that were added to the list's sets only because of
+// the deleted rule. IPs still claimed by another active rule or listed in
+// static_ips stay in the set.
+func (h *Handlers) releaseRule(w http.ResponseWriter, listName, rule string) {
+	if h.claims == nil {
+		return
+	}
+	list, _ := h.cfg.GetIPSetList(listName)
+	for _, addr := range h.claims.Release(listName, rule) {
+		if slices.Contains(list.StaticIPs, addr.Value) {
+			continue
+		}
+		if err := h.ipSet.RemoveElement(addr.Set, addr.Value); err != nil {
+			w.Write([]byte(fmt.Sprintf("error removing %s from ipset %s: %v\n", addr.Value, addr.Set, err)))
+		}
+	}
+}
+
+func (h *Handlers) getListSuffixes(w http.ResponseWriter, r *http.Request, listName string) {
+	rules := h.cfg.GetListRules(listName)
 	if rules == nil {
 		http.Error(w, "List not found", http.StatusNotFound)
 		return
@@ -570,7 +1183,7 @@ func (h *Handlers) getListSuffixes(w http.ResponseWriter, r *http.Request, listI
 	}
 }
 
-func (h *Handlers) addListSuffixes(w http.ResponseWriter, r *http.Request, listIndex int) {
+func (h *Handlers) addListSuffixes(w http.ResponseWriter, r *http.Request, listName string) {
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "failed to read body", http.StatusBadRequest)
@@ -578,13 +1191,13 @@ func (h *Handlers) addListSuffixes(w http.ResponseWriter, r *http.Request, listI
 	}
 
 	lines := strings.Split(string(bodyBytes), "\n")
-	listCache := h.listDomainCaches[listIndex]
+	listCache := h.listDomainCaches.Get(listName)
 
 	for _, line := range lines {
 		suffix := strings.TrimSpace(line)
 		if suffix != "" {
 			// Add to list config
-			h.cfg.AddSuffixToList(listIndex, suffix)
+			h.cfg.AddSuffixToList(listName, suffix)
 			// Add to per-list cache if available
 			if listCache != nil && !listCache.ContainsSuffix(suffix) {
 				listCache.AddSuffix(suffix)
@@ -592,14 +1205,14 @@ func (h *Handlers) addListSuffixes(w http.ResponseWriter, r *http.Request, listI
 		}
 	}
 
-	if err := h.cfg.SaveConfig(); err != nil {
+	if err := h.persist.Save(); err != nil {
 		http.Error(w, "Failed to save config", http.StatusInternalServerError)
 		return
 	}
 	w.Write([]byte("ok"))
 }
 
-func (h *Handlers) removeListSuffixes(w http.ResponseWriter, r *http.Request, listIndex int) {
+func (h *Handlers) removeListSuffixes(w http.ResponseWriter, r *http.Request, listName string) {
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, "failed to read body", http.StatusBadRequest)
@@ -607,21 +1220,209 @@ func (h *Handlers) removeListSuffixes(w http.ResponseWriter, r *http.Request, li
 	}
 
 	lines := strings.Split(string(bodyBytes), "\n")
-	listCache := h.listDomainCaches[listIndex]
+	listCache := h.listDomainCaches.Get(listName)
 
 	for _, line := range lines {
 		suffix := strings.TrimSpace(line)
 		if suffix != "" {
 			// Remove from list config
-			h.cfg.RemoveSuffixFromList(listIndex, suffix)
+			h.cfg.RemoveSuffixFromList(listName, suffix)
+			// В кеше суффиксы хранятся с ведущей точкой (см. DomainCache.AddSuffix)
+			rule := suffix
+			if !strings.HasPrefix(rule, ".") {
+				rule = "." + rule
+			}
 			// Remove from per-list cache if available
 			if listCache != nil {
-				listCache.Remove(suffix)
+				listCache.Remove(rule)
+			}
+			h.releaseRule(w, listName, rule)
+		}
+	}
+
+	if err := h.persist.Save(); err != nil {
+		http.Error(w, "Failed to save config", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+func (h *Handlers) getListExclusions(w http.ResponseWriter, listName string, suffix bool) {
+	list, ok := h.cfg.GetIPSetList(listName)
+	if !ok {
+		http.Error(w, "List not found", http.StatusNotFound)
+		return
+	}
+	values := list.Rules.ExcludeDomains
+	if suffix {
+		values = list.Rules.ExcludeDomainSuffix
+	}
+	if values == nil {
+		values = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(values); err != nil {
+		http.Error(w, "failed to encode exclusions", http.StatusInternalServerError)
+	}
+}
+
+// changeListExclusions adds (POST) or removes (DELETE) excluded domains or
+// suffixes, one per line. Addresses already added for a newly excluded
+// domain stay in the sets until their timeout expires.
+func (h *Handlers) changeListExclusions(w http.ResponseWriter, r *http.Request, listName string, suffix bool) {
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+
+	for _, line := range strings.Split(string(bodyBytes), "\n") {
+		value := strings.TrimSpace(line)
+		if value == "" {
+			continue
+		}
+		if r.Method == http.MethodPost {
+			h.cfg.AddExclusionToList(listName, value, suffix)
+		} else {
+			h.cfg.RemoveExclusionFromList(listName, value, suffix)
+		}
+	}
+	if list, ok := h.cfg.GetIPSetList(listName); ok {
+		h.listDomainCaches.Exclude(list.Name, list.Rules.ExcludeDomains, list.Rules.ExcludeDomainSuffix)
+	}
+
+	if err := h.persist.Save(); err != nil {
+		http.Error(w, "Failed to save config", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+func (h *Handlers) getListStaticIPs(w http.ResponseWriter, listName string) {
+	list, ok := h.cfg.GetIPSetList(listName)
+	if !ok {
+		http.Error(w, "List not found", http.StatusNotFound)
+		return
+	}
+	ips := list.StaticIPs
+	if ips == nil {
+		ips = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ips); err != nil {
+		http.Error(w, "failed to encode static ips", http.StatusInternalServerError)
+	}
+}
+
+// staticIPSet returns the set of the list that holds the address.
+func staticIPSet(list config.IPSetListConfig, addr netip.Addr) (string, error) {
+	if !addr.Is6() {
+		return list.Name, nil
+	}
+	if !list.EnableIPv6 {
+		return "", fmt.Errorf("list %s has no IPv6 set", list.Name)
+	}
+	return list.Name + "6", nil
+}
+
+// addStaticIPs adds the static IPs of a new list to its sets without a
+// timeout, so they stay even if a sync fails. Failed addresses are retried
+// by netlist.Manager on its next sync.
+func (h *Handlers) addStaticIPs(list config.IPSetListConfig) {
+	for _, value := range list.StaticIPs {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			continue
+		}
+		if setName, err := staticIPSet(list, addr.Unmap()); err == nil {
+			h.ipSet.AddElement(setName, addr.Unmap().String(), 0)
+		}
+	}
+}
+
+// addListStaticIPs adds addresses to the list's sets right away and without
+// a timeout; netlist.Manager re-adds them if they are missing.
+func (h *Handlers) addListStaticIPs(w http.ResponseWriter, r *http.Request, listName string) {
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	list, ok := h.cfg.GetIPSetList(listName)
+	if !ok {
+		http.Error(w, "List not found", http.StatusNotFound)
+		return
+	}
+
+	for _, line := range strings.Split(string(bodyBytes), "\n") {
+		value := strings.TrimSpace(line)
+		if value == "" {
+			continue
+		}
+		addr, parseErr := netip.ParseAddr(value)
+		if parseErr != nil {
+			w.Write([]byte(fmt.Sprintf("invalid ip %s: %v\n", value, parseErr)))
+			continue
+		}
+		addr = addr.Unmap()
+		setName, setErr := staticIPSet(list, addr)
+		if setErr != nil {
+			w.Write([]byte(fmt.Sprintf("ip %s is skipped: %v\n", value, setErr)))
+			continue
+		}
+		if !h.cfg.AddStaticIPToList(listName, addr.String()) {
+			http.Error(w, config.ErrLegacyIPSet.Error(), http.StatusConflict)
+			return
+		}
+		if addErr := h.ipSet.AddElement(setName, addr.String(), 0); addErr != nil {
+			w.Write([]byte(fmt.Sprintf("error adding ip %s to ipset: %v\n", value, addErr)))
+			if !slices.Contains(list.StaticIPs, addr.String()) {
+				h.cfg.RemoveStaticIPFromList(listName, addr.String())
 			}
 		}
 	}
 
-	if err := h.cfg.SaveConfig(); err != nil {
+	if err := h.persist.Save(); err != nil {
+		http.Error(w, "Failed to save config", http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+func (h *Handlers) removeListStaticIPs(w http.ResponseWriter, r *http.Request, listName string) {
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "failed to read body", http.StatusBadRequest)
+		return
+	}
+	list, ok := h.cfg.GetIPSetList(listName)
+	if !ok {
+		http.Error(w, "List not found", http.StatusNotFound)
+		return
+	}
+
+	for _, line := range strings.Split(string(bodyBytes), "\n") {
+		value := strings.TrimSpace(line)
+		if value == "" {
+			continue
+		}
+		h.cfg.RemoveStaticIPFromList(listName, value)
+		addr, parseErr := netip.ParseAddr(value)
+		if parseErr != nil {
+			continue
+		}
+		setName, setErr := staticIPSet(list, addr.Unmap())
+		if setErr != nil {
+			continue
+		}
+		if delErr := h.ipSet.RemoveElement(setName, addr.Unmap().String()); delErr != nil {
+			w.Write([]byte(fmt.Sprintf("error removing ip %s from ipset %s: %v\n", value, setName, delErr)))
+		}
+	}
+
+	if err := h.persist.Save(); err != nil {
 		http.Error(w, "Failed to save config", http.StatusInternalServerError)
 		return
 	}
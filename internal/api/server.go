@@ -9,6 +9,7 @@ import (
 	"github.com/crazytypewriter/dns-box/internal/cache"
 	"github.com/crazytypewriter/dns-box/internal/config"
 	"github.com/crazytypewriter/dns-box/internal/ipset"
+	"github.com/crazytypewriter/dns-box/internal/netlist"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -19,11 +20,15 @@ type Server struct {
 	httpServer       *http.Server
 	log              *log.Logger
 	blockList        *blocklist.BlockList
-	listDomainCaches map[int]*cache.DomainCache
-	ipSet            *ipset.IPSet
+	listDomainCaches *cache.ListCaches
+	ipSet            *ipset.Writer
+	provenance       *ipset.Provenance
+	claims           *ipset.Claims
+	persist          *config.Persister
+	netLists         *netlist.Manager
 }
 
-func NewServer(cfg *config.Config, dnsCache *cache.DNSCache, domainCache *cache.DomainCache, blockList *blocklist.BlockList, listDomainCaches map[int]*cache.DomainCache, ipSet *ipset.IPSet, l *log.Logger) *Server {
+func NewServer(cfg *config.Config, dnsCache *cache.DNSCache, domainCache *cache.DomainCache, blockList *blocklist.BlockList, listDomainCaches *cache.ListCaches, ipSet *ipset.Writer, provenance *ipset.Provenance, claims *ipset.Claims, persist *config.Persister, netLists *netlist.Manager, l *log.Logger) *Server {
 	return &Server{
 		cfg:              cfg,
 		dnsCache:         dnsCache,
@@ -32,11 +37,15 @@ func NewServer(cfg *config.Config, dnsCache *cache.DNSCache, domainCache *cache.
 		blockList:        blockList,
 		listDomainCaches: listDomainCaches,
 		ipSet:            ipSet,
+		provenance:       provenance,
+		claims:           claims,
+		persist:          persist,
+		netLists:         netLists,
 	}
 }
 
 func (s *Server) Start(ctx context.Context, addr string) {
-	handlers := NewHandlers(s.cfg, s.dnsCache, s.domainCache, s.blockList, s.listDomainCaches, s.ipSet)
+	handlers := NewHandlers(s.cfg, s.dnsCache, s.domainCache, s.blockList, s.listDomainCaches, s.ipSet, s.provenance, s.claims, s.persist, s.netLists)
 
 	s.httpServer = &http.Server{
 		Addr:    addr,
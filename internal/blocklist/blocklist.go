@@ -3,10 +3,15 @@ package blocklist
 import (
 	"bufio"
 	"context"
+	"fmt"
 	"io"
 	"net/http"
+	"net/netip"
 	"os"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/crazytypewriter/dns-box/internal/cache"
@@ -14,143 +19,641 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-type BlockList struct {
-	urls           []string
-	refreshTicker  *time.Ticker
+// SourceStatus описывает результат последней загрузки одного источника.
+type SourceStatus struct {
+	URL        string    `json:"url"`
+	LastFetch  time.Time `json:"last_fetch"`
+	HTTPStatus int       `json:"http_status,omitempty"`
+	Domains    int       `json:"domains"`
+	Prefixes   int       `json:"prefixes,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// GroupStatus — состояние одной группы блоклиста.
+type GroupStatus struct {
+	Name         string         `json:"name"`
+	Enabled      bool           `json:"enabled"`
+	RefreshHours int            `json:"refresh_hours"`
+	LastUpdated  time.Time      `json:"last_updated"`
+	TotalDomains int            `json:"total_domains"`
+	Blocked      uint64         `json:"blocked"`
+	CNAMEBlocked uint64         `json:"cname_blocked"` // из них по звену цепочки CNAME
+	LastCNAME    *CNAMEBlock    `json:"last_cname,omitempty"`
+	Pause        *PauseStatus   `json:"pause,omitempty"`
+	URLs         []string       `json:"urls"`
+	Sources      []SourceStatus `json:"sources"`
+}
+
+// CNAMEBlock — запрос, заблокированный по звену цепочки CNAME.
+type CNAMEBlock struct {
+	Domain string    `json:"domain"`
+	CNAME  string    `json:"cname"`
+	Time   time.Time `json:"time"`
+}
+
+// PauseStatus — действующая пауза блокировки.
+type PauseStatus struct {
+	Until            time.Time `json:"until"`
+	RemainingSeconds int64     `json:"remaining_seconds"`
+}
+
+// Status — состояние блоклиста для API. TotalDomains учитывает только домены
+// включённых групп.
+type Status struct {
+	LastUpdated  time.Time     `json:"last_updated"`
+	TotalDomains int           `json:"total_domains"`
+	Pause        *PauseStatus  `json:"pause,omitempty"`
+	Groups       []GroupStatus `json:"groups"`
+	IPLists      *IPListStatus `json:"ip_lists,omitempty"`
+}
+
+// IPListStatus — состояние списков запрещённых IP и подсетей.
+type IPListStatus struct {
+	LastUpdated   time.Time      `json:"last_updated"`
+	TotalPrefixes int            `json:"total_prefixes"`
+	Blocked       uint64         `json:"blocked"`
+	URLs          []string       `json:"urls"`
+	Sources       []SourceStatus `json:"sources"`
+}
+
+// pause хранит срок временной приостановки блокировки (unix nano, 0 — паузы нет)
+// и таймер, который логирует автоматическое возобновление.
+type pause struct {
+	until atomic.Int64
+	timer *time.Timer // защищён BlockList.pauseMu
+}
+
+func (p *pause) active(now time.Time) bool {
+	return now.UnixNano() < p.until.Load()
+}
+
+func (p *pause) status(now time.Time) *PauseStatus {
+	until := p.until.Load()
+	if now.UnixNano() >= until {
+		return nil
+	}
+	return &PauseStatus{
+		Until:            time.Unix(0, until),
+		RemainingSeconds: int64(time.Unix(0, until).Sub(now).Round(time.Second) / time.Second),
+	}
+}
+
+// snapshot — неизменяемое состояние группы. После публикации через
+// atomic.Pointer его поля никогда не изменяются, поэтому читатели
+// (DNS и API горутины) обходятся без блокировок.
+type snapshot struct {
 	blockedDomains *cache.DomainCache
-	httpClient     *http.Client
-	logger         *log.Logger
-	stopChan       chan struct{}
-	forceUpdate    chan struct{}
-	lastUpdated    time.Time
 	totalDomains   int
+	lastUpdated    time.Time
+	sources        []SourceStatus
 }
 
-func NewBlockList(cfg *config.BlockListConfig, logger *log.Logger) *BlockList {
-	refreshHours := time.Duration(cfg.RefreshHours)
-	if refreshHours <= 0 {
-		logger.Warnf("Non-positive refresh interval specified (%d hours), defaulting to 24 hours", cfg.RefreshHours)
-		refreshHours = 24
-	}
+// group — группа источников со своим расписанием обновления.
+// Отключённая группа продолжает обновляться, поэтому её можно
+// включить обратно без повторной загрузки.
+type group struct {
+	name         string
+	refreshHours int
+	enabled      atomic.Bool
+	blocked      atomic.Uint64
+	cnameBlocked atomic.Uint64
+	lastCNAME    atomic.Pointer[CNAMEBlock]
+	pause        pause
+	state        atomic.Pointer[snapshot]
+	forceUpdate  chan struct{}
+
+	mu   sync.RWMutex
+	urls []string
+}
+
+func (g *group) getURLs() []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.urls
+}
+
+// ipSnapshot — неизменяемое состояние IP/CIDR списков.
+type ipSnapshot struct {
+	prefixes    *prefixTrie
+	lastUpdated time.Time
+	sources     []SourceStatus
+}
+
+type BlockList struct {
+	// groups заменяется целиком при добавлении группы, поэтому читается без
+	// блокировок; groupsMu сериализует добавления и защищает runCtx.
+	groups       atomic.Pointer[[]*group]
+	groupsMu     sync.Mutex
+	runCtx       context.Context // контекст Start, nil до запуска
+	refreshHours int             // blocklist.refresh_hours для групп, созданных через API
+	ipURLs       []string
+	ipRefresh    int
+	ipState      atomic.Pointer[ipSnapshot]
+	ipBlocked    atomic.Uint64
+	ipForce      chan struct{}
+	pause        pause
+	pauseMu      sync.Mutex
+	httpClient   *http.Client
+	logger       *log.Logger
+}
 
-	return &BlockList{
-		urls:           cfg.URLs,
-		logger:         logger,
-		blockedDomains: cache.NewDomainCache(1000000), // Размер кеша можно вынести в конфиг
+func NewBlockList(cfg *config.BlockListConfig, logger *log.Logger) *BlockList {
+	b := &BlockList{
+		logger: logger,
 		httpClient: &http.Client{
 			Timeout: 10 * time.Second,
 		},
-		refreshTicker: time.NewTicker(refreshHours * time.Hour),
-		stopChan:      make(chan struct{}),
-		forceUpdate:   make(chan struct{}, 1), // Буферизованный канал
+		refreshHours: cfg.RefreshHours,
+		ipURLs:       append([]string(nil), cfg.IPURLs...),
+		ipRefresh:    cfg.RefreshHours,
+		ipForce:      make(chan struct{}, 1),
+	}
+	if b.refreshHours <= 0 {
+		b.refreshHours = 24
+	}
+	if b.ipRefresh <= 0 {
+		b.ipRefresh = 24
 	}
+
+	var groups []*group
+	for _, groupCfg := range cfg.EffectiveGroups() {
+		if slices.ContainsFunc(groups, func(g *group) bool { return g.name == groupCfg.Name }) {
+			logger.Warnf("Duplicate blocklist group %q ignored", groupCfg.Name)
+			continue
+		}
+		refreshHours := groupCfg.RefreshHours
+		if refreshHours <= 0 {
+			logger.Warnf("Non-positive refresh interval specified for group %s (%d hours), defaulting to 24 hours", groupCfg.Name, refreshHours)
+			refreshHours = 24
+		}
+
+		g := &group{
+			name:         groupCfg.Name,
+			refreshHours: refreshHours,
+			urls:         append([]string(nil), groupCfg.URLs...),
+			forceUpdate:  make(chan struct{}, 1), // Буферизованный канал
+		}
+		g.enabled.Store(groupCfg.Enabled)
+		groups = append(groups, g)
+	}
+	b.groups.Store(&groups)
+
+	for _, groupCfg := range cfg.EffectiveGroups() {
+		if groupCfg.PausedUntil != nil {
+			b.PauseUntil(groupCfg.Name, *groupCfg.PausedUntil)
+		}
+	}
+
+	// Пауза хранится в конфиге, поэтому переживает перезапуск и перезагрузку конфига.
+	if cfg.PausedUntil != nil {
+		b.PauseUntil("", *cfg.PausedUntil)
+	}
+
+	return b
 }
 
 func (b *BlockList) Start(ctx context.Context) {
 	b.logger.Info("Starting blocklist service...")
-	go func() {
-		b.updateLists()
-
-		for {
-			select {
-			case <-b.refreshTicker.C:
-				b.updateLists()
-			case <-b.forceUpdate:
-				b.updateLists()
-			case <-ctx.Done():
-				b.logger.Info("Stopping blocklist service...")
-				b.refreshTicker.Stop()
-				return
+	b.groupsMu.Lock()
+	b.runCtx = ctx
+	for _, g := range b.groupList() {
+		go b.runGroup(ctx, g)
+	}
+	b.groupsMu.Unlock()
+	if len(b.ipURLs) > 0 {
+		go b.runIPLists(ctx)
+	}
+}
+
+// runIPLists обновляет IP/CIDR списки по расписанию blocklist.refresh_hours.
+func (b *BlockList) runIPLists(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(b.ipRefresh) * time.Hour)
+	defer ticker.Stop()
+
+	b.updateIPLists()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.updateIPLists()
+		case <-b.ipForce:
+			b.updateIPLists()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *BlockList) updateIPLists() {
+	b.logger.Info("Updating IP blocklists...")
+	prefixes := newPrefixTrie()
+	sources := make([]SourceStatus, 0, len(b.ipURLs))
+
+	for _, url := range b.ipURLs {
+		body, status := b.openSource(url)
+		if body != nil {
+			n, err := parsePrefixes(body, prefixes)
+			body.Close()
+			status.Prefixes = n
+			if err != nil {
+				status.Error = fmt.Sprintf("read failed: %v", err)
 			}
 		}
-	}()
+		if status.Error != "" {
+			b.logger.Errorf("Failed to load IP blocklist from %s: %s", url, status.Error)
+		} else {
+			b.logger.Infof("Loaded %d prefixes from %s", status.Prefixes, url)
+		}
+		sources = append(sources, status)
+	}
+
+	b.ipState.Store(&ipSnapshot{
+		prefixes:    prefixes,
+		lastUpdated: time.Now(),
+		sources:     sources,
+	})
+	b.logger.Infof("IP blocklists updated successfully. Total prefixes: %d", prefixes.Len())
+}
+
+// runGroup обновляет группу при старте и далее по её собственному расписанию.
+func (b *BlockList) runGroup(ctx context.Context, g *group) {
+	ticker := time.NewTicker(time.Duration(g.refreshHours) * time.Hour)
+	defer ticker.Stop()
+
+	b.updateGroup(g)
+
+	for {
+		select {
+		case <-ticker.C:
+			b.updateGroup(g)
+		case <-g.forceUpdate:
+			b.updateGroup(g)
+		case <-ctx.Done():
+			b.logger.Infof("Stopping blocklist group %s...", g.name)
+			return
+		}
+	}
 }
 
+// updateLists синхронно обновляет все группы и IP-списки.
 func (b *BlockList) updateLists() {
-	b.logger.Info("Updating blocklists...")
-	newBlockedDomains := cache.NewDomainCache(1000000) // Временный кеш для обновления
+	for _, g := range b.groupList() {
+		b.updateGroup(g)
+	}
+	if len(b.ipURLs) > 0 {
+		b.updateIPLists()
+	}
+}
+
+func (b *BlockList) updateGroup(g *group) {
+	b.logger.Infof("Updating blocklist group %s...", g.name)
+	newBlockedDomains := cache.NewDomainCache(1000000) // Размер кеша можно вынести в конфиг
 	totalDomains := 0
 
-	for _, url := range b.urls {
+	urls := g.getURLs()
+	sources := make([]SourceStatus, 0, len(urls))
+	for _, url := range urls {
 		b.logger.Infof("Processing blocklist from %s...", url)
-		var body io.ReadCloser
-		var err error
-
-		if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
-			var resp *http.Response
-			resp, err = b.httpClient.Get(url)
-			if err != nil {
-				b.logger.Errorf("Failed to download blocklist from %s: %v", url, err)
-				continue
-			}
-			if resp.StatusCode != http.StatusOK {
-				b.logger.Errorf("Failed to download blocklist from %s: status code %d", url, resp.StatusCode)
-				resp.Body.Close()
-				continue
-			}
-			body = resp.Body
+		status := b.fetchSource(url, newBlockedDomains)
+		if status.Error != "" {
+			b.logger.Errorf("Failed to load blocklist from %s: %s", url, status.Error)
 		} else {
-			body, err = os.Open(url)
-			if err != nil {
-				b.logger.Errorf("Failed to open blocklist file %s: %v", url, err)
-				continue
-			}
+			b.logger.Infof("Loaded %d domains from %s", status.Domains, url)
+			totalDomains += status.Domains
 		}
+		sources = append(sources, status)
+	}
 
-		// Парсинг доменов
-		scanner := bufio.NewScanner(body)
-		domainsLoaded := 0
-		for scanner.Scan() {
-			line := strings.TrimSpace(scanner.Text())
-			if line == "" || strings.HasPrefix(line, "#") {
-				continue
-			}
-			parts := strings.Fields(line)
-			if len(parts) >= 2 {
-				domain := parts[1]
-				newBlockedDomains.Add(domain)
-				domainsLoaded++
-			}
-		}
-		body.Close()
+	g.state.Store(&snapshot{
+		blockedDomains: newBlockedDomains,
+		totalDomains:   totalDomains,
+		lastUpdated:    time.Now(),
+		sources:        sources,
+	})
+	b.logger.Infof("Blocklists updated successfully. Group: %s, total domains: %d", g.name, totalDomains)
+}
+
+// fetchSource загружает один источник (HTTP/HTTPS или локальный файл)
+// и добавляет найденные домены в dst.
+func (b *BlockList) fetchSource(url string, dst *cache.DomainCache) SourceStatus {
+	body, status := b.openSource(url)
+	if body == nil {
+		return status
+	}
+	defer body.Close()
 
-		if err := scanner.Err(); err != nil {
-			b.logger.Errorf("Error reading blocklist from %s: %v", url, err)
+	// Парсинг доменов
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
+		parts := strings.Fields(line)
+		if len(parts) >= 2 {
+			dst.Add(parts[1])
+			status.Domains++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		status.Error = fmt.Sprintf("read failed: %v", err)
+	}
+	return status
+}
+
+// openSource открывает источник по HTTP/HTTPS или как локальный файл.
+// При ошибке возвращает nil и статус с заполненным полем Error.
+func (b *BlockList) openSource(url string) (io.ReadCloser, SourceStatus) {
+	status := SourceStatus{URL: url, LastFetch: time.Now()}
 
-		b.logger.Infof("Loaded %d domains from %s", domainsLoaded, url)
-		totalDomains += domainsLoaded
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		resp, err := b.httpClient.Get(url)
+		if err != nil {
+			status.Error = fmt.Sprintf("download failed: %v", err)
+			return nil, status
+		}
+		status.HTTPStatus = resp.StatusCode
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			status.Error = fmt.Sprintf("unexpected status code %d", resp.StatusCode)
+			return nil, status
+		}
+		return resp.Body, status
 	}
 
-	b.blockedDomains = newBlockedDomains
-	b.totalDomains = totalDomains
-	b.lastUpdated = time.Now()
-	b.logger.Infof("Blocklists updated successfully. Total domains: %d", totalDomains)
+	file, err := os.Open(url)
+	if err != nil {
+		status.Error = fmt.Sprintf("open failed: %v", err)
+		return nil, status
+	}
+	return file, status
 }
 
-func (b *BlockList) IsBlocked(domain string) bool {
-	if b.blockedDomains == nil {
+// IsIPBlocked сообщает, попадает ли адрес из ответа в запрещённую подсеть.
+func (b *BlockList) IsIPBlocked(addr netip.Addr) bool {
+	if b.pause.active(time.Now()) {
+		return false
+	}
+	s := b.ipState.Load()
+	if s == nil || !s.prefixes.Contains(addr) {
 		return false
 	}
-	return b.blockedDomains.Contains(domain)
+	b.ipBlocked.Add(1)
+	return true
+}
+
+func (b *BlockList) IsBlocked(domain string) bool {
+	return b.BlockedBy(domain) != ""
+}
+
+// BlockedBy возвращает имя первой включённой группы, блокирующей домен,
+// или пустую строку, если домен не заблокирован.
+// Каждый положительный ответ учитывается в счётчике blocked группы.
+func (b *BlockList) BlockedBy(domain string) string {
+	g := b.match(domain)
+	if g == nil {
+		return ""
+	}
+	g.blocked.Add(1)
+	return g.name
+}
+
+// BlockedByCNAME работает как BlockedBy для звена cname цепочки CNAME
+// запроса domain и запоминает его в статусе группы.
+func (b *BlockList) BlockedByCNAME(domain, cname string) string {
+	g := b.match(cname)
+	if g == nil {
+		return ""
+	}
+	g.blocked.Add(1)
+	g.cnameBlocked.Add(1)
+	g.lastCNAME.Store(&CNAMEBlock{Domain: domain, CNAME: cname, Time: time.Now()})
+	return g.name
+}
+
+// Match работает как BlockedBy, но не увеличивает счётчик блокировок.
+func (b *BlockList) Match(domain string) string {
+	if g := b.match(domain); g != nil {
+		return g.name
+	}
+	return ""
 }
 
-// ForceRefresh инициирует немедленное обновление списков блокировки.
+func (b *BlockList) match(domain string) *group {
+	now := time.Now()
+	if b.pause.active(now) {
+		return nil
+	}
+	for _, g := range b.groupList() {
+		if !g.enabled.Load() || g.pause.active(now) {
+			continue
+		}
+		s := g.state.Load()
+		if s == nil {
+			continue
+		}
+		if s.blockedDomains.Contains(domain) {
+			return g
+		}
+	}
+	return nil
+}
+
+// ForceRefresh инициирует немедленное обновление всех групп и IP-списков.
 func (b *BlockList) ForceRefresh() {
+	for _, g := range b.groupList() {
+		select {
+		case g.forceUpdate <- struct{}{}:
+		default:
+		}
+	}
 	select {
-	case b.forceUpdate <- struct{}{}:
+	case b.ipForce <- struct{}{}:
 	default:
 	}
 }
 
-// UpdateURLs обновляет список URL-адресов для списков блокировки.
+// UpdateURLs обновляет список URL-адресов группы по умолчанию. Если группы
+// ещё нет (в конфиге её создал первый URL из API), она создаётся включённой
+// и сразу загружается.
 func (b *BlockList) UpdateURLs(urls []string) {
-	b.urls = urls
+	newURLs := make([]string, len(urls))
+	copy(newURLs, urls)
+
+	b.groupsMu.Lock()
+	defer b.groupsMu.Unlock()
+
+	if g := b.findGroup(config.DefaultBlockListGroup); g != nil {
+		g.mu.Lock()
+		g.urls = newURLs
+		g.mu.Unlock()
+		return
+	}
+	if len(newURLs) == 0 {
+		return
+	}
+
+	g := &group{
+		name:         config.DefaultBlockListGroup,
+		refreshHours: b.refreshHours,
+		urls:         newURLs,
+		forceUpdate:  make(chan struct{}, 1),
+	}
+	g.enabled.Store(true)
+	groups := append([]*group{g}, b.groupList()...)
+	b.groups.Store(&groups)
+	b.logger.Infof("Blocklist group %s created", g.name)
+	if b.runCtx != nil {
+		go b.runGroup(b.runCtx, g)
+	}
+}
+
+// SetGroupEnabled включает или выключает группу без повторной загрузки списков.
+// Возвращает false, если группа не найдена.
+func (b *BlockList) SetGroupEnabled(name string, enabled bool) bool {
+	g := b.findGroup(name)
+	if g == nil {
+		return false
+	}
+	g.enabled.Store(enabled)
+	b.logger.Infof("Blocklist group %s enabled: %t", name, enabled)
+	return true
+}
+
+// groupList возвращает текущий список групп; его нельзя изменять.
+func (b *BlockList) groupList() []*group {
+	if groups := b.groups.Load(); groups != nil {
+		return *groups
+	}
+	return nil
+}
+
+// PauseUntil приостанавливает блокировку до указанного момента: глобально,
+// если group пуст, или для одной группы. По истечении срока блокировка
+// возобновляется автоматически. Возвращает false, если группа не найдена.
+func (b *BlockList) PauseUntil(group string, until time.Time) bool {
+	p, ok := b.pauseFor(group)
+	if !ok {
+		return false
+	}
+
+	b.pauseMu.Lock()
+	defer b.pauseMu.Unlock()
+
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+
+	d := time.Until(until)
+	if d <= 0 {
+		p.until.Store(0)
+		return true
+	}
+
+	p.until.Store(until.UnixNano())
+	p.timer = time.AfterFunc(d, func() {
+		b.logger.Infof("Blocking pause expired, resuming %s", pauseTarget(group))
+	})
+	b.logger.Infof("Blocking paused for %s until %s (%s)", pauseTarget(group), until.Format(time.RFC3339), d.Round(time.Second))
+	return true
+}
+
+// Resume досрочно снимает паузу. Возвращает false, если группа не найдена.
+func (b *BlockList) Resume(group string) bool {
+	p, ok := b.pauseFor(group)
+	if !ok {
+		return false
+	}
+
+	b.pauseMu.Lock()
+	defer b.pauseMu.Unlock()
+
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	if p.until.Swap(0) > time.Now().UnixNano() {
+		b.logger.Infof("Blocking resumed for %s", pauseTarget(group))
+	}
+	return true
 }
 
-func (b *BlockList) GetStatus() (time.Time, int, []string) {
-	return b.lastUpdated, b.totalDomains, b.urls
+func (b *BlockList) pauseFor(group string) (*pause, bool) {
+	if group == "" {
+		return &b.pause, true
+	}
+	g := b.findGroup(group)
+	if g == nil {
+		return nil, false
+	}
+	return &g.pause, true
+}
+
+func pauseTarget(group string) string {
+	if group == "" {
+		return "all groups"
+	}
+	return "group " + group
+}
+
+func (b *BlockList) findGroup(name string) *group {
+	for _, g := range b.groupList() {
+		if g.name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// GetStatus возвращает состояние каждой группы и статус её источников.
+func (b *BlockList) GetStatus() Status {
+	now := time.Now()
+	status := Status{
+		Pause:  b.pause.status(now),
+		Groups: make([]GroupStatus, 0, len(b.groupList())),
+	}
+	for _, g := range b.groupList() {
+		gs := GroupStatus{
+			Name:         g.name,
+			Enabled:      g.enabled.Load(),
+			RefreshHours: g.refreshHours,
+			Blocked:      g.blocked.Load(),
+			CNAMEBlocked: g.cnameBlocked.Load(),
+			LastCNAME:    g.lastCNAME.Load(),
+			Pause:        g.pause.status(now),
+			URLs:         append([]string(nil), g.getURLs()...),
+			Sources:      []SourceStatus{},
+		}
+		if s := g.state.Load(); s != nil {
+			gs.LastUpdated = s.lastUpdated
+			gs.TotalDomains = s.totalDomains
+			gs.Sources = append(gs.Sources, s.sources...)
+		}
+
+		if gs.LastUpdated.After(status.LastUpdated) {
+			status.LastUpdated = gs.LastUpdated
+		}
+		if gs.Enabled {
+			status.TotalDomains += gs.TotalDomains
+		}
+		status.Groups = append(status.Groups, gs)
+	}
+
+	if len(b.ipURLs) > 0 {
+		ips := &IPListStatus{
+			Blocked: b.ipBlocked.Load(),
+			URLs:    append([]string(nil), b.ipURLs...),
+			Sources: []SourceStatus{},
+		}
+		if s := b.ipState.Load(); s != nil {
+			ips.LastUpdated = s.lastUpdated
+			ips.TotalPrefixes = s.prefixes.Len()
+			ips.Sources = append(ips.Sources, s.sources...)
+		}
+		status.IPLists = ips
+	}
+	return status
 }
 
 func (b *BlockList) Stop() {
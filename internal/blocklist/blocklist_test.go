@@ -0,0 +1,282 @@
+package blocklist
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/crazytypewriter/dns-box/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+func newTestBlockList(t *testing.T, urls ...string) *BlockList {
+	t.Helper()
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	return NewBlockList(&config.BlockListConfig{Enabled: true, RefreshHours: 24, Groups: []config.BlockListGroupConfig{
+		{Name: config.DefaultBlockListGroup, Enabled: true, URLs: urls},
+	}}, logger)
+}
+
+func TestUpdateListsSourceStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintln(w, "# comment")
+		fmt.Fprintln(w, "0.0.0.0 ads.example.com")
+		fmt.Fprintln(w, "0.0.0.0 tracker.example.com")
+	}))
+	defer srv.Close()
+
+	localPath := filepath.Join(t.TempDir(), "local.txt")
+	if err := os.WriteFile(localPath, []byte("0.0.0.0 local.example.com\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	b := newTestBlockList(t, srv.URL+"/list", srv.URL+"/missing", localPath)
+	if b.IsBlocked("ads.example.com") {
+		t.Fatal("nothing should be blocked before the first refresh")
+	}
+
+	b.updateLists()
+
+	for _, domain := range []string{"ads.example.com", "tracker.example.com", "local.example.com"} {
+		if !b.IsBlocked(domain) {
+			t.Errorf("Expected %s to be blocked", domain)
+		}
+	}
+
+	status := b.GetStatus()
+	if status.TotalDomains != 3 {
+		t.Errorf("Expected 3 domains in total, got %d", status.TotalDomains)
+	}
+	if len(status.Groups) != 1 || status.Groups[0].Name != config.DefaultBlockListGroup {
+		t.Fatalf("Expected only the default group, got %+v", status.Groups)
+	}
+	sources := status.Groups[0].Sources
+	if len(sources) != 3 {
+		t.Fatalf("Expected 3 source statuses, got %d", len(sources))
+	}
+
+	ok, missing, local := sources[0], sources[1], sources[2]
+	if ok.HTTPStatus != http.StatusOK || ok.Domains != 2 || ok.Error != "" {
+		t.Errorf("Unexpected status for healthy source: %+v", ok)
+	}
+	if missing.HTTPStatus != http.StatusNotFound || missing.Error == "" {
+		t.Errorf("Expected failed status for missing source, got %+v", missing)
+	}
+	if local.HTTPStatus != 0 || local.Domains != 1 || local.LastFetch.IsZero() {
+		t.Errorf("Unexpected status for local source: %+v", local)
+	}
+}
+
+func TestConcurrentRefreshAndLookup(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "0.0.0.0 ads.example.com")
+	}))
+	defer srv.Close()
+
+	b := newTestBlockList(t, srv.URL)
+	b.updateLists()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if !b.IsBlocked("ads.example.com") {
+					t.Error("ads.example.com must stay blocked across refreshes")
+					return
+				}
+				b.GetStatus()
+			}
+		}()
+	}
+
+	for i := 0; i < 5; i++ {
+		b.UpdateURLs([]string{srv.URL, srv.URL + "/?n=" + fmt.Sprint(i)})
+		b.updateLists()
+	}
+	close(stop)
+	wg.Wait()
+
+	if got := len(b.GetStatus().Groups[0].Sources); got != 2 {
+		t.Errorf("Expected 2 sources after URL update, got %d", got)
+	}
+}
+
+func TestUpdateURLsCreatesDefaultGroup(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "0.0.0.0 ads.example.com")
+	}))
+	defer srv.Close()
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	b := NewBlockList(&config.BlockListConfig{Enabled: true, RefreshHours: 12}, logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b.Start(ctx)
+
+	// Первый URL из API создаёт группу default без перезапуска.
+	b.UpdateURLs([]string{srv.URL})
+	deadline := time.Now().Add(5 * time.Second)
+	for !b.IsBlocked("ads.example.com") {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the new default group to load")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	status := b.GetStatus()
+	if len(status.Groups) != 1 || status.Groups[0].Name != config.DefaultBlockListGroup || status.Groups[0].RefreshHours != 12 {
+		t.Errorf("groups = %+v", status.Groups)
+	}
+	if !b.SetGroupEnabled(config.DefaultBlockListGroup, false) || b.IsBlocked("ads.example.com") {
+		t.Error("the created group must be toggled like any other group")
+	}
+}
+
+func TestGroupsToggleWithoutRefetch(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch r.URL.Path {
+		case "/ads":
+			fmt.Fprintln(w, "0.0.0.0 ads.example.com")
+		case "/adult":
+			fmt.Fprintln(w, "0.0.0.0 adult.example.com")
+		}
+	}))
+	defer srv.Close()
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	b := NewBlockList(&config.BlockListConfig{
+		Enabled:      true,
+		RefreshHours: 24,
+		Groups: []config.BlockListGroupConfig{
+			{Name: "ads", Enabled: true, URLs: []string{srv.URL + "/ads"}, RefreshHours: 6},
+			{Name: "adult", Enabled: false, URLs: []string{srv.URL + "/adult"}},
+		},
+	}, logger)
+	b.updateLists()
+	fetched := requests.Load()
+
+	if got := b.BlockedBy("ads.example.com"); got != "ads" {
+		t.Errorf("Expected ads.example.com to be blocked by group ads, got %q", got)
+	}
+	if b.IsBlocked("adult.example.com") {
+		t.Error("Disabled group must not block")
+	}
+
+	if !b.SetGroupEnabled("adult", true) {
+		t.Fatal("SetGroupEnabled returned false for an existing group")
+	}
+	if !b.IsBlocked("adult.example.com") {
+		t.Error("Expected adult.example.com to be blocked after enabling the group")
+	}
+	if b.SetGroupEnabled("missing", true) {
+		t.Error("SetGroupEnabled must return false for an unknown group")
+	}
+	if requests.Load() != fetched {
+		t.Error("Toggling a group must not refetch its lists")
+	}
+
+	status := b.GetStatus()
+	if len(status.Groups) != 2 {
+		t.Fatalf("Expected 2 groups, got %d", len(status.Groups))
+	}
+	if status.Groups[0].RefreshHours != 6 || status.Groups[1].RefreshHours != 24 {
+		t.Errorf("Unexpected refresh intervals: %d, %d", status.Groups[0].RefreshHours, status.Groups[1].RefreshHours)
+	}
+	if status.Groups[0].Blocked != 1 {
+		t.Errorf("Expected 1 blocked query for group ads, got %d", status.Groups[0].Blocked)
+	}
+	if status.TotalDomains != 2 {
+		t.Errorf("Expected 2 domains in enabled groups, got %d", status.TotalDomains)
+	}
+}
+
+func TestPauseAutoResume(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "0.0.0.0 ads.example.com")
+	}))
+	defer srv.Close()
+
+	b := newTestBlockList(t, srv.URL)
+	b.updateLists()
+
+	if !b.PauseUntil("", time.Now().Add(100*time.Millisecond)) {
+		t.Fatal("global pause must always succeed")
+	}
+	if b.IsBlocked("ads.example.com") {
+		t.Error("Nothing should be blocked during a global pause")
+	}
+	if p := b.GetStatus().Pause; p == nil || p.Until.IsZero() {
+		t.Errorf("Expected pause in status, got %+v", p)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if !b.IsBlocked("ads.example.com") {
+		t.Error("Blocking must resume after the pause expires")
+	}
+	if p := b.GetStatus().Pause; p != nil {
+		t.Errorf("Expected no pause after expiry, got %+v", p)
+	}
+
+	b.PauseUntil(config.DefaultBlockListGroup, time.Now().Add(time.Hour))
+	if b.IsBlocked("ads.example.com") {
+		t.Error("Paused group must not block")
+	}
+	if gp := b.GetStatus().Groups[0].Pause; gp == nil || gp.RemainingSeconds <= 0 {
+		t.Errorf("Expected remaining pause time for the group, got %+v", gp)
+	}
+	b.Resume(config.DefaultBlockListGroup)
+	if !b.IsBlocked("ads.example.com") {
+		t.Error("Blocking must resume after Resume")
+	}
+	if b.PauseUntil("missing", time.Now().Add(time.Minute)) {
+		t.Error("PauseUntil must return false for an unknown group")
+	}
+}
+
+func TestPauseRestoredFromConfig(t *testing.T) {
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+	b := NewBlockList(&config.BlockListConfig{
+		RefreshHours: 24,
+		PausedUntil:  &past,
+		Groups: []config.BlockListGroupConfig{
+			{Name: "ads", Enabled: true, PausedUntil: &future},
+		},
+	}, logger)
+
+	status := b.GetStatus()
+	if status.Pause != nil {
+		t.Errorf("Expired global pause must be ignored, got %+v", status.Pause)
+	}
+	if status.Groups[0].Pause == nil || !status.Groups[0].Pause.Until.Equal(future) {
+		t.Errorf("Expected group pause until %v, got %+v", future, status.Groups[0].Pause)
+	}
+}
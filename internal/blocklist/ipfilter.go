@@ -0,0 +1,119 @@
+package blocklist
+
+import (
+	"bufio"
+	"io"
+	"net/netip"
+	"strings"
+)
+
+// prefixTrie — бинарное префиксное дерево подсетей. Поиск адреса занимает
+// не больше 32/128 шагов независимо от количества подсетей в списке.
+// После построения дерево не изменяется и читается без блокировок.
+type prefixTrie struct {
+	v4   *trieNode
+	v6   *trieNode
+	size int
+}
+
+type trieNode struct {
+	child [2]*trieNode
+	leaf  bool // подсеть, заканчивающаяся в этом узле, покрывает всё поддерево
+}
+
+func newPrefixTrie() *prefixTrie {
+	return &prefixTrie{v4: &trieNode{}, v6: &trieNode{}}
+}
+
+// Insert добавляет подсеть в дерево. IPv4-mapped подсеть (::ffff:a.b.c.d/96+)
+// хранится как IPv4: Contains проверяет такие адреса по IPv4.
+func (t *prefixTrie) Insert(p netip.Prefix) {
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	p = p.Masked()
+	addr := p.Addr()
+	node := t.v6
+	if addr.Is4() {
+		node = t.v4
+	}
+
+	bytes := addr.AsSlice()
+	for i := 0; i < p.Bits(); i++ {
+		if node.leaf {
+			return // уже покрыто более короткой подсетью
+		}
+		bit := (bytes[i/8] >> (7 - i%8)) & 1
+		if node.child[bit] == nil {
+			node.child[bit] = &trieNode{}
+		}
+		node = node.child[bit]
+	}
+	if !node.leaf {
+		// Поглощённые более узкие подсети больше не считаются.
+		t.size -= node.leaves() - 1
+		node.leaf = true
+		node.child = [2]*trieNode{}
+	}
+}
+
+// leaves считает подсети в поддереве узла.
+func (n *trieNode) leaves() int {
+	if n == nil {
+		return 0
+	}
+	if n.leaf {
+		return 1
+	}
+	return n.child[0].leaves() + n.child[1].leaves()
+}
+
+// Contains сообщает, входит ли адрес в одну из подсетей.
+func (t *prefixTrie) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	node := t.v6
+	if addr.Is4() {
+		node = t.v4
+	}
+
+	bytes := addr.AsSlice()
+	for i := 0; i < len(bytes)*8; i++ {
+		if node.leaf {
+			return true
+		}
+		node = node.child[(bytes[i/8]>>(7-i%8))&1]
+		if node == nil {
+			return false
+		}
+	}
+	return node.leaf
+}
+
+// Len возвращает количество подсетей в дереве (без поглощённых более короткими).
+func (t *prefixTrie) Len() int {
+	return t.size
+}
+
+// parsePrefixes читает список подсетей: одна подсеть или адрес на строку,
+// комментарии начинаются с '#' или ';'. Возвращает количество добавленных записей.
+func parsePrefixes(r io.Reader, dst *prefixTrie) (int, error) {
+	loaded := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		field := strings.Fields(line)[0]
+
+		if prefix, err := netip.ParsePrefix(field); err == nil {
+			dst.Insert(prefix)
+			loaded++
+		} else if addr, err := netip.ParseAddr(field); err == nil {
+			addr = addr.Unmap()
+			dst.Insert(netip.PrefixFrom(addr, addr.BitLen()))
+			loaded++
+		}
+	}
+	return loaded, scanner.Err()
+}
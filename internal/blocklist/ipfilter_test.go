@@ -0,0 +1,69 @@
+package blocklist
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestPrefixTrie(t *testing.T) {
+	trie := newPrefixTrie()
+	n, err := parsePrefixes(strings.NewReader(`
+# comment
+; another comment
+10.0.0.0/8
+10.1.0.0/16
+192.0.2.1
+2001:db8::/32 trailing text
+not-a-prefix
+`), trie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 4 {
+		t.Errorf("Expected 4 parsed entries, got %d", n)
+	}
+	if trie.Len() != 3 {
+		t.Errorf("Expected 3 prefixes (10.1.0.0/16 is covered by 10.0.0.0/8), got %d", trie.Len())
+	}
+
+	for addr, want := range map[string]bool{
+		"10.200.3.4":        true,
+		"11.0.0.1":          false,
+		"192.0.2.1":         true,
+		"192.0.2.2":         false,
+		"::ffff:10.0.0.1":   true,
+		"2001:db8:1::1":     true,
+		"2001:db9::1":       false,
+		"::":                false,
+		"0.0.0.0":           false,
+		"255.255.255.255":   false,
+		"2001:db8:ffff::ff": true,
+	} {
+		if got := trie.Contains(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Contains(%s) = %t, want %t", addr, got, want)
+		}
+	}
+}
+
+func TestPrefixTrieAbsorbsAndUnmaps(t *testing.T) {
+	trie := newPrefixTrie()
+	// Более короткая подсеть после более узких поглощает их.
+	for _, p := range []string{"10.1.0.0/16", "10.2.0.0/16", "10.3.1.0/24", "10.0.0.0/8", "::ffff:198.51.100.0/120"} {
+		trie.Insert(netip.MustParsePrefix(p))
+	}
+	if trie.Len() != 2 {
+		t.Errorf("Expected 2 prefixes after 10.0.0.0/8 absorbed the narrower ones, got %d", trie.Len())
+	}
+	for addr, want := range map[string]bool{
+		"10.9.9.9":               true,
+		"198.51.100.7":           true,
+		"::ffff:198.51.100.7":    true,
+		"198.51.101.1":           false,
+		"2001:db8::198.51.100.7": false,
+	} {
+		if got := trie.Contains(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Contains(%s) = %t, want %t", addr, got, want)
+		}
+	}
+}
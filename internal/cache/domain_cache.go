@@ -35,6 +35,12 @@ func (c *DomainCache) Contains(domain string) bool {
 }
 
 func (c *DomainCache) ContainsSuffix(domain string) bool {
+	_, ok := c.MatchSuffix(domain)
+	return ok
+}
+
+// MatchSuffix returns the stored suffix rule that matches the domain.
+func (c *DomainCache) MatchSuffix(domain string) (string, bool) {
 	parts := strings.Split(domain, ".")
 
 	if len(parts) > 2 {
@@ -45,5 +51,8 @@ func (c *DomainCache) ContainsSuffix(domain string) bool {
 		domain = "." + domain
 	}
 
-	return c.cache.Has([]byte(domain))
+	if !c.cache.Has([]byte(domain)) {
+		return "", false
+	}
+	return domain, true
 }
@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"strings"
+	"sync"
+)
+
+// listCacheSize — размер кеша доменов одного ipset-списка.
+const listCacheSize = 1024 * 1024 * 2 // 2MB per list
+
+// ListCaches хранит кеши доменов ipset-списков по имени списка. Списки можно
+// создавать и удалять во время работы, поэтому доступ защищён мьютексом.
+type ListCaches struct {
+	mu     sync.RWMutex
+	caches map[string]*DomainCache
+	// exclusions — exclude_domain и exclude_domain_suffix списков. Их мало,
+	// поэтому хватает обычного множества: домены как есть, суффиксы с точкой.
+	exclusions map[string]map[string]struct{}
+}
+
+func NewListCaches() *ListCaches {
+	return &ListCaches{caches: make(map[string]*DomainCache), exclusions: make(map[string]map[string]struct{})}
+}
+
+// Build создаёт кеш списка из доменов и суффиксов, заменяя существующий.
+func (l *ListCaches) Build(name string, domains, suffixes []string) *DomainCache {
+	c := NewDomainCache(listCacheSize)
+	for _, domain := range domains {
+		c.Add(domain)
+	}
+	for _, suffix := range suffixes {
+		c.AddSuffix(suffix)
+	}
+
+	l.mu.Lock()
+	l.caches[name] = c
+	l.mu.Unlock()
+	return c
+}
+
+// Get возвращает кеш списка или nil, если списка нет.
+func (l *ListCaches) Get(name string) *DomainCache {
+	if l == nil {
+		return nil
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.caches[name]
+}
+
+// Exclude заменяет исключения списка.
+func (l *ListCaches) Exclude(name string, domains, suffixes []string) {
+	excluded := make(map[string]struct{}, len(domains)+len(suffixes))
+	for _, domain := range domains {
+		excluded[strings.TrimSuffix(domain, ".")] = struct{}{}
+	}
+	for _, suffix := range suffixes {
+		if !strings.HasPrefix(suffix, ".") {
+			suffix = "." + suffix
+		}
+		excluded[strings.TrimSuffix(suffix, ".")] = struct{}{}
+	}
+
+	l.mu.Lock()
+	l.exclusions[name] = excluded
+	l.mu.Unlock()
+}
+
+// Excluded сообщает, исключён ли домен из списка. В отличие от MatchSuffix
+// суффикс сверяется на любой глубине: исключают обычно отдельные хосты под
+// общим суффиксом правила, например login.example.com под .example.com.
+func (l *ListCaches) Excluded(name, domain string) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	excluded := l.exclusions[name]
+	if len(excluded) == 0 {
+		return false
+	}
+
+	domain = strings.TrimSuffix(domain, ".")
+	if _, ok := excluded[domain]; ok {
+		return true
+	}
+	for rest := domain; rest != ""; {
+		if _, ok := excluded["."+rest]; ok {
+			return true
+		}
+		_, rest, _ = strings.Cut(rest, ".")
+	}
+	return false
+}
+
+// Delete удаляет кеш и исключения списка.
+func (l *ListCaches) Delete(name string) {
+	l.mu.Lock()
+	delete(l.caches, name)
+	delete(l.exclusions, name)
+	l.mu.Unlock()
+}
@@ -7,14 +7,29 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/crazytypewriter/dns-box/internal/github"
 )
 
 type ServerConfig struct {
-	Address []string `json:"address"`
-	Log     string   `json:"log"`
+	Address    []string `json:"address"`
+	Log        string   `json:"log"`
+	APIAddress string   `json:"api_address,omitempty"` // HTTP API listen address, default ":8090"
+}
+
+// DefaultAPIAddress — адрес HTTP API, если server.api_address не задан.
+const DefaultAPIAddress = ":8090"
+
+// GetAPIAddress возвращает адрес HTTP API: server.api_address или DefaultAPIAddress.
+func (s ServerConfig) GetAPIAddress() string {
+	if s.APIAddress != "" {
+		return s.APIAddress
+	}
+	return DefaultAPIAddress
 }
 
 type DNSConfig struct {
@@ -23,47 +38,146 @@ type DNSConfig struct {
 }
 
 type IPSetListConfig struct {
-	Name       string      `json:"name"`
-	EnableIPv6 bool        `json:"enable_ipv6"`
-	Timeout    uint32      `json:"timeout"` // in seconds, 0 means use default
-	Rules      RulesConfig `json:"rules"`
+	Name       string       `json:"name"`
+	EnableIPv6 bool         `json:"enable_ipv6"`
+	Timeout    uint32       `json:"timeout"`               // in seconds, 0 means use default
+	MatchCNAME bool         `json:"match_cname,omitempty"` // also match CNAME targets from the answer
+	SyncAdd    bool         `json:"sync_add,omitempty"`    // reply only after addresses are written to the set
+	Route      *RouteConfig `json:"route,omitempty"`       // policy routing for addresses of the list
+	HashSize   uint32       `json:"hashsize,omitempty"`    // initial hash size of the sets, 0 means the kernel default
+	MaxElem    uint32       `json:"maxelem,omitempty"`     // element limit of the sets, 0 means the kernel default (65536)
+	Counters   bool         `json:"counters,omitempty"`    // per-element packet and byte counters
+	Comment    bool         `json:"comment,omitempty"`     // store the queried domain as the element comment
+	IPv6Prefix int          `json:"ipv6_prefix,omitempty"` // add IPv6 answers as prefixes of this length, e.g. 64
+	StaticIPs  []string     `json:"static_ips,omitempty"`  // addresses kept in the sets regardless of DNS answers
+	Rules      RulesConfig  `json:"rules"`
+}
+
+// RouteConfig направляет трафик к адресам списка через отдельную таблицу
+// маршрутизации: пакеты помечаются fwmark, ip rule отправляет помеченные в
+// table, где маршрут по умолчанию ведёт в interface и/или через gateway.
+type RouteConfig struct {
+	Interface string `json:"interface,omitempty"` // outbound interface, e.g. "tun0"
+	Gateway   string `json:"gateway,omitempty"`   // next hop, IPv4 or IPv6
+	FWMark    uint32 `json:"fwmark"`
+	Table     int    `json:"table"`
+	Priority  int    `json:"priority,omitempty"` // ip rule priority, 0 lets the kernel choose
 }
 
 type IPSetConfig struct {
-	IPv4Name string            `json:"ipv4name"` // deprecated, kept for backward compatibility
-	IPv6Name string            `json:"ipv6name"` // deprecated, kept for backward compatibility
-	Lists    []IPSetListConfig `json:"lists"`    // new multi-list config
-	NetLists []NetListConfig   `json:"net_lists"` // static CIDR net lists
+	IPv4Name string            `json:"ipv4name,omitempty"` // deprecated, kept for backward compatibility
+	IPv6Name string            `json:"ipv6name,omitempty"` // deprecated, kept for backward compatibility
+	Lists    []IPSetListConfig `json:"lists"`              // new multi-list config
+	NetLists []NetListConfig   `json:"net_lists"`          // static CIDR net lists
+	Backend  string            `json:"backend,omitempty"`  // "ipset" (default), "nftables" or "dry_run"
+	NFTables NFTablesConfig    `json:"nftables,omitempty"` // used when backend is "nftables"
+
+	DestroyRemovedSets bool   `json:"destroy_removed_sets,omitempty"` // destroy sets of lists removed from config on startup
+	StateFile          string `json:"state_file,omitempty"`           // names of sets created by dns-box, default next to the config
+
+	ASNDatabase   *PrefixDatabaseConfig `json:"asn_database,omitempty"`   // prefix database for net_lists[].asn
+	GeoIPDatabase *PrefixDatabaseConfig `json:"geoip_database,omitempty"` // MMDB for net_lists[].country
+}
+
+// PrefixDatabaseConfig задаёт локальную базу подсетей для net-списков:
+// "подсеть → ASN" (IPtoASN TSV, CAIDA pfx2as, строки "CIDR ASN") или
+// GeoIP MMDB (MaxMind, DB-IP, sing-box geoip.db). Файлы .gz распаковываются.
+type PrefixDatabaseConfig struct {
+	Path         string `json:"path"`                    // local file; without it the download goes to the temp dir
+	URL          string `json:"url,omitempty"`           // optional download source
+	RefreshHours int    `json:"refresh_hours,omitempty"` // default 24
+}
+
+// NFTablesConfig задаёт таблицу, в которой nftables-бэкенд создаёт именованные множества.
+type NFTablesConfig struct {
+	Table  string `json:"table"`  // default "dns_box"
+	Family string `json:"family"` // "inet" (default), "ip" or "ip6"
 }
 
 type NetListConfig struct {
-	Name       string   `json:"name"`
-	EnableIPv6 bool     `json:"enable_ipv6"`
-	Timeout    uint32   `json:"timeout"`
-	ASN        string   `json:"asn,omitempty"`
-	CIDRs      []string `json:"cidr"`
+	Name       string          `json:"name"`
+	EnableIPv6 bool            `json:"enable_ipv6"`
+	Timeout    uint32          `json:"timeout"`
+	ASN        string          `json:"asn,omitempty"`
+	Countries  []string        `json:"country,omitempty"` // ISO 3166-1 alpha-2 codes
+	Sources    []NetListSource `json:"sources,omitempty"` // remote CIDR lists
+	Route      *RouteConfig    `json:"route,omitempty"`   // policy routing for the subnets of the list
+	CIDRs      []string        `json:"cidr"`
+}
+
+// NetListSource — подписка на опубликованный список подсетей.
+type NetListSource struct {
+	URL          string   `json:"url"`
+	Format       string   `json:"format,omitempty"`        // "text" (default), "aws", "gcp" or "cloudflare"
+	Services     []string `json:"services,omitempty"`      // aws/gcp service filter
+	Regions      []string `json:"regions,omitempty"`       // aws region / gcp scope filter
+	RefreshHours int      `json:"refresh_hours,omitempty"` // default 24
 }
 
 type RulesConfig struct {
 	Domains      []string `json:"domain"`
 	DomainSuffix []string `json:"domain_suffix"`
+	// Исключения важнее правил: домен не попадает в список, даже если
+	// совпал с domain или domain_suffix.
+	ExcludeDomains      []string `json:"exclude_domain,omitempty"`
+	ExcludeDomainSuffix []string `json:"exclude_domain_suffix,omitempty"`
 }
 
 type BlockListConfig struct {
-	Enabled      bool     `json:"enabled"`
-	URLs         []string `json:"urls"`
-	RefreshHours int      `json:"refresh_hours"`
+	Enabled      bool                   `json:"enabled"`
+	RefreshHours int                    `json:"refresh_hours"`
+	Groups       []BlockListGroupConfig `json:"groups,omitempty"`
+	PausedUntil  *time.Time             `json:"paused_until,omitempty"` // global pause deadline
+	IPURLs       []string               `json:"ip_urls,omitempty"`      // IP/CIDR deny lists, one prefix per line
+	BlockReply   string                 `json:"block_reply,omitempty"`  // "zero_ip" (default) or "nxdomain"
+}
+
+// Ответы на заблокированные запросы (blocklist.block_reply).
+const (
+	BlockReplyZeroIP   = "zero_ip"
+	BlockReplyNXDomain = "nxdomain"
+)
+
+// BlockListGroupConfig is a named set of blocklist sources (ads, trackers, ...)
+// that is refreshed on its own schedule and can be toggled independently.
+type BlockListGroupConfig struct {
+	Name         string     `json:"name"`
+	Enabled      bool       `json:"enabled"`
+	URLs         []string   `json:"urls"`
+	RefreshHours int        `json:"refresh_hours"` // 0 means use blocklist.refresh_hours
+	PausedUntil  *time.Time `json:"paused_until,omitempty"`
+}
+
+// DefaultBlockListGroup is the group edited by the /blocklist/urls API. The
+// top-level blocklist.urls of version 1 configs is migrated into it.
+const DefaultBlockListGroup = "default"
+
+// EffectiveGroups returns the configured groups with refresh_hours: 0
+// replaced by blocklist.refresh_hours.
+func (b BlockListConfig) EffectiveGroups() []BlockListGroupConfig {
+	groups := make([]BlockListGroupConfig, 0, len(b.Groups))
+	for _, g := range b.Groups {
+		if g.RefreshHours <= 0 {
+			g.RefreshHours = b.RefreshHours
+		}
+		groups = append(groups, g)
+	}
+	return groups
 }
 
 type Config struct {
-	Server       ServerConfig    `json:"server"`
-	DNS          DNSConfig       `json:"dns"`
-	IPSet        IPSetConfig     `json:"ipset"`
-	Rules        RulesConfig     `json:"rules"`
-	BlockList    BlockListConfig `json:"blocklist"`
-	GithubBackup GithubConfig    `json:"github_backup"`
-	mu           sync.RWMutex    `json:"-"`
-	Path         string          `json:"-"`
+	Version      int               `json:"version"`           // версия схемы, см. CurrentVersion
+	Include      string            `json:"include,omitempty"` // каталог с файлами списков и групп, например "lists.d"
+	Server       ServerConfig      `json:"server"`
+	DNS          DNSConfig         `json:"dns"`
+	IPSet        IPSetConfig       `json:"ipset"`
+	Rules        RulesConfig       `json:"rules"`
+	BlockList    BlockListConfig   `json:"blocklist"`
+	GithubBackup GithubConfig      `json:"github_backup"`
+	mu           sync.RWMutex      `json:"-"`
+	Path         string            `json:"-"`
+	sources      map[string]string // файл-владелец списка, net-списка или группы, см. loadIncludes
+	overrides    []appliedOverride // поля из окружения и флагов, см. Overrides
 }
 
 const GitHubTokenEnv = "DNS_BOX_GITHUB_TOKEN"
@@ -75,6 +189,9 @@ type GithubConfig struct {
 	Repo    string `json:"repo"`
 	Path    string `json:"path"`
 	Branch  string `json:"branch"`
+	// Изменения через API отправляются в GitHub одним коммитом, когда
+	// после последнего изменения прошло debounce_seconds (по умолчанию 5).
+	DebounceSeconds int `json:"debounce_seconds,omitempty"`
 }
 
 // GetToken возвращает GitHub-токен: приоритет у переменной окружения DNS_BOX_GITHUB_TOKEN,
@@ -92,20 +209,33 @@ type HostsConfig struct {
 	IPSetLists   []IPSetListConfig `json:"ipset_lists,omitempty"` // new multi-list format
 }
 
+// LoadConfig читает конфиг. Конфиг старой версии обновляется до
+// CurrentVersion и перезаписывается, исходный файл остаётся рядом (см.
+// Migration.BackupPath).
 func LoadConfig(filename string) (*Config, error) {
-	file, err := os.Open(filename)
+	return LoadConfigWithOverrides(filename, nil)
+}
+
+// LoadConfigWithOverrides — LoadConfig, который применяет o до проверки
+// конфига. Переопределённые значения в файл не записываются.
+func LoadConfigWithOverrides(filename string, o *Overrides) (*Config, error) {
+	cfg, m, err := ReadConfigWithOverrides(filename, o)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-
-	var cfg Config
-	if err := json.NewDecoder(file).Decode(&cfg); err != nil {
-		return nil, err
+	if m != nil {
+		for _, note := range m.Notes {
+			log.Printf("[config] Migration: %s", note)
+		}
+		// Конфиг уже обновлён в памяти, поэтому сбой записи (например, файл
+		// только для чтения) не мешает запуску.
+		if err := m.WriteFile(filename); err != nil {
+			log.Printf("[config] Warning: config migrated from version %d to %d in memory only: %v", m.From, m.To, err)
+		} else {
+			log.Printf("[config] Config migrated from version %d to %d, backup saved to %s", m.From, m.To, m.BackupPath(filename))
+		}
 	}
-
-	cfg.Path = filename
-	return &cfg, nil
+	return cfg, nil
 }
 
 // LoadConfigFromGitHub загружает конфигурацию из GitHub репозитория.
@@ -128,21 +258,13 @@ func LoadConfigFromGitHub(ctx context.Context, githubCfg GithubConfig) (*HostsCo
 	return &hostsConfig, nil
 }
 
-// SaveConfig сохраняет текущую конфигурацию в файл и, при необходимости, в GitHub.
-// GitHub-сохранение выполняется без удержания мьютекса, чтобы не блокировать DNS.
-func (c *Config) SaveConfig() error {
-	c.mu.Lock()
-
-	if c.Path == "" {
-		c.mu.Unlock()
-		return ErrNoConfigPath
-	}
-
-	// Читаем статичные части из существующего файла, если он есть и валиден.
-	// При сбое питания файл может быть пустым/битым — тогда используем in-memory значения.
-	staticServer := c.Server
-	staticDNS := c.DNS
-	staticGithubBackup := c.GithubBackup
+// marshalJSONLocked собирает config.json. Статичные части (server, dns,
+// github_backup) берутся из существующего файла, если он есть и валиден:
+// при сбое питания файл может быть пустым/битым — тогда используем in-memory значения.
+func (c *Config) marshalJSONLocked(s savedSections) ([]byte, error) {
+	staticServer := s.Server
+	staticDNS := s.DNS
+	staticGithubBackup := s.GithubBackup
 
 	file, err := os.Open(c.Path)
 	if err == nil {
@@ -164,11 +286,12 @@ func (c *Config) SaveConfig() error {
 			log.Printf("[config] Warning: failed to decode existing config (%v), using in-memory static values", decodeErr)
 		}
 	} else if !os.IsNotExist(err) {
-		c.mu.Unlock()
-		return err
+		return nil, err
 	}
 
 	finalConfig := struct {
+		Version      int             `json:"version"`
+		Include      string          `json:"include,omitempty"`
 		Server       ServerConfig    `json:"server"`
 		DNS          DNSConfig       `json:"dns"`
 		IPSet        IPSetConfig     `json:"ipset"`
@@ -176,12 +299,66 @@ func (c *Config) SaveConfig() error {
 		Rules        RulesConfig     `json:"rules"`
 		BlockList    BlockListConfig `json:"blocklist"`
 	}{
+		Version:      CurrentVersion,
+		Include:      s.Include,
 		Server:       staticServer,
 		DNS:          staticDNS,
-		IPSet:        c.IPSet,
+		IPSet:        s.IPSet,
 		GithubBackup: staticGithubBackup,
-		Rules:        c.Rules,
-		BlockList:    c.BlockList,
+		Rules:        s.Rules,
+		BlockList:    s.BlockList,
+	}
+
+	data, err := json.MarshalIndent(finalConfig, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// marshalDocumentLocked накладывает изменяемые через API секции на
+// существующий YAML/TOML-файл. Остальное, включая комментарии, остаётся как
+// в файле; если файл не читается, он пишется заново из памяти.
+func (c *Config) marshalDocumentLocked(format configFormat, s savedSections) ([]byte, error) {
+	original, err := os.ReadFile(c.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	doc, err := decodeDocument(format, original)
+	if err != nil {
+		log.Printf("[config] Warning: failed to decode existing config (%v), using in-memory static values", err)
+		original, doc = nil, make(map[string]any)
+	}
+
+	sections := map[string]any{
+		"version":   CurrentVersion,
+		"ipset":     s.IPSet,
+		"blocklist": s.BlockList,
+	}
+	// Корневые rules нужны только legacy-конфигу, после миграции их нет в файле.
+	if _, ok := doc["rules"]; ok || len(s.Rules.Domains) > 0 || len(s.Rules.DomainSuffix) > 0 {
+		sections["rules"] = s.Rules
+	}
+	if len(original) == 0 {
+		sections["server"], sections["dns"], sections["github_backup"] = s.Server, s.DNS, s.GithubBackup
+		if s.Include != "" {
+			sections["include"] = s.Include
+		}
+	}
+	return mergeDocument(format, original, doc, sections)
+}
+
+// writeMainLocked записывает в основной конфиг секции s.
+func (c *Config) writeMainLocked(s savedSections) error {
+	var data []byte
+	var err error
+	if format := formatOf(c.Path); format != formatJSON {
+		data, err = c.marshalDocumentLocked(format, s)
+	} else {
+		data, err = c.marshalJSONLocked(s)
+	}
+	if err != nil {
+		return err
 	}
 
 	// Атомарная запись: пишем во временный файл, fsync, затем rename.
@@ -189,77 +366,145 @@ func (c *Config) SaveConfig() error {
 	tmpPath := c.Path + ".tmp"
 	outFile, err := os.Create(tmpPath)
 	if err != nil {
-		c.mu.Unlock()
 		return err
 	}
 
-	encoder := json.NewEncoder(outFile)
-	encoder.SetIndent("", "  ")
-	if err := encoder.Encode(finalConfig); err != nil {
+	if _, err := outFile.Write(data); err != nil {
 		outFile.Close()
 		os.Remove(tmpPath)
-		c.mu.Unlock()
 		return err
 	}
 	if err := outFile.Sync(); err != nil {
 		outFile.Close()
 		os.Remove(tmpPath)
-		c.mu.Unlock()
 		return err
 	}
 	if err := outFile.Close(); err != nil {
 		os.Remove(tmpPath)
-		c.mu.Unlock()
 		return err
 	}
 
 	if err := os.Rename(tmpPath, c.Path); err != nil {
 		os.Remove(tmpPath)
-		c.mu.Unlock()
 		return err
 	}
+	return nil
+}
 
-	// Копируем данные для GitHub под локом, чтобы отпустить его до сетевого вызова
-	var needGitHubSave bool
-	var githubToken, githubOwner, githubRepo, githubPath, githubBranch string
-	var hostsConfig HostsConfig
-	if c.GithubBackup.Enabled {
-		needGitHubSave = true
-		githubToken = c.GithubBackup.GetToken()
-		githubOwner = c.GithubBackup.Owner
-		githubRepo = c.GithubBackup.Repo
-		githubPath = c.GithubBackup.Path
-		githubBranch = c.GithubBackup.Branch
-
-		if len(c.IPSet.Lists) > 0 {
-			hostsConfig.IPSetLists = make([]IPSetListConfig, len(c.IPSet.Lists))
-			copy(hostsConfig.IPSetLists, c.IPSet.Lists)
-		} else {
-			hostsConfig.Domains = make([]string, len(c.Rules.Domains))
-			copy(hostsConfig.Domains, c.Rules.Domains)
-			hostsConfig.DomainSuffix = make([]string, len(c.Rules.DomainSuffix))
-			copy(hostsConfig.DomainSuffix, c.Rules.DomainSuffix)
-		}
+// mainUnchangedLocked сообщает, что изменяемые секции основного конфига в
+// файле совпадают с s.
+func (c *Config) mainUnchangedLocked(s savedSections) bool {
+	type sections struct {
+		Version   int             `json:"version"`
+		IPSet     IPSetConfig     `json:"ipset"`
+		Rules     RulesConfig     `json:"rules"`
+		BlockList BlockListConfig `json:"blocklist"`
+	}
+	data, err := os.ReadFile(c.Path)
+	if err != nil {
+		return false
+	}
+	doc, err := decodeDocument(formatOf(c.Path), data)
+	if err != nil {
+		return false
+	}
+	if data, err = json.Marshal(doc); err != nil {
+		return false
+	}
+	var current sections
+	if err := json.Unmarshal(data, &current); err != nil {
+		return false
+	}
+	return sameDocument(current, sections{CurrentVersion, s.IPSet, s.Rules, s.BlockList})
+}
+
+// SaveConfig сохраняет текущую конфигурацию в файл и, при необходимости, в GitHub.
+// GitHub-сохранение выполняется без удержания мьютекса, чтобы не блокировать DNS.
+// API сохраняет конфиг через Persister, который отправляет копию в GitHub в фоне.
+func (c *Config) SaveConfig() error {
+	if err := c.SaveFile(); err != nil {
+		return err
 	}
-	c.mu.Unlock()
+	return c.SaveToGitHub(context.Background())
+}
 
-	if needGitHubSave {
-		log.Printf("[config] Saving rules to GitHub: owner=%s, repo=%s, path=%s, branch=%s",
-			githubOwner, githubRepo, githubPath, githubBranch)
+// SaveFile записывает конфиг и файлы include на диск.
+func (c *Config) SaveFile() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-		data, err := json.MarshalIndent(hostsConfig, "", "  ")
-		if err != nil {
-			return fmt.Errorf("failed to marshal hosts config: %w", err)
-		}
+	if c.Path == "" {
+		return ErrNoConfigPath
+	}
+	// Конфиг с ошибками не записывается: при следующем запуске он бы не загрузился.
+	if err := checkIssues(c.validateLocked()); err != nil {
+		return err
+	}
+	c.clearExpiredPausesLocked(time.Now())
+
+	// Элементы из файлов include в основной конфиг не попадают, значения из
+	// окружения и флагов — тоже.
+	files := c.splitLocked()
+	own := files[c.Path]
+	saved := c.savedLocked()
+	saved.IPSet.Lists, saved.IPSet.NetLists, saved.BlockList.Groups = nil, nil, nil
+	if own.IPSet != nil {
+		saved.IPSet.Lists, saved.IPSet.NetLists = own.IPSet.Lists, own.IPSet.NetLists
+	}
+	if own.BlockList != nil {
+		saved.BlockList.Groups = own.BlockList.Groups
+	}
 
-		client := github.NewClient(githubToken)
-		if err := client.SaveFile(context.Background(), githubOwner, githubRepo, githubPath, githubBranch, data); err != nil {
-			log.Printf("[config] ERROR: failed to save config to github: %v", err)
-			return fmt.Errorf("failed to save config to github: %w", err)
+	// С include основной конфиг переписывается, только если изменилась его
+	// часть: правка списка из lists.d меняет только файл этого списка.
+	if c.Include == "" || !c.mainUnchangedLocked(saved) {
+		if err := c.writeMainLocked(saved); err != nil {
+			return err
 		}
-		log.Printf("[config] Successfully saved rules to GitHub")
 	}
+	return c.saveIncludesLocked(files)
+}
 
+// SaveToGitHub отправляет правила в GitHub, если github_backup включён.
+func (c *Config) SaveToGitHub(ctx context.Context) error {
+	// Копируем данные для GitHub под локом, чтобы отпустить его до сетевого вызова
+	c.mu.RLock()
+	if !c.GithubBackup.Enabled {
+		c.mu.RUnlock()
+		return nil
+	}
+	githubToken := c.GithubBackup.GetToken()
+	githubOwner := c.GithubBackup.Owner
+	githubRepo := c.GithubBackup.Repo
+	githubPath := c.GithubBackup.Path
+	githubBranch := c.GithubBackup.Branch
+
+	var hostsConfig HostsConfig
+	if len(c.IPSet.Lists) > 0 {
+		hostsConfig.IPSetLists = make([]IPSetListConfig, len(c.IPSet.Lists))
+		copy(hostsConfig.IPSetLists, c.IPSet.Lists)
+	} else {
+		hostsConfig.Domains = make([]string, len(c.Rules.Domains))
+		copy(hostsConfig.Domains, c.Rules.Domains)
+		hostsConfig.DomainSuffix = make([]string, len(c.Rules.DomainSuffix))
+		copy(hostsConfig.DomainSuffix, c.Rules.DomainSuffix)
+	}
+	c.mu.RUnlock()
+
+	log.Printf("[config] Saving rules to GitHub: owner=%s, repo=%s, path=%s, branch=%s",
+		githubOwner, githubRepo, githubPath, githubBranch)
+
+	data, err := json.MarshalIndent(hostsConfig, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal hosts config: %w", err)
+	}
+
+	client := github.NewClient(githubToken)
+	if err := client.SaveFile(ctx, githubOwner, githubRepo, githubPath, githubBranch, data); err != nil {
+		log.Printf("[config] ERROR: failed to save config to github: %v", err)
+		return fmt.Errorf("failed to save config to github: %w", err)
+	}
+	log.Printf("[config] Successfully saved rules to GitHub")
 	return nil
 }
 
@@ -316,31 +561,112 @@ func (c *Config) RemoveSuffix(suffix string) {
 
 var ErrNoConfigPath = errors.New("no config file path specified")
 
-// AddBlockListURL добавляет новый URL в список, если он еще не существует.
+// Ошибки изменения списков ipset через API.
+var (
+	ErrListExists   = errors.New("ipset list already exists")
+	ErrListNotFound = errors.New("ipset list not found")
+	ErrLegacyIPSet  = errors.New("legacy ipv4name/ipv6name config does not support multiple lists")
+)
+
+// AddBlockListURL добавляет URL в группу default, если его там ещё нет.
+// Группа создаётся при первом добавлении.
 func (c *Config) AddBlockListURL(url string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	for _, u := range c.BlockList.URLs {
-		if u == url {
-			return // URL уже существует
-		}
+	g := c.blockListGroupLocked(DefaultBlockListGroup)
+	if g == nil {
+		c.BlockList.Groups = slices.Insert(c.BlockList.Groups, 0, BlockListGroupConfig{
+			Name:    DefaultBlockListGroup,
+			Enabled: true,
+			URLs:    []string{url},
+		})
+		return
+	}
+	if !slices.Contains(g.URLs, url) {
+		g.URLs = append(g.URLs, url)
 	}
-	c.BlockList.URLs = append(c.BlockList.URLs, url)
 }
 
-// RemoveBlockListURL удаляет URL из списка.
+// RemoveBlockListURL удаляет URL из группы default.
 func (c *Config) RemoveBlockListURL(url string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	newURLs := make([]string, 0, len(c.BlockList.URLs))
-	for _, u := range c.BlockList.URLs {
-		if u != url {
-			newURLs = append(newURLs, u)
+	if g := c.blockListGroupLocked(DefaultBlockListGroup); g != nil {
+		g.URLs = slices.DeleteFunc(slices.Clone(g.URLs), func(u string) bool { return u == url })
+	}
+}
+
+// blockListGroupLocked возвращает группу с именем name или nil. Вызывается
+// под c.mu.
+func (c *Config) blockListGroupLocked(name string) *BlockListGroupConfig {
+	for i := range c.BlockList.Groups {
+		if c.BlockList.Groups[i].Name == name {
+			return &c.BlockList.Groups[i]
+		}
+	}
+	return nil
+}
+
+// SetBlockListGroupEnabled включает или выключает группу блоклистов.
+// Возвращает false, если группа с таким именем не описана в конфигурации.
+func (c *Config) SetBlockListGroupEnabled(name string, enabled bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := range c.BlockList.Groups {
+		if c.BlockList.Groups[i].Name == name {
+			c.BlockList.Groups[i].Enabled = enabled
+			return true
+		}
+	}
+	return false
+}
+
+// SetBlockListPause сохраняет срок паузы блокировки: для всего блоклиста,
+// если group пуст, или для конкретной группы. nil снимает паузу.
+// Возвращает false, если группа не описана в конфигурации.
+func (c *Config) SetBlockListPause(group string, until *time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if group == "" {
+		c.BlockList.PausedUntil = until
+		return true
+	}
+	for i := range c.BlockList.Groups {
+		if c.BlockList.Groups[i].Name == group {
+			c.BlockList.Groups[i].PausedUntil = until
+			return true
 		}
 	}
-	c.BlockList.URLs = newURLs
+	return false
+}
+
+// clearExpiredPausesLocked снимает истёкшие сроки пауз, чтобы они не
+// записывались в файл. Вызывается под c.mu.
+func (c *Config) clearExpiredPausesLocked(now time.Time) {
+	if p := c.BlockList.PausedUntil; p != nil && !p.After(now) {
+		c.BlockList.PausedUntil = nil
+	}
+	for i := range c.BlockList.Groups {
+		if p := c.BlockList.Groups[i].PausedUntil; p != nil && !p.After(now) {
+			c.BlockList.Groups[i].PausedUntil = nil
+		}
+	}
+}
+
+// GetBlockListURLs возвращает копию списка URL группы default.
+func (c *Config) GetBlockListURLs() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	urls := []string{}
+	if g := c.blockListGroupLocked(DefaultBlockListGroup); g != nil {
+		urls = append(urls, g.URLs...)
+	}
+	return urls
 }
 
 const defaultIPSetTimeout = 7200 // default timeout in seconds
@@ -348,8 +674,13 @@ const defaultIPSetTimeout = 7200 // default timeout in seconds
 // GetIPSetLists returns the list of ipset configurations.
 // If Lists is empty, it falls back to the legacy IPv4Name/IPv6Name fields.
 func (c *Config) GetIPSetLists() []IPSetListConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	if len(c.IPSet.Lists) > 0 {
-		return c.IPSet.Lists
+		lists := make([]IPSetListConfig, len(c.IPSet.Lists))
+		copy(lists, c.IPSet.Lists)
+		return lists
 	}
 
 	// Backward compatibility: convert legacy IPv4Name/IPv6Name to list format
@@ -365,209 +696,349 @@ func (c *Config) GetIPSetLists() []IPSetListConfig {
 	return lists
 }
 
-// AddDomainToList adds a domain to a specific ipset list's rules.
-func (c *Config) AddDomainToList(listIndex int, domain string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// listLocked returns the list with the given name, or nil. Must be called
+// with c.mu held.
+func (c *Config) listLocked(name string) *IPSetListConfig {
+	for i := range c.IPSet.Lists {
+		if c.IPSet.Lists[i].Name == name {
+			return &c.IPSet.Lists[i]
+		}
+	}
+	return nil
+}
 
-	// Legacy mode: use shared rules
+// listRulesLocked returns the rules of the named list (the shared rules of
+// the legacy ipv4name list), or nil. Must be called with c.mu held.
+func (c *Config) listRulesLocked(name string) *RulesConfig {
 	if len(c.IPSet.Lists) == 0 {
-		if listIndex != 0 {
-			return
-		}
-		for _, d := range c.Rules.Domains {
-			if d == domain {
-				return
-			}
+		if name == "" || name != c.IPSet.IPv4Name {
+			return nil
 		}
-		c.Rules.Domains = append(c.Rules.Domains, domain)
-		return
+		return &c.Rules
 	}
-
-	if listIndex < 0 || listIndex >= len(c.IPSet.Lists) {
-		return
+	if list := c.listLocked(name); list != nil {
+		return &list.Rules
 	}
+	return nil
+}
 
-	rules := &c.IPSet.Lists[listIndex].Rules
-	for _, d := range rules.Domains {
-		if d == domain {
-			return
-		}
+// AddDomainToList adds a domain to the rules of the named ipset list.
+func (c *Config) AddDomainToList(name, domain string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rules := c.listRulesLocked(name)
+	if rules == nil || slices.Contains(rules.Domains, domain) {
+		return
 	}
 	rules.Domains = append(rules.Domains, domain)
 }
 
-// RemoveDomainFromList removes a domain from a specific ipset list's rules.
-func (c *Config) RemoveDomainFromList(listIndex int, domain string) {
+// RemoveDomainFromList removes a domain from the rules of the named ipset list.
+func (c *Config) RemoveDomainFromList(name, domain string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// Legacy mode: use shared rules
-	if len(c.IPSet.Lists) == 0 {
-		if listIndex != 0 {
-			return
-		}
-		newDomains := make([]string, 0, len(c.Rules.Domains))
-		for _, d := range c.Rules.Domains {
-			if d != domain {
-				newDomains = append(newDomains, d)
-			}
-		}
-		c.Rules.Domains = newDomains
+	rules := c.listRulesLocked(name)
+	if rules == nil {
 		return
 	}
+	rules.Domains = slices.DeleteFunc(slices.Clone(rules.Domains), func(d string) bool { return d == domain })
+}
 
-	if listIndex < 0 || listIndex >= len(c.IPSet.Lists) {
-		return
-	}
+// AddSuffixToList adds a suffix to the rules of the named ipset list.
+func (c *Config) AddSuffixToList(name, suffix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	rules := &c.IPSet.Lists[listIndex].Rules
-	newDomains := make([]string, 0, len(rules.Domains))
-	for _, d := range rules.Domains {
-		if d != domain {
-			newDomains = append(newDomains, d)
-		}
+	rules := c.listRulesLocked(name)
+	if rules == nil || slices.Contains(rules.DomainSuffix, suffix) {
+		return
 	}
-	rules.Domains = newDomains
+	rules.DomainSuffix = append(rules.DomainSuffix, suffix)
 }
 
-// AddSuffixToList adds a suffix to a specific ipset list's rules.
-func (c *Config) AddSuffixToList(listIndex int, suffix string) {
+// RemoveSuffixFromList removes a suffix from the rules of the named ipset list.
+func (c *Config) RemoveSuffixFromList(name, suffix string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// Legacy mode: use shared rules
-	if len(c.IPSet.Lists) == 0 {
-		if listIndex != 0 {
-			return
-		}
-		for _, s := range c.Rules.DomainSuffix {
-			if s == suffix {
-				return
-			}
-		}
-		c.Rules.DomainSuffix = append(c.Rules.DomainSuffix, suffix)
+	rules := c.listRulesLocked(name)
+	if rules == nil {
 		return
 	}
+	rules.DomainSuffix = slices.DeleteFunc(slices.Clone(rules.DomainSuffix), func(s string) bool { return s == suffix })
+}
 
-	if listIndex < 0 || listIndex >= len(c.IPSet.Lists) {
-		return
+// GetListRules returns a copy of the rules of the named ipset list, or nil if
+// there is no such list.
+func (c *Config) GetListRules(name string) *RulesConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	rules := c.listRulesLocked(name)
+	if rules == nil {
+		return nil
 	}
+	copied := *rules
+	return &copied
+}
 
-	rules := &c.IPSet.Lists[listIndex].Rules
-	for _, s := range rules.DomainSuffix {
-		if s == suffix {
-			return
+// GetIPSetList returns a copy of the named ipset list; the legacy ipv4name
+// list is converted like in GetIPSetLists.
+func (c *Config) GetIPSetList(name string) (IPSetListConfig, bool) {
+	for _, list := range c.GetIPSetLists() {
+		if list.Name == name {
+			return list, true
 		}
 	}
-	rules.DomainSuffix = append(rules.DomainSuffix, suffix)
+	return IPSetListConfig{}, false
 }
 
-// RemoveSuffixFromList removes a suffix from a specific ipset list's rules.
-func (c *Config) RemoveSuffixFromList(listIndex int, suffix string) {
+// AddExclusionToList adds an excluded domain or, if suffix, an excluded suffix
+// to the rules of the named ipset list.
+func (c *Config) AddExclusionToList(name, value string, suffix bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// Legacy mode: use shared rules
-	if len(c.IPSet.Lists) == 0 {
-		if listIndex != 0 {
-			return
-		}
-		newSuffixes := make([]string, 0, len(c.Rules.DomainSuffix))
-		for _, s := range c.Rules.DomainSuffix {
-			if s != suffix {
-				newSuffixes = append(newSuffixes, s)
-			}
-		}
-		c.Rules.DomainSuffix = newSuffixes
+	rules := c.listRulesLocked(name)
+	if rules == nil {
 		return
 	}
+	values := &rules.ExcludeDomains
+	if suffix {
+		values = &rules.ExcludeDomainSuffix
+	}
+	if !slices.Contains(*values, value) {
+		*values = append(*values, value)
+	}
+}
 
-	if listIndex < 0 || listIndex >= len(c.IPSet.Lists) {
+// RemoveExclusionFromList removes an excluded domain or suffix from the rules
+// of the named ipset list.
+func (c *Config) RemoveExclusionFromList(name, value string, suffix bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rules := c.listRulesLocked(name)
+	if rules == nil {
 		return
 	}
+	values := &rules.ExcludeDomains
+	if suffix {
+		values = &rules.ExcludeDomainSuffix
+	}
+	*values = slices.DeleteFunc(slices.Clone(*values), func(v string) bool { return v == value })
+}
 
-	rules := &c.IPSet.Lists[listIndex].Rules
-	newSuffixes := make([]string, 0, len(rules.DomainSuffix))
-	for _, s := range rules.DomainSuffix {
-		if s != suffix {
-			newSuffixes = append(newSuffixes, s)
-		}
+// AddStaticIPToList adds a static address to the named ipset list. Legacy
+// configs have no list to keep it in, so false is returned for them, as well
+// as for an unknown list.
+func (c *Config) AddStaticIPToList(name, ip string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	list := c.listLocked(name)
+	if list == nil {
+		return false
+	}
+	if !slices.Contains(list.StaticIPs, ip) {
+		list.StaticIPs = append(list.StaticIPs, ip)
+	}
+	return true
+}
+
+// RemoveStaticIPFromList removes a static address from the named ipset list.
+func (c *Config) RemoveStaticIPFromList(name, ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if list := c.listLocked(name); list != nil {
+		list.StaticIPs = slices.DeleteFunc(slices.Clone(list.StaticIPs), func(v string) bool { return v == ip })
 	}
-	rules.DomainSuffix = newSuffixes
 }
 
-// GetListRules returns the rules for a specific ipset list.
-func (c *Config) GetListRules(listIndex int) *RulesConfig {
+// GetNetLists returns the net list configurations.
+func (c *Config) GetNetLists() []NetListConfig {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
+	lists := make([]NetListConfig, len(c.IPSet.NetLists))
+	copy(lists, c.IPSet.NetLists)
+	return lists
+}
 
-	// Legacy mode: return shared rules
-	if len(c.IPSet.Lists) == 0 {
-		if listIndex != 0 {
-			return nil
+// GetNetList returns a copy of the named net list.
+func (c *Config) GetNetList(name string) (NetListConfig, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if list := c.netListLocked(name); list != nil {
+		return *list, true
+	}
+	return NetListConfig{}, false
+}
+
+// netListLocked returns the net list with the given name, or nil. Must be
+// called with c.mu held.
+func (c *Config) netListLocked(name string) *NetListConfig {
+	for i := range c.IPSet.NetLists {
+		if c.IPSet.NetLists[i].Name == name {
+			return &c.IPSet.NetLists[i]
 		}
-		return &c.Rules
 	}
+	return nil
+}
 
-	if listIndex < 0 || listIndex >= len(c.IPSet.Lists) {
-		return nil
+// AddCIDRToNetList adds a CIDR to the named net list.
+func (c *Config) AddCIDRToNetList(name, cidr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	list := c.netListLocked(name)
+	if list == nil || slices.Contains(list.CIDRs, cidr) {
+		return
 	}
+	list.CIDRs = append(list.CIDRs, cidr)
+}
+
+// RemoveCIDRFromNetList removes a CIDR from the named net list.
+func (c *Config) RemoveCIDRFromNetList(name, cidr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	return &c.IPSet.Lists[listIndex].Rules
+	if list := c.netListLocked(name); list != nil {
+		list.CIDRs = slices.DeleteFunc(slices.Clone(list.CIDRs), func(v string) bool { return v == cidr })
+	}
 }
 
-// GetNetLists returns the net list configurations.
-func (c *Config) GetNetLists() []NetListConfig {
+// GetNetListCIDRs returns a copy of the CIDRs of the named net list, or nil if
+// there is no such list.
+func (c *Config) GetNetListCIDRs(name string) []string {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	return c.IPSet.NetLists
+
+	list := c.netListLocked(name)
+	if list == nil {
+		return nil
+	}
+	return append([]string{}, list.CIDRs...)
 }
 
-// AddCIDRToNetList adds a CIDR to a specific net list.
-func (c *Config) AddCIDRToNetList(listIndex int, cidr string) {
+// setNameTaken reports whether name (or its IPv6 pair) clashes with an existing
+// list or net list. Must be called with c.mu held.
+func (c *Config) setNameTaken(name string) bool {
+	for _, n := range []string{name, name + "6", strings.TrimSuffix(name, "6")} {
+		for _, l := range c.IPSet.Lists {
+			if l.Name == n {
+				return true
+			}
+		}
+		for _, l := range c.IPSet.NetLists {
+			if l.Name == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AddIPSetList appends a new ipset list. Names must be unique across lists and
+// net lists, including the IPv6 set name (name + "6").
+func (c *Config) AddIPSetList(list IPSetListConfig) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if listIndex < 0 || listIndex >= len(c.IPSet.NetLists) {
-		return
+	if len(c.IPSet.Lists) == 0 && c.IPSet.IPv4Name != "" {
+		return ErrLegacyIPSet
 	}
+	if c.setNameTaken(list.Name) {
+		return ErrListExists
+	}
+	c.IPSet.Lists = append(c.IPSet.Lists, list)
+	return nil
+}
 
-	list := &c.IPSet.NetLists[listIndex]
-	for _, existing := range list.CIDRs {
-		if existing == cidr {
-			return
+// RemoveIPSetList deletes the list with the given name and returns it.
+func (c *Config) RemoveIPSetList(name string) (IPSetListConfig, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, l := range c.IPSet.Lists {
+		if l.Name == name {
+			c.IPSet.Lists = append(c.IPSet.Lists[:i:i], c.IPSet.Lists[i+1:]...)
+			return l, nil
 		}
 	}
-	list.CIDRs = append(list.CIDRs, cidr)
+	return IPSetListConfig{}, ErrListNotFound
 }
 
-// RemoveCIDRFromNetList removes a CIDR from a specific net list.
-func (c *Config) RemoveCIDRFromNetList(listIndex int, cidr string) {
+// UpdateIPSetList changes EnableIPv6 and/or Timeout of a list; nil leaves the
+// field unchanged. Returns the list before and after the change.
+func (c *Config) UpdateIPSetList(name string, enableIPv6 *bool, timeout *uint32) (IPSetListConfig, IPSetListConfig, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if listIndex < 0 || listIndex >= len(c.IPSet.NetLists) {
-		return
+	for i := range c.IPSet.Lists {
+		list := &c.IPSet.Lists[i]
+		if list.Name != name {
+			continue
+		}
+		before := *list
+		if enableIPv6 != nil {
+			list.EnableIPv6 = *enableIPv6
+		}
+		if timeout != nil {
+			list.Timeout = *timeout
+		}
+		return before, *list, nil
+	}
+	return IPSetListConfig{}, IPSetListConfig{}, ErrListNotFound
+}
+
+// AddNetList appends a new net list.
+func (c *Config) AddNetList(list NetListConfig) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.setNameTaken(list.Name) || c.IPSet.IPv4Name == list.Name || c.IPSet.IPv6Name == list.Name {
+		return ErrListExists
 	}
+	c.IPSet.NetLists = append(c.IPSet.NetLists, list)
+	return nil
+}
+
+// RemoveNetList deletes the net list with the given name and returns it.
+func (c *Config) RemoveNetList(name string) (NetListConfig, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	list := &c.IPSet.NetLists[listIndex]
-	newCIDRs := make([]string, 0, len(list.CIDRs))
-	for _, existing := range list.CIDRs {
-		if existing != cidr {
-			newCIDRs = append(newCIDRs, existing)
+	for i, l := range c.IPSet.NetLists {
+		if l.Name == name {
+			c.IPSet.NetLists = append(c.IPSet.NetLists[:i:i], c.IPSet.NetLists[i+1:]...)
+			return l, nil
 		}
 	}
-	list.CIDRs = newCIDRs
+	return NetListConfig{}, ErrListNotFound
 }
 
-// GetNetListCIDRs returns the CIDRs for a specific net list.
-func (c *Config) GetNetListCIDRs(listIndex int) []string {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+// UpdateNetList changes EnableIPv6 and/or Timeout of a net list; nil leaves the
+// field unchanged. Returns the list before and after the change.
+func (c *Config) UpdateNetList(name string, enableIPv6 *bool, timeout *uint32) (NetListConfig, NetListConfig, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	if listIndex < 0 || listIndex >= len(c.IPSet.NetLists) {
-		return nil
+	for i := range c.IPSet.NetLists {
+		list := &c.IPSet.NetLists[i]
+		if list.Name != name {
+			continue
+		}
+		before := *list
+		if enableIPv6 != nil {
+			list.EnableIPv6 = *enableIPv6
+		}
+		if timeout != nil {
+			list.Timeout = *timeout
+		}
+		return before, *list, nil
 	}
-	return c.IPSet.NetLists[listIndex].CIDRs
+	return NetListConfig{}, NetListConfig{}, ErrListNotFound
 }
@@ -1,8 +1,18 @@
 package config
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestConfig(t *testing.T) {
@@ -25,7 +35,7 @@ func TestConfig(t *testing.T) {
 		}
 	}`
 
-	tmpFile, err := os.CreateTemp("", "config-*.json")
+	tmpFile, err := os.CreateTemp(t.TempDir(), "config-*.json")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -67,7 +77,7 @@ func TestSaveConfigPreservesIPSetLists(t *testing.T) {
   "github_backup": {"enabled": false}
 }`
 
-	tmpFile, err := os.CreateTemp("", "config-*.json")
+	tmpFile, err := os.CreateTemp(t.TempDir(), "config-*.json")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -84,7 +94,7 @@ func TestSaveConfigPreservesIPSetLists(t *testing.T) {
 	}
 
 	// Добавляем домен в список через API
-	cfg.AddDomainToList(0, "newdomain.com")
+	cfg.AddDomainToList("test-list", "newdomain.com")
 
 	if err := cfg.SaveConfig(); err != nil {
 		t.Fatalf("SaveConfig failed: %v", err)
@@ -127,7 +137,7 @@ func TestSaveConfigAtomicWrite(t *testing.T) {
   "github_backup": {"enabled": false}
 }`
 
-	tmpFile, err := os.CreateTemp("", "config-*.json")
+	tmpFile, err := os.CreateTemp(t.TempDir(), "config-*.json")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -165,7 +175,7 @@ func TestSaveConfigAtomicWrite(t *testing.T) {
 }
 
 func TestSaveConfigFallbackOnCorruptFile(t *testing.T) {
-	tmpFile, err := os.CreateTemp("", "config-*.json")
+	tmpFile, err := os.CreateTemp(t.TempDir(), "config-*.json")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -261,7 +271,7 @@ func TestNetListsConfig(t *testing.T) {
   "github_backup": {"enabled": false}
 }`
 
-	tmpFile, err := os.CreateTemp("", "config-*.json")
+	tmpFile, err := os.CreateTemp(t.TempDir(), "config-*.json")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -294,21 +304,21 @@ func TestNetListsConfig(t *testing.T) {
 	}
 
 	// Добавляем CIDR
-	cfg.AddCIDRToNetList(0, "172.16.0.0/12")
-	if len(cfg.GetNetListCIDRs(0)) != 3 {
-		t.Errorf("Expected 3 CIDRs after add, got %d", len(cfg.GetNetListCIDRs(0)))
+	cfg.AddCIDRToNetList("test-net", "172.16.0.0/12")
+	if len(cfg.GetNetListCIDRs("test-net")) != 3 {
+		t.Errorf("Expected 3 CIDRs after add, got %d", len(cfg.GetNetListCIDRs("test-net")))
 	}
 
 	// Повторное добавление того же CIDR не дублирует
-	cfg.AddCIDRToNetList(0, "172.16.0.0/12")
-	if len(cfg.GetNetListCIDRs(0)) != 3 {
-		t.Errorf("Expected 3 CIDRs after duplicate add, got %d", len(cfg.GetNetListCIDRs(0)))
+	cfg.AddCIDRToNetList("test-net", "172.16.0.0/12")
+	if len(cfg.GetNetListCIDRs("test-net")) != 3 {
+		t.Errorf("Expected 3 CIDRs after duplicate add, got %d", len(cfg.GetNetListCIDRs("test-net")))
 	}
 
 	// Удаляем CIDR
-	cfg.RemoveCIDRFromNetList(0, "10.0.0.0/8")
-	if len(cfg.GetNetListCIDRs(0)) != 2 {
-		t.Errorf("Expected 2 CIDRs after remove, got %d", len(cfg.GetNetListCIDRs(0)))
+	cfg.RemoveCIDRFromNetList("test-net", "10.0.0.0/8")
+	if len(cfg.GetNetListCIDRs("test-net")) != 2 {
+		t.Errorf("Expected 2 CIDRs after remove, got %d", len(cfg.GetNetListCIDRs("test-net")))
 	}
 
 	// Сохраняем и перезагружаем
@@ -329,3 +339,888 @@ func TestNetListsConfig(t *testing.T) {
 		t.Errorf("Expected 2 CIDRs after reload, got %d", len(reloaded[0].CIDRs))
 	}
 }
+
+func TestIPSetListsRuntimeChanges(t *testing.T) {
+	cfg := &Config{IPSet: IPSetConfig{
+		Lists:    []IPSetListConfig{{Name: "vpn"}, {Name: "proxy"}},
+		NetLists: []NetListConfig{{Name: "tg"}},
+	}}
+
+	for _, name := range []string{"vpn", "vpn6", "tg", "proxy6"} {
+		if err := cfg.AddIPSetList(IPSetListConfig{Name: name}); !errors.Is(err, ErrListExists) {
+			t.Errorf("Expected ErrListExists for %s, got %v", name, err)
+		}
+	}
+	if err := cfg.AddNetList(NetListConfig{Name: "vpn"}); !errors.Is(err, ErrListExists) {
+		t.Errorf("Expected ErrListExists for a net list named like a list, got %v", err)
+	}
+
+	if err := cfg.AddIPSetList(IPSetListConfig{Name: "media", EnableIPv6: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Удаление из середины не должно сдвигать остальные списки по имени.
+	removed, err := cfg.RemoveIPSetList("proxy")
+	if err != nil || removed.Name != "proxy" {
+		t.Fatalf("Unexpected result of removing proxy: %v, %v", removed, err)
+	}
+	lists := cfg.GetIPSetLists()
+	if len(lists) != 2 || lists[0].Name != "vpn" || lists[1].Name != "media" {
+		t.Errorf("Unexpected lists after removal: %v", lists)
+	}
+	if _, err := cfg.RemoveIPSetList("proxy"); !errors.Is(err, ErrListNotFound) {
+		t.Errorf("Expected ErrListNotFound, got %v", err)
+	}
+
+	timeout := uint32(600)
+	disable := false
+	before, after, err := cfg.UpdateIPSetList("media", &disable, &timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !before.EnableIPv6 || after.EnableIPv6 || after.Timeout != 600 {
+		t.Errorf("Unexpected update result: before %+v, after %+v", before, after)
+	}
+	if _, after, _ := cfg.UpdateNetList("tg", nil, &timeout); after.Timeout != 600 {
+		t.Errorf("Expected net list timeout 600, got %d", after.Timeout)
+	}
+
+	legacy := &Config{IPSet: IPSetConfig{IPv4Name: "old"}}
+	if err := legacy.AddIPSetList(IPSetListConfig{Name: "new"}); !errors.Is(err, ErrLegacyIPSet) {
+		t.Errorf("Expected ErrLegacyIPSet, got %v", err)
+	}
+}
+
+func TestListExclusionsAndStaticIPs(t *testing.T) {
+	cfg := &Config{IPSet: IPSetConfig{Lists: []IPSetListConfig{{Name: "vpn"}}}}
+
+	cfg.AddExclusionToList("vpn", "login.example.com", false)
+	cfg.AddExclusionToList("vpn", "login.example.com", false)
+	cfg.AddExclusionToList("vpn", ".corp.example.com", true)
+	rules := cfg.GetListRules("vpn")
+	if !reflect.DeepEqual(rules.ExcludeDomains, []string{"login.example.com"}) || !reflect.DeepEqual(rules.ExcludeDomainSuffix, []string{".corp.example.com"}) {
+		t.Errorf("Unexpected exclusions: %+v", rules)
+	}
+	cfg.RemoveExclusionFromList("vpn", "login.example.com", false)
+	if rules := cfg.GetListRules("vpn"); len(rules.ExcludeDomains) != 0 || len(rules.ExcludeDomainSuffix) != 1 {
+		t.Errorf("Expected only the suffix exclusion to remain, got %+v", rules)
+	}
+
+	if !cfg.AddStaticIPToList("vpn", "192.0.2.1") || !cfg.AddStaticIPToList("vpn", "192.0.2.1") {
+		t.Fatal("Expected static IPs to be accepted")
+	}
+	if ips := cfg.GetIPSetLists()[0].StaticIPs; !reflect.DeepEqual(ips, []string{"192.0.2.1"}) {
+		t.Errorf("Unexpected static IPs: %v", ips)
+	}
+	cfg.RemoveStaticIPFromList("vpn", "192.0.2.1")
+	if ips := cfg.GetIPSetLists()[0].StaticIPs; len(ips) != 0 {
+		t.Errorf("Expected no static IPs, got %v", ips)
+	}
+
+	legacy := &Config{IPSet: IPSetConfig{IPv4Name: "old"}}
+	if legacy.AddStaticIPToList("old", "192.0.2.1") {
+		t.Error("Expected static IPs to be rejected in legacy mode")
+	}
+	legacy.AddExclusionToList("old", "login.example.com", false)
+	legacy.AddExclusionToList("other", "mail.example.com", false)
+	if rules := legacy.GetListRules("old"); !reflect.DeepEqual(rules.ExcludeDomains, []string{"login.example.com"}) {
+		t.Errorf("Expected the legacy list to use the shared rules, got %+v", rules)
+	}
+	if legacy.GetListRules("other") != nil {
+		t.Error("Expected no rules for an unknown list")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := &Config{
+		Path:   filepath.Join(t.TempDir(), "config.json"),
+		Server: ServerConfig{Address: []string{"0.0.0.0:53"}, Log: "verbose"},
+		DNS:    DNSConfig{UpstreamServers: []string{"https://dns.google/dns-query", "8.8.8.8:53"}},
+		IPSet: IPSetConfig{Lists: []IPSetListConfig{
+			{Name: "vpn", StaticIPs: []string{"2001:db8::1"}, Rules: RulesConfig{Domains: []string{"https://example.com"}}},
+		}},
+	}
+
+	issues := cfg.Validate()
+	want := []Issue{
+		{Path: "server.log", Message: `unknown log level "verbose", info is used`, Warning: true},
+		{Path: "ipset.lists[0].static_ips[0]", Message: "IPv6 address 2001:db8::1 is skipped without enable_ipv6", Warning: true},
+		{Path: "ipset.lists[0].rules.domain[0]", Message: `"https://example.com" is not a domain name and never matches`, Warning: true},
+	}
+	if !reflect.DeepEqual(issues, want) {
+		t.Errorf("Unexpected issues:\n got %+v\nwant %+v", issues, want)
+	}
+	// Предупреждения не мешают сохранению.
+	if err := cfg.SaveConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.IPSet.Lists = append(cfg.IPSet.Lists, IPSetListConfig{Name: "vpn"})
+	var invalid *ValidationError
+	if err := cfg.SaveConfig(); !errors.As(err, &invalid) || !strings.Contains(err.Error(), "ipset.lists[1].name") {
+		t.Errorf("Expected a validation error for the duplicate list, got %v", err)
+	}
+	if _, err := LoadConfig(cfg.Path); err != nil {
+		t.Errorf("Expected the last valid config to stay on disk, got %v", err)
+	}
+}
+
+func TestLoadConfigMigratesLegacyLayout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	legacy := `{
+		"server": {"address": ["127.0.0.1:53"], "unknown_field": 1},
+		"dns": {"upstream_servers": ["8.8.8.8"]},
+		"ipset": {"ipv4name": "vpn", "ipv6name": "vpn_v6"},
+		"rules": {"domain": ["example.com"], "domain_suffix": ["example.org"]}
+	}`
+	if err := os.WriteFile(path, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, m, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("ReadConfig: %v", err)
+	}
+	if m == nil || m.From != 1 || m.To != CurrentVersion {
+		t.Fatalf("migration = %+v, want 1 → %d", m, CurrentVersion)
+	}
+	if len(m.Notes) != 2 || !strings.Contains(m.Notes[1], "vpn_v6 is renamed to vpn6") {
+		t.Errorf("notes = %q", m.Notes)
+	}
+	diff := m.Diff()
+	for _, want := range []string{"--- version 1\n+++ version 2\n", `-    "ipv4name": "vpn",`, `+  "version": 2`} {
+		if !strings.Contains(diff, want) {
+			t.Errorf("diff does not contain %q:\n%s", want, diff)
+		}
+	}
+	if data, _ := os.ReadFile(path); string(data) != legacy {
+		t.Fatal("ReadConfig must not write the config")
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if cfg.Version != CurrentVersion || cfg.IPSet.IPv4Name != "" || len(cfg.Rules.Domains) != 0 {
+		t.Errorf("legacy fields survived migration: %+v", cfg)
+	}
+	want := []IPSetListConfig{{Name: "vpn", EnableIPv6: true, Rules: RulesConfig{
+		Domains: []string{"example.com"}, DomainSuffix: []string{"example.org"},
+	}}}
+	if got := cfg.GetIPSetLists(); !reflect.DeepEqual(got, want) {
+		t.Errorf("lists = %+v, want %+v", got, want)
+	}
+
+	if backup, err := os.ReadFile(m.BackupPath(path)); err != nil || string(backup) != legacy {
+		t.Errorf("backup = %q, %v", backup, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"unknown_field": 1`) {
+		t.Errorf("migration dropped unknown fields:\n%s", data)
+	}
+
+	// Обновлённый конфиг больше не мигрирует.
+	if _, m, err := ReadConfig(path); err != nil || m != nil {
+		t.Errorf("second ReadConfig = %+v, %v", m, err)
+	}
+}
+
+func TestMigrateBlockListURLs(t *testing.T) {
+	for _, tt := range []struct {
+		name, file, config string
+		want               []string
+	}{
+		{
+			name: "yaml",
+			file: "config.yaml",
+			config: `server:
+  address: [":53"]
+dns:
+  upstream_servers: [8.8.8.8]
+ipset:
+  lists:
+    - name: vpn
+blocklist:
+  enabled: true
+  # основной список
+  urls: [https://example.com/hosts]
+  groups:
+    - name: ads # реклама
+      enabled: false
+      urls: [https://example.com/ads.txt]
+`,
+			want: []string{"default", "ads"},
+		},
+		{
+			name: "toml",
+			file: "config.toml",
+			config: `[server]
+address = [":53"]
+
+[dns]
+upstream_servers = ["8.8.8.8"]
+
+[[ipset.lists]]
+name = "vpn"
+
+[blocklist]
+enabled = true
+urls = ["https://example.com/hosts"]
+
+# реклама
+[[blocklist.groups]]
+name = "ads"
+enabled = false
+urls = ["https://example.com/ads.txt"]
+`,
+			want: []string{"default", "ads"},
+		},
+		{
+			name: "json",
+			file: "config.json",
+			config: `{"server": {"address": [":53"]}, "dns": {"upstream_servers": ["8.8.8.8"]},
+				"ipset": {"lists": [{"name": "vpn"}]},
+				"blocklist": {"enabled": true, "urls": ["https://example.com/hosts"],
+					"groups": [{"name": "ads", "enabled": false, "urls": ["https://example.com/ads.txt"]}]}}`,
+			want: []string{"default", "ads"},
+		},
+		{
+			name: "json with a default group",
+			file: "config.json",
+			config: `{"server": {"address": [":53"]}, "dns": {"upstream_servers": ["8.8.8.8"]},
+				"ipset": {"lists": [{"name": "vpn"}]},
+				"blocklist": {"urls": ["https://example.com/hosts"], "groups": [{"name": "default", "urls": ["https://example.com/ads.txt"]}]}}`,
+			want: []string{"default"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig(path)
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			var names []string
+			for _, g := range cfg.BlockList.Groups {
+				names = append(names, g.Name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Fatalf("groups = %v, want %v", names, tt.want)
+			}
+			if urls := cfg.GetBlockListURLs(); !slices.Contains(urls, "https://example.com/hosts") {
+				t.Errorf("default group urls = %v", urls)
+			}
+
+			// Группа default выключается и сохраняется, как любая другая.
+			if !cfg.SetBlockListGroupEnabled(DefaultBlockListGroup, false) {
+				t.Fatal("default group is not found")
+			}
+			if err := cfg.SaveConfig(); err != nil {
+				t.Fatal(err)
+			}
+			saved, err := LoadConfig(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saved.BlockList.Groups[0].Name != DefaultBlockListGroup || saved.BlockList.Groups[0].Enabled {
+				t.Errorf("saved groups = %+v", saved.BlockList.Groups)
+			}
+			if data, _ := os.ReadFile(path); tt.file != "config.json" && !strings.Contains(string(data), "реклама") {
+				t.Errorf("migration dropped comments:\n%s", data)
+			}
+		})
+	}
+}
+
+func TestBlockListPauseSaved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	content := `{"version": 2, "server": {"address": [":53"]}, "dns": {"upstream_servers": ["8.8.8.8"]},
+		"ipset": {"lists": [{"name": "vpn"}]},
+		"blocklist": {"enabled": true, "groups": [
+			{"name": "default", "enabled": true, "urls": ["https://example.com/hosts"]},
+			{"name": "ads", "enabled": true, "urls": ["https://example.com/ads.txt"]}
+		]}}`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	future := time.Now().Add(time.Hour).Truncate(time.Second)
+	past := time.Now().Add(-time.Minute)
+	if !cfg.SetBlockListPause(DefaultBlockListGroup, &future) || !cfg.SetBlockListPause("ads", &past) || !cfg.SetBlockListPause("", &past) {
+		t.Fatal("SetBlockListPause must accept the global pause and configured groups")
+	}
+	if cfg.SetBlockListPause("missing", &future) {
+		t.Error("SetBlockListPause must reject an unknown group")
+	}
+	if err := cfg.SaveFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Истёкшие паузы в файл не попадают.
+	saved, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := saved.BlockList.Groups
+	if saved.BlockList.PausedUntil != nil || groups[1].PausedUntil != nil {
+		t.Errorf("expired pauses were saved: global %v, ads %v", saved.BlockList.PausedUntil, groups[1].PausedUntil)
+	}
+	if groups[0].PausedUntil == nil || !groups[0].PausedUntil.Equal(future) {
+		t.Errorf("default group pause = %v, want %v", groups[0].PausedUntil, future)
+	}
+}
+
+func TestReadConfigRejectsNewerVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"version": 99}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ReadConfig(path); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("ReadConfig error = %v", err)
+	}
+}
+
+func TestConfigFormatsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		config string
+		// keep — строки, которые должны пережить сохранение без изменений.
+		keep []string
+		want string
+	}{
+		{
+			name: "yaml",
+			file: "config.yaml",
+			config: `# dns-box
+version: 2
+server:
+  address: ["127.0.0.1:53"] # только локально
+  log: info
+dns:
+  upstream_servers:
+    - tls://1.1.1.1
+ipset:
+  lists:
+    # Через VPN
+    - name: vpn
+      enable_ipv6: true
+      timeout: 0
+      rules:
+        domain:
+          - example.com # заблокирован у провайдера
+          - example.net
+        domain_suffix: [.youtube.com]
+    - name: media
+      enable_ipv6: false
+      timeout: 3600
+      rules:
+        domain_suffix:
+          - .nflxvideo.net # CDN
+# конец
+`,
+			keep: []string{
+				"# dns-box\nversion: 2\nserver:\n",
+				`  address: ["127.0.0.1:53"] # только локально`,
+				"    # Через VPN\n    - name: vpn\n",
+				"          - example.com # заблокирован у провайдера\n          - example.net\n          - example.org\n",
+				"        domain_suffix: [.youtube.com]",
+				"          - .nflxvideo.net # CDN",
+			},
+			want: "    - name: media\n      enable_ipv6: false\n      timeout: 7200\n",
+		},
+		{
+			name: "toml",
+			file: "config.toml",
+			config: `# dns-box
+version = 2
+
+[server]
+address = ["127.0.0.1:53"] # только локально
+log = "info"
+
+[dns]
+upstream_servers = ["tls://1.1.1.1"]
+
+# Через VPN
+[[ipset.lists]]
+name = "vpn"
+enable_ipv6 = true
+timeout = 0
+
+[ipset.lists.rules]
+domain = [
+  # заблокирован у провайдера
+  "example.com",
+  "example.net", # зеркало
+]
+domain_suffix = [".youtube.com"]
+
+[[ipset.lists]]
+name = "media"
+enable_ipv6 = false
+timeout = 3600
+
+[ipset.lists.rules]
+domain_suffix = [".nflxvideo.net"] # CDN
+# конец
+`,
+			keep: []string{
+				"# dns-box\nversion = 2\n\n[server]\n",
+				`address = ["127.0.0.1:53"] # только локально`,
+				"# Через VPN\n[[ipset.lists]]\nname = \"vpn\"\n",
+				"domain = [\n  # заблокирован у провайдера\n  \"example.com\",\n  \"example.net\", # зеркало\n  \"example.org\",\n]\n",
+				`domain_suffix = [".nflxvideo.net"] # CDN`,
+			},
+			want: "name = \"media\"\nenable_ipv6 = false\ntimeout = 7200\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.config), 0600); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig(path)
+			if err != nil {
+				t.Fatalf("LoadConfig: %v", err)
+			}
+			if got := cfg.GetIPSetLists(); len(got) != 2 || got[0].Rules.Domains[1] != "example.net" || got[1].Timeout != 3600 {
+				t.Fatalf("lists = %+v", got)
+			}
+
+			cfg.AddDomainToList("vpn", "example.org")
+			timeout := uint32(7200)
+			if _, _, err := cfg.UpdateIPSetList("media", nil, &timeout); err != nil {
+				t.Fatal(err)
+			}
+			if err := cfg.SaveConfig(); err != nil {
+				t.Fatalf("SaveConfig: %v", err)
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range append(tt.keep, tt.want) {
+				if !strings.Contains(string(data), want) {
+					t.Errorf("saved config does not contain %q:\n%s", want, data)
+				}
+			}
+			if !strings.HasSuffix(string(data), "# конец\n") {
+				t.Errorf("trailing comment moved:\n%s", data)
+			}
+			// Нулевые поля структур, которых не было в файле, не дописываются.
+			for _, unwanted := range []string{"nftables", "blocklist", "rules:\n        domain: []", "static_ips"} {
+				if strings.Contains(string(data), unwanted) {
+					t.Errorf("saved config contains %q:\n%s", unwanted, data)
+				}
+			}
+
+			reloaded, err := LoadConfig(path)
+			if err != nil {
+				t.Fatalf("reload: %v", err)
+			}
+			if !reflect.DeepEqual(reloaded.GetIPSetLists(), cfg.GetIPSetLists()) {
+				t.Errorf("reloaded lists = %+v, want %+v", reloaded.GetIPSetLists(), cfg.GetIPSetLists())
+			}
+
+			// Повторное сохранение без изменений не меняет файл.
+			if err := reloaded.SaveConfig(); err != nil {
+				t.Fatal(err)
+			}
+			if again, _ := os.ReadFile(path); string(again) != string(data) {
+				t.Errorf("second save changed the file:\n%s\nwant:\n%s", again, data)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMigratesYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	legacy := `# legacy
+
+server:
+  address: [":53"] # все интерфейсы
+dns:
+  upstream_servers: [8.8.8.8]
+ipset:
+  ipv4name: vpn
+rules:
+  domain: [example.com]
+`
+	if err := os.WriteFile(path, []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if lists := cfg.GetIPSetLists(); len(lists) != 1 || lists[0].Name != "vpn" || lists[0].Rules.Domains[0] != "example.com" {
+		t.Errorf("lists = %+v", lists)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# legacy\n\nversion: 2\n", `address: [":53"] # все интерфейсы`, "ipset:\n  lists:\n    - name: vpn\n"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("migrated config does not contain %q:\n%s", want, data)
+		}
+	}
+	if backup, err := os.ReadFile(path + ".v1.bak"); err != nil || string(backup) != legacy {
+		t.Errorf("backup = %q, %v", backup, err)
+	}
+}
+
+func TestIncludeDirectory(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	mainConfig := `{
+		"version": 2,
+		"include": "lists.d",
+		"server": {"address": ["127.0.0.1:53"]},
+		"dns": {"upstream_servers": ["8.8.8.8"]},
+		"ipset": {"lists": [{"name": "vpn", "rules": {"domain": ["example.com"]}}]},
+		"blocklist": {"enabled": true}
+	}`
+	files := map[string]string{
+		"config.json":          mainConfig,
+		"lists.d/youtube.json": `{"ipset": {"lists": [{"name": "youtube", "rules": {"domain_suffix": [".youtube.com"]}}]}}`,
+		"lists.d/corp.yaml": `# офис
+ipset:
+  net_lists:
+    - name: corp
+      cidr: [10.0.0.0/8] # VPN офиса
+blocklist:
+  groups:
+    - name: ads
+      enabled: true
+      urls: [https://example.com/ads.txt]
+`,
+		"lists.d/README.md": "не конфиг",
+	}
+	for name, content := range files {
+		full := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	var names []string
+	for _, l := range cfg.GetIPSetLists() {
+		names = append(names, l.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"vpn", "youtube"}) {
+		t.Errorf("lists = %v", names)
+	}
+	if nets := cfg.GetNetLists(); len(nets) != 1 || nets[0].CIDRs[0] != "10.0.0.0/8" {
+		t.Errorf("net lists = %+v", nets)
+	}
+	if groups := cfg.BlockList.Groups; len(groups) != 1 || groups[0].Name != "ads" {
+		t.Errorf("groups = %+v", groups)
+	}
+
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// Правка списка из lists.d меняет только его файл.
+	cfg.AddDomainToList("youtube", "youtu.be")
+	if err := cfg.SaveConfig(); err != nil {
+		t.Fatalf("SaveConfig: %v", err)
+	}
+	if got := read("config.json"); got != mainConfig {
+		t.Errorf("main config rewritten:\n%s", got)
+	}
+	if got := read("lists.d/corp.yaml"); got != files["lists.d/corp.yaml"] {
+		t.Errorf("corp.yaml rewritten:\n%s", got)
+	}
+	if got := read("lists.d/youtube.json"); !strings.Contains(got, `"youtu.be"`) || strings.Contains(got, `"vpn"`) {
+		t.Errorf("youtube.json = %s", got)
+	}
+
+	// Правка группы в YAML сохраняет комментарии файла.
+	cfg.SetBlockListGroupEnabled("ads", false)
+	if err := cfg.SaveConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := read("lists.d/corp.yaml"); !strings.Contains(got, "enabled: false") || !strings.Contains(got, "# VPN офиса") {
+		t.Errorf("corp.yaml = %s", got)
+	}
+
+	// Новый список получает свой файл, удалённый — удаляет файл.
+	if err := cfg.AddIPSetList(IPSetListConfig{Name: "media"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.RemoveIPSetList("youtube"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.SaveConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := read("lists.d/media.json"); !strings.Contains(got, `"name": "media"`) {
+		t.Errorf("media.json = %s", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "lists.d/youtube.json")); !os.IsNotExist(err) {
+		t.Errorf("youtube.json was not removed: %v", err)
+	}
+	if got := read("config.json"); got != mainConfig {
+		t.Errorf("main config rewritten:\n%s", got)
+	}
+
+	reloaded, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if !reflect.DeepEqual(reloaded.GetIPSetLists(), cfg.GetIPSetLists()) {
+		t.Errorf("reloaded lists = %+v, want %+v", reloaded.GetIPSetLists(), cfg.GetIPSetLists())
+	}
+
+	// Ошибки в файле include показываются с его именем и индексом в нём.
+	if err := os.WriteFile(filepath.Join(dir, "lists.d/dup.json"), []byte(`{"ipset": {"lists": [{"name": "vpn"}]}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "list vpn is already defined in config.json") {
+		t.Errorf("duplicate list error = %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "lists.d/dup.json"), []byte(`{"ipset": {"lists": [{"name": "dup"}, {"name": "bad name"}]}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "lists.d/dup.json: ipset.lists[1].name") {
+		t.Errorf("invalid list name error = %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "lists.d/dup.json"), []byte(`{"server": {"address": [":53"]}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), `unexpected key "server"`) {
+		t.Errorf("include with server section error = %v", err)
+	}
+}
+
+func TestOverrides(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	// Без server.address конфиг не проходит проверку: адрес задаётся окружением.
+	content := `{
+		"version": 2,
+		"server": {"log": "info"},
+		"dns": {"upstream_servers": ["8.8.8.8"]},
+		"ipset": {"lists": [{"name": "vpn"}]},
+		"blocklist": {"enabled": false, "ip_urls": ["https://example.com/cidrs"]},
+		"github_backup": {"token": "file-token"}
+	}`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("expected missing server.address error")
+	}
+
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("env-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	o := NewOverrides([]string{
+		"DNS_BOX_SERVER_ADDRESS=127.0.0.1:53, [::1]:53",
+		"DNS_BOX_SERVER_LOG=debug",
+		"DNS_BOX_SERVER_API_ADDRESS=127.0.0.1:8091",
+		"DNS_BOX_DNS_TIMEOUT=5",
+		"DNS_BOX_BLOCKLIST_ENABLED=true",
+		"DNS_BOX_BLOCKLIST_IP_URLS=https://example.com/env",
+		"DNS_BOX_IPSET_ASN_DATABASE_URL=https://example.com/asn.tsv",
+		"DNS_BOX_GITHUB_BACKUP_TOKEN_FILE=" + tokenFile,
+		"DNS_BOX_DNS_CACHE=1", // неизвестная переменная только попадает в лог
+		"PATH=/bin",
+	})
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	o.RegisterFlags(fs)
+	if err := fs.Parse([]string{"-server.log", "warn", "-ipset.destroy_removed_sets"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfigWithOverrides(path, o)
+	if err != nil {
+		t.Fatalf("LoadConfigWithOverrides: %v", err)
+	}
+	if !reflect.DeepEqual(cfg.Server.Address, []string{"127.0.0.1:53", "[::1]:53"}) {
+		t.Errorf("server.address = %v", cfg.Server.Address)
+	}
+	if cfg.Server.Log != "warn" {
+		t.Errorf("server.log = %q, the flag must win over the environment", cfg.Server.Log)
+	}
+	if got := cfg.Server.GetAPIAddress(); got != "127.0.0.1:8091" {
+		t.Errorf("api address = %q", got)
+	}
+	if cfg.DNS.Timeout != 5 || !cfg.BlockList.Enabled || !cfg.IPSet.DestroyRemovedSets {
+		t.Errorf("dns.timeout = %d, blocklist.enabled = %v, ipset.destroy_removed_sets = %v",
+			cfg.DNS.Timeout, cfg.BlockList.Enabled, cfg.IPSet.DestroyRemovedSets)
+	}
+	if cfg.IPSet.ASNDatabase == nil || cfg.IPSet.ASNDatabase.URL != "https://example.com/asn.tsv" {
+		t.Errorf("ipset.asn_database = %+v", cfg.IPSet.ASNDatabase)
+	}
+	if cfg.GithubBackup.GetToken() != "env-secret" {
+		t.Errorf("token = %q", cfg.GithubBackup.GetToken())
+	}
+
+	effective, err := cfg.EffectiveConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(effective), "secret") || !strings.Contains(string(effective), `"token": "<redacted>"`) {
+		t.Errorf("secret is not redacted:\n%s", effective)
+	}
+	if !strings.Contains(string(effective), `"api_address": "127.0.0.1:8091"`) {
+		t.Errorf("effective config has no overrides:\n%s", effective)
+	}
+
+	// В файл попадают значения из файла, а не из окружения; поле, изменённое
+	// после переопределения, сохраняется с новым значением.
+	cfg.mu.Lock()
+	cfg.BlockList.IPURLs = append(cfg.BlockList.IPURLs, "https://example.com/api")
+	cfg.mu.Unlock()
+	if err := cfg.SaveConfig(); err != nil {
+		t.Fatalf("SaveConfig: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved Config
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if saved.BlockList.Enabled || saved.IPSet.DestroyRemovedSets || saved.IPSet.ASNDatabase != nil ||
+		saved.GithubBackup.Token != "file-token" || len(saved.Server.Address) != 0 || saved.Server.Log != "info" {
+		t.Errorf("overrides leaked into the file:\n%s", data)
+	}
+	if want := []string{"https://example.com/env", "https://example.com/api"}; !reflect.DeepEqual(saved.BlockList.IPURLs, want) {
+		t.Errorf("blocklist.ip_urls = %v, want %v", saved.BlockList.IPURLs, want)
+	}
+
+	for _, tt := range []struct {
+		environ []string
+		want    string
+	}{
+		{[]string{"DNS_BOX_SERVER_ADDRESS=:53", "DNS_BOX_BLOCKLIST_ENABLED=maybe"}, `DNS_BOX_BLOCKLIST_ENABLED: invalid boolean "maybe"`},
+		{[]string{"DNS_BOX_SERVER_ADDRESS=:53", "DNS_BOX_GITHUB_BACKUP_TOKEN=a", "DNS_BOX_GITHUB_BACKUP_TOKEN_FILE=" + tokenFile}, "both DNS_BOX_GITHUB_BACKUP_TOKEN and DNS_BOX_GITHUB_BACKUP_TOKEN_FILE are set"},
+		{[]string{"DNS_BOX_SERVER_ADDRESS=:53", "DNS_BOX_SERVER_API_ADDRESS=localhost"}, "server.api_address: invalid address"},
+	} {
+		if _, err := LoadConfigWithOverrides(path, NewOverrides(tt.environ)); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: error = %v, want %q", tt.environ, err, tt.want)
+		}
+	}
+}
+
+func TestPersister(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	content := `{"version": 2, "server": {"address": [":53"]}, "dns": {"upstream_servers": ["8.8.8.8"]},
+		"ipset": {"lists": [{"name": "vpn"}]},
+		"github_backup": {"enabled": true, "token": "t", "owner": "o", "repo": "r", "path": "hosts.json"}}`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pushes, failing atomic.Int32
+	p := NewPersister(cfg)
+	p.push = func(ctx context.Context) error {
+		if failing.Load() != 0 {
+			return errors.New("github is down")
+		}
+		pushes.Add(1)
+		return nil
+	}
+	p.delay, p.retryMin, p.retryMax = 50*time.Millisecond, 20*time.Millisecond, 40*time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.Start(ctx)
+
+	waitFor := func(what string, cond func(PersistStatus) bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond(p.Status()) {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s: %+v", what, p.Status())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// Файл пишется сразу, пачка изменений уходит в GitHub одним коммитом.
+	for _, domain := range []string{"a.example", "b.example", "c.example"} {
+		cfg.AddDomainToList("vpn", domain)
+		if err := p.Save(); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), "c.example") {
+		t.Errorf("config is not written on Save:\n%s", data)
+	}
+	if s := p.Status(); !s.Pending || s.LastSave == nil || pushes.Load() != 0 {
+		t.Errorf("status after Save = %+v, pushes = %d", s, pushes.Load())
+	}
+	waitFor("backup", func(s PersistStatus) bool { return !s.Pending })
+	time.Sleep(2 * p.delay)
+	if got := pushes.Load(); got != 1 {
+		t.Errorf("pushes = %d, want 1", got)
+	}
+
+	// Ошибка GitHub не мешает записи на диск, отправка повторяется.
+	failing.Store(1)
+	cfg.AddDomainToList("vpn", "d.example")
+	if err := p.Save(); err != nil {
+		t.Fatalf("Save with GitHub down: %v", err)
+	}
+	waitFor("retries", func(s PersistStatus) bool { return s.FailedAttempts >= 2 })
+	if s := p.Status(); !s.Pending || s.LastBackupError != "github is down" {
+		t.Errorf("status after failures = %+v", s)
+	}
+	failing.Store(0)
+	waitFor("backup after retry", func(s PersistStatus) bool { return !s.Pending })
+	if s := p.Status(); s.FailedAttempts != 0 || s.LastBackupError != "" || s.Backups != 2 {
+		t.Errorf("status after recovery = %+v", s)
+	}
+
+	// Flush отправляет неотправленные изменения сразу.
+	cfg.AddDomainToList("vpn", "e.example")
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if s := p.Status(); s.Pending || pushes.Load() != 3 {
+		t.Errorf("status after Flush = %+v, pushes = %d", s, pushes.Load())
+	}
+
+	noPath := NewPersister(&Config{})
+	if err := noPath.Save(); !errors.Is(err, ErrNoConfigPath) || noPath.Status().LastSaveError == "" {
+		t.Errorf("Save without path = %v, status %+v", err, noPath.Status())
+	}
+}
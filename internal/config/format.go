@@ -0,0 +1,320 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// configFormat — формат файла конфига, выбирается по расширению.
+type configFormat int
+
+const (
+	formatJSON configFormat = iota
+	formatYAML
+	formatTOML
+)
+
+func formatOf(path string) configFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return formatYAML
+	case ".toml":
+		return formatTOML
+	default:
+		return formatJSON
+	}
+}
+
+func (f configFormat) String() string {
+	switch f {
+	case formatYAML:
+		return "yaml"
+	case formatTOML:
+		return "toml"
+	default:
+		return "json"
+	}
+}
+
+// decodeDocument разбирает файл в дерево map[string]any/[]any. Ключи те же,
+// что в JSON, поэтому дерево переводится в Config через encoding/json.
+func decodeDocument(f configFormat, data []byte) (map[string]any, error) {
+	var doc map[string]any
+	switch f {
+	case formatYAML:
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+	case formatTOML:
+		if err := toml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return nil, err
+		}
+	}
+	if doc == nil {
+		doc = make(map[string]any)
+	}
+	return doc, nil
+}
+
+// encodeDocument записывает doc в формате f. YAML и TOML накладываются на
+// original: комментарии и порядок ключей пользователя сохраняются, новые
+// ключи встают в порядке полей Config.
+func encodeDocument(f configFormat, original []byte, doc map[string]any) ([]byte, error) {
+	switch f {
+	case formatYAML:
+		return encodeYAML(original, doc)
+	case formatTOML:
+		return encodeTOML(original, doc)
+	default:
+		return marshalDocument(doc)
+	}
+}
+
+// toDocument переводит значение в дерево, как его видит decodeDocument для JSON.
+func toDocument(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+var configType = reflect.TypeOf(Config{})
+
+// fieldType возвращает тип поля структуры t с JSON-именем key или nil.
+func fieldType(t reflect.Type, key string) reflect.Type {
+	t = indirectType(t)
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	for i := range t.NumField() {
+		if jsonName(t.Field(i)) == key {
+			return t.Field(i).Type
+		}
+	}
+	return nil
+}
+
+// elemType возвращает тип элемента среза t или nil.
+func elemType(t reflect.Type) reflect.Type {
+	t = indirectType(t)
+	if t == nil || t.Kind() != reflect.Slice {
+		return nil
+	}
+	return t.Elem()
+}
+
+func indirectType(t reflect.Type) reflect.Type {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
+
+func jsonName(f reflect.StructField) string {
+	if !f.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+// keyOrder возвращает порядок ключей таблицы: существующие ключи остаются на
+// своих местах, новые встают перед первым существующим ключом, который идёт
+// после них в структуре t. Ключи, которых нет в t, добавляются в конец по
+// алфавиту.
+func keyOrder(existing []string, doc map[string]any, t reflect.Type) []string {
+	rank := make(map[string]int)
+	if t = indirectType(t); t != nil && t.Kind() == reflect.Struct {
+		for i := range t.NumField() {
+			if name := jsonName(t.Field(i)); name != "" {
+				rank[name] = i
+			}
+		}
+	}
+
+	var order []string
+	for _, key := range existing {
+		if _, ok := doc[key]; ok && !slices.Contains(order, key) {
+			order = append(order, key)
+		}
+	}
+	var added []string
+	for key := range doc {
+		if !slices.Contains(order, key) {
+			added = append(added, key)
+		}
+	}
+	slices.SortFunc(added, func(a, b string) int {
+		ra, okA := rank[a]
+		rb, okB := rank[b]
+		switch {
+		case okA && okB:
+			return ra - rb
+		case okA:
+			return -1
+		case okB:
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+
+	for _, key := range added {
+		pos := len(order)
+		if r, ok := rank[key]; ok {
+			for i, other := range order {
+				if ro, ok := rank[other]; ok && ro > r {
+					pos = i
+					break
+				}
+			}
+		}
+		order = slices.Insert(order, pos, key)
+	}
+	return order
+}
+
+// normalizeScalar приводит числа разных декодеров к int64/float64, чтобы
+// значения из файла и из памяти можно было сравнить.
+func normalizeScalar(v any) any {
+	switch n := v.(type) {
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return i
+		}
+		if f, err := n.Float64(); err == nil {
+			return f
+		}
+		return n.String()
+	case int:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case uint32:
+		return int64(n)
+	case uint64:
+		return int64(n)
+	case float32:
+		return float64(n)
+	}
+	return v
+}
+
+// elementID определяет элемент массива при слиянии: таблица — по name,
+// скаляр — по значению. Для остальных ok равен false, и элементы
+// сопоставляются по позиции.
+func elementID(v any) (id any, ok bool) {
+	switch e := v.(type) {
+	case map[string]any:
+		name, ok := e["name"].(string)
+		return name, ok
+	case []any:
+		return nil, false
+	default:
+		return normalizeScalar(v), true
+	}
+}
+
+// pruneDocument убирает из v пустые значения, которых нет в old: в YAML и
+// TOML пишутся только заданные пользователем поля, а не все нули структуры.
+func pruneDocument(v, old any) any {
+	switch value := v.(type) {
+	case map[string]any:
+		oldMap, _ := old.(map[string]any)
+		pruned := make(map[string]any, len(value))
+		for key, child := range value {
+			oldChild, existed := oldMap[key]
+			child = pruneDocument(child, oldChild)
+			if existed || !isZeroDocument(child) {
+				pruned[key] = child
+			}
+		}
+		return pruned
+	case []any:
+		oldList, _ := old.([]any)
+		oldByID := make(map[any]any, len(oldList))
+		for _, elem := range oldList {
+			if id, ok := elementID(elem); ok {
+				oldByID[id] = elem
+			}
+		}
+		pruned := make([]any, len(value))
+		for i, elem := range value {
+			var oldElem any
+			if id, ok := elementID(elem); ok {
+				oldElem = oldByID[id]
+			} else if i < len(oldList) {
+				oldElem = oldList[i]
+			}
+			pruned[i] = pruneDocument(elem, oldElem)
+		}
+		return pruned
+	}
+	return v
+}
+
+func isZeroDocument(v any) bool {
+	switch value := normalizeScalar(v).(type) {
+	case nil:
+		return true
+	case string:
+		return value == ""
+	case bool:
+		return !value
+	case int64:
+		return value == 0
+	case float64:
+		return value == 0
+	case map[string]any:
+		return len(value) == 0
+	case []any:
+		return len(value) == 0
+	}
+	return false
+}
+
+// mergeDocument заменяет в doc секции sections (nil удаляет секцию) и
+// записывает результат поверх original. Пустые значения, которых не было в
+// файле, не добавляются.
+func mergeDocument(f configFormat, original []byte, doc, sections map[string]any) ([]byte, error) {
+	for key, v := range sections {
+		if v == nil {
+			delete(doc, key)
+			continue
+		}
+		section, err := toDocument(v)
+		if err != nil {
+			return nil, err
+		}
+		old, ok := doc[key]
+		if section = pruneDocument(section, old); ok || !isZeroDocument(section) {
+			doc[key] = section
+		}
+	}
+	return encodeDocument(f, original, doc)
+}
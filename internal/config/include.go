@@ -0,0 +1,370 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// includeFile — файл из каталога include: кусок основного конфига, в котором
+// могут быть только списки, net-списки и группы блоклистов.
+type includeFile struct {
+	IPSet     *includeIPSet     `json:"ipset,omitempty"`
+	BlockList *includeBlockList `json:"blocklist,omitempty"`
+}
+
+type includeIPSet struct {
+	Lists    []IPSetListConfig `json:"lists,omitempty"`
+	NetLists []NetListConfig   `json:"net_lists,omitempty"`
+}
+
+type includeBlockList struct {
+	Groups []BlockListGroupConfig `json:"groups,omitempty"`
+}
+
+// includeSections — ключи, разрешённые в файлах include.
+var includeSections = map[string][]string{
+	"ipset":     {"lists", "net_lists"},
+	"blocklist": {"groups"},
+}
+
+// Ключи элементов в Config.sources.
+func listSource(name string) string    { return "lists/" + name }
+func netListSource(name string) string { return "net_lists/" + name }
+func groupSource(name string) string   { return "groups/" + name }
+
+// includeDir возвращает каталог include; относительный путь считается от
+// каталога основного конфига.
+func (c *Config) includeDir() string {
+	if c.Include == "" || filepath.IsAbs(c.Include) {
+		return c.Include
+	}
+	return filepath.Join(filepath.Dir(c.Path), c.Include)
+}
+
+// loadIncludes добавляет к конфигу элементы из файлов каталога include и
+// запоминает, какой файл владеет каждым элементом.
+func (c *Config) loadIncludes() error {
+	c.sources = make(map[string]string)
+	c.addSources(c.Path, &includeFile{
+		IPSet:     &includeIPSet{Lists: c.IPSet.Lists, NetLists: c.IPSet.NetLists},
+		BlockList: &includeBlockList{Groups: c.BlockList.Groups},
+	})
+
+	dir := c.includeDir()
+	if dir == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		// Каталог создаётся при сохранении первого списка.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !isIncludeFile(entry) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		inc, err := readIncludeFile(path)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if err := c.checkOwners(path, inc); err != nil {
+			return err
+		}
+		if inc.IPSet != nil {
+			c.IPSet.Lists = append(c.IPSet.Lists, inc.IPSet.Lists...)
+			c.IPSet.NetLists = append(c.IPSet.NetLists, inc.IPSet.NetLists...)
+		}
+		if inc.BlockList != nil {
+			c.BlockList.Groups = append(c.BlockList.Groups, inc.BlockList.Groups...)
+		}
+		c.addSources(path, inc)
+	}
+	return nil
+}
+
+// checkOwners не даёт двум файлам определить элемент с одним именем: иначе
+// непонятно, в какой из них записывать изменения.
+func (c *Config) checkOwners(path string, inc *includeFile) error {
+	check := func(kind, key string) error {
+		if owner, ok := c.sources[key]; ok {
+			if rel, err := filepath.Rel(filepath.Dir(c.Path), owner); err == nil {
+				owner = rel
+			}
+			return fmt.Errorf("%s: %s is already defined in %s", path, kind, owner)
+		}
+		return nil
+	}
+	if inc.IPSet != nil {
+		for _, l := range inc.IPSet.Lists {
+			if err := check("list "+l.Name, listSource(l.Name)); err != nil {
+				return err
+			}
+		}
+		for _, l := range inc.IPSet.NetLists {
+			if err := check("net list "+l.Name, netListSource(l.Name)); err != nil {
+				return err
+			}
+		}
+	}
+	if inc.BlockList != nil {
+		for _, g := range inc.BlockList.Groups {
+			if err := check("blocklist group "+g.Name, groupSource(g.Name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Config) addSources(path string, inc *includeFile) {
+	if inc.IPSet != nil {
+		for _, l := range inc.IPSet.Lists {
+			c.sources[listSource(l.Name)] = path
+		}
+		for _, l := range inc.IPSet.NetLists {
+			c.sources[netListSource(l.Name)] = path
+		}
+	}
+	if inc.BlockList != nil {
+		for _, g := range inc.BlockList.Groups {
+			c.sources[groupSource(g.Name)] = path
+		}
+	}
+}
+
+// isIncludeFile пропускает подкаталоги, скрытые файлы (в том числе
+// временные файлы атомарной записи) и файлы других форматов.
+func isIncludeFile(entry os.DirEntry) bool {
+	if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(entry.Name())) {
+	case ".json", ".yaml", ".yml", ".toml":
+		return true
+	}
+	return false
+}
+
+func readIncludeFile(path string) (*includeFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := decodeDocument(formatOf(path), data)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range doc {
+		allowed, ok := includeSections[key]
+		section, isMap := value.(map[string]any)
+		if !ok || !isMap {
+			return nil, fmt.Errorf("unexpected key %q, include files may only contain ipset.lists, ipset.net_lists and blocklist.groups", key)
+		}
+		for sub := range section {
+			if !slices.Contains(allowed, sub) {
+				return nil, fmt.Errorf("unexpected key %q, include files may only contain ipset.lists, ipset.net_lists and blocklist.groups", key+"."+sub)
+			}
+		}
+	}
+	if data, err = json.Marshal(doc); err != nil {
+		return nil, err
+	}
+	var inc includeFile
+	if err := json.Unmarshal(data, &inc); err != nil {
+		return nil, err
+	}
+	return &inc, nil
+}
+
+// splitLocked раскладывает списки, net-списки и группы по файлам-владельцам.
+// Элемент без владельца (созданный через API) попадает в новый файл
+// <name><расширение конфига> в каталоге include, а без include — в основной
+// конфиг. В результате есть и файлы, у которых не осталось элементов.
+func (c *Config) splitLocked() map[string]*includeFile {
+	files := make(map[string]*includeFile)
+	for _, path := range c.sources {
+		files[path] = &includeFile{}
+	}
+	files[c.Path] = &includeFile{}
+	ext := filepath.Ext(c.Path)
+	if !slices.Contains([]string{".json", ".yaml", ".yml", ".toml"}, strings.ToLower(ext)) {
+		ext = ".json"
+	}
+	owner := func(key, name string) *includeFile {
+		path, ok := c.sources[key]
+		if !ok {
+			path = c.Path
+			if dir := c.includeDir(); dir != "" {
+				path = filepath.Join(dir, name+ext)
+			}
+		}
+		if files[path] == nil {
+			files[path] = &includeFile{}
+		}
+		return files[path]
+	}
+
+	for _, l := range c.IPSet.Lists {
+		inc := owner(listSource(l.Name), l.Name)
+		inc.ipset().Lists = append(inc.ipset().Lists, l)
+	}
+	for _, l := range c.IPSet.NetLists {
+		inc := owner(netListSource(l.Name), l.Name)
+		inc.ipset().NetLists = append(inc.ipset().NetLists, l)
+	}
+	for _, g := range c.BlockList.Groups {
+		inc := owner(groupSource(g.Name), g.Name)
+		inc.blockList().Groups = append(inc.blockList().Groups, g)
+	}
+	return files
+}
+
+func (inc *includeFile) ipset() *includeIPSet {
+	if inc.IPSet == nil {
+		inc.IPSet = &includeIPSet{}
+	}
+	return inc.IPSet
+}
+
+func (inc *includeFile) blockList() *includeBlockList {
+	if inc.BlockList == nil {
+		inc.BlockList = &includeBlockList{}
+	}
+	return inc.BlockList
+}
+
+// saveIncludesLocked записывает файлы include, элементы которых изменились,
+// и удаляет файлы, у которых не осталось элементов.
+func (c *Config) saveIncludesLocked(files map[string]*includeFile) error {
+	for _, path := range slices.Sorted(maps.Keys(files)) {
+		if path == c.Path {
+			continue
+		}
+		inc := files[path]
+		if inc.IPSet == nil && inc.BlockList == nil {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		if current, err := readIncludeFile(path); err == nil && sameDocument(current, inc) {
+			continue
+		}
+		data, err := marshalIncludeFile(path, inc)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path, data); err != nil {
+			return err
+		}
+	}
+
+	c.sources = make(map[string]string)
+	for path, inc := range files {
+		c.addSources(path, inc)
+	}
+	return nil
+}
+
+// marshalIncludeFile записывает inc в формате файла; YAML и TOML
+// накладываются на существующий файл, как в SaveConfig.
+func marshalIncludeFile(path string, inc *includeFile) ([]byte, error) {
+	format := formatOf(path)
+	if format == formatJSON {
+		data, err := json.MarshalIndent(inc, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	}
+
+	original, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	doc, err := decodeDocument(format, original)
+	if err != nil {
+		original, doc = nil, make(map[string]any)
+	}
+	sections := map[string]any{"ipset": nil, "blocklist": nil}
+	if inc.IPSet != nil {
+		sections["ipset"] = inc.IPSet
+	}
+	if inc.BlockList != nil {
+		sections["blocklist"] = inc.BlockList
+	}
+	return mergeDocument(format, original, doc, sections)
+}
+
+// sameDocument сравнивает значения так, как они записываются в файл.
+func sameDocument(a, b any) bool {
+	docA, errA := toDocument(a)
+	docB, errB := toDocument(b)
+	return errA == nil && errB == nil && documentEqual(docA, docB)
+}
+
+var itemPathRe = regexp.MustCompile(`(ipset\.lists|ipset\.net_lists|blocklist\.groups)\[(\d+)\]`)
+
+// includeIssues переписывает пути элементов из файлов include: вместо
+// индекса в общем списке — файл и индекс в нём.
+func (c *Config) includeIssues(issues []Issue) []Issue {
+	if len(c.sources) == 0 || c.Include == "" {
+		return issues
+	}
+	locate := func(match string) string {
+		m := itemPathRe.FindStringSubmatch(match)
+		i, _ := strconv.Atoi(m[2])
+		var keys []string
+		switch m[1] {
+		case "ipset.lists":
+			for _, l := range c.IPSet.Lists {
+				keys = append(keys, listSource(l.Name))
+			}
+		case "ipset.net_lists":
+			for _, l := range c.IPSet.NetLists {
+				keys = append(keys, netListSource(l.Name))
+			}
+		default:
+			for _, g := range c.BlockList.Groups {
+				keys = append(keys, groupSource(g.Name))
+			}
+		}
+		if i >= len(keys) {
+			return match
+		}
+		file, ok := c.sources[keys[i]]
+		if !ok || file == c.Path {
+			return match
+		}
+		local := 0
+		for _, key := range keys[:i] {
+			if c.sources[key] == file {
+				local++
+			}
+		}
+		if rel, err := filepath.Rel(filepath.Dir(c.Path), file); err == nil {
+			file = rel
+		}
+		return fmt.Sprintf("%s: %s[%d]", file, m[1], local)
+	}
+	for i := range issues {
+		issues[i].Path = itemPathRe.ReplaceAllStringFunc(issues[i].Path, locate)
+		issues[i].Message = itemPathRe.ReplaceAllStringFunc(issues[i].Message, locate)
+	}
+	return issues
+}
@@ -0,0 +1,277 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// CurrentVersion — версия схемы конфига, которую понимает эта сборка. Конфиг
+// без поля version считается версией 1.
+const CurrentVersion = 2
+
+// migration переводит документ конфига из версии from в from+1. Миграции
+// работают с разобранным JSON, а не с Config: так переживают и поля, которых
+// в Config уже нет, и поля, о которых миграция не знает.
+type migration struct {
+	from  int
+	apply func(doc map[string]any) (notes []string)
+}
+
+var migrations = []migration{
+	{from: 1, apply: migrateLegacyIPSet},
+	{from: 1, apply: migrateBlockListURLs},
+}
+
+// Migration — результат обновления конфига до CurrentVersion.
+type Migration struct {
+	From, To int
+	// Notes описывают изменения, которые требуют внимания, например
+	// переименованное множество.
+	Notes []string
+	// Original и Migrated — документ до и после, в одном форматировании,
+	// чтобы разница показывала только изменения.
+	Original, Migrated []byte
+
+	source []byte // файл как есть, для резервной копии
+}
+
+// Diff возвращает разницу между исходным и обновлённым конфигом в формате
+// unified diff.
+func (m *Migration) Diff() string {
+	return unifiedDiff(m.Original, m.Migrated, fmt.Sprintf("version %d", m.From), fmt.Sprintf("version %d", m.To))
+}
+
+// BackupPath возвращает путь, куда сохраняется исходный файл перед миграцией.
+func (m *Migration) BackupPath(path string) string {
+	return fmt.Sprintf("%s.v%d.bak", path, m.From)
+}
+
+// migrate обновляет документ doc до CurrentVersion на месте. Для актуального
+// конфига возвращает nil. Original и Migrated заполняются в JSON; ReadConfig
+// заменяет их на файл в его формате.
+func migrate(doc map[string]any) (*Migration, error) {
+	version := 1
+	if raw, ok := doc["version"]; ok {
+		v, ok := normalizeScalar(raw).(int64)
+		if !ok || v < 1 {
+			return nil, fmt.Errorf("invalid config version %v", raw)
+		}
+		version = int(v)
+	}
+	switch {
+	case version > CurrentVersion:
+		return nil, fmt.Errorf("config version %d is newer than the supported version %d", version, CurrentVersion)
+	case version == CurrentVersion:
+		return nil, nil
+	}
+
+	original, err := marshalDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+	m := &Migration{From: version, To: CurrentVersion, Original: original}
+	for _, step := range migrations {
+		if step.from < version {
+			continue
+		}
+		m.Notes = append(m.Notes, step.apply(doc)...)
+		doc["version"] = step.from + 1
+	}
+	if m.Migrated, err = marshalDocument(doc); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func marshalDocument(doc map[string]any) ([]byte, error) {
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// migrateLegacyIPSet (1 → 2) переносит ipset.ipv4name/ipv6name и общие rules
+// в именованный список ipset.lists. Если списки уже есть, общие rules ни на
+// что не влияли и удаляются.
+func migrateLegacyIPSet(doc map[string]any) []string {
+	var notes []string
+	ipset, _ := doc["ipset"].(map[string]any)
+	if ipset == nil {
+		ipset = make(map[string]any)
+		doc["ipset"] = ipset
+	}
+	ipv4Name, _ := ipset["ipv4name"].(string)
+	ipv6Name, _ := ipset["ipv6name"].(string)
+	lists, _ := ipset["lists"].([]any)
+	rules, hasRules := doc["rules"].(map[string]any)
+
+	switch {
+	case len(lists) == 0 && ipv4Name != "":
+		if rules == nil {
+			rules = make(map[string]any)
+		}
+		list := map[string]any{
+			"name":        ipv4Name,
+			"enable_ipv6": ipv6Name != "",
+			"rules":       rules,
+		}
+		ipset["lists"] = []any{list}
+		notes = append(notes, fmt.Sprintf("ipset.ipv4name %s and the global rules are moved to ipset.lists[0]", ipv4Name))
+		if ipv6Name != "" && ipv6Name != ipv4Name+"6" {
+			notes = append(notes, fmt.Sprintf("IPv6 set %s is renamed to %s6, update firewall rules that reference it", ipv6Name, ipv4Name))
+		}
+	case len(lists) > 0 && ipv4Name != "":
+		notes = append(notes, fmt.Sprintf("ipset.ipv4name %s was ignored because ipset.lists is set and is removed", ipv4Name))
+		fallthrough
+	default:
+		if hasRules && !emptyRules(rules) {
+			notes = append(notes, "global rules were not used by any list and are removed")
+		}
+	}
+
+	delete(ipset, "ipv4name")
+	delete(ipset, "ipv6name")
+	delete(doc, "rules")
+	return notes
+}
+
+// emptyRules сообщает, что в документе rules нет ни одного правила.
+func emptyRules(rules map[string]any) bool {
+	for _, values := range rules {
+		if list, ok := values.([]any); ok && len(list) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// migrateBlockListURLs (1 → 2) переносит blocklist.urls в группу default в
+// начале blocklist.groups: раньше из них строилась неявная группа, которую
+// нельзя было выключить или поставить на паузу так, чтобы это сохранилось.
+func migrateBlockListURLs(doc map[string]any) []string {
+	blocklist, _ := doc["blocklist"].(map[string]any)
+	if blocklist == nil {
+		return nil
+	}
+	urls, _ := blocklist["urls"].([]any)
+	delete(blocklist, "urls")
+	if len(urls) == 0 {
+		return nil
+	}
+
+	groups, _ := blocklist["groups"].([]any)
+	for _, g := range groups {
+		if group, _ := g.(map[string]any); group != nil && group["name"] == DefaultBlockListGroup {
+			// Такой конфиг не проходил проверку: имя default было занято
+			// неявной группой. Объединяем URL.
+			existing, _ := group["urls"].([]any)
+			for _, u := range urls {
+				if !slices.Contains(existing, u) {
+					existing = append(existing, u)
+				}
+			}
+			group["urls"] = existing
+			return []string{fmt.Sprintf("blocklist.urls are merged into the existing blocklist group %s", DefaultBlockListGroup)}
+		}
+	}
+	group := map[string]any{
+		"name":    DefaultBlockListGroup,
+		"enabled": true,
+		"urls":    urls,
+	}
+	blocklist["groups"] = append([]any{group}, groups...)
+	return []string{fmt.Sprintf("blocklist.urls are moved to blocklist.groups[0] %s", DefaultBlockListGroup)}
+}
+
+// ReadConfig читает конфиг и проверяет его, как LoadConfig, но обновляет
+// старую схему только в памяти и ничего не пишет. Для актуального конфига
+// Migration равен nil. Формат (JSON, YAML или TOML) выбирается по расширению.
+func ReadConfig(filename string) (*Config, *Migration, error) {
+	return ReadConfigWithOverrides(filename, nil)
+}
+
+// ReadConfigWithOverrides — ReadConfig, который применяет o до проверки
+// конфига.
+func ReadConfigWithOverrides(filename string, o *Overrides) (*Config, *Migration, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	format := formatOf(filename)
+	doc, err := decodeDocument(format, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := migrate(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m != nil {
+		m.source = data
+		if format != formatJSON {
+			// YAML и TOML сравниваются как есть: комментарии переживают миграцию.
+			m.Original = data
+			if m.Migrated, err = encodeDocument(format, data, doc); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if format != formatJSON || m != nil {
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, nil, err
+		}
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, nil, err
+	}
+	cfg.Path = filename
+	if err := cfg.loadIncludes(); err != nil {
+		return nil, nil, err
+	}
+	if err := o.apply(&cfg); err != nil {
+		return nil, nil, err
+	}
+	if err := checkIssues(cfg.validateLocked()); err != nil {
+		return nil, nil, err
+	}
+	return &cfg, m, nil
+}
+
+// WriteFile сохраняет исходный файл в BackupPath и атомарно записывает на
+// его место обновлённый конфиг.
+func (m *Migration) WriteFile(path string) error {
+	if err := writeFileAtomic(m.BackupPath(path), m.source); err != nil {
+		return fmt.Errorf("failed to back up config: %w", err)
+	}
+	if err := writeFileAtomic(path, m.Migrated); err != nil {
+		return fmt.Errorf("failed to write migrated config: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic пишет файл через временный и rename, как SaveConfig.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
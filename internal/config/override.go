@@ -0,0 +1,387 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix — префикс переменных окружения, переопределяющих поля конфига:
+// server.log задаётся через DNS_BOX_SERVER_LOG, ipset.nftables.table — через
+// DNS_BOX_IPSET_NFTABLES_TABLE. Значение переменной <имя>_FILE читается из файла.
+const EnvPrefix = "DNS_BOX_"
+
+// redacted заменяет секреты в выводе EffectiveConfig.
+const redacted = "<redacted>"
+
+// overrideField — поле конфига, которое можно переопределить: скаляр или
+// список строк вне списков и групп.
+type overrideField struct {
+	path   []string // JSON-имена от корня, например {"server", "log"}
+	typ    reflect.Type
+	secret bool
+}
+
+func (f overrideField) name() string { return strings.Join(f.path, ".") }
+
+func (f overrideField) env() string {
+	return EnvPrefix + strings.ToUpper(strings.Join(f.path, "_"))
+}
+
+// notOverridable — поля, которые нельзя переопределить: version и include
+// определяют, какие файлы читаются, корневые rules остались от legacy-схемы.
+var notOverridable = []string{"version", "include", "rules"}
+
+// secretFields не показываются в EffectiveConfig.
+var secretFields = []string{"github_backup.token"}
+
+var overrideFields = collectOverrideFields(configType, nil)
+
+func collectOverrideFields(t reflect.Type, prefix []string) []overrideField {
+	var fields []overrideField
+	for i := range t.NumField() {
+		name := jsonName(t.Field(i))
+		if name == "" || (prefix == nil && slices.Contains(notOverridable, name)) {
+			continue
+		}
+		path := append(slices.Clip(prefix), name)
+		ft := t.Field(i).Type
+		switch st := indirectType(ft); {
+		case st == reflect.TypeOf(time.Time{}):
+		case st.Kind() == reflect.Struct:
+			fields = append(fields, collectOverrideFields(st, path)...)
+		case isOverridableType(ft):
+			f := overrideField{path: path, typ: ft}
+			f.secret = slices.Contains(secretFields, f.name())
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+func isOverridableType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int32, reflect.Int64,
+		reflect.Uint32, reflect.Uint64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.String
+	}
+	return false
+}
+
+// parseOverride разбирает значение поля типа t; список строк задаётся через запятую.
+func parseOverride(t reflect.Type, s string) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return v, fmt.Errorf("invalid boolean %q", s)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, t.Bits())
+		if err != nil {
+			return v, fmt.Errorf("invalid integer %q", s)
+		}
+		v.SetInt(n)
+	case reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, t.Bits())
+		if err != nil {
+			return v, fmt.Errorf("invalid unsigned integer %q", s)
+		}
+		v.SetUint(n)
+	case reflect.Slice:
+		items := []string{}
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	}
+	return v, nil
+}
+
+// fieldByPath возвращает поле структуры root (указатель) по JSON-именам.
+// Пустые указатели по пути создаются; если alloc равен false, они
+// копируются перед изменением, чтобы не трогать значения, на которые
+// ссылается исходный конфиг. ok равен false, если поля нет.
+func fieldByPath(root reflect.Value, path []string, alloc bool) (v reflect.Value, ok bool) {
+	v = root.Elem()
+	for _, name := range path {
+		if v.Kind() == reflect.Pointer {
+			elem := reflect.New(v.Type().Elem())
+			if !v.IsNil() {
+				if alloc {
+					elem = v
+				} else {
+					elem.Elem().Set(v.Elem())
+				}
+			}
+			v.Set(elem)
+			v = v.Elem()
+		}
+		found := false
+		for i := range v.NumField() {
+			if jsonName(v.Type().Field(i)) == name {
+				v, found = v.Field(i), true
+				break
+			}
+		}
+		if !found {
+			return reflect.Value{}, false
+		}
+	}
+	return v, true
+}
+
+// nilPointers возвращает путь первого пустого указателя на структуру вдоль
+// path в root.
+func nilPointers(root reflect.Value, path []string) [][]string {
+	v := root.Elem()
+	for i, name := range path {
+		if v.Kind() == reflect.Pointer {
+			if v.IsNil() {
+				return [][]string{slices.Clone(path[:i])}
+			}
+			v = v.Elem()
+		}
+		index := -1
+		for j := range v.NumField() {
+			if jsonName(v.Type().Field(j)) == name {
+				index = j
+				break
+			}
+		}
+		if index < 0 {
+			break
+		}
+		v = v.Field(index)
+	}
+	return nil
+}
+
+// appliedOverride запоминает значение поля из файла, чтобы SaveConfig не
+// записал в файл значение из окружения или флага.
+type appliedOverride struct {
+	field     overrideField
+	file, set reflect.Value
+	allocated [][]string // пустые в файле указатели, созданные переопределением
+}
+
+// Overrides — переопределения полей конфига из переменных окружения
+// DNS_BOX_* и флагов командной строки. Флаги важнее переменных окружения,
+// переменные окружения — файла. Пустая переменная считается незаданной,
+// как DNS_BOX_GITHUB_TOKEN.
+type Overrides struct {
+	env   map[string]string
+	flags map[string]string
+}
+
+// NewOverrides создаёт переопределения из окружения environ в формате os.Environ.
+func NewOverrides(environ []string) *Overrides {
+	o := &Overrides{env: make(map[string]string), flags: make(map[string]string)}
+	for _, kv := range environ {
+		key, value, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(key, EnvPrefix) && value != "" {
+			o.env[key] = value
+		}
+	}
+	return o
+}
+
+// overrideFlag — флаг -<путь поля>, например -server.log.
+type overrideFlag struct {
+	o     *Overrides
+	field overrideField
+}
+
+func (f overrideFlag) String() string { return "" }
+
+func (f overrideFlag) Set(s string) error {
+	if _, err := parseOverride(f.field.typ, s); err != nil {
+		return err
+	}
+	f.o.flags[f.field.name()] = s
+	return nil
+}
+
+func (f overrideFlag) IsBoolFlag() bool { return f.field.typ.Kind() == reflect.Bool }
+
+// RegisterFlags добавляет в fs флаг для каждого переопределяемого поля:
+// -server.log debug, -dns.upstream_servers tls://1.1.1.1,8.8.8.8.
+func (o *Overrides) RegisterFlags(fs *flag.FlagSet) {
+	for _, f := range overrideFields {
+		usage := "override " + f.name() + " (env " + f.env() + ")"
+		if f.typ.Kind() == reflect.Slice {
+			usage += ", comma-separated"
+		}
+		if f.secret {
+			usage += "; prefer " + f.env() + "_FILE, flags are visible in the process list"
+		}
+		fs.Var(overrideFlag{o: o, field: f}, f.name(), usage)
+	}
+}
+
+// lookup возвращает значение поля f и его источник для сообщений об ошибках.
+func (o *Overrides) lookup(f overrideField) (value, source string, ok bool, err error) {
+	if value, ok := o.flags[f.name()]; ok {
+		return value, "-" + f.name(), true, nil
+	}
+	env, envOK := o.env[f.env()]
+	file, fileOK := o.env[f.env()+"_FILE"]
+	switch {
+	case envOK && fileOK:
+		return "", "", false, fmt.Errorf("both %s and %s_FILE are set", f.env(), f.env())
+	case envOK:
+		return env, f.env(), true, nil
+	case fileOK:
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", "", false, fmt.Errorf("%s_FILE: %v", f.env(), err)
+		}
+		// Секреты Docker и Kubernetes обычно заканчиваются переводом строки.
+		return strings.TrimRight(string(data), "\r\n"), f.env() + "_FILE", true, nil
+	}
+	return "", "", false, nil
+}
+
+// apply переопределяет поля c. Вызывается до проверки конфига, поэтому
+// обязательные поля можно задать только в окружении.
+func (o *Overrides) apply(c *Config) error {
+	if o == nil {
+		return nil
+	}
+	known := map[string]bool{GitHubTokenEnv: true}
+	root := reflect.ValueOf(c)
+	for _, f := range overrideFields {
+		known[f.env()], known[f.env()+"_FILE"] = true, true
+		s, source, ok, err := o.lookup(f)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		value, err := parseOverride(f.typ, s)
+		if err != nil {
+			return fmt.Errorf("%s: %v", source, err)
+		}
+
+		applied := appliedOverride{field: f, allocated: nilPointers(root, f.path)}
+		field, _ := fieldByPath(root, f.path, true)
+		applied.file = reflect.New(f.typ).Elem()
+		applied.file.Set(field)
+		applied.set = value
+		field.Set(value)
+		c.overrides = append(c.overrides, applied)
+		log.Printf("[config] %s is set by %s", f.name(), source)
+	}
+	for key := range o.env {
+		if !known[key] {
+			log.Printf("[config] Warning: unknown environment variable %s", key)
+		}
+	}
+	return nil
+}
+
+// savedSections — части конфига, которые SaveConfig записывает в файл.
+type savedSections struct {
+	Include      string          `json:"include,omitempty"`
+	Server       ServerConfig    `json:"server"`
+	DNS          DNSConfig       `json:"dns"`
+	IPSet        IPSetConfig     `json:"ipset"`
+	Rules        RulesConfig     `json:"rules"`
+	BlockList    BlockListConfig `json:"blocklist"`
+	GithubBackup GithubConfig    `json:"github_backup"`
+}
+
+// savedLocked возвращает копию записываемых секций, в которой
+// переопределённые поля снова имеют значения из файла. Поле, которое после
+// переопределения изменили через API, записывается с новым значением.
+func (c *Config) savedLocked() savedSections {
+	s := savedSections{
+		Include:      c.Include,
+		Server:       c.Server,
+		DNS:          c.DNS,
+		IPSet:        c.IPSet,
+		Rules:        c.Rules,
+		BlockList:    c.BlockList,
+		GithubBackup: c.GithubBackup,
+	}
+	root := reflect.ValueOf(&s)
+	var allocated [][]string
+	for _, applied := range c.overrides {
+		field, ok := fieldByPath(root, applied.field.path, false)
+		if ok && reflect.DeepEqual(field.Interface(), applied.set.Interface()) {
+			field.Set(applied.file)
+			allocated = append(allocated, applied.allocated...)
+		}
+	}
+	// Структура, созданная только ради переопределения, в файл не попадает.
+	for _, path := range allocated {
+		if ptr, ok := fieldByPath(root, path, false); ok && ptr.Kind() == reflect.Pointer && ptr.Elem().IsZero() {
+			ptr.Set(reflect.Zero(ptr.Type()))
+		}
+	}
+	return s
+}
+
+// EffectiveConfig возвращает конфиг с переопределениями и списками из
+// каталога include в формате файла конфига. Секреты заменены на <redacted>.
+func (c *Config) EffectiveConfig() ([]byte, error) {
+	c.mu.RLock()
+	effective := struct {
+		Version      int             `json:"version"`
+		Include      string          `json:"include,omitempty"`
+		Server       ServerConfig    `json:"server"`
+		DNS          DNSConfig       `json:"dns"`
+		IPSet        IPSetConfig     `json:"ipset"`
+		Rules        RulesConfig     `json:"rules"`
+		BlockList    BlockListConfig `json:"blocklist"`
+		GithubBackup GithubConfig    `json:"github_backup"`
+	}{c.Version, c.Include, c.Server, c.DNS, c.IPSet, c.Rules, c.BlockList, c.GithubBackup}
+	c.mu.RUnlock()
+
+	// Токен из DNS_BOX_GITHUB_TOKEN важнее всех остальных источников.
+	effective.GithubBackup.Token = effective.GithubBackup.GetToken()
+	root := reflect.ValueOf(&effective)
+	for _, f := range overrideFields {
+		if !f.secret {
+			continue
+		}
+		if field, ok := fieldByPath(root, f.path, false); ok && field.Kind() == reflect.String && field.String() != "" {
+			field.SetString(redacted)
+		}
+	}
+
+	format := formatOf(c.Path)
+	if format == formatJSON {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(effective); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	doc, err := toDocument(effective)
+	if err != nil {
+		return nil, err
+	}
+	return encodeDocument(format, nil, doc.(map[string]any))
+}
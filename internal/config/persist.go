@@ -0,0 +1,203 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBackupDelay = 5 * time.Second // github_backup.debounce_seconds по умолчанию
+	// При непрерывных изменениях копия всё равно отправляется не реже, чем
+	// раз в backupMaxDelayFactor окон.
+	backupMaxDelayFactor = 12
+	backupRetryMin       = 10 * time.Second
+	backupRetryMax       = 10 * time.Minute
+)
+
+// PersistStatus — состояние сохранения конфига.
+type PersistStatus struct {
+	LastSave        *time.Time `json:"last_save,omitempty"` // последняя успешная запись на диск
+	LastSaveError   string     `json:"last_save_error,omitempty"`
+	BackupEnabled   bool       `json:"backup_enabled"`
+	Pending         bool       `json:"pending"` // есть изменения, не отправленные в GitHub
+	PendingSince    *time.Time `json:"pending_since,omitempty"`
+	NextAttempt     *time.Time `json:"next_attempt,omitempty"`
+	LastBackup      *time.Time `json:"last_backup,omitempty"` // последняя успешная отправка в GitHub
+	LastBackupError string     `json:"last_backup_error,omitempty"`
+	FailedAttempts  int        `json:"failed_attempts"` // неудачные отправки после последней успешной
+	Backups         int64      `json:"backups"`         // успешные отправки (коммиты) с запуска
+}
+
+// Persister сохраняет изменения конфига из API. Файл пишется сразу, а копия
+// в GitHub отправляется в фоне: изменения, сделанные за окно
+// github_backup.debounce_seconds, уходят одним коммитом, при ошибке отправка
+// повторяется с растущей паузой.
+type Persister struct {
+	cfg  *Config
+	push func(ctx context.Context) error
+	now  func() time.Time
+
+	delay, retryMin, retryMax time.Duration
+
+	pushMu sync.Mutex // отправки идут по одной: GitHub отклоняет обновление с устаревшим SHA
+	mu     sync.Mutex
+	status PersistStatus
+	gen    uint64 // растёт при каждом изменении, чтобы не потерять изменение во время отправки
+	wake   chan struct{}
+}
+
+func NewPersister(cfg *Config) *Persister {
+	cfg.mu.RLock()
+	enabled := cfg.GithubBackup.Enabled
+	delay := time.Duration(cfg.GithubBackup.DebounceSeconds) * time.Second
+	cfg.mu.RUnlock()
+	if delay <= 0 {
+		delay = defaultBackupDelay
+	}
+	return &Persister{
+		cfg:      cfg,
+		push:     cfg.SaveToGitHub,
+		now:      time.Now,
+		delay:    delay,
+		retryMin: backupRetryMin,
+		retryMax: backupRetryMax,
+		status:   PersistStatus{BackupEnabled: enabled},
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Start запускает фоновую отправку в GitHub. Неотправленные к отмене ctx
+// изменения отправляет Flush.
+func (p *Persister) Start(ctx context.Context) {
+	go p.run(ctx)
+}
+
+func (p *Persister) run(ctx context.Context) {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.wake:
+		case <-timer.C:
+			p.backup(ctx, true)
+		}
+		p.mu.Lock()
+		if p.status.NextAttempt != nil {
+			timer.Reset(p.status.NextAttempt.Sub(p.now()))
+		}
+		p.mu.Unlock()
+	}
+}
+
+// Save записывает конфиг на диск и планирует отправку в GitHub. Ошибка
+// означает, что файл не записан.
+func (p *Persister) Save() error {
+	err := p.cfg.SaveFile()
+	now := p.now()
+
+	p.mu.Lock()
+	if err != nil {
+		p.status.LastSaveError = err.Error()
+		p.mu.Unlock()
+		return err
+	}
+	p.status.LastSave, p.status.LastSaveError = &now, ""
+	if p.status.BackupEnabled {
+		p.gen++
+		if !p.status.Pending {
+			p.status.Pending, p.status.PendingSince = true, &now
+		}
+		// После ошибки отправка ждёт своей паузы, новые изменения её не ускоряют.
+		if p.status.FailedAttempts == 0 {
+			next := now.Add(p.delay)
+			if limit := p.status.PendingSince.Add(backupMaxDelayFactor * p.delay); limit.Before(next) {
+				next = limit
+			}
+			p.status.NextAttempt = &next
+		}
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Flush записывает конфиг на диск и сразу отправляет в GitHub изменения,
+// которые ещё не отправлены. Вызывается при остановке.
+func (p *Persister) Flush(ctx context.Context) error {
+	err := p.cfg.SaveFile()
+	if err != nil {
+		p.mu.Lock()
+		p.status.LastSaveError = err.Error()
+		p.mu.Unlock()
+	}
+	return errors.Join(err, p.backup(ctx, false))
+}
+
+// backup отправляет копию в GitHub, если есть неотправленные изменения; с
+// due=true — только когда подошло время NextAttempt.
+func (p *Persister) backup(ctx context.Context, due bool) error {
+	p.pushMu.Lock()
+	defer p.pushMu.Unlock()
+
+	p.mu.Lock()
+	if !p.status.Pending || (due && p.status.NextAttempt != nil && p.status.NextAttempt.After(p.now())) {
+		p.mu.Unlock()
+		return nil
+	}
+	gen := p.gen
+	p.mu.Unlock()
+
+	err := p.push(ctx)
+	now := p.now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		if ctx.Err() != nil {
+			// Остановка: изменения остаются для Flush.
+			return err
+		}
+		p.status.FailedAttempts++
+		p.status.LastBackupError = err.Error()
+		retry := p.retryMin
+		for i := 1; i < p.status.FailedAttempts && retry < p.retryMax; i++ {
+			retry *= 2
+		}
+		retry = min(retry, p.retryMax)
+		p.status.NextAttempt = ptrTime(now.Add(retry))
+		log.Printf("[config] GitHub backup failed (attempt %d), retrying in %s: %v", p.status.FailedAttempts, retry, err)
+		return err
+	}
+
+	p.status.LastBackup, p.status.LastBackupError = &now, ""
+	p.status.FailedAttempts = 0
+	p.status.Backups++
+	if p.gen == gen {
+		p.status.Pending, p.status.PendingSince, p.status.NextAttempt = false, nil, nil
+	} else {
+		// Во время отправки конфиг снова изменился.
+		p.status.PendingSince = &now
+		p.status.NextAttempt = ptrTime(now.Add(p.delay))
+	}
+	return nil
+}
+
+// Status возвращает снимок состояния.
+func (p *Persister) Status() PersistStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+func ptrTime(t time.Time) *time.Time { return &t }
@@ -0,0 +1,485 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2/unstable"
+)
+
+// tomlLineWidth — длина, после которой массив пишется по элементу на строку.
+const tomlLineWidth = 100
+
+// tomlLayout — то, что нужно взять из исходного TOML при перезаписи:
+// комментарии и порядок ключей. Пути строятся из ключей через точку,
+// элемент массива таблиц обозначается [name] или [#индекс], элемент
+// массива значений — [=значение].
+type tomlLayout struct {
+	lead   map[string][]string // комментарии на строках перед ключом, таблицей или элементом
+	inline map[string]string   // комментарий в конце строки
+	tail   map[string][]string // комментарии после последнего элемента массива, "" — конец файла
+	order  map[string][]string // порядок ключей таблицы
+}
+
+// encodeTOML записывает doc в TOML, перенося комментарии и порядок ключей из original.
+func encodeTOML(original []byte, doc map[string]any) ([]byte, error) {
+	layout, err := parseTOMLLayout(original)
+	if err != nil {
+		return nil, err
+	}
+	w := &tomlWriter{layout: layout}
+	if err := w.table("", "", doc, configType, false); err != nil {
+		return nil, err
+	}
+	if tail := layout.tail[""]; len(tail) > 0 {
+		w.buf.WriteByte('\n')
+		w.comments(tail, "")
+	}
+	return w.buf.Bytes(), nil
+}
+
+func parseTOMLLayout(data []byte) (*tomlLayout, error) {
+	layout := &tomlLayout{
+		lead:   make(map[string][]string),
+		inline: make(map[string]string),
+		tail:   make(map[string][]string),
+		order:  make(map[string][]string),
+	}
+	addKey := func(table, key string) {
+		if !slices.Contains(layout.order[table], key) {
+			layout.order[table] = append(layout.order[table], key)
+		}
+	}
+
+	p := unstable.Parser{KeepComments: true}
+	p.Reset(data)
+	var (
+		pending []string
+		last    string // путь последнего ключа или таблицы, для комментария в конце строки
+		table   string
+		arrays  = make(map[string]int) // последний индекс массива таблиц
+		names   = make(map[string]string)
+	)
+	// resolve превращает ключ заголовка в путь: [a.b] внутри [[a]] относится к
+	// последнему элементу a.
+	resolve := func(parts []string) string {
+		path := ""
+		for _, part := range parts {
+			path = joinTOMLPath(path, part)
+			if i, ok := arrays[path]; ok {
+				path += fmt.Sprintf("[#%d]", i)
+			}
+		}
+		return path
+	}
+
+	for p.NextExpression() {
+		e := p.Expression()
+		switch e.Kind {
+		case unstable.Comment:
+			if isInlineComment(data, e) && last != "" {
+				layout.inline[last] = string(e.Data)
+			} else {
+				pending = append(pending, string(e.Data))
+			}
+
+		case unstable.Table, unstable.ArrayTable:
+			parts := tomlKey(e.Key())
+			parent := resolve(parts[:len(parts)-1])
+			addKey(parent, parts[len(parts)-1])
+			table = joinTOMLPath(parent, parts[len(parts)-1])
+			if e.Kind == unstable.ArrayTable {
+				i, ok := arrays[table]
+				if !ok {
+					i = -1
+				}
+				arrays[table] = i + 1
+				table += fmt.Sprintf("[#%d]", i+1)
+			}
+			layout.lead[table], pending = pending, nil
+			last = table
+
+		case unstable.KeyValue:
+			parts := tomlKey(e.Key())
+			path := table
+			for _, part := range parts {
+				addKey(path, part)
+				path = joinTOMLPath(path, part)
+			}
+			layout.lead[path], pending = pending, nil
+			last = path
+
+			value := e.Value()
+			if len(parts) == 1 && parts[0] == "name" && value.Kind == unstable.String && strings.HasSuffix(table, "]") {
+				names[table] = string(value.Data)
+			}
+			if value.Kind == unstable.Array {
+				parseTOMLArray(data, layout, path, value)
+			}
+		}
+		// Комментарий в конце строки парсер отдаёт соседом ключа или заголовка.
+		if next := e.Next(); next != nil && next.Kind == unstable.Comment && last != "" {
+			layout.inline[last] = string(next.Data)
+		}
+	}
+	if err := p.Error(); err != nil {
+		return nil, err
+	}
+	layout.tail[""] = pending
+
+	// Элементы массивов таблиц с name сопоставляются по имени, а не по
+	// индексу: удаление списка не должно сдвигать комментарии соседей.
+	// Внешние пути короче, поэтому переименовываются первыми.
+	indexed := make([]string, 0, len(names))
+	for path := range names {
+		indexed = append(indexed, path)
+	}
+	slices.SortFunc(indexed, func(a, b string) int { return len(a) - len(b) })
+	for i, from := range indexed {
+		to := from[:strings.LastIndex(from, "[#")] + "[" + names[from] + "]"
+		layout.rename(from, to)
+		for j := i + 1; j < len(indexed); j++ {
+			if rest, ok := strings.CutPrefix(indexed[j], from); ok {
+				names[to+rest] = names[indexed[j]]
+				delete(names, indexed[j])
+				indexed[j] = to + rest
+			}
+		}
+	}
+	return layout, nil
+}
+
+func parseTOMLArray(data []byte, layout *tomlLayout, path string, array *unstable.Node) {
+	var pending []string
+	last := ""
+	it := array.Children()
+	for it.Next() {
+		n := it.Node()
+		if n.Kind != unstable.Comment {
+			if n.Kind == unstable.Array || n.Kind == unstable.InlineTable {
+				last = ""
+				continue
+			}
+			last = path + "[=" + tomlScalarID(n) + "]"
+			layout.lead[last], pending = pending, nil
+			continue
+		}
+		// Подряд идущие комментарии парсер складывает в дочерние узлы первого.
+		group := []*unstable.Node{n}
+		for children := n.Children(); children.Next(); {
+			group = append(group, children.Node())
+		}
+		for _, c := range group {
+			if isInlineComment(data, c) && last != "" {
+				layout.inline[last] = string(c.Data)
+			} else {
+				pending = append(pending, string(c.Data))
+			}
+		}
+	}
+	layout.tail[path] = pending
+}
+
+// tomlScalarID возвращает значение элемента в том виде, в каком его
+// сравнивает tomlWriter.
+func tomlScalarID(n *unstable.Node) string {
+	switch n.Kind {
+	case unstable.Integer:
+		if i, err := strconv.ParseInt(strings.ReplaceAll(string(n.Data), "_", ""), 0, 64); err == nil {
+			return fmt.Sprint(i)
+		}
+	case unstable.Float:
+		if f, err := strconv.ParseFloat(strings.ReplaceAll(string(n.Data), "_", ""), 64); err == nil {
+			return fmt.Sprint(f)
+		}
+	}
+	return string(n.Data)
+}
+
+func (l *tomlLayout) rename(from, to string) {
+	moved := func(path string) (string, bool) {
+		if path == from {
+			return to, true
+		}
+		if rest, ok := strings.CutPrefix(path, from); ok && (rest[0] == '.' || rest[0] == '[') {
+			return to + rest, true
+		}
+		return "", false
+	}
+	for _, m := range []map[string][]string{l.lead, l.tail, l.order} {
+		for path, v := range m {
+			if renamed, ok := moved(path); ok {
+				delete(m, path)
+				m[renamed] = v
+			}
+		}
+	}
+	for path, v := range l.inline {
+		if renamed, ok := moved(path); ok {
+			delete(l.inline, path)
+			l.inline[renamed] = v
+		}
+	}
+}
+
+// isInlineComment сообщает, что перед комментарием на его строке есть код.
+func isInlineComment(data []byte, n *unstable.Node) bool {
+	start := int(n.Raw.Offset)
+	lineStart := bytes.LastIndexByte(data[:start], '\n') + 1
+	return len(bytes.TrimSpace(data[lineStart:start])) > 0
+}
+
+func tomlKey(it unstable.Iterator) []string {
+	var parts []string
+	for it.Next() {
+		parts = append(parts, string(it.Node().Data))
+	}
+	return parts
+}
+
+func joinTOMLPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+type tomlWriter struct {
+	buf    bytes.Buffer
+	layout *tomlLayout
+}
+
+// table пишет таблицу path с заголовком header: сначала значения, затем
+// вложенные таблицы и массивы таблиц, как того требует TOML.
+func (w *tomlWriter) table(path, header string, doc map[string]any, t reflect.Type, element bool) error {
+	present := make(map[string]any, len(doc))
+	for key, v := range doc {
+		if v != nil {
+			present[key] = v
+		}
+	}
+	var values, tables []string
+	for _, key := range keyOrder(w.layout.order[path], present, t) {
+		if isTOMLTable(present[key]) {
+			tables = append(tables, key)
+		} else {
+			values = append(values, key)
+		}
+	}
+
+	if path != "" && (element || len(values) > 0 || len(tables) == 0 || len(w.layout.lead[path]) > 0) {
+		if w.buf.Len() > 0 {
+			w.buf.WriteByte('\n')
+		}
+		w.comments(w.layout.lead[path], "")
+		if element {
+			fmt.Fprintf(&w.buf, "[[%s]]", header)
+		} else {
+			fmt.Fprintf(&w.buf, "[%s]", header)
+		}
+		w.lineEnd(path)
+	}
+
+	for _, key := range values {
+		keyPath := joinTOMLPath(path, key)
+		w.comments(w.layout.lead[keyPath], "")
+		w.buf.WriteString(tomlBareKey(key))
+		w.buf.WriteString(" = ")
+		if err := w.value(keyPath, present[key], len(key)+3); err != nil {
+			return fmt.Errorf("%s: %w", keyPath, err)
+		}
+		w.lineEnd(keyPath)
+	}
+
+	for _, key := range tables {
+		keyPath, keyHeader := joinTOMLPath(path, key), joinTOMLPath(header, tomlBareKey(key))
+		switch v := present[key].(type) {
+		case map[string]any:
+			if err := w.table(keyPath, keyHeader, v, fieldType(t, key), false); err != nil {
+				return err
+			}
+		case []any:
+			for i, elem := range v {
+				elemPath := fmt.Sprintf("%s[#%d]", keyPath, i)
+				if id, ok := elementID(elem); ok {
+					elemPath = fmt.Sprintf("%s[%v]", keyPath, id)
+				}
+				if err := w.table(elemPath, keyHeader, elem.(map[string]any), elemType(fieldType(t, key)), true); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// isTOMLTable сообщает, что значение пишется отдельной таблицей, а не в строку.
+func isTOMLTable(v any) bool {
+	switch value := v.(type) {
+	case map[string]any:
+		return true
+	case []any:
+		if len(value) == 0 {
+			return false
+		}
+		for _, elem := range value {
+			if _, ok := elem.(map[string]any); !ok {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (w *tomlWriter) comments(lines []string, indent string) {
+	for _, line := range lines {
+		w.buf.WriteString(indent)
+		w.buf.WriteString(line)
+		w.buf.WriteByte('\n')
+	}
+}
+
+func (w *tomlWriter) lineEnd(path string) {
+	if c := w.layout.inline[path]; c != "" {
+		w.buf.WriteByte(' ')
+		w.buf.WriteString(c)
+	}
+	w.buf.WriteByte('\n')
+}
+
+// value пишет значение ключа path. Массив с комментариями у элементов или
+// длиннее строки пишется по элементу на строку.
+func (w *tomlWriter) value(path string, v any, column int) error {
+	array, ok := v.([]any)
+	if !ok {
+		s, err := tomlInline(v)
+		if err != nil {
+			return err
+		}
+		w.buf.WriteString(s)
+		return nil
+	}
+
+	elems := make([]string, len(array))
+	ids := make([]string, len(array))
+	multiline := len(w.layout.tail[path]) > 0
+	width := column + 2
+	for i, elem := range array {
+		s, err := tomlInline(elem)
+		if err != nil {
+			return err
+		}
+		elems[i] = s
+		ids[i] = path + "[=" + fmt.Sprint(normalizeScalar(elem)) + "]"
+		if len(w.layout.lead[ids[i]]) > 0 || w.layout.inline[ids[i]] != "" {
+			multiline = true
+		}
+		width += len(s) + 2
+	}
+	if !multiline && width <= tomlLineWidth {
+		w.buf.WriteString("[" + strings.Join(elems, ", ") + "]")
+		return nil
+	}
+
+	w.buf.WriteString("[\n")
+	for i, s := range elems {
+		w.comments(w.layout.lead[ids[i]], "  ")
+		w.buf.WriteString("  " + s + ",")
+		if c := w.layout.inline[ids[i]]; c != "" {
+			w.buf.WriteString(" " + c)
+		}
+		w.buf.WriteByte('\n')
+	}
+	w.comments(w.layout.tail[path], "  ")
+	w.buf.WriteString("]")
+	return nil
+}
+
+// tomlInline возвращает значение в записи, допустимой внутри строки.
+func tomlInline(v any) (string, error) {
+	switch value := normalizeScalar(v).(type) {
+	case string:
+		return tomlString(value), nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case int64:
+		return strconv.FormatInt(value, 10), nil
+	case float64:
+		s := strconv.FormatFloat(value, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".eEn") {
+			s += ".0"
+		}
+		return s, nil
+	case time.Time:
+		return value.Format(time.RFC3339Nano), nil
+	case []any:
+		elems := make([]string, len(value))
+		for i, elem := range value {
+			s, err := tomlInline(elem)
+			if err != nil {
+				return "", err
+			}
+			elems[i] = s
+		}
+		return "[" + strings.Join(elems, ", ") + "]", nil
+	case map[string]any:
+		keys := keyOrder(nil, value, nil)
+		elems := make([]string, 0, len(keys))
+		for _, key := range keys {
+			if value[key] == nil {
+				continue
+			}
+			s, err := tomlInline(value[key])
+			if err != nil {
+				return "", err
+			}
+			elems = append(elems, tomlBareKey(key)+" = "+s)
+		}
+		if len(elems) == 0 {
+			return "{}", nil
+		}
+		return "{ " + strings.Join(elems, ", ") + " }", nil
+	default:
+		return "", fmt.Errorf("unsupported value %T", v)
+	}
+}
+
+func tomlBareKey(key string) string {
+	if key != "" && strings.Trim(key, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-") == "" {
+		return key
+	}
+	return tomlString(key)
+}
+
+func tomlString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
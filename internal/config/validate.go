@@ -0,0 +1,372 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxSetNameLen — предел длины имени множества в ядре (IPSET_MAXNAMELEN без
+// завершающего нуля).
+const maxSetNameLen = 31
+
+// Issue — проблема конфига: путь к полю (например, "ipset.lists[1].name") и
+// описание. Предупреждения не мешают запуску, ошибки — мешают.
+type Issue struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+	Warning bool   `json:"warning,omitempty"`
+}
+
+func (i Issue) String() string {
+	kind := "error"
+	if i.Warning {
+		kind = "warning"
+	}
+	return fmt.Sprintf("%s: %s: %s", kind, i.Path, i.Message)
+}
+
+// ValidationError возвращается, если в конфиге есть ошибки. Issues содержит
+// и ошибки, и предупреждения.
+type ValidationError struct {
+	Issues []Issue
+}
+
+func (e *ValidationError) Error() string {
+	var errs []string
+	for _, issue := range e.Issues {
+		if !issue.Warning {
+			errs = append(errs, issue.Path+": "+issue.Message)
+		}
+	}
+	return "invalid config: " + strings.Join(errs, "; ")
+}
+
+// Warnings возвращает только предупреждения.
+func Warnings(issues []Issue) []Issue {
+	var warnings []Issue
+	for _, issue := range issues {
+		if issue.Warning {
+			warnings = append(warnings, issue)
+		}
+	}
+	return warnings
+}
+
+// checkIssues возвращает *ValidationError, если среди issues есть ошибки.
+func checkIssues(issues []Issue) error {
+	for _, issue := range issues {
+		if !issue.Warning {
+			return &ValidationError{Issues: issues}
+		}
+	}
+	return nil
+}
+
+// Validate проверяет конфиг целиком и возвращает все найденные проблемы в
+// порядке полей. Маршруты списков проверяет route.Policies.
+func (c *Config) Validate() []Issue {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.validateLocked()
+}
+
+// validator собирает проблемы по ходу проверки.
+type validator struct {
+	issues []Issue
+}
+
+func (v *validator) errorf(path, format string, args ...any) {
+	v.issues = append(v.issues, Issue{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) warnf(path, format string, args ...any) {
+	v.issues = append(v.issues, Issue{Path: path, Message: fmt.Sprintf(format, args...), Warning: true})
+}
+
+// validateLocked — Validate под уже взятым c.mu.
+func (c *Config) validateLocked() []Issue {
+	v := &validator{}
+	c.validateServer(v)
+	c.validateDNS(v)
+	c.validateIPSet(v)
+	validateRules(v, "rules", c.Rules)
+	c.validateBlockList(v)
+	c.validateGithub(v)
+	return c.includeIssues(v.issues)
+}
+
+func (c *Config) validateServer(v *validator) {
+	if len(c.Server.Address) == 0 {
+		v.errorf("server.address", "at least one listen address is required")
+	}
+	for i, addr := range c.Server.Address {
+		if err := validateHostPort(addr); err != nil {
+			v.errorf(fmt.Sprintf("server.address[%d]", i), "%v", err)
+		}
+	}
+	switch c.Server.Log {
+	case "", "panic", "fatal", "error", "warn", "warning", "info", "debug", "trace":
+	default:
+		v.warnf("server.log", "unknown log level %q, info is used", c.Server.Log)
+	}
+	if c.Server.APIAddress != "" {
+		if err := validateHostPort(c.Server.APIAddress); err != nil {
+			v.errorf("server.api_address", "%v", err)
+		}
+	}
+}
+
+func (c *Config) validateDNS(v *validator) {
+	if len(c.DNS.UpstreamServers) == 0 {
+		v.errorf("dns.upstream_servers", "at least one upstream server is required")
+	}
+	for i, upstream := range c.DNS.UpstreamServers {
+		if err := validateUpstream(upstream); err != nil {
+			v.errorf(fmt.Sprintf("dns.upstream_servers[%d]", i), "%v", err)
+		}
+	}
+	if c.DNS.Timeout < 0 {
+		v.errorf("dns.timeout", "must not be negative")
+	}
+}
+
+// validateHostPort проверяет адрес вида host:port.
+func validateHostPort(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %v", addr, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port in %q", addr)
+	}
+	return nil
+}
+
+// validateUpstream проверяет upstream так же, как его разбирает DNS-обработчик:
+// схема и хост, порт необязателен.
+func validateUpstream(upstream string) error {
+	host := upstream
+	if strings.Contains(upstream, "://") {
+		u, err := url.Parse(upstream)
+		if err != nil {
+			return fmt.Errorf("invalid upstream %q: %v", upstream, err)
+		}
+		switch u.Scheme {
+		case "https", "doh", "tls", "dot", "tcp", "udp":
+		default:
+			return fmt.Errorf("unsupported upstream scheme %q in %q", u.Scheme, upstream)
+		}
+		host = u.Host
+	}
+	if host == "" {
+		return fmt.Errorf("upstream %q has no host", upstream)
+	}
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return validateHostPort(host)
+	}
+	if strings.ContainsAny(host, "/ ") {
+		return fmt.Errorf("invalid upstream host %q", host)
+	}
+	return nil
+}
+
+func (c *Config) validateIPSet(v *validator) {
+	switch c.IPSet.Backend {
+	case "", "ipset", "nftables", "dry_run":
+	default:
+		v.errorf("ipset.backend", "unknown backend %q, expected ipset, nftables or dry_run", c.IPSet.Backend)
+	}
+	switch c.IPSet.NFTables.Family {
+	case "", "inet", "ip", "ip6":
+	default:
+		v.errorf("ipset.nftables.family", "unknown family %q, expected inet, ip or ip6", c.IPSet.NFTables.Family)
+	}
+	switch {
+	case len(c.IPSet.Lists) > 0 && (c.IPSet.IPv4Name != "" || c.IPSet.IPv6Name != ""):
+		v.warnf("ipset.ipv4name", "ignored because ipset.lists is set")
+	case c.IPSet.IPv4Name != "":
+		validateSetName(v, "ipset.ipv4name", c.IPSet.IPv4Name, false)
+		if c.IPSet.IPv6Name != "" {
+			validateSetName(v, "ipset.ipv6name", c.IPSet.IPv6Name, false)
+		}
+	}
+
+	// Имена множеств всех списков с их IPv6-парами должны быть уникальны.
+	sets := make(map[string]string)
+	claim := func(path, name string) {
+		if other, ok := sets[name]; ok {
+			v.errorf(path, "set %s is already used by %s", name, other)
+			return
+		}
+		sets[name] = path
+	}
+
+	for i, list := range c.IPSet.Lists {
+		path := fmt.Sprintf("ipset.lists[%d]", i)
+		validateSetName(v, path+".name", list.Name, list.EnableIPv6)
+		if list.Name != "" {
+			claim(path+".name", list.Name)
+			if list.EnableIPv6 {
+				claim(path+".name", list.Name+"6")
+			}
+		}
+
+		if list.IPv6Prefix < 0 || list.IPv6Prefix > 128 {
+			v.errorf(path+".ipv6_prefix", "must be between 0 and 128")
+		} else if list.IPv6Prefix > 0 && !list.EnableIPv6 {
+			v.warnf(path+".ipv6_prefix", "has no effect without enable_ipv6")
+		}
+		for j, value := range list.StaticIPs {
+			addr, err := netip.ParseAddr(value)
+			switch {
+			case err != nil:
+				v.errorf(fmt.Sprintf("%s.static_ips[%d]", path, j), "invalid IP address %q", value)
+			case addr.Unmap().Is6() && !list.EnableIPv6:
+				v.warnf(fmt.Sprintf("%s.static_ips[%d]", path, j), "IPv6 address %s is skipped without enable_ipv6", value)
+			}
+		}
+		validateRules(v, path+".rules", list.Rules)
+	}
+
+	for i, list := range c.IPSet.NetLists {
+		path := fmt.Sprintf("ipset.net_lists[%d]", i)
+		validateSetName(v, path+".name", list.Name, list.EnableIPv6)
+		if list.Name != "" {
+			claim(path+".name", list.Name)
+			if list.EnableIPv6 {
+				claim(path+".name", list.Name+"6")
+			}
+		}
+
+		for j, cidr := range list.CIDRs {
+			if _, err := netip.ParsePrefix(cidr); err != nil {
+				if _, addrErr := netip.ParseAddr(cidr); addrErr != nil {
+					v.errorf(fmt.Sprintf("%s.cidr[%d]", path, j), "invalid CIDR %q", cidr)
+				}
+			}
+		}
+		for j, country := range list.Countries {
+			if len(country) != 2 {
+				v.errorf(fmt.Sprintf("%s.country[%d]", path, j), "expected an ISO 3166-1 alpha-2 code, got %q", country)
+			}
+		}
+		if len(list.Countries) > 0 && c.IPSet.GeoIPDatabase == nil {
+			v.warnf(path+".country", "ignored without ipset.geoip_database")
+		}
+		if list.ASN != "" && c.IPSet.ASNDatabase == nil {
+			v.warnf(path+".asn", "ignored without ipset.asn_database")
+		}
+		for j, src := range list.Sources {
+			srcPath := fmt.Sprintf("%s.sources[%d]", path, j)
+			if u, err := url.Parse(src.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				v.errorf(srcPath+".url", "expected an http(s) URL, got %q", src.URL)
+			}
+			switch src.Format {
+			case "", "text", "aws", "gcp", "cloudflare":
+			default:
+				v.errorf(srcPath+".format", "unknown format %q, expected text, aws, gcp or cloudflare", src.Format)
+			}
+		}
+	}
+
+	validatePrefixDatabase(v, "ipset.asn_database", c.IPSet.ASNDatabase)
+	validatePrefixDatabase(v, "ipset.geoip_database", c.IPSet.GeoIPDatabase)
+}
+
+// validateSetName проверяет имя множества в конфиге, см. CheckSetName.
+func validateSetName(v *validator, path, name string, ipv6 bool) {
+	if err := CheckSetName(name, ipv6); err != nil {
+		v.errorf(path, "%v", err)
+	}
+}
+
+// CheckSetName проверяет, что имя годится для множества ядра (с IPv6-парой
+// name + "6", если ipv6) и для пути API. Тем же правилом API проверяет имена
+// создаваемых списков.
+func CheckSetName(name string, ipv6 bool) error {
+	maxLen := maxSetNameLen
+	if ipv6 {
+		maxLen--
+	}
+	switch {
+	case name == "":
+		return errors.New("is required")
+	case len(name) > maxLen:
+		return fmt.Errorf("%q is longer than %d characters, the kernel limit for set names (including the IPv6 suffix 6)", name, maxLen)
+	case strings.ContainsAny(name, "/ \t"):
+		return fmt.Errorf("%q must not contain spaces or slashes", name)
+	}
+	return nil
+}
+
+func validatePrefixDatabase(v *validator, path string, db *PrefixDatabaseConfig) {
+	if db != nil && db.Path == "" && db.URL == "" {
+		v.errorf(path, "path or url is required")
+	}
+}
+
+// validateRules предупреждает о правилах, которые никогда не совпадут,
+// например о вставленных URL.
+func validateRules(v *validator, path string, rules RulesConfig) {
+	fields := []struct {
+		name   string
+		values []string
+	}{
+		{"domain", rules.Domains},
+		{"domain_suffix", rules.DomainSuffix},
+		{"exclude_domain", rules.ExcludeDomains},
+		{"exclude_domain_suffix", rules.ExcludeDomainSuffix},
+	}
+	for _, field := range fields {
+		for i, value := range field.values {
+			if value == "" || strings.ContainsAny(value, "/: \t") {
+				v.warnf(fmt.Sprintf("%s.%s[%d]", path, field.name, i), "%q is not a domain name and never matches", value)
+			}
+		}
+	}
+}
+
+func (c *Config) validateBlockList(v *validator) {
+	switch c.BlockList.BlockReply {
+	case "", BlockReplyZeroIP, BlockReplyNXDomain:
+	default:
+		v.errorf("blocklist.block_reply", "unknown reply %q, expected %s or %s", c.BlockList.BlockReply, BlockReplyZeroIP, BlockReplyNXDomain)
+	}
+	if c.BlockList.Enabled && len(c.BlockList.EffectiveGroups()) == 0 && len(c.BlockList.IPURLs) == 0 {
+		v.warnf("blocklist", "enabled without groups or ip_urls")
+	}
+
+	groups := make(map[string]bool)
+	for i, group := range c.BlockList.Groups {
+		path := fmt.Sprintf("blocklist.groups[%d].name", i)
+		switch {
+		case group.Name == "":
+			v.errorf(path, "is required")
+		case groups[group.Name]:
+			v.errorf(path, "group %q is defined twice", group.Name)
+		}
+		groups[group.Name] = true
+	}
+}
+
+func (c *Config) validateGithub(v *validator) {
+	if !c.GithubBackup.Enabled {
+		return
+	}
+	for _, field := range [][2]string{{"owner", c.GithubBackup.Owner}, {"repo", c.GithubBackup.Repo}, {"path", c.GithubBackup.Path}} {
+		if field[1] == "" {
+			v.errorf("github_backup."+field[0], "is required when github_backup is enabled")
+		}
+	}
+	if c.GithubBackup.GetToken() == "" {
+		v.warnf("github_backup.token", "no token in config or %s, saving to GitHub will fail", GitHubTokenEnv)
+	}
+	if c.GithubBackup.DebounceSeconds < 0 {
+		v.errorf("github_backup.debounce_seconds", "must not be negative")
+	}
+}
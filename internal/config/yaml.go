@@ -0,0 +1,213 @@
+package config
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// encodeYAML накладывает doc на дерево узлов original. Узлы, значения которых
+// не изменились, остаются как есть вместе с комментариями и стилем, поэтому
+// сохранение меняет в файле только изменённые строки.
+func encodeYAML(original []byte, doc map[string]any) ([]byte, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(original, &root); err != nil {
+		return nil, err
+	}
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		root = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{nil}}
+	}
+	content, err := mergeYAML(root.Content[0], doc, configType)
+	if err != nil {
+		return nil, err
+	}
+	root.Content[0] = content
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(yamlIndent(original))
+	if err := enc.Encode(&root); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// yamlIndent угадывает отступ файла по первой строке с отступом.
+func yamlIndent(data []byte) int {
+	for _, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || trimmed == line || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if n := len(line) - len(trimmed); n >= 2 && n <= 8 {
+			return n
+		}
+		break
+	}
+	return 2
+}
+
+// mergeYAML возвращает узел со значением v, по возможности переиспользуя node.
+func mergeYAML(node *yaml.Node, v any, t reflect.Type) (*yaml.Node, error) {
+	if node == nil || node.Kind == yaml.AliasNode {
+		// Якорь может использоваться в других местах, поэтому его не трогаем:
+		// если значение изменилось, алиас заменяется новым узлом.
+		if node != nil && yamlEqual(node, v) {
+			return node, nil
+		}
+		return newYAMLNode(v, t)
+	}
+
+	switch value := v.(type) {
+	case map[string]any:
+		if node.Kind != yaml.MappingNode {
+			return replaceYAML(node, v, t)
+		}
+		existing := make(map[string]*yaml.Node, len(node.Content)/2)
+		keys := make(map[string]*yaml.Node, len(node.Content)/2)
+		var order []string
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			keys[key], existing[key] = node.Content[i], node.Content[i+1]
+			order = append(order, key)
+		}
+		present := make(map[string]any, len(value))
+		for key, child := range value {
+			if child != nil {
+				present[key] = child
+			}
+		}
+		content := make([]*yaml.Node, 0, 2*len(present))
+		for _, key := range keyOrder(order, present, t) {
+			child, err := mergeYAML(existing[key], present[key], fieldType(t, key))
+			if err != nil {
+				return nil, err
+			}
+			keyNode := keys[key]
+			if keyNode == nil {
+				keyNode = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}
+			}
+			content = append(content, keyNode, child)
+		}
+		// Комментарий в конце таблицы (часто — в конце файла) остаётся
+		// последним, даже если после него добавились ключи.
+		if n := len(order); n > 0 && len(content) > 0 {
+			lastKey, newLast := keys[order[n-1]], content[len(content)-2]
+			if lastKey != newLast && lastKey.FootComment != "" && newLast.FootComment == "" {
+				newLast.FootComment, lastKey.FootComment = lastKey.FootComment, ""
+			}
+		}
+		node.Content = content
+		node.Tag = "!!map"
+		return node, nil
+
+	case []any:
+		if node.Kind != yaml.SequenceNode {
+			return replaceYAML(node, v, t)
+		}
+		old := make(map[any][]*yaml.Node)
+		for _, elem := range node.Content {
+			var decoded any
+			if err := elem.Decode(&decoded); err != nil {
+				continue
+			}
+			if id, ok := elementID(decoded); ok {
+				old[id] = append(old[id], elem)
+			}
+		}
+		content := make([]*yaml.Node, 0, len(value))
+		for i, elem := range value {
+			var prev *yaml.Node
+			if id, ok := elementID(elem); ok {
+				if nodes := old[id]; len(nodes) > 0 {
+					prev, old[id] = nodes[0], nodes[1:]
+				}
+			} else if i < len(node.Content) {
+				prev = node.Content[i]
+			}
+			child, err := mergeYAML(prev, elem, elemType(t))
+			if err != nil {
+				return nil, err
+			}
+			content = append(content, child)
+		}
+		node.Content = content
+		if len(content) == 0 {
+			node.Style |= yaml.FlowStyle
+		}
+		return node, nil
+
+	default:
+		if node.Kind == yaml.ScalarNode && yamlEqual(node, v) {
+			return node, nil
+		}
+		return replaceYAML(node, v, t)
+	}
+}
+
+// replaceYAML строит новый узел вместо node, сохраняя его комментарии.
+func replaceYAML(node *yaml.Node, v any, t reflect.Type) (*yaml.Node, error) {
+	fresh, err := newYAMLNode(v, t)
+	if err != nil {
+		return nil, err
+	}
+	fresh.HeadComment, fresh.LineComment, fresh.FootComment = node.HeadComment, node.LineComment, node.FootComment
+	return fresh, nil
+}
+
+// newYAMLNode строит узел для v; ключи таблиц идут в порядке полей t.
+func newYAMLNode(v any, t reflect.Type) (*yaml.Node, error) {
+	switch value := v.(type) {
+	case map[string]any:
+		return mergeYAML(&yaml.Node{Kind: yaml.MappingNode}, value, t)
+	case []any:
+		return mergeYAML(&yaml.Node{Kind: yaml.SequenceNode}, value, t)
+	}
+	var node yaml.Node
+	if err := node.Encode(normalizeScalar(v)); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+func yamlEqual(node *yaml.Node, v any) bool {
+	var decoded any
+	if err := node.Decode(&decoded); err != nil {
+		return false
+	}
+	return documentEqual(decoded, v)
+}
+
+// documentEqual сравнивает деревья разных декодеров.
+func documentEqual(a, b any) bool {
+	switch x := a.(type) {
+	case map[string]any:
+		y, ok := b.(map[string]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for key, value := range x {
+			if other, ok := y[key]; !ok || !documentEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		y, ok := b.([]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !documentEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(normalizeScalar(a), normalizeScalar(b))
+}
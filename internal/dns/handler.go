@@ -3,11 +3,14 @@ package dns
 import (
 	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"slices"
 	"strings"
 	"time"
 
@@ -24,17 +27,25 @@ type Handler struct {
 	config      *config.Config
 	dnsCache    *C.DNSCache
 	domainCache *cache.DomainCache
-	ipSet       *ipset.IPSet
+	ipSet       *ipset.Writer
 	blockList   *blocklist.BlockList
 	log         *log.Logger
 	httpClient  *http.Client // общий клиент для DoH с reuse соединений
 	timeout     time.Duration
 
 	// Per-list domain caches for routing IPs to correct ipsets
-	listDomainCaches map[int]*cache.DomainCache
+	listDomainCaches *cache.ListCaches
+
+	// provenance хранит, какой домен добавил адрес в множество (для API)
+	provenance *ipset.Provenance
+	// claims хранит, какие правила списков добавили адрес (для удаления правил)
+	claims *ipset.Claims
 }
 
-func NewDnsHandler(cfg *config.Config, dnsCache *C.DNSCache, domainCache *cache.DomainCache, ipSet *ipset.IPSet, blockList *blocklist.BlockList, listDomainCaches map[int]*cache.DomainCache, l *log.Logger) *Handler {
+// provenanceCapacity ограничивает индекс "адрес → домен"; старые записи вытесняются.
+const provenanceCapacity = 65536
+
+func NewDnsHandler(cfg *config.Config, dnsCache *C.DNSCache, domainCache *cache.DomainCache, ipSet *ipset.Writer, blockList *blocklist.BlockList, listDomainCaches *cache.ListCaches, l *log.Logger) *Handler {
 	timeout := time.Duration(cfg.DNS.Timeout) * time.Second
 	if cfg.DNS.Timeout <= 0 {
 		timeout = 5 * time.Second
@@ -58,11 +69,23 @@ func NewDnsHandler(cfg *config.Config, dnsCache *C.DNSCache, domainCache *cache.
 			},
 		},
 		listDomainCaches: listDomainCaches,
+		provenance:       ipset.NewProvenance(provenanceCapacity),
+		claims:           ipset.NewClaims(),
 	}
 
 	return h
 }
 
+// Provenance возвращает индекс источников адресов, добавленных в ipset.
+func (h *Handler) Provenance() *ipset.Provenance {
+	return h.provenance
+}
+
+// Claims возвращает учёт правил, по которым адреса попали в ipset.
+func (h *Handler) Claims() *ipset.Claims {
+	return h.claims
+}
+
 func (h *Handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	msg := new(dns.Msg)
 	msg.SetReply(r)
@@ -73,17 +96,24 @@ func (h *Handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 
 	for _, question := range r.Question {
 		domain := strings.TrimSuffix(question.Name, ".")
-		if h.blockList != nil && h.blockList.IsBlocked(domain) {
-			h.log.Debugf("Blocked domain: %s", domain)
-			rr, err := dns.NewRR(fmt.Sprintf("%s A 0.0.0.0", question.Name))
-			if err == nil {
-				msg.Answer = append(msg.Answer, rr)
-			}
+		if group := h.blockedBy(domain); group != "" {
+			h.log.Debugf("Blocked domain: %s (group: %s)", domain, group)
+			h.block(msg, question)
 			continue
 		}
 
 		answers, rcode := h.resolver(question.Name, question.Qtype, 0)
-		if h.shouldProcess(question.Name) {
+		if link, group := h.blockedCNAME(domain, answers); group != "" {
+			h.log.Debugf("Blocked domain: %s via CNAME %s (group: %s)", domain, link, group)
+			h.block(msg, question)
+			continue
+		}
+		if ip := h.blockedIP(answers); ip.IsValid() {
+			h.log.Debugf("Blocked domain: %s, answer %s is in a denied range", domain, ip)
+			h.block(msg, question)
+			continue
+		}
+		if h.shouldProcess(question.Name) || h.cnameMatches(answers) {
 			h.log.Debugf("Processing question: %s", question.Name)
 			h.processAnswers(answers, question.Name)
 		}
@@ -98,6 +128,70 @@ func (h *Handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	}
 }
 
+// blockedBy возвращает имя группы блоклиста, блокирующей домен, или пустую строку.
+func (h *Handler) blockedBy(domain string) string {
+	if h.blockList == nil {
+		return ""
+	}
+	return h.blockList.BlockedBy(domain)
+}
+
+// blockedCNAME проверяет по блоклисту каждое звено цепочки CNAME в ответе,
+// чтобы first-party CNAME cloaking (metrics.shop.example → shop.tracker-vendor.net)
+// не обходил блокировку. Возвращает заблокированное звено и имя группы;
+// звено попадает в статус группы (см. blocklist.BlockList.BlockedByCNAME).
+// Цепочка берётся из ответа, а не из resolver, так как она может прийти из кеша.
+func (h *Handler) blockedCNAME(domain string, answers []dns.RR) (string, string) {
+	if h.blockList == nil {
+		return "", ""
+	}
+	for _, rr := range answers {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			target := strings.TrimSuffix(cname.Target, ".")
+			if group := h.blockList.BlockedByCNAME(domain, target); group != "" {
+				return target, group
+			}
+		}
+	}
+	return "", ""
+}
+
+// blockedIP возвращает первый адрес из A/AAAA записей ответа, попадающий
+// в запрещённую подсеть, или невалидный netip.Addr, если таких нет.
+func (h *Handler) blockedIP(answers []dns.RR) netip.Addr {
+	if h.blockList == nil {
+		return netip.Addr{}
+	}
+	for _, rr := range answers {
+		var ip net.IP
+		switch r := rr.(type) {
+		case *dns.A:
+			ip = r.A
+		case *dns.AAAA:
+			ip = r.AAAA
+		default:
+			continue
+		}
+		if addr, ok := netip.AddrFromSlice(ip); ok && h.blockList.IsIPBlocked(addr) {
+			return addr.Unmap()
+		}
+	}
+	return netip.Addr{}
+}
+
+// block заменяет ответ на вопрос ответом для заблокированных запросов
+// согласно blocklist.block_reply.
+func (h *Handler) block(msg *dns.Msg, question dns.Question) {
+	if h.config.BlockList.BlockReply == config.BlockReplyNXDomain {
+		msg.Rcode = dns.RcodeNameError
+		return
+	}
+	rr, err := dns.NewRR(fmt.Sprintf("%s A 0.0.0.0", question.Name))
+	if err == nil {
+		msg.Answer = append(msg.Answer, rr)
+	}
+}
+
 // normalizeTTL применяет политику ограничения TTL:
 //   - TTL <= 0    → 3600 (защита от нулевых/отрицательных)
 //   - TTL < 180   → 900  (минимум 15 минут для коротких TTL)
@@ -146,15 +240,19 @@ func (h *Handler) shouldProcess(domain string) bool {
 	}
 
 	// Check per-list caches (new multi-list mode)
-	for listIndex, listCache := range h.listDomainCaches {
+	for _, listCfg := range h.config.GetIPSetLists() {
+		listCache := h.listDomainCaches.Get(listCfg.Name)
+		if listCache == nil || h.listDomainCaches.Excluded(listCfg.Name, domainWithoutDot) {
+			continue
+		}
 		if listCache.Contains(domainWithoutDot) {
-			h.log.Debugf("Domain found in list %d config, process: %s", listIndex, domainWithoutDot)
+			h.log.Debugf("Domain found in list %s config, process: %s", listCfg.Name, domainWithoutDot)
 			return true
 		}
 		for i := 0; i <= len(parts)-2; i++ {
 			suffix := "." + strings.Join(parts[i:], ".")
 			if listCache.ContainsSuffix(suffix) {
-				h.log.Debugf("Domain matches suffix in list %d config, process: %s (suffix: %s)", listIndex, domainWithoutDot, suffix)
+				h.log.Debugf("Domain matches suffix in list %s config, process: %s (suffix: %s)", listCfg.Name, domainWithoutDot, suffix)
 				return true
 			}
 		}
@@ -164,63 +262,182 @@ func (h *Handler) shouldProcess(domain string) bool {
 	return false
 }
 
+// cnameMatches сообщает, совпадает ли цель CNAME из ответа с правилами
+// какого-либо списка с match_cname.
+func (h *Handler) cnameMatches(answers []dns.RR) bool {
+	targets := cnameTargets(answers)
+	if len(targets) == 0 {
+		return false
+	}
+	for _, listCfg := range h.config.GetIPSetLists() {
+		if !listCfg.MatchCNAME {
+			continue
+		}
+		for _, target := range targets {
+			if len(h.matchingRules(target, listCfg.Name)) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cnameTargets возвращает цели записей CNAME ответа — все звенья цепочки после
+// исходного имени. Как и в blockedCNAME, цепочка берётся из ответа.
+func cnameTargets(answers []dns.RR) []string {
+	var targets []string
+	for _, rr := range answers {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			targets = append(targets, cname.Target)
+		}
+	}
+	return targets
+}
+
+// listRules возвращает правила списка, совпавшие с вопросом или, при
+// match_cname, с любым звеном цепочки CNAME. Исключённое имя в вопросе
+// исключает и всю его цепочку.
+func (h *Handler) listRules(listCfg config.IPSetListConfig, question string, targets []string) []string {
+	if h.listDomainCaches.Excluded(listCfg.Name, question) {
+		return nil
+	}
+	rules := h.matchingRules(question, listCfg.Name)
+	if !listCfg.MatchCNAME {
+		return rules
+	}
+	for _, target := range targets {
+		for _, rule := range h.matchingRules(target, listCfg.Name) {
+			if !slices.Contains(rules, rule) {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	return rules
+}
+
+// syncAddTimeout ограничивает ожидание записи для списков с sync_add, чтобы
+// зависший netlink не задерживал ответы бесконечно.
+const syncAddTimeout = time.Second
+
+// processAnswers ставит адреса ответа в очередь записи. Для списков с
+// sync_add ждёт, пока адреса окажутся в множествах, чтобы первое соединение
+// клиента уже шло по нужному маршруту.
+// Статические адреса списка поддерживает netlist.Manager: запись из ответа
+// сократила бы их таймаут до TTL.
 func (h *Handler) processAnswers(answers []dns.RR, question string) {
 	ipSetLists := h.config.GetIPSetLists()
+	targets := cnameTargets(answers)
 
+	var waits []*ipset.Pending
 	for _, rr := range answers {
 		switch r := rr.(type) {
 		case *dns.A:
 			// Find which lists this domain belongs to
-			for i, listCfg := range ipSetLists {
-				if h.isDomainInList(question, i) {
+			for _, listCfg := range ipSetLists {
+				if slices.Contains(listCfg.StaticIPs, r.A.String()) {
+					continue
+				}
+				if rules := h.listRules(listCfg, question, targets); len(rules) > 0 {
 					ipv4Name := listCfg.Name
 					effectiveTTL := normalizeTTL(r.Hdr.Ttl)
-					err := h.ipSet.AddElement(ipv4Name, r.A.String(), effectiveTTL)
-					if err != nil {
-						h.log.Error(fmt.Sprintf("Error %v added address %s to ipset: %s", err.Error(), r.A.String(), ipv4Name))
+					pending := h.ipSet.Add(ipv4Name, listEntry(listCfg, r.A.String(), question, effectiveTTL), listCfg.SyncAdd)
+					if listCfg.SyncAdd {
+						waits = append(waits, pending)
 					}
-					h.log.Debugf("Added IPv4 address %s with original TTL %d, effective TTL %d for domain: %s, to ipset: %s", r.A.String(), r.Hdr.Ttl, effectiveTTL, question, ipv4Name)
+					h.recordAdded(listCfg.Name, rules, ipv4Name, r.A.String(), question, pending.Timeout())
+					h.log.Debugf("Queued IPv4 address %s with original TTL %d, effective TTL %d for domain: %s, to ipset: %s", r.A.String(), r.Hdr.Ttl, effectiveTTL, question, ipv4Name)
 				}
 			}
 		case *dns.AAAA:
 			// Find which lists this domain belongs to
-			for i, listCfg := range ipSetLists {
-				if h.isDomainInList(question, i) && listCfg.EnableIPv6 {
+			for _, listCfg := range ipSetLists {
+				if !listCfg.EnableIPv6 || slices.Contains(listCfg.StaticIPs, r.AAAA.String()) {
+					continue
+				}
+				if rules := h.listRules(listCfg, question, targets); len(rules) > 0 {
 					ipv6Name := listCfg.Name + "6"
 					effectiveTTL := normalizeTTL(r.Hdr.Ttl)
-					err := h.ipSet.AddElement(ipv6Name, r.AAAA.String(), effectiveTTL)
-					if err != nil {
-						h.log.Error(fmt.Sprintf("Error %v when added address %s to ipset: %s", err.Error(), r.AAAA.String(), ipv6Name))
+					value := ipv6Value(listCfg, r.AAAA)
+					pending := h.ipSet.Add(ipv6Name, listEntry(listCfg, value, question, effectiveTTL), listCfg.SyncAdd)
+					if listCfg.SyncAdd {
+						waits = append(waits, pending)
 					}
-					h.log.Debugf("Added IPv6 address %s with original TTL %d, effective TTL %d for domain: %s, to ipset: %s", r.AAAA.String(), r.Hdr.Ttl, effectiveTTL, question, ipv6Name)
+					h.recordAdded(listCfg.Name, rules, ipv6Name, value, question, pending.Timeout())
+					h.log.Debugf("Queued IPv6 address %s with original TTL %d, effective TTL %d for domain: %s, to ipset: %s", value, r.Hdr.Ttl, effectiveTTL, question, ipv6Name)
 				}
 			}
 		}
 	}
+
+	// Ошибки записи журналирует Writer; здесь важно только не отдать ответ раньше.
+	for _, pending := range waits {
+		if err := pending.Wait(syncAddTimeout); errors.Is(err, ipset.ErrWaitTimeout) {
+			h.log.Warnf("Replying to %s before its addresses were written to ipset: %v", question, err)
+			break
+		}
+	}
 }
 
-// isDomainInList checks if a domain matches the rules for a specific ipset list.
-func (h *Handler) isDomainInList(domain string, listIndex int) bool {
-	listCache, ok := h.listDomainCaches[listIndex]
-	if !ok {
-		return false
+// listEntry — элемент множества списка; с comment в комментарий пишется
+// запрошенное имя.
+func listEntry(listCfg config.IPSetListConfig, value, question string, ttl uint32) ipset.Entry {
+	entry := ipset.Entry{Value: value, Timeout: ttl}
+	if listCfg.Comment {
+		entry.Comment = strings.TrimSuffix(question, ".")
+	}
+	return entry
+}
+
+// ipv6Value — адрес AAAA или, с ipv6_prefix, его подсеть: у одного сервиса
+// адреса меняются внутри /64, и одна запись покрывает их все.
+func ipv6Value(listCfg config.IPSetListConfig, ip net.IP) string {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok || !ipset.AggregatesIPv6(listCfg) {
+		return ip.String()
+	}
+	return netip.PrefixFrom(addr, listCfg.IPv6Prefix).Masked().String()
+}
+
+// recordAdded запоминает, какой домен и какие правила списка добавили адрес,
+// чтобы показать источник в API и убрать адрес при удалении правила. ttl —
+// таймаут, с которым адрес записан в множество; 0 значит, что Writer отбросил
+// адрес и запоминать нечего.
+func (h *Handler) recordAdded(listName string, rules []string, setName, ip, question string, ttl uint32) {
+	if ttl == 0 {
+		return
+	}
+	h.provenance.Record(setName, ip, strings.TrimSuffix(question, "."), time.Now())
+	for _, rule := range rules {
+		h.claims.Record(listName, rule, ipset.Address{Set: setName, Value: ip}, ttl)
+	}
+}
+
+// matchingRules returns the rules of a specific ipset list that match the domain:
+// the domain itself for an exact rule and the stored suffix for a suffix rule.
+// Domains excluded from the list match no rules.
+func (h *Handler) matchingRules(domain string, listName string) []string {
+	listCache := h.listDomainCaches.Get(listName)
+	if listCache == nil || h.listDomainCaches.Excluded(listName, domain) {
+		return nil
 	}
 
 	domainWithoutDot := strings.TrimSuffix(domain, ".")
 
+	var rules []string
 	if listCache.Contains(domainWithoutDot) {
-		return true
+		rules = append(rules, domainWithoutDot)
 	}
 
 	parts := strings.Split(domainWithoutDot, ".")
 	for i := 0; i <= len(parts)-2; i++ {
 		suffix := "." + strings.Join(parts[i:], ".")
-		if listCache.ContainsSuffix(suffix) {
-			return true
+		if rule, ok := listCache.MatchSuffix(suffix); ok {
+			rules = append(rules, rule)
+			break
 		}
 	}
 
-	return false
+	return rules
 }
 
 func (h *Handler) resolver(domain string, qtype uint16, depth int) ([]dns.RR, int) {
@@ -334,10 +551,25 @@ func (h *Handler) resolver(domain string, qtype uint16, depth int) ([]dns.RR, in
 		if cname, ok := answer.(*dns.CNAME); ok {
 			h.log.Debugf("Found CNAME for %s: %s", domain, cname.Target)
 			cnameChain = append(cnameChain, answer)
+			// Заблокированную цель не резолвим дальше и не кешируем:
+			// ServeDNS увидит её в цепочке и заблокирует весь ответ.
+			if h.blockList != nil {
+				target := strings.TrimSuffix(cname.Target, ".")
+				if group := h.blockList.Match(target); group != "" {
+					h.log.Debugf("CNAME target %s of %s is blocked (group: %s), not following", target, domain, group)
+					return cnameChain, dns.RcodeSuccess
+				}
+			}
 			recursiveAnswers, rcode := h.resolver(cname.Target, qtype, depth+1)
 			if rcode == dns.RcodeSuccess {
 				finalAnswers = append(cnameChain, recursiveAnswers...)
-				h.cacheResponse(domain, qtype, finalAnswers)
+				// Цепочка, оборванная на заблокированном CNAME, не кешируется,
+				// иначе после снятия блокировки клиенты получали бы неполный ответ.
+				// Цепочка, которая просто заканчивается CNAME (нет записей
+				// нужного типа), кешируется как обычно.
+				if !h.cutAtBlocked(finalAnswers) {
+					h.cacheResponse(domain, qtype, finalAnswers)
+				}
 				return finalAnswers, dns.RcodeSuccess
 			}
 			// propagate error/NXDOMAIN but still return CNAMEs we found
@@ -355,6 +587,16 @@ func (h *Handler) resolver(domain string, qtype uint16, depth int) ([]dns.RR, in
 	return finalAnswers, dns.RcodeSuccess
 }
 
+// cutAtBlocked сообщает, что resolver оборвал цепочку на заблокированной
+// цели: последняя запись — CNAME, цель которого в блоклисте.
+func (h *Handler) cutAtBlocked(answers []dns.RR) bool {
+	if h.blockList == nil || len(answers) == 0 {
+		return false
+	}
+	last, ok := answers[len(answers)-1].(*dns.CNAME)
+	return ok && h.blockList.Match(strings.TrimSuffix(last.Target, ".")) != ""
+}
+
 func (h *Handler) getFromCache(domain string, qtype uint16) []dns.RR {
 	h.log.Tracef("Cache getFromCache for %s (type %d)", domain, qtype)
 	result := h.dnsCache.Get(fmt.Sprintf("%s|%d", domain, qtype))
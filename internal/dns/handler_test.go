@@ -0,0 +1,432 @@
+package dns
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/crazytypewriter/dns-box/internal/blocklist"
+	"github.com/crazytypewriter/dns-box/internal/cache"
+	"github.com/crazytypewriter/dns-box/internal/config"
+	"github.com/crazytypewriter/dns-box/internal/ipset"
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// recorder is a dns.ResponseWriter that keeps the last written message.
+type recorder struct {
+	msg *dns.Msg
+}
+
+func (r *recorder) LocalAddr() net.Addr       { return &net.UDPAddr{} }
+func (r *recorder) RemoteAddr() net.Addr      { return &net.UDPAddr{} }
+func (r *recorder) WriteMsg(m *dns.Msg) error { r.msg = m; return nil }
+func (r *recorder) Write([]byte) (int, error) { return 0, nil }
+func (r *recorder) Close() error              { return nil }
+func (r *recorder) TsigStatus() error         { return nil }
+func (r *recorder) TsigTimersOnly(bool)       {}
+func (r *recorder) Hijack()                   {}
+
+// startUpstream runs a UDP DNS server answering from the given zone records.
+func startUpstream(t *testing.T, records ...string) string {
+	t.Helper()
+
+	zone := make(map[string][]dns.RR)
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zone[rr.Header().Name] = append(zone[rr.Header().Name], rr)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for _, rr := range zone[r.Question[0].Name] {
+			if rr.Header().Rrtype == r.Question[0].Qtype || rr.Header().Rrtype == dns.TypeCNAME {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		w.WriteMsg(m)
+	})}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+
+	return pc.LocalAddr().String()
+}
+
+func writeList(t *testing.T, name string, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestHandler(t *testing.T, upstream string, blCfg *config.BlockListConfig) *Handler {
+	t.Helper()
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	cfg := &config.Config{DNS: config.DNSConfig{UpstreamServers: []string{upstream}, Timeout: 2}}
+
+	var bl *blocklist.BlockList
+	if blCfg != nil {
+		cfg.BlockList = *blCfg
+		bl = blocklist.NewBlockList(blCfg, logger)
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		bl.Start(ctx)
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			status := bl.GetStatus()
+			if !status.LastUpdated.IsZero() && (status.IPLists == nil || !status.IPLists.LastUpdated.IsZero()) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("blocklist was not loaded in time")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	return NewDnsHandler(cfg, cache.NewDNSCache(1024*1024, logger), cache.NewDomainCache(1024*1024), nil, bl, nil, logger)
+}
+
+// startWriter запускает фоновую запись в backend до конца теста.
+func startWriter(t *testing.T, backend ipset.Backend, logger *log.Logger) *ipset.Writer {
+	t.Helper()
+	writer := ipset.NewWriter(backend, logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	writer.Start(ctx)
+	return writer
+}
+
+func query(h *Handler, name string, qtype uint16) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	w := &recorder{}
+	h.ServeDNS(w, req)
+	return w.msg
+}
+
+func TestServeDNSBlocksCNAMECloaking(t *testing.T) {
+	upstream := startUpstream(t,
+		"metrics.shop.example. 300 IN CNAME shop.tracker-vendor.net.",
+		"shop.tracker-vendor.net. 300 IN A 203.0.113.10",
+		"www.shop.example. 300 IN CNAME cdn.shop.example.",
+		"cdn.shop.example. 300 IN A 198.51.100.1",
+	)
+	h := newTestHandler(t, upstream, &config.BlockListConfig{
+		Enabled: true,
+		Groups:  []config.BlockListGroupConfig{{Name: config.DefaultBlockListGroup, Enabled: true, URLs: []string{writeList(t, "hosts.txt", "0.0.0.0 shop.tracker-vendor.net")}}},
+	})
+
+	resp := query(h, "metrics.shop.example", dns.TypeA)
+	if len(resp.Answer) != 1 {
+		t.Fatalf("Expected a single blocked answer, got %v", resp.Answer)
+	}
+	if a, ok := resp.Answer[0].(*dns.A); !ok || !a.A.Equal(net.IPv4zero) {
+		t.Errorf("Expected 0.0.0.0 for a cloaked tracker, got %v", resp.Answer[0])
+	}
+
+	// Цепочка, оборванная на заблокированном звене, не должна попасть в кеш.
+	if cached := h.getFromCache("metrics.shop.example.", dns.TypeA); cached != nil {
+		t.Errorf("Blocked chain must not be cached, got %v", cached)
+	}
+
+	// Заблокированное звено попадает в статус группы.
+	g := h.blockList.GetStatus().Groups[0]
+	if g.CNAMEBlocked != 1 || g.LastCNAME == nil ||
+		g.LastCNAME.Domain != "metrics.shop.example" || g.LastCNAME.CNAME != "shop.tracker-vendor.net" {
+		t.Errorf("Expected the blocking CNAME in group status, got %d, %+v", g.CNAMEBlocked, g.LastCNAME)
+	}
+
+	resp = query(h, "www.shop.example", dns.TypeA)
+	if len(resp.Answer) != 2 {
+		t.Fatalf("Expected CNAME and A for an allowed chain, got %v", resp.Answer)
+	}
+	if a, ok := resp.Answer[1].(*dns.A); !ok || a.A.String() != "198.51.100.1" {
+		t.Errorf("Unexpected answer for an allowed chain: %v", resp.Answer[1])
+	}
+
+	// Разрешённая цепочка без записей нужного типа заканчивается CNAME,
+	// но оборванной не считается и кешируется.
+	resp = query(h, "www.shop.example", dns.TypeAAAA)
+	if len(resp.Answer) != 1 {
+		t.Fatalf("Expected a bare CNAME for a NODATA chain, got %v", resp.Answer)
+	}
+	if cached := h.getFromCache("www.shop.example.", dns.TypeAAAA); len(cached) != 1 {
+		t.Errorf("NODATA chain ending in a CNAME must be cached, got %v", cached)
+	}
+}
+
+func TestServeDNSBlocksDeniedAnswerIPs(t *testing.T) {
+	upstream := startUpstream(t,
+		"ads.rotating.example. 300 IN A 192.0.2.55",
+		"ads6.rotating.example. 300 IN AAAA 2001:db8:bad::1",
+		"ok.example. 300 IN A 198.51.100.7",
+	)
+	h := newTestHandler(t, upstream, &config.BlockListConfig{
+		Enabled:    true,
+		Groups:     []config.BlockListGroupConfig{{Name: config.DefaultBlockListGroup, Enabled: true, URLs: []string{writeList(t, "hosts.txt", "0.0.0.0 unrelated.example")}}},
+		IPURLs:     []string{writeList(t, "cidrs.txt", "# ad network", "192.0.2.0/24", "2001:db8:bad::/48")},
+		BlockReply: config.BlockReplyNXDomain,
+	})
+
+	for _, tc := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"ads.rotating.example", dns.TypeA},
+		{"ads6.rotating.example", dns.TypeAAAA},
+	} {
+		resp := query(h, tc.name, tc.qtype)
+		if resp.Rcode != dns.RcodeNameError || len(resp.Answer) != 0 {
+			t.Errorf("Expected NXDOMAIN for %s, got rcode %d, answers %v", tc.name, resp.Rcode, resp.Answer)
+		}
+	}
+
+	resp := query(h, "ok.example", dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Errorf("Expected an allowed answer for ok.example, got rcode %d, answers %v", resp.Rcode, resp.Answer)
+	}
+}
+
+func TestProcessAnswersFillsMatchingSets(t *testing.T) {
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	cfg := &config.Config{IPSet: config.IPSetConfig{Lists: []config.IPSetListConfig{
+		{Name: "vpn", EnableIPv6: true, Rules: config.RulesConfig{DomainSuffix: []string{".video.example"}}},
+		{Name: "proxy", Rules: config.RulesConfig{Domains: []string{"api.example"}}},
+	}}}
+
+	memory := ipset.NewMemory()
+	listDomainCaches := cache.NewListCaches()
+	for _, list := range cfg.IPSet.Lists {
+		listDomainCaches.Build(list.Name, list.Rules.Domains, list.Rules.DomainSuffix)
+
+		if err := memory.CreateSet(list.Name, ipset.SetOptions{Type: ipset.TypeHashIP}); err != nil {
+			t.Fatal(err)
+		}
+		if list.EnableIPv6 {
+			if err := memory.CreateSet(list.Name+"6", ipset.SetOptions{Type: ipset.TypeHashIP, IPv6: true}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	writer := startWriter(t, memory, logger)
+	h := NewDnsHandler(cfg, cache.NewDNSCache(1024*1024, logger), cache.NewDomainCache(1024*1024), writer, nil, listDomainCaches, logger)
+
+	var answers []dns.RR
+	for _, record := range []string{
+		"cdn.video.example. 60 IN A 198.51.100.1",
+		"cdn.video.example. 86400 IN AAAA 2001:db8::1",
+	} {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answers = append(answers, rr)
+	}
+
+	if !h.shouldProcess("cdn.video.example.") || h.shouldProcess("other.example.") {
+		t.Fatal("shouldProcess does not follow per-list rules")
+	}
+	h.processAnswers(answers, "cdn.video.example.")
+	writer.Drain()
+
+	// TTL проходит через normalizeTTL: 60 → 900, 86400 → 3600.
+	expected := map[string][]ipset.Entry{
+		"vpn":   {{Value: "198.51.100.1", Timeout: 900}},
+		"vpn6":  {{Value: "2001:db8::1", Timeout: 3600}},
+		"proxy": {},
+	}
+	for name, want := range expected {
+		got, err := memory.List(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(want) {
+			t.Errorf("Set %s: expected %v, got %v", name, want, got)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("Set %s: expected %v, got %v", name, want[i], got[i])
+			}
+		}
+	}
+
+	if origin, ok := h.Provenance().Lookup("vpn6", "2001:db8::1"); !ok || origin.Domain != "cdn.video.example" {
+		t.Errorf("Expected provenance of 2001:db8::1 to be cdn.video.example, got %+v", origin)
+	}
+	if _, ok := h.Provenance().Lookup("proxy", "198.51.100.1"); ok {
+		t.Error("Unexpected provenance for a set the address was not added to")
+	}
+
+	if released := h.Claims().Release("vpn", ".video.example"); len(released) != 2 {
+		t.Errorf("Expected both addresses to be claimed by the suffix rule, got %v", released)
+	}
+}
+
+func TestServeDNSMatchesCNAMEChain(t *testing.T) {
+	upstream := startUpstream(t,
+		"video.partner.example. 300 IN CNAME edge.partner-cdn.example.",
+		"edge.partner-cdn.example. 300 IN CNAME x.videocdn.example.",
+		"x.videocdn.example. 300 IN A 198.51.100.7",
+	)
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	rules := config.RulesConfig{DomainSuffix: []string{".videocdn.example"}}
+	cfg := &config.Config{
+		DNS: config.DNSConfig{UpstreamServers: []string{upstream}, Timeout: 2},
+		IPSet: config.IPSetConfig{Lists: []config.IPSetListConfig{
+			{Name: "follow", MatchCNAME: true, SyncAdd: true, Rules: rules},
+			{Name: "strict", Rules: rules},
+		}},
+	}
+
+	memory := ipset.NewMemory()
+	listDomainCaches := cache.NewListCaches()
+	for _, list := range cfg.IPSet.Lists {
+		listDomainCaches.Build(list.Name, list.Rules.Domains, list.Rules.DomainSuffix)
+		if err := memory.CreateSet(list.Name, ipset.SetOptions{Type: ipset.TypeHashIP}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := NewDnsHandler(cfg, cache.NewDNSCache(1024*1024, logger), cache.NewDomainCache(1024*1024), startWriter(t, memory, logger), nil, listDomainCaches, logger)
+
+	// Второй запрос отвечается из кеша: цепочка должна учитываться и там.
+	for i := 0; i < 2; i++ {
+		if resp := query(h, "video.partner.example", dns.TypeA); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 3 {
+			t.Fatalf("Expected the full CNAME chain, got rcode %d, answers %v", resp.Rcode, resp.Answer)
+		}
+	}
+
+	// С sync_add адрес записан до ответа, ждать Writer не нужно.
+	if got, _ := memory.List("follow"); len(got) != 1 || got[0].Value != "198.51.100.7" {
+		t.Errorf("Expected the address in the list with match_cname, got %v", got)
+	}
+	if got, _ := memory.List("strict"); len(got) != 0 {
+		t.Errorf("Expected no addresses in the list without match_cname, got %v", got)
+	}
+	if origin, ok := h.Provenance().Lookup("follow", "198.51.100.7"); !ok || origin.Domain != "video.partner.example" {
+		t.Errorf("Expected provenance of the queried name, got %+v", origin)
+	}
+	if released := h.Claims().Release("follow", ".videocdn.example"); len(released) != 1 {
+		t.Errorf("Expected the address to be claimed by the CNAME target's rule, got %v", released)
+	}
+}
+
+func TestProcessAnswersCommentsAndIPv6Prefix(t *testing.T) {
+	upstream := startUpstream(t,
+		"www.video.example. 300 IN A 198.51.100.9",
+		"www.video.example. 300 IN AAAA 2001:db8:1:2:3:4:5:6",
+	)
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	list := config.IPSetListConfig{
+		Name:       "video",
+		EnableIPv6: true,
+		SyncAdd:    true,
+		Comment:    true,
+		IPv6Prefix: 64,
+		Rules:      config.RulesConfig{DomainSuffix: []string{".video.example"}},
+	}
+	cfg := &config.Config{
+		DNS:   config.DNSConfig{UpstreamServers: []string{upstream}, Timeout: 2},
+		IPSet: config.IPSetConfig{Lists: []config.IPSetListConfig{list}},
+	}
+
+	memory := ipset.NewMemory()
+	for _, set := range ipset.DesiredSets(cfg.IPSet.Lists, nil) {
+		if err := memory.CreateSet(set.Name, set.Options); err != nil {
+			t.Fatal(err)
+		}
+	}
+	listDomainCaches := cache.NewListCaches()
+	listDomainCaches.Build(list.Name, list.Rules.Domains, list.Rules.DomainSuffix)
+	h := NewDnsHandler(cfg, cache.NewDNSCache(1024*1024, logger), cache.NewDomainCache(1024*1024), startWriter(t, memory, logger), nil, listDomainCaches, logger)
+
+	query(h, "www.video.example", dns.TypeA)
+	query(h, "www.video.example", dns.TypeAAAA)
+
+	if got, _ := memory.List("video"); len(got) != 1 || got[0].Value != "198.51.100.9" || got[0].Comment != "www.video.example" {
+		t.Errorf("Expected the address with the queried name as comment, got %+v", got)
+	}
+	// IPv6-адрес сводится к его /64.
+	if got, _ := memory.List("video6"); len(got) != 1 || got[0].Value != "2001:db8:1:2::/64" || got[0].Comment != "www.video.example" {
+		t.Errorf("Expected the /64 prefix of the address, got %+v", got)
+	}
+}
+
+func TestProcessAnswersHonoursExclusions(t *testing.T) {
+	upstream := startUpstream(t,
+		"www.example.com. 300 IN A 198.51.100.1",
+		"www.example.com. 300 IN A 198.51.100.2",
+		"login.example.com. 300 IN A 198.51.100.3",
+		"git.corp.example.com. 300 IN A 198.51.100.4",
+	)
+
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+
+	list := config.IPSetListConfig{
+		Name:      "vpn",
+		SyncAdd:   true,
+		StaticIPs: []string{"198.51.100.2"},
+		Rules: config.RulesConfig{
+			DomainSuffix:        []string{".example.com"},
+			ExcludeDomains:      []string{"login.example.com"},
+			ExcludeDomainSuffix: []string{".corp.example.com"},
+		},
+	}
+	cfg := &config.Config{
+		DNS:   config.DNSConfig{UpstreamServers: []string{upstream}, Timeout: 2},
+		IPSet: config.IPSetConfig{Lists: []config.IPSetListConfig{list}},
+	}
+
+	memory := ipset.NewMemory()
+	if err := memory.CreateSet("vpn", ipset.SetOptions{Type: ipset.TypeHashIP}); err != nil {
+		t.Fatal(err)
+	}
+	listDomainCaches := cache.NewListCaches()
+	listDomainCaches.Build(list.Name, list.Rules.Domains, list.Rules.DomainSuffix)
+	listDomainCaches.Exclude(list.Name, list.Rules.ExcludeDomains, list.Rules.ExcludeDomainSuffix)
+	h := NewDnsHandler(cfg, cache.NewDNSCache(1024*1024, logger), cache.NewDomainCache(1024*1024), startWriter(t, memory, logger), nil, listDomainCaches, logger)
+
+	for _, name := range []string{"www.example.com", "login.example.com", "git.corp.example.com"} {
+		if resp := query(h, name, dns.TypeA); len(resp.Answer) == 0 {
+			t.Fatalf("Expected %s to be resolved, got %v", name, resp)
+		}
+	}
+
+	// Статический адрес пишет netlist.Manager, исключённые имена не пишутся вовсе.
+	if got, _ := memory.List("vpn"); len(got) != 1 || got[0].Value != "198.51.100.1" {
+		t.Errorf("Expected only the address of www.example.com, got %+v", got)
+	}
+	if h.shouldProcess("login.example.com.") {
+		t.Error("Expected an excluded domain not to be processed")
+	}
+}
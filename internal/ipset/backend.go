@@ -0,0 +1,149 @@
+package ipset
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/netip"
+
+	"github.com/crazytypewriter/dns-box/internal/config"
+)
+
+// Имена бэкендов для ipset.backend.
+const (
+	BackendIPSet    = "ipset"
+	BackendNFTables = "nftables"
+	BackendDryRun   = "dry_run"
+)
+
+// DefaultTimeout — таймаут элементов в секундах, если в списке указан 0.
+const DefaultTimeout = 7200
+
+// SetType is the kind of elements a set holds.
+type SetType string
+
+const (
+	TypeHashIP  SetType = "hash:ip"  // single addresses
+	TypeHashNet SetType = "hash:net" // CIDR prefixes
+)
+
+// SetOptions describes a set to create.
+type SetOptions struct {
+	Type     SetType
+	IPv6     bool
+	Timeout  uint32 // default element timeout in seconds
+	HashSize uint32 // initial hash size, 0 means the kernel default
+	MaxElem  uint32 // element limit, 0 means the kernel default (65536 for ipset)
+	Counters bool   // per-element packet and byte counters
+	Comment  bool   // elements carry a comment
+}
+
+// Entry is a single element of a set.
+type Entry struct {
+	Value   string `json:"value"`             // IP address or CIDR
+	Timeout uint32 `json:"timeout"`           // remaining seconds, 0 means no timeout
+	Comment string `json:"comment,omitempty"` // only for sets with Comment
+	Packets uint64 `json:"packets,omitempty"` // only for sets with Counters
+	Bytes   uint64 `json:"bytes,omitempty"`
+}
+
+// ErrSetFull — в множестве maxelem элементов, новый элемент не добавлен.
+var ErrSetFull = errors.New("set is full")
+
+// Backend управляет именованными множествами адресов в ядре.
+// Реализации: ipset (hash:ip/hash:net), nftables (именованные множества с флагом timeout)
+// и Memory — хранение в памяти для тестов и режима dry_run.
+type Backend interface {
+	// CreateSet создаёт множество; существующее множество не является ошибкой.
+	CreateSet(name string, opts SetOptions) error
+	// DestroySet удаляет множество; отсутствующее множество не является ошибкой.
+	DestroySet(name string) error
+	// AddElement добавляет IP или CIDR с указанным таймаутом в секундах;
+	// 0 — элемент не истекает, даже если у множества есть таймаут по умолчанию.
+	AddElement(setName, entry string, timeout uint32) error
+	RemoveElement(setName, entry string) error
+	// Flush удаляет все элементы множества.
+	Flush(setName string) error
+	// List возвращает текущие элементы множества.
+	List(setName string) ([]Entry, error)
+}
+
+// Replacer — необязательная возможность бэкенда атомарно заменить всё
+// содержимое множества: правила маршрутизации не видят его пустым или
+// заполненным наполовину. Элементы получают таймаут opts.Timeout.
+type Replacer interface {
+	ReplaceSet(name string, opts SetOptions, entries []string) error
+}
+
+// BatchAdder — бэкенд умеет добавлять несколько элементов одной операцией.
+// Как и AddElement, обновляет таймаут существующих элементов; Comment
+// записывается, если множество создано с Comment. При ошибке часть
+// элементов может остаться добавленной.
+type BatchAdder interface {
+	AddElements(setName string, entries []Entry) error
+}
+
+// MarkRule — пометить fwmark пакеты, идущие к адресам множества.
+type MarkRule struct {
+	Set  string
+	IPv6 bool
+	Mark uint32
+}
+
+// Marker — бэкенд умеет ставить fwmark пакетам к адресам множеств (правила
+// mangle для транзитного и локального трафика). SetMarkRules заменяет все
+// правила dns-box; пустой список удаляет их.
+type Marker interface {
+	SetMarkRules(rules []MarkRule) error
+}
+
+// NewBackend создаёт бэкенд, выбранный в ipset.backend.
+func NewBackend(cfg config.IPSetConfig) (Backend, error) {
+	switch cfg.Backend {
+	case "", BackendIPSet:
+		set, err := New()
+		if err != nil {
+			return nil, err
+		}
+		return set, nil
+	case BackendNFTables:
+		return NewNFTables(cfg.NFTables)
+	case BackendDryRun:
+		return NewMemory(), nil
+	default:
+		return nil, fmt.Errorf("unknown ipset backend %q", cfg.Backend)
+	}
+}
+
+// swapSuffix добавляется к имени временного множества при замене через swap.
+const swapSuffix = "_swp"
+
+// maxSetNameLen — ограничение ядра на длину имени ipset (IPSET_MAXNAMELEN без NUL).
+const maxSetNameLen = 31
+
+// swapSetName возвращает имя временного множества для name. Если имя с
+// суффиксом не помещается в maxSetNameLen, хвост заменяется коротким хешем
+// полного имени: простое усечение давало одно временное множество для
+// списков с общим префиксом, и их замены портили друг друга.
+func swapSetName(name string) string {
+	if len(name)+len(swapSuffix) <= maxSetNameLen {
+		return name + swapSuffix
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	hash := fmt.Sprintf("_%08x", h.Sum32())
+	return name[:maxSetNameLen-len(hash)-len(swapSuffix)] + hash + swapSuffix
+}
+
+// parseEntry разбирает IP или CIDR в нормализованный префикс.
+func parseEntry(entry string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(entry); err == nil {
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP or CIDR %q", entry)
+	}
+	return prefix.Masked(), nil
+}
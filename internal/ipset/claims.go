@@ -0,0 +1,127 @@
+package ipset
+
+import (
+	"sync"
+	"time"
+)
+
+// claimsSweepInterval — как часто Record вычищает истёкшие записи.
+const claimsSweepInterval = time.Minute
+
+// Claims отслеживает, какие правила списка (домен или суффикс) привели к
+// добавлению адреса в множество. Один адрес может принадлежать нескольким
+// правилам; при удалении правила адрес убирается из множества, только если
+// на него больше не претендует ни одно другое правило с неистёкшим таймаутом.
+type Claims struct {
+	mu        sync.Mutex
+	byRule    map[ruleKey]map[Address]time.Time
+	byAddr    map[Address]map[string]time.Time
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// Address — элемент конкретного множества.
+type Address struct {
+	Set   string
+	Value string
+}
+
+type ruleKey struct {
+	list string
+	rule string
+}
+
+func NewClaims() *Claims {
+	return &Claims{
+		byRule: make(map[ruleKey]map[Address]time.Time),
+		byAddr: make(map[Address]map[string]time.Time),
+		now:    time.Now,
+	}
+}
+
+// Record запоминает, что правило rule списка list добавило адрес в множество
+// с таймаутом timeout секунд. Срок уже известной записи только продлевается:
+// элемент в ядре живёт до самого позднего из выставленных таймаутов.
+func (c *Claims) Record(list, rule string, addr Address, timeout uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	expires := now.Add(time.Duration(timeout) * time.Second)
+
+	key := ruleKey{list: list, rule: rule}
+	if c.byRule[key] == nil {
+		c.byRule[key] = make(map[Address]time.Time)
+	}
+	if old := c.byRule[key][addr]; old.Before(expires) {
+		c.byRule[key][addr] = expires
+	}
+
+	if c.byAddr[addr] == nil {
+		c.byAddr[addr] = make(map[string]time.Time)
+	}
+	if old := c.byAddr[addr][rule]; old.Before(expires) {
+		c.byAddr[addr][rule] = expires
+	}
+
+	if now.Sub(c.lastSweep) >= claimsSweepInterval {
+		c.sweep(now)
+		c.lastSweep = now
+	}
+}
+
+// Release забывает правило и возвращает адреса, которые больше никем не
+// заняты и должны быть удалены из множеств.
+func (c *Claims) Release(list, rule string) []Address {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := ruleKey{list: list, rule: rule}
+	addrs := c.byRule[key]
+	delete(c.byRule, key)
+
+	now := c.now()
+	var orphaned []Address
+	for addr, expires := range addrs {
+		owners := c.byAddr[addr]
+		delete(owners, rule)
+
+		active := false
+		for other, otherExpires := range owners {
+			if otherExpires.After(now) {
+				active = true
+				continue
+			}
+			delete(owners, other)
+		}
+		if len(owners) == 0 {
+			delete(c.byAddr, addr)
+		}
+		// Адрес с истёкшим таймаутом ядро уже удалило само.
+		if !active && expires.After(now) {
+			orphaned = append(orphaned, addr)
+		}
+	}
+	return orphaned
+}
+
+// sweep удаляет истёкшие записи. Вызывается под c.mu.
+func (c *Claims) sweep(now time.Time) {
+	for key, addrs := range c.byRule {
+		for addr, expires := range addrs {
+			if expires.After(now) {
+				continue
+			}
+			delete(addrs, addr)
+			if owners := c.byAddr[addr]; owners != nil {
+				delete(owners, key.rule)
+				if len(owners) == 0 {
+					delete(c.byAddr, addr)
+				}
+			}
+		}
+		if len(addrs) == 0 {
+			delete(c.byRule, key)
+		}
+	}
+}
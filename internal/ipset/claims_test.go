@@ -0,0 +1,72 @@
+package ipset
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClaimsReleaseKeepsSharedAddresses(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := NewClaims()
+	c.now = func() time.Time { return now }
+
+	shared := Address{Set: "vpn", Value: "192.0.2.1"}
+	only := Address{Set: "vpn6", Value: "2001:db8::1"}
+	stale := Address{Set: "vpn", Value: "192.0.2.9"}
+
+	c.Record("vpn", ".youtube.com", shared, 3600)
+	c.Record("vpn", ".youtube.com", only, 3600)
+	c.Record("vpn", "www.youtube.com", shared, 3600)
+	c.Record("vpn", ".youtube.com", stale, 60)
+	// Правило с тем же именем в другом списке не должно мешать.
+	c.Record("proxy", ".youtube.com", Address{Set: "proxy", Value: "192.0.2.1"}, 3600)
+
+	now = now.Add(5 * time.Minute)
+
+	released := c.Release("vpn", ".youtube.com")
+	if len(released) != 1 || released[0] != only {
+		t.Fatalf("Expected only %v to be released, got %v", only, released)
+	}
+
+	// После удаления второго правила общий адрес тоже освобождается.
+	released = c.Release("vpn", "www.youtube.com")
+	if len(released) != 1 || released[0] != shared {
+		t.Fatalf("Expected %v to be released, got %v", shared, released)
+	}
+
+	if released := c.Release("vpn", ".youtube.com"); len(released) != 0 {
+		t.Errorf("Expected nothing for an already released rule, got %v", released)
+	}
+}
+
+func TestClaimsExpiredOwnerDoesNotHoldAddress(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := NewClaims()
+	c.now = func() time.Time { return now }
+
+	addr := Address{Set: "vpn", Value: "192.0.2.1"}
+	c.Record("vpn", "a.example", addr, 300)
+	now = now.Add(2 * time.Minute)
+	c.Record("vpn", ".example", addr, 3600)
+
+	now = now.Add(5 * time.Minute)
+	if released := c.Release("vpn", ".example"); len(released) != 1 || released[0] != addr {
+		t.Errorf("Expected an expired claim not to keep %v, got %v", addr, released)
+	}
+}
+
+func TestClaimsShorterTimeoutKeepsLongerExpiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	c := NewClaims()
+	c.now = func() time.Time { return now }
+
+	addr := Address{Set: "vpn", Value: "192.0.2.1"}
+	c.Record("vpn", ".example", addr, 3600)
+	c.Record("vpn", ".example", addr, 60)
+
+	// Ядро держит элемент до большего таймаута, значит и заявка должна жить.
+	now = now.Add(5 * time.Minute)
+	if released := c.Release("vpn", ".example"); len(released) != 1 || released[0] != addr {
+		t.Errorf("Expected %v to be released with the longer expiry, got %v", addr, released)
+	}
+}
@@ -3,39 +3,387 @@
 package ipset
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
+	"syscall"
+
 	I "github.com/crazytypewriter/ipset"
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/xt"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
 )
 
+// nfnlSubsysIPSet — подсистема nfnetlink ipset (NFNL_SUBSYS_IPSET).
+const nfnlSubsysIPSet = 6
+
+// ipsetErrHashFull — IPSET_ERR_HASH_FULL: в множестве maxelem элементов.
+const ipsetErrHashFull = nl.IPSET_ERR_TYPE_SPECIFIC
+
+// IPSet — бэкенд на основе ipset (hash:ip / hash:net).
 type IPSet struct{}
 
-func New() *IPSet {
+// New подключается к ipset через netlink. Без прав CAP_NET_ADMIN или без
+// поддержки ipset в ядре возвращает ошибку.
+func New() (*IPSet, error) {
 	if err := I.Init(); err != nil {
-		panic(fmt.Sprintf("ipset Init failed: %v", err))
+		return nil, fmt.Errorf("ipset init failed: %w", err)
 	}
-	return &IPSet{}
+	return &IPSet{}, nil
 }
 
-func (i *IPSet) CreateIPv4Set(name string, timeout uint32) error {
-	return I.Create(name, I.OptTimeout(timeout))
+// CreateSet создаёт множество сообщением IPSET_CMD_CREATE: crazytypewriter/ipset
+// не умеет задавать hashsize, maxelem и расширения. Без NLM_F_EXCL ядро
+// молча принимает существующее множество с теми же параметрами.
+func (i *IPSet) CreateSet(name string, opts SetOptions) error {
+	typeName := string(opts.Type)
+	if typeName == "" {
+		typeName = string(TypeHashIP)
+	}
+	family := uint8(syscall.AF_INET)
+	if opts.IPv6 {
+		family = syscall.AF_INET6
+	}
+	revision, err := typeRevision(typeName, family)
+	if err != nil {
+		return err
+	}
+
+	req := newIPSetRequest(nl.IPSET_CMD_CREATE)
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_SETNAME, nl.ZeroTerminated(name)))
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_TYPENAME, nl.ZeroTerminated(typeName)))
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_REVISION, nl.Uint8Attr(revision)))
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_FAMILY, nl.Uint8Attr(family)))
+
+	data := nl.NewRtAttr(nl.IPSET_ATTR_DATA|int(nl.NLA_F_NESTED), nil)
+	if opts.Timeout != 0 {
+		data.AddChild(&nl.Uint32Attribute{Type: nl.IPSET_ATTR_TIMEOUT | nl.NLA_F_NET_BYTEORDER, Value: opts.Timeout})
+	}
+	if opts.HashSize != 0 {
+		data.AddChild(&nl.Uint32Attribute{Type: nl.IPSET_ATTR_HASHSIZE | nl.NLA_F_NET_BYTEORDER, Value: opts.HashSize})
+	}
+	if opts.MaxElem != 0 {
+		data.AddChild(&nl.Uint32Attribute{Type: nl.IPSET_ATTR_MAXELEM | nl.NLA_F_NET_BYTEORDER, Value: opts.MaxElem})
+	}
+	var flags uint32
+	if opts.Counters {
+		flags |= nl.IPSET_FLAG_WITH_COUNTERS
+	}
+	if opts.Comment {
+		flags |= nl.IPSET_FLAG_WITH_COMMENT
+	}
+	if flags != 0 {
+		data.AddChild(&nl.Uint32Attribute{Type: nl.IPSET_ATTR_CADT_FLAGS | nl.NLA_F_NET_BYTEORDER, Value: flags})
+	}
+	req.AddData(data)
+
+	if _, err := req.Execute(syscall.NETLINK_NETFILTER, 0); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return fmt.Errorf("failed to create ipset %s: %w", name, err)
+	}
+	return nil
 }
 
-func (i *IPSet) CreateIPv6Set(name string, timeout uint32) error {
-	return I.Create(name, I.OptIPv6(), I.OptTimeout(timeout))
+// newIPSetRequest начинает сообщение ipset с подтверждением и версией протокола.
+func newIPSetRequest(cmd int) *nl.NetlinkRequest {
+	req := nl.NewNetlinkRequest(cmd|(nfnlSubsysIPSet<<8), syscall.NLM_F_ACK)
+	req.AddData(&nl.Nfgenmsg{NfgenFamily: syscall.AF_INET, Version: nl.NFNETLINK_V0})
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_PROTOCOL, nl.Uint8Attr(nl.IPSET_PROTOCOL)))
+	return req
 }
 
-func (i *IPSet) CreateIPv4NetSet(name string, timeout uint32) error {
-	return I.Create(name, I.OptType("hash:net"), I.OptTimeout(timeout))
+// typeRevision возвращает последнюю ревизию типа множества, известную ядру:
+// от ревизии зависят доступные расширения (counters, comment).
+func typeRevision(typeName string, family uint8) (uint8, error) {
+	req := newIPSetRequest(nl.IPSET_CMD_TYPE)
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_TYPENAME, nl.ZeroTerminated(typeName)))
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_FAMILY, nl.Uint8Attr(family)))
+
+	msgs, err := req.Execute(syscall.NETLINK_NETFILTER, 0)
+	if err != nil {
+		return 0, fmt.Errorf("ipset type %s is not supported by the kernel: %w", typeName, err)
+	}
+	for _, msg := range msgs {
+		if len(msg) < nl.SizeofNfgenmsg {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(msg[nl.SizeofNfgenmsg:])
+		if err != nil {
+			return 0, err
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type == nl.IPSET_ATTR_REVISION && len(attr.Value) == 1 {
+				return attr.Value[0], nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no revision of ipset type %s in the kernel reply", typeName)
 }
 
-func (i *IPSet) CreateIPv6NetSet(name string, timeout uint32) error {
-	return I.Create(name, I.OptType("hash:net"), I.OptIPv6(), I.OptTimeout(timeout))
+func (i *IPSet) DestroySet(name string) error {
+	// Отсутствующее множество ядро сообщает как ENOENT.
+	_, err := netlink.IpsetList(name)
+	if errors.Is(err, syscall.ENOENT) {
+		return nil // множества уже нет
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read ipset %s: %w", name, err)
+	}
+	return I.Destroy(name)
 }
 
+// AddElement добавляет элемент тем же сообщением, что и AddElements, чтобы
+// получить ошибку ядра (например, ErrSetFull).
 func (i *IPSet) AddElement(setName, ip string, ttl uint32) error {
-	return I.Add(setName, ip, I.OptTimeout(ttl))
+	return i.AddElements(setName, []Entry{{Value: ip, Timeout: ttl}})
+}
+
+// AddElements добавляет элементы одним netlink-сообщением с вложенными
+// IPSET_ATTR_DATA (так пишет ipset restore). Ядро применяет их по порядку и
+// останавливается на первой ошибке. Без NLM_F_EXCL существующие элементы
+// получают новый таймаут.
+func (i *IPSet) AddElements(setName string, entries []Entry) error {
+	// Без атрибута таймаута элемент получил бы таймаут множества по
+	// умолчанию, а нулевой делает его бессрочным. Множество без таймаута
+	// отвергает и нулевой, тогда таймаут не передаётся.
+	err := i.addElements(setName, entries, true)
+	if errors.Is(err, syscall.Errno(nl.IPSET_ERR_TIMEOUT)) && slices.ContainsFunc(entries, func(e Entry) bool { return e.Timeout == 0 }) {
+		err = i.addElements(setName, entries, false)
+	}
+	if errors.Is(err, syscall.Errno(ipsetErrHashFull)) {
+		return fmt.Errorf("ipset %s: %w", setName, ErrSetFull)
+	}
+	return err
+}
+
+func (i *IPSet) addElements(setName string, entries []Entry, zeroTimeout bool) error {
+	req := newIPSetRequest(nl.IPSET_CMD_ADD)
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_SETNAME, nl.ZeroTerminated(setName)))
+	// С IPSET_ATTR_ADT ядро требует и общий номер строки.
+	req.AddData(&nl.Uint32Attribute{Type: nl.IPSET_ATTR_LINENO | nl.NLA_F_NET_BYTEORDER, Value: 0})
+
+	adt := nl.NewRtAttr(nl.IPSET_ATTR_ADT|int(nl.NLA_F_NESTED), nil)
+	for n, e := range entries {
+		prefix, err := parseEntry(e.Value)
+		if err != nil {
+			return err
+		}
+		data := nl.NewRtAttrChild(adt, nl.IPSET_ATTR_DATA|int(nl.NLA_F_NESTED), nil)
+		if e.Timeout != 0 || zeroTimeout {
+			data.AddChild(&nl.Uint32Attribute{Type: nl.IPSET_ATTR_TIMEOUT | nl.NLA_F_NET_BYTEORDER, Value: e.Timeout})
+		}
+		addrType := nl.IPSET_ATTR_IPADDR_IPV4
+		if prefix.Addr().Is6() {
+			addrType = nl.IPSET_ATTR_IPADDR_IPV6
+		}
+		ip := nl.NewRtAttrChild(data, nl.IPSET_ATTR_IP|int(nl.NLA_F_NESTED), nil)
+		nl.NewRtAttrChild(ip, addrType|int(nl.NLA_F_NET_BYTEORDER), prefix.Addr().AsSlice())
+		if !prefix.IsSingleIP() {
+			nl.NewRtAttrChild(data, nl.IPSET_ATTR_CIDR, nl.Uint8Attr(uint8(prefix.Bits())))
+		}
+		if e.Comment != "" {
+			nl.NewRtAttrChild(data, nl.IPSET_ATTR_COMMENT, nl.ZeroTerminated(e.Comment))
+		}
+		// Номер строки ядро возвращает в ошибке, как для ipset restore.
+		data.AddChild(&nl.Uint32Attribute{Type: nl.IPSET_ATTR_LINENO | nl.NLA_F_NET_BYTEORDER, Value: uint32(n + 1)})
+	}
+	req.AddData(adt)
+
+	_, err := req.Execute(syscall.NETLINK_NETFILTER, 0)
+	return err
 }
 
 func (i *IPSet) RemoveElement(setName, ip string) error {
 	return I.Del(setName, ip)
 }
+
+func (i *IPSet) Flush(setName string) error {
+	return I.Flush(setName)
+}
+
+// ReplaceSet заполняет временное множество и меняет его местами с рабочим
+// через ipset swap, после чего удаляет временное (со старым содержимым).
+func (i *IPSet) ReplaceSet(name string, opts SetOptions, entries []string) error {
+	tmp := swapSetName(name)
+
+	// Остаток прошлой прерванной замены.
+	if err := i.DestroySet(tmp); err != nil {
+		return err
+	}
+	if err := i.CreateSet(tmp, opts); err != nil {
+		return fmt.Errorf("failed to create temporary set %s: %w", tmp, err)
+	}
+	elems := make([]Entry, len(entries))
+	for n, entry := range entries {
+		elems[n] = Entry{Value: entry, Timeout: opts.Timeout}
+	}
+	if err := copyEntries(i, tmp, elems); err != nil {
+		I.Destroy(tmp)
+		return fmt.Errorf("failed to fill temporary set %s: %w", tmp, err)
+	}
+	if err := netlink.IpsetSwap(tmp, name); err != nil {
+		I.Destroy(tmp)
+		return fmt.Errorf("failed to swap sets %s and %s: %w", tmp, name, err)
+	}
+	return I.Destroy(tmp)
+}
+
+// DescribeSet читает тип, семейство, таймаут по умолчанию, размеры и
+// расширения множества.
+func (i *IPSet) DescribeSet(name string) (SetOptions, bool, error) {
+	result, err := netlink.IpsetList(name)
+	if errors.Is(err, syscall.ENOENT) {
+		return SetOptions{}, false, nil // множества нет
+	}
+	if err != nil {
+		return SetOptions{}, false, fmt.Errorf("failed to read ipset %s: %w", name, err)
+	}
+	opts := SetOptions{
+		Type:     SetType(result.TypeName),
+		IPv6:     result.Family == nl.FAMILY_V6,
+		HashSize: result.HashSize,
+		MaxElem:  result.MaxElements,
+		Counters: result.CadtFlags&nl.IPSET_FLAG_WITH_COUNTERS != 0,
+		Comment:  result.CadtFlags&nl.IPSET_FLAG_WITH_COMMENT != 0,
+	}
+	if result.Timeout != nil {
+		opts.Timeout = *result.Timeout
+	}
+	return opts, true, nil
+}
+
+func (i *IPSet) SwapSets(a, b string) error {
+	return netlink.IpsetSwap(a, b)
+}
+
+// markTable — таблицы nftables (ip и ip6) с правилами fwmark для ipset.
+const markTable = "dns_box_mark"
+
+// SetMarkRules ставит правила fwmark в собственные таблицы nftables. nftables
+// не видит множества ipset, поэтому адрес проверяется xt-матчем set через
+// nft_compat — так же правила -m set хранит iptables-nft.
+func (i *IPSet) SetMarkRules(rules []MarkRule) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("nftables connection failed: %w", err)
+	}
+
+	byFamily := make(map[nftables.TableFamily][][]expr.Any)
+	var families []nftables.TableFamily
+	for _, rule := range rules {
+		index, err := setIndex(rule.Set)
+		if err != nil {
+			return err
+		}
+		family := nftables.TableFamilyIPv4
+		if rule.IPv6 {
+			family = nftables.TableFamilyIPv6
+		}
+		if _, ok := byFamily[family]; !ok {
+			families = append(families, family)
+		}
+		byFamily[family] = append(byFamily[family], append([]expr.Any{xtSetMatch(index)}, setMarkExprs(rule.Mark)...))
+	}
+
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		if _, err := conn.ListTableOfFamily(markTable, family); err == nil {
+			conn.DelTable(&nftables.Table{Name: markTable, Family: family})
+		}
+	}
+	for _, family := range families {
+		table := conn.AddTable(&nftables.Table{Name: markTable, Family: family})
+		for _, chain := range addMarkChains(conn, table) {
+			for _, exprs := range byFamily[family] {
+				conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: exprs})
+			}
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to update mark rules in nftables table %s: %w", markTable, err)
+	}
+	return nil
+}
+
+// xtSetMatch — матч set ревизии 1 (xt_set_info_match_v1) по адресу
+// назначения: индекс множества, размерность 1, флаги 0; дополнен до 8 байт.
+func xtSetMatch(index uint16) *expr.Match {
+	info := make(xt.Unknown, 8)
+	copy(info, binaryutil.NativeEndian.PutUint16(index))
+	info[2] = 1
+	return &expr.Match{Name: "set", Rev: 1, Info: &info}
+}
+
+// IPSET_CMD_GET_BYNAME и IPSET_ATTR_INDEX в его ответе.
+const (
+	ipsetCmdGetByName = 14
+	ipsetAttrIndex    = 11
+)
+
+// setIndex возвращает индекс множества в ядре, по которому на него ссылаются
+// xt-матчи.
+func setIndex(name string) (uint16, error) {
+	// GET_BYNAME принимает только текущую версию протокола ядра, а не
+	// минимальную, как остальные команды.
+	protocol, _, err := netlink.IpsetProtocol()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get ipset protocol version: %w", err)
+	}
+	req := nl.NewNetlinkRequest(ipsetCmdGetByName|(nfnlSubsysIPSet<<8), 0)
+	req.AddData(&nl.Nfgenmsg{NfgenFamily: syscall.AF_INET, Version: nl.NFNETLINK_V0})
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_PROTOCOL, nl.Uint8Attr(protocol)))
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_SETNAME, nl.ZeroTerminated(name)))
+
+	msgs, err := req.Execute(syscall.NETLINK_NETFILTER, 0)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find ipset %s: %w", name, err)
+	}
+	for _, msg := range msgs {
+		if len(msg) < nl.SizeofNfgenmsg {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(msg[nl.SizeofNfgenmsg:])
+		if err != nil {
+			return 0, err
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type&^(nl.NLA_F_NESTED|nl.NLA_F_NET_BYTEORDER) == ipsetAttrIndex && len(attr.Value) >= 2 {
+				return binary.BigEndian.Uint16(attr.Value), nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no index for ipset %s in the kernel reply", name)
+}
+
+// List читает содержимое множества. crazytypewriter/ipset не умеет делать dump,
+// поэтому используется ipset-часть vishvananda/netlink.
+func (i *IPSet) List(setName string) ([]Entry, error) {
+	result, err := netlink.IpsetList(setName)
+	if err != nil {
+		return nil, err
+	}
+
+	isNet := strings.HasPrefix(result.TypeName, "hash:net")
+	entries := make([]Entry, 0, len(result.Entries))
+	for _, e := range result.Entries {
+		value := e.IP.String()
+		if isNet {
+			value = fmt.Sprintf("%s/%d", e.IP, e.CIDR)
+		}
+		entry := Entry{Value: value, Comment: e.Comment}
+		if e.Timeout != nil {
+			entry.Timeout = *e.Timeout
+		}
+		if e.Packets != nil {
+			entry.Packets = *e.Packets
+		}
+		if e.Bytes != nil {
+			entry.Bytes = *e.Bytes
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
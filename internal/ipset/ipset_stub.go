@@ -4,30 +4,50 @@ package ipset
 
 type IPSet struct{}
 
-func New() *IPSet {
-	return &IPSet{}
+func New() (*IPSet, error) {
+	return &IPSet{}, nil
 }
 
-func (i *IPSet) CreateIPv4Set(name string, timeout uint32) error {
+func (i *IPSet) CreateSet(name string, opts SetOptions) error {
 	return nil
 }
 
-func (i *IPSet) CreateIPv6Set(name string, timeout uint32) error {
+func (i *IPSet) DestroySet(name string) error {
 	return nil
 }
 
-func (i *IPSet) CreateIPv4NetSet(name string, timeout uint32) error {
+func (i *IPSet) RemoveElement(setName, ip string) error {
 	return nil
 }
 
-func (i *IPSet) CreateIPv6NetSet(name string, timeout uint32) error {
+func (i *IPSet) AddElement(setName, ip string, ttl uint32) error {
 	return nil
 }
 
-func (i *IPSet) RemoveElement(setName, ip string) error {
+func (i *IPSet) AddElements(setName string, entries []Entry) error {
 	return nil
 }
 
-func (i *IPSet) AddElement(setName, ip string, ttl uint32) error {
+func (i *IPSet) Flush(setName string) error {
 	return nil
 }
+
+func (i *IPSet) ReplaceSet(name string, opts SetOptions, entries []string) error {
+	return nil
+}
+
+func (i *IPSet) DescribeSet(name string) (SetOptions, bool, error) {
+	return SetOptions{}, false, nil
+}
+
+func (i *IPSet) SwapSets(a, b string) error {
+	return nil
+}
+
+func (i *IPSet) SetMarkRules(rules []MarkRule) error {
+	return nil
+}
+
+func (i *IPSet) List(setName string) ([]Entry, error) {
+	return nil, nil
+}
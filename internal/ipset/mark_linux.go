@@ -0,0 +1,70 @@
+//go:build linux
+
+package ipset
+
+import (
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// Цепочки с правилами fwmark: prerouting — транзитный трафик роутера,
+// output (type route) — локальный; для него ядро заново выбирает маршрут
+// после смены метки.
+const (
+	markPreroutingChain = "dns_box_mark_prerouting"
+	markOutputChain     = "dns_box_mark_output"
+)
+
+// NFPROTO_IPV4 и NFPROTO_IPV6 для meta nfproto.
+const (
+	nfprotoIPv4 = 2
+	nfprotoIPv6 = 10
+)
+
+func isMarkChain(chain *nftables.Chain) bool {
+	return chain.Name == markPreroutingChain || chain.Name == markOutputChain
+}
+
+// addMarkChains добавляет в table цепочки mangle для правил fwmark.
+func addMarkChains(conn *nftables.Conn, table *nftables.Table) []*nftables.Chain {
+	return []*nftables.Chain{
+		conn.AddChain(&nftables.Chain{
+			Name:     markPreroutingChain,
+			Table:    table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  nftables.ChainHookPrerouting,
+			Priority: nftables.ChainPriorityMangle,
+		}),
+		conn.AddChain(&nftables.Chain{
+			Name:     markOutputChain,
+			Table:    table,
+			Type:     nftables.ChainTypeRoute,
+			Hooknum:  nftables.ChainHookOutput,
+			Priority: nftables.ChainPriorityMangle,
+		}),
+	}
+}
+
+// setMarkExprs — meta mark set mark.
+func setMarkExprs(mark uint32) []expr.Any {
+	return []expr.Any{
+		&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(mark)},
+		&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+	}
+}
+
+// daddrLookupExprs — ip daddr @set (ip6 daddr @set для IPv6). Проверка
+// nfproto нужна в таблицах inet, где встречаются оба семейства.
+func daddrLookupExprs(set *nftables.Set, ipv6 bool) []expr.Any {
+	proto, offset, length := byte(nfprotoIPv4), uint32(16), uint32(4)
+	if ipv6 {
+		proto, offset, length = nfprotoIPv6, 24, 16
+	}
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: length},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+	}
+}
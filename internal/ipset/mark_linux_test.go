@@ -0,0 +1,122 @@
+//go:build linux
+
+package ipset
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/crazytypewriter/dns-box/internal/config"
+	"github.com/google/nftables"
+	"github.com/vishvananda/netns"
+)
+
+// enterTestNetns переводит поток теста в новое сетевое пространство имён,
+// чтобы множества и правила не задели систему.
+func enterTestNetns(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("Network namespaces require root")
+	}
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Skipf("Failed to get the current netns: %v", err)
+	}
+	ns, err := netns.New()
+	if err != nil {
+		origin.Close()
+		runtime.UnlockOSThread()
+		t.Skipf("Failed to create a netns: %v", err)
+	}
+	t.Cleanup(func() {
+		netns.Set(origin)
+		ns.Close()
+		origin.Close()
+		runtime.UnlockOSThread()
+	})
+}
+
+// markRuleCount считает правила в цепочках fwmark по таблицам.
+func markRuleCount(t *testing.T) map[string]int {
+	t.Helper()
+	conn, err := nftables.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chains, err := conn.ListChains()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for _, chain := range chains {
+		if !isMarkChain(chain) {
+			continue
+		}
+		rules, err := conn.GetRules(chain.Table, chain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[fmt.Sprintf("%d/%s/%s", chain.Table.Family, chain.Table.Name, chain.Name)] = len(rules)
+	}
+	return counts
+}
+
+func testSetMarkRules(t *testing.T, backend Backend) {
+	t.Helper()
+	for _, opts := range []struct {
+		name string
+		ipv6 bool
+	}{{"vpn", false}, {"vpn6", true}} {
+		if err := backend.CreateSet(opts.name, SetOptions{Type: TypeHashIP, IPv6: opts.ipv6}); err != nil {
+			t.Skipf("Failed to create a set: %v", err)
+		}
+	}
+	marker := backend.(Marker)
+
+	rules := []MarkRule{{Set: "vpn", Mark: 0x10}, {Set: "vpn6", IPv6: true, Mark: 0x10}}
+	if err := marker.SetMarkRules(rules); err != nil {
+		t.Fatal(err)
+	}
+	// Повторный вызов заменяет правила, а не добавляет.
+	if err := marker.SetMarkRules(rules); err != nil {
+		t.Fatal(err)
+	}
+	counts := markRuleCount(t)
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	// По правилу на множество в каждой из двух цепочек.
+	if total != 4 {
+		t.Errorf("Expected 4 mark rules, got %v", counts)
+	}
+
+	if err := marker.SetMarkRules(nil); err != nil {
+		t.Fatal(err)
+	}
+	if counts := markRuleCount(t); len(counts) != 0 {
+		t.Errorf("Expected mark chains to be removed, got %v", counts)
+	}
+}
+
+func TestIPSetSetMarkRules(t *testing.T) {
+	enterTestNetns(t)
+	backend, err := New()
+	if err != nil {
+		t.Skipf("ipset is not available: %v", err)
+	}
+	testSetMarkRules(t, backend)
+}
+
+func TestNFTablesSetMarkRules(t *testing.T) {
+	enterTestNetns(t)
+	backend, err := NewNFTables(config.NFTablesConfig{})
+	if err != nil {
+		t.Skipf("nftables is not available: %v", err)
+	}
+	testSetMarkRules(t, backend)
+}
@@ -0,0 +1,275 @@
+package ipset
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory — бэкенд, хранящий множества в памяти процесса. Используется в тестах
+// и в режиме dry_run, чтобы видеть, что dns-box добавил бы в ipset на машине
+// без прав на netlink. Поведение повторяет ядро: добавление в несуществующее
+// множество — ошибка, повторное добавление обновляет таймаут, истёкшие
+// элементы не возвращаются, сверх MaxElem элементы не добавляются.
+type Memory struct {
+	mu   sync.Mutex
+	sets map[string]*memorySet
+	now  func() time.Time
+}
+
+type memorySet struct {
+	opts     SetOptions
+	elements map[string]memoryElement
+}
+
+type memoryElement struct {
+	expires time.Time // нулевое время — элемент без таймаута
+	comment string
+}
+
+// SetContents — снимок одного множества для API.
+type SetContents struct {
+	Name    string  `json:"name"`
+	Type    SetType `json:"type"`
+	IPv6    bool    `json:"ipv6"`
+	Timeout uint32  `json:"timeout"`
+	Entries []Entry `json:"entries"`
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		sets: make(map[string]*memorySet),
+		now:  time.Now,
+	}
+}
+
+func (m *Memory) CreateSet(name string, opts SetOptions) error {
+	if opts.Type == "" {
+		opts.Type = TypeHashIP
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if set, ok := m.sets[name]; ok {
+		set.opts = opts
+		return nil
+	}
+	m.sets[name] = &memorySet{opts: opts, elements: make(map[string]memoryElement)}
+	return nil
+}
+
+func (m *Memory) DestroySet(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sets, name)
+	return nil
+}
+
+func (m *Memory) AddElement(setName, entry string, timeout uint32) error {
+	return m.AddElements(setName, []Entry{{Value: entry, Timeout: timeout}})
+}
+
+// AddElements добавляет элементы по порядку и, как ядро, останавливается на
+// первой ошибке.
+func (m *Memory) AddElements(setName string, entries []Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, e := range entries {
+		set, key, err := m.lookup(setName, e.Value)
+		if err != nil {
+			return err
+		}
+		if _, ok := set.elements[key]; !ok && set.opts.MaxElem > 0 && len(set.elements) >= int(set.opts.MaxElem) {
+			// Место освобождают только истёкшие элементы.
+			m.expire(set)
+			if len(set.elements) >= int(set.opts.MaxElem) {
+				return fmt.Errorf("%w: %s has %d elements", ErrSetFull, setName, set.opts.MaxElem)
+			}
+		}
+
+		elem := memoryElement{}
+		if e.Timeout > 0 {
+			elem.expires = m.now().Add(time.Duration(e.Timeout) * time.Second)
+		}
+		if set.opts.Comment {
+			elem.comment = e.Comment
+		}
+		set.elements[key] = elem
+	}
+	return nil
+}
+
+func (m *Memory) RemoveElement(setName, entry string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	set, key, err := m.lookup(setName, entry)
+	if err != nil {
+		return err
+	}
+	delete(set.elements, key)
+	return nil
+}
+
+func (m *Memory) Flush(setName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	set, ok := m.sets[setName]
+	if !ok {
+		return fmt.Errorf("set %s does not exist", setName)
+	}
+	set.elements = make(map[string]memoryElement)
+	return nil
+}
+
+func (m *Memory) List(setName string) ([]Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	set, ok := m.sets[setName]
+	if !ok {
+		return nil, fmt.Errorf("set %s does not exist", setName)
+	}
+	return m.entries(set), nil
+}
+
+// ReplaceSet заполняет новое множество и подменяет им существующее под одной
+// блокировкой. При ошибке в любом элементе содержимое не меняется.
+func (m *Memory) ReplaceSet(name string, opts SetOptions, entries []string) error {
+	if opts.Type == "" {
+		opts.Type = TypeHashIP
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.sets[name]; !ok {
+		return fmt.Errorf("set %s does not exist", name)
+	}
+	var expires time.Time
+	if opts.Timeout > 0 {
+		expires = m.now().Add(time.Duration(opts.Timeout) * time.Second)
+	}
+	replacement := &memorySet{opts: opts, elements: make(map[string]memoryElement, len(entries))}
+	for _, entry := range entries {
+		key, err := replacement.key(name, entry)
+		if err != nil {
+			return err
+		}
+		replacement.elements[key] = memoryElement{expires: expires}
+	}
+	if opts.MaxElem > 0 && len(replacement.elements) > int(opts.MaxElem) {
+		return fmt.Errorf("%w: %s has %d elements", ErrSetFull, name, opts.MaxElem)
+	}
+	m.sets[name] = replacement
+	return nil
+}
+
+func (m *Memory) DescribeSet(name string) (SetOptions, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	set, ok := m.sets[name]
+	if !ok {
+		return SetOptions{}, false, nil
+	}
+	return set.opts, true, nil
+}
+
+// SwapSets меняет множества местами, как ipset swap: типы и семейства должны совпадать.
+func (m *Memory) SwapSets(a, b string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	setA, okA := m.sets[a]
+	setB, okB := m.sets[b]
+	if !okA || !okB {
+		return fmt.Errorf("sets %s and %s must both exist", a, b)
+	}
+	if setA.opts.Type != setB.opts.Type || setA.opts.IPv6 != setB.opts.IPv6 {
+		return fmt.Errorf("sets %s and %s have incompatible types", a, b)
+	}
+	m.sets[a], m.sets[b] = setB, setA
+	return nil
+}
+
+// Dump возвращает содержимое всех множеств, отсортированных по имени.
+func (m *Memory) Dump() []SetContents {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]SetContents, 0, len(m.sets))
+	for name, set := range m.sets {
+		result = append(result, SetContents{
+			Name:    name,
+			Type:    set.opts.Type,
+			IPv6:    set.opts.IPv6,
+			Timeout: set.opts.Timeout,
+			Entries: m.entries(set),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// lookup находит множество и нормализует элемент. Вызывается под m.mu.
+func (m *Memory) lookup(setName, entry string) (*memorySet, string, error) {
+	set, ok := m.sets[setName]
+	if !ok {
+		return nil, "", fmt.Errorf("set %s does not exist", setName)
+	}
+	key, err := set.key(setName, entry)
+	if err != nil {
+		return nil, "", err
+	}
+	return set, key, nil
+}
+
+// key нормализует элемент с проверкой типа и семейства множества.
+func (s *memorySet) key(setName, entry string) (string, error) {
+	prefix, err := parseEntry(entry)
+	if err != nil {
+		return "", err
+	}
+	if prefix.Addr().Is6() != s.opts.IPv6 {
+		return "", fmt.Errorf("address family of %s does not match set %s", entry, setName)
+	}
+	if s.opts.Type == TypeHashIP {
+		if !prefix.IsSingleIP() {
+			return "", fmt.Errorf("set %s holds single addresses, got %s", setName, entry)
+		}
+		return prefix.Addr().String(), nil
+	}
+	return prefix.String(), nil
+}
+
+// entries удаляет истёкшие элементы и возвращает оставшиеся, отсортированные
+// по значению. Вызывается под m.mu.
+func (m *Memory) entries(set *memorySet) []Entry {
+	m.expire(set)
+	now := m.now()
+	entries := make([]Entry, 0, len(set.elements))
+	for value, elem := range set.elements {
+		var timeout uint32
+		if !elem.expires.IsZero() {
+			timeout = uint32((elem.expires.Sub(now) + time.Second - 1) / time.Second)
+		}
+		entries = append(entries, Entry{Value: value, Timeout: timeout, Comment: elem.comment})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Value < entries[j].Value })
+	return entries
+}
+
+// expire удаляет истёкшие элементы. Вызывается под m.mu.
+func (m *Memory) expire(set *memorySet) {
+	now := m.now()
+	for value, elem := range set.elements {
+		if !elem.expires.IsZero() && !elem.expires.After(now) {
+			delete(set.elements, value)
+		}
+	}
+}
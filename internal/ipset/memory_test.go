@@ -0,0 +1,146 @@
+package ipset
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	m := NewMemory()
+	m.now = func() time.Time { return now }
+
+	if err := m.AddElement("missing", "192.0.2.1", 60); err == nil {
+		t.Error("Expected an error when adding to a set that does not exist")
+	}
+
+	if err := m.CreateSet("vpn", SetOptions{Type: TypeHashIP, Timeout: 7200}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CreateSet("vpn_net6", SetOptions{Type: TypeHashNet, IPv6: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		set, entry string
+	}{
+		{"vpn", "10.0.0.0/8"},
+		{"vpn", "2001:db8::1"},
+		{"vpn_net6", "192.0.2.0/24"},
+		{"vpn", "not-an-ip"},
+	} {
+		if err := m.AddElement(tc.set, tc.entry, 60); err == nil {
+			t.Errorf("Expected %s to be rejected by set %s", tc.entry, tc.set)
+		}
+	}
+
+	if err := m.AddElement("vpn", "192.0.2.1", 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddElement("vpn", "192.0.2.2", 300); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddElement("vpn_net6", "2001:db8:1::/48", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Повторное добавление продлевает таймаут, как в ядре.
+	now = now.Add(50 * time.Second)
+	if err := m.AddElement("vpn", "192.0.2.2", 600); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(20 * time.Second)
+	entries, err := m.List("vpn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0] != (Entry{Value: "192.0.2.2", Timeout: 580}) {
+		t.Errorf("Expected only the refreshed entry to remain, got %v", entries)
+	}
+
+	dump := m.Dump()
+	if len(dump) != 2 || dump[1].Name != "vpn_net6" || len(dump[1].Entries) != 1 || dump[1].Entries[0].Timeout != 0 {
+		t.Errorf("Unexpected dump: %+v", dump)
+	}
+
+	if err := m.RemoveElement("vpn", "192.0.2.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Flush("vpn_net6"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"vpn", "vpn_net6"} {
+		if entries, _ := m.List(name); len(entries) != 0 {
+			t.Errorf("Expected %s to be empty, got %v", name, entries)
+		}
+	}
+}
+
+func TestMemoryReplaceSet(t *testing.T) {
+	m := NewMemory()
+	opts := SetOptions{Type: TypeHashNet, Timeout: 3600}
+	if err := m.CreateSet("geo", opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddElement("geo", "10.0.0.0/8", 60); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ошибка в одном элементе оставляет множество нетронутым.
+	if err := m.ReplaceSet("geo", opts, []string{"192.0.2.0/24", "2001:db8::/32"}); err == nil {
+		t.Error("Expected an error for an IPv6 prefix in an IPv4 set")
+	}
+	if entries, _ := m.List("geo"); len(entries) != 1 || entries[0].Value != "10.0.0.0/8" {
+		t.Errorf("Failed replace must keep the old contents, got %v", entries)
+	}
+
+	if err := m.ReplaceSet("geo", opts, []string{"192.0.2.0/24", "198.51.100.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []Entry{{Value: "192.0.2.0/24", Timeout: 3600}, {Value: "198.51.100.0/24", Timeout: 3600}}
+	if entries, _ := m.List("geo"); !reflect.DeepEqual(entries, want) {
+		t.Errorf("Expected %v after replace, got %v", want, entries)
+	}
+
+	if err := m.ReplaceSet("missing", opts, nil); err == nil {
+		t.Error("Expected an error when replacing a set that does not exist")
+	}
+}
+
+func TestMemoryMaxElemAndComments(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	m := NewMemory()
+	m.now = func() time.Time { return now }
+	m.CreateSet("vpn", SetOptions{Type: TypeHashIP, MaxElem: 2, Comment: true})
+	m.CreateSet("plain", SetOptions{Type: TypeHashIP})
+
+	if err := m.AddElements("vpn", []Entry{{Value: "192.0.2.1", Timeout: 60, Comment: "a.example"}, {Value: "192.0.2.2", Timeout: 120}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.AddElement("vpn", "192.0.2.3", 60); !errors.Is(err, ErrSetFull) {
+		t.Errorf("Expected ErrSetFull, got %v", err)
+	}
+	// Обновление существующего элемента в полном множестве не ошибка.
+	if err := m.AddElement("vpn", "192.0.2.2", 300); err != nil {
+		t.Errorf("Expected an existing entry to be refreshed, got %v", err)
+	}
+	// Истёкший элемент освобождает место.
+	now = now.Add(90 * time.Second)
+	if err := m.AddElement("vpn", "192.0.2.3", 60); err != nil {
+		t.Errorf("Expected an expired entry to free a slot, got %v", err)
+	}
+
+	entries, _ := m.List("vpn")
+	want := []Entry{{Value: "192.0.2.2", Timeout: 210}, {Value: "192.0.2.3", Timeout: 60}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("Entries = %v, want %v", entries, want)
+	}
+
+	m.AddElements("plain", []Entry{{Value: "192.0.2.1", Comment: "a.example"}})
+	if entries, _ := m.List("plain"); entries[0].Comment != "" {
+		t.Errorf("Expected no comment in a set without comments, got %q", entries[0].Comment)
+	}
+}
@@ -0,0 +1,475 @@
+//go:build linux
+
+package ipset
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/crazytypewriter/dns-box/internal/config"
+	"github.com/google/nftables"
+)
+
+const defaultNFTablesTable = "dns_box"
+
+// nftNoExpiry — таймаут элемента без таймаута в множестве с таймаутом по
+// умолчанию. Нулевой таймаут элемента библиотека не передаёт, и ядро выставило
+// бы таймаут множества, поэтому берётся наибольший, который принимают и старые
+// ядра с 32-битным таймаутом в миллисекундах (около 49 дней).
+const nftNoExpiry = time.Duration(math.MaxUint32) * time.Millisecond
+
+// NFTables — бэкенд на основе именованных множеств nftables. Множества
+// создаются с флагом timeout в отдельной таблице, правила маршрутизации
+// ссылаются на них как @name.
+type NFTables struct {
+	mu    sync.Mutex
+	conn  *nftables.Conn
+	table *nftables.Table
+	sets  map[string]*nftables.Set
+}
+
+func NewNFTables(cfg config.NFTablesConfig) (Backend, error) {
+	family, err := parseFamily(cfg.Family)
+	if err != nil {
+		return nil, err
+	}
+	name := cfg.Table
+	if name == "" {
+		name = defaultNFTablesTable
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("nftables connection failed: %w", err)
+	}
+
+	table := conn.AddTable(&nftables.Table{Name: name, Family: family})
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to create nftables table %s: %w", name, err)
+	}
+
+	return &NFTables{
+		conn:  conn,
+		table: table,
+		sets:  make(map[string]*nftables.Set),
+	}, nil
+}
+
+func parseFamily(family string) (nftables.TableFamily, error) {
+	switch family {
+	case "", "inet":
+		return nftables.TableFamilyINet, nil
+	case "ip":
+		return nftables.TableFamilyIPv4, nil
+	case "ip6":
+		return nftables.TableFamilyIPv6, nil
+	default:
+		return 0, fmt.Errorf("unsupported nftables family %q", family)
+	}
+}
+
+func (n *NFTables) CreateSet(name string, opts SetOptions) error {
+	set := &nftables.Set{
+		Table:      n.table,
+		Name:       name,
+		KeyType:    nftables.TypeIPAddr,
+		HasTimeout: true,
+		Timeout:    time.Duration(opts.Timeout) * time.Second,
+		Interval:   opts.Type == TypeHashNet,
+		Size:       opts.MaxElem,
+		Counter:    opts.Counters,
+	}
+	if opts.IPv6 {
+		set.KeyType = nftables.TypeIP6Addr
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err := n.conn.AddSet(set, nil); err != nil {
+		return err
+	}
+	if err := n.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to create nftables set %s: %w", name, err)
+	}
+	n.sets[name] = set
+	return nil
+}
+
+func (n *NFTables) DestroySet(name string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	set, err := n.getSet(name)
+	if errors.Is(err, syscall.ENOENT) {
+		return nil // множества уже нет
+	}
+	if err != nil {
+		return err
+	}
+	n.conn.DelSet(set)
+	if err := n.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to delete nftables set %s: %w", name, err)
+	}
+	delete(n.sets, name)
+	return nil
+}
+
+// AddElement добавляет элемент или обновляет таймаут существующего.
+// nftables не продлевает таймаут при повторном добавлении, поэтому
+// существующий элемент атомарно заменяется в одной транзакции.
+func (n *NFTables) AddElement(setName, entry string, timeout uint32) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	set, err := n.getSet(setName)
+	if err != nil {
+		return err
+	}
+	elems, err := elementsFor(set, entry, elementTimeout(set, timeout))
+	if err != nil {
+		return err
+	}
+	keys, _ := elementsFor(set, entry, 0)
+
+	if err := n.conn.SetDeleteElements(set, keys); err != nil {
+		return err
+	}
+	if err := n.conn.SetAddElements(set, elems); err != nil {
+		return err
+	}
+	if err := n.conn.Flush(); err == nil {
+		return nil
+	}
+
+	// Элемента ещё нет: удаление откатило транзакцию, добавляем без него.
+	if err := n.conn.SetAddElements(set, elems); err != nil {
+		return err
+	}
+	return setFullError(setName, n.conn.Flush())
+}
+
+// AddElements добавляет элементы в одной транзакции. Чтобы обновить таймаут
+// существующих элементов без отката транзакции, каждый элемент сначала
+// добавляется (для существующего это не ошибка), затем удаляется и
+// добавляется снова с новым таймаутом.
+func (n *NFTables) AddElements(setName string, entries []Entry) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	set, err := n.getSet(setName)
+	if err != nil {
+		return err
+	}
+	var elems, keys []nftables.SetElement
+	for _, e := range entries {
+		elem, err := elementsFor(set, e.Value, elementTimeout(set, e.Timeout))
+		if err != nil {
+			return err
+		}
+		// Комментарий хранится в userdata элемента, флаг множества не нужен.
+		elem[0].Comment = e.Comment
+		key, _ := elementsFor(set, e.Value, 0)
+		elems = append(elems, elem...)
+		keys = append(keys, key...)
+	}
+
+	if err := n.conn.SetAddElements(set, keys); err != nil {
+		return err
+	}
+	if err := n.conn.SetDeleteElements(set, keys); err != nil {
+		return err
+	}
+	if err := n.conn.SetAddElements(set, elems); err != nil {
+		return err
+	}
+	if err := n.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to add elements to nftables set %s: %w", setName, setFullError(setName, err))
+	}
+	return nil
+}
+
+// setFullError приводит ENFILE (в множестве size элементов) к ErrSetFull.
+func setFullError(setName string, err error) error {
+	if errors.Is(err, syscall.ENFILE) {
+		return fmt.Errorf("nftables set %s: %w", setName, ErrSetFull)
+	}
+	return err
+}
+
+func (n *NFTables) RemoveElement(setName, entry string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	set, err := n.getSet(setName)
+	if err != nil {
+		return err
+	}
+	keys, err := elementsFor(set, entry, 0)
+	if err != nil {
+		return err
+	}
+	if err := n.conn.SetDeleteElements(set, keys); err != nil {
+		return err
+	}
+	return n.conn.Flush()
+}
+
+func (n *NFTables) Flush(setName string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	set, err := n.getSet(setName)
+	if err != nil {
+		return err
+	}
+	n.conn.FlushSet(set)
+	return n.conn.Flush()
+}
+
+// ReplaceSet очищает множество и добавляет новые элементы в одной транзакции
+// netlink, поэтому замена атомарна без временного множества.
+func (n *NFTables) ReplaceSet(name string, opts SetOptions, entries []string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	set, err := n.getSet(name)
+	if err != nil {
+		return err
+	}
+	var elems []nftables.SetElement
+	for _, entry := range entries {
+		e, err := elementsFor(set, entry, time.Duration(opts.Timeout)*time.Second)
+		if err != nil {
+			return err
+		}
+		elems = append(elems, e...)
+	}
+
+	n.conn.FlushSet(set)
+	if len(elems) > 0 {
+		if err := n.conn.SetAddElements(set, elems); err != nil {
+			return err
+		}
+	}
+	if err := n.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to replace nftables set %s: %w", name, setFullError(name, err))
+	}
+	return nil
+}
+
+// DescribeSet читает параметры множества из ядра, минуя кеш n.sets.
+// Интервальное множество соответствует hash:net.
+func (n *NFTables) DescribeSet(name string) (SetOptions, bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	set, err := n.conn.GetSetByName(n.table, name)
+	if errors.Is(err, syscall.ENOENT) {
+		return SetOptions{}, false, nil // множества нет
+	}
+	if err != nil {
+		return SetOptions{}, false, fmt.Errorf("failed to read nftables set %s: %w", name, err)
+	}
+	opts := SetOptions{
+		Type:    TypeHashIP,
+		IPv6:    set.KeyType.Name == nftables.TypeIP6Addr.Name,
+		Timeout: uint32(set.Timeout / time.Second),
+		MaxElem: set.Size,
+	}
+	if set.Interval {
+		opts.Type = TypeHashNet
+	}
+	return opts, true, nil
+}
+
+// comparableOptions: у множеств nftables нет hashsize, комментарий хранится
+// в элементе, а флаг counter библиотека не читает обратно.
+func (n *NFTables) comparableOptions(opts SetOptions) SetOptions {
+	opts.HashSize = 0
+	opts.Counters = false
+	opts.Comment = false
+	return opts
+}
+
+func (n *NFTables) List(setName string) ([]Entry, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	set, err := n.getSet(setName)
+	if err != nil {
+		return nil, err
+	}
+	elems, err := n.conn.GetSetElements(set)
+	if err != nil {
+		return nil, err
+	}
+
+	if !set.Interval {
+		entries := make([]Entry, 0, len(elems))
+		for _, e := range elems {
+			addr, ok := netip.AddrFromSlice(e.Key)
+			if !ok {
+				continue
+			}
+			entries = append(entries, elementEntry(addr.String(), e))
+		}
+		return entries, nil
+	}
+
+	// Интервальное множество хранит начало подсети и следующий за её концом
+	// адрес с флагом IntervalEnd. Сортируем и собираем пары обратно в CIDR.
+	sort.Slice(elems, func(i, j int) bool {
+		a, _ := netip.AddrFromSlice(elems[i].Key)
+		b, _ := netip.AddrFromSlice(elems[j].Key)
+		if c := a.Compare(b); c != 0 {
+			return c < 0
+		}
+		return elems[i].IntervalEnd && !elems[j].IntervalEnd
+	})
+
+	var entries []Entry
+	for i, e := range elems {
+		if e.IntervalEnd {
+			continue
+		}
+		start, ok := netip.AddrFromSlice(e.Key)
+		if !ok {
+			continue
+		}
+		end := netip.Addr{}
+		if i+1 < len(elems) && elems[i+1].IntervalEnd {
+			end, _ = netip.AddrFromSlice(elems[i+1].Key)
+		}
+		entries = append(entries, elementEntry(rangeToPrefix(start, end).String(), e))
+	}
+	return entries, nil
+}
+
+func elementEntry(value string, e nftables.SetElement) Entry {
+	entry := Entry{Value: value, Timeout: uint32(e.Expires / time.Second), Comment: e.Comment}
+	if e.Counter != nil {
+		entry.Packets = e.Counter.Packets
+		entry.Bytes = e.Counter.Bytes
+	}
+	return entry
+}
+
+// getSet возвращает описание множества, при необходимости запрашивая его у ядра
+// (например, если множество создано до перезапуска). Вызывается под n.mu.
+func (n *NFTables) getSet(name string) (*nftables.Set, error) {
+	if set, ok := n.sets[name]; ok {
+		return set, nil
+	}
+	set, err := n.conn.GetSetByName(n.table, name)
+	if err != nil {
+		return nil, fmt.Errorf("nftables set %s not found: %w", name, err)
+	}
+	n.sets[name] = set
+	return set, nil
+}
+
+// SetMarkRules пересоздаёт цепочки fwmark в таблице бэкенда: правила
+// ссылаются на множества через lookup, как ip daddr @name.
+func (n *NFTables) SetMarkRules(rules []MarkRule) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	sets := make([]*nftables.Set, len(rules))
+	for i, rule := range rules {
+		set, err := n.getSet(rule.Set)
+		if err != nil {
+			return err
+		}
+		sets[i] = set
+	}
+	chains, err := n.conn.ListChainsOfTableFamily(n.table.Family)
+	if err != nil {
+		return err
+	}
+
+	for _, chain := range chains {
+		if chain.Table.Name == n.table.Name && isMarkChain(chain) {
+			n.conn.FlushChain(chain)
+			n.conn.DelChain(chain)
+		}
+	}
+	if len(rules) > 0 {
+		for _, chain := range addMarkChains(n.conn, n.table) {
+			for i, rule := range rules {
+				n.conn.AddRule(&nftables.Rule{
+					Table: n.table,
+					Chain: chain,
+					Exprs: append(daddrLookupExprs(sets[i], rule.IPv6), setMarkExprs(rule.Mark)...),
+				})
+			}
+		}
+	}
+	if err := n.conn.Flush(); err != nil {
+		return fmt.Errorf("failed to update nftables mark rules: %w", err)
+	}
+	return nil
+}
+
+// elementTimeout переводит таймаут элемента в секундах; 0 — элемент не
+// истекает.
+func elementTimeout(set *nftables.Set, seconds uint32) time.Duration {
+	if seconds == 0 && set.Timeout != 0 {
+		return nftNoExpiry
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// elementsFor преобразует IP или CIDR в элементы множества. Для интервальных
+// множеств подсеть задаётся парой: начало и первый адрес за её концом.
+func elementsFor(set *nftables.Set, entry string, timeout time.Duration) ([]nftables.SetElement, error) {
+	prefix, err := parseEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	if !set.Interval {
+		if !prefix.IsSingleIP() {
+			return nil, fmt.Errorf("set %s holds single addresses, got %s", set.Name, entry)
+		}
+		return []nftables.SetElement{{Key: prefix.Addr().AsSlice(), Timeout: timeout}}, nil
+	}
+
+	elems := []nftables.SetElement{{Key: prefix.Addr().AsSlice(), Timeout: timeout}}
+	if end := lastAddr(prefix).Next(); end.IsValid() {
+		elems = append(elems, nftables.SetElement{Key: end.AsSlice(), IntervalEnd: true})
+	}
+	return elems, nil
+}
+
+// lastAddr возвращает последний адрес подсети.
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// rangeToPrefix восстанавливает подсеть по её началу и адресу за концом.
+// Невалидный end означает, что подсеть доходит до конца адресного пространства.
+func rangeToPrefix(start, end netip.Addr) netip.Prefix {
+	for bits := 0; bits <= start.BitLen(); bits++ {
+		p := netip.PrefixFrom(start, bits)
+		if p.Masked().Addr() != start {
+			continue
+		}
+		next := lastAddr(p).Next()
+		if next == end || (!end.IsValid() && !next.IsValid()) {
+			return p
+		}
+	}
+	return netip.PrefixFrom(start, start.BitLen())
+}
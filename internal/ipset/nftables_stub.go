@@ -0,0 +1,13 @@
+//go:build !linux
+
+package ipset
+
+import (
+	"errors"
+
+	"github.com/crazytypewriter/dns-box/internal/config"
+)
+
+func NewNFTables(cfg config.NFTablesConfig) (Backend, error) {
+	return nil, errors.New("nftables backend is only supported on linux")
+}
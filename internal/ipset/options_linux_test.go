@@ -0,0 +1,75 @@
+//go:build linux
+
+package ipset
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/crazytypewriter/dns-box/internal/config"
+)
+
+// testSetOptions проверяет на ядре, что параметры множества применяются и
+// читаются обратно, а переполнение возвращает ErrSetFull.
+func testSetOptions(t *testing.T, backend Backend, opts SetOptions) {
+	t.Helper()
+	if err := backend.CreateSet("vpn", opts); err != nil {
+		t.Skipf("Failed to create a set: %v", err)
+	}
+	// Повторное создание с теми же параметрами не ошибка.
+	if err := backend.CreateSet("vpn", opts); err != nil {
+		t.Errorf("Expected an existing set to be accepted, got %v", err)
+	}
+
+	current, exists, err := backend.(Inspector).DescribeSet("vpn")
+	if err != nil || !exists {
+		t.Fatalf("DescribeSet = %v, %v", exists, err)
+	}
+	want := opts
+	if filter, ok := backend.(optionsFilter); ok {
+		want = filter.comparableOptions(want)
+	}
+	if !sameOptions(current, want) {
+		t.Errorf("DescribeSet = %+v, want %+v", current, want)
+	}
+
+	batcher := backend.(BatchAdder)
+	if err := batcher.AddElements("vpn", []Entry{
+		{Value: "192.0.2.1", Timeout: 300, Comment: "a.example"},
+		{Value: "192.0.2.2", Timeout: 300, Comment: "b.example"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.AddElement("vpn", "192.0.2.3", 300); !errors.Is(err, ErrSetFull) {
+		t.Errorf("Expected ErrSetFull, got %v", err)
+	}
+	if err := batcher.AddElements("vpn", []Entry{{Value: "192.0.2.4", Timeout: 300}}); !errors.Is(err, ErrSetFull) {
+		t.Errorf("Expected ErrSetFull from a batch, got %v", err)
+	}
+
+	entries, err := backend.List("vpn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Comment != "a.example" && entries[1].Comment != "a.example" {
+		t.Errorf("Expected two entries with comments, got %+v", entries)
+	}
+}
+
+func TestIPSetSetOptions(t *testing.T) {
+	enterTestNetns(t)
+	backend, err := New()
+	if err != nil {
+		t.Skipf("ipset is not available: %v", err)
+	}
+	testSetOptions(t, backend, SetOptions{Type: TypeHashIP, Timeout: 7200, HashSize: 1024, MaxElem: 2, Counters: true, Comment: true})
+}
+
+func TestNFTablesSetOptions(t *testing.T) {
+	enterTestNetns(t)
+	backend, err := NewNFTables(config.NFTablesConfig{})
+	if err != nil {
+		t.Skipf("nftables is not available: %v", err)
+	}
+	testSetOptions(t, backend, SetOptions{Type: TypeHashIP, Timeout: 7200, MaxElem: 2, Comment: true})
+}
@@ -0,0 +1,81 @@
+package ipset
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Origin описывает, какой DNS-ответ добавил адрес в множество.
+type Origin struct {
+	Domain  string    `json:"domain"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// Provenance — ограниченный по размеру индекс "множество + адрес → домен".
+// При переполнении вытесняются записи, которые дольше всего не обновлялись,
+// поэтому память не растёт вместе с количеством разрешённых доменов.
+type Provenance struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List // от самых свежих к самым старым
+	items    map[provenanceKey]*list.Element
+}
+
+type provenanceKey struct {
+	set   string
+	value string
+}
+
+type provenanceItem struct {
+	key    provenanceKey
+	origin Origin
+}
+
+func NewProvenance(capacity int) *Provenance {
+	return &Provenance{
+		capacity: capacity,
+		order:    list.New(),
+		items:    make(map[provenanceKey]*list.Element),
+	}
+}
+
+// Record запоминает домен, из-за которого адрес попал в множество.
+func (p *Provenance) Record(setName, value, domain string, at time.Time) {
+	key := provenanceKey{set: setName, value: value}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if el, ok := p.items[key]; ok {
+		el.Value.(*provenanceItem).origin = Origin{Domain: domain, AddedAt: at}
+		p.order.MoveToFront(el)
+		return
+	}
+
+	p.items[key] = p.order.PushFront(&provenanceItem{key: key, origin: Origin{Domain: domain, AddedAt: at}})
+	for p.order.Len() > p.capacity {
+		oldest := p.order.Back()
+		p.order.Remove(oldest)
+		delete(p.items, oldest.Value.(*provenanceItem).key)
+	}
+}
+
+// Lookup возвращает источник адреса, если он ещё есть в индексе.
+func (p *Provenance) Lookup(setName, value string) (Origin, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	el, ok := p.items[provenanceKey{set: setName, value: value}]
+	if !ok {
+		return Origin{}, false
+	}
+	return el.Value.(*provenanceItem).origin, true
+}
+
+// Len возвращает количество записей в индексе.
+func (p *Provenance) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.order.Len()
+}
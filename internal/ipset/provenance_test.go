@@ -0,0 +1,31 @@
+package ipset
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProvenanceEvictsOldest(t *testing.T) {
+	p := NewProvenance(2)
+	at := time.Unix(1700000000, 0)
+
+	p.Record("vpn", "192.0.2.1", "a.example", at)
+	p.Record("vpn", "192.0.2.2", "b.example", at)
+	// Обновление переносит запись в начало, вытесняться должна 192.0.2.2.
+	p.Record("vpn", "192.0.2.1", "c.example", at.Add(time.Minute))
+	p.Record("vpn6", "2001:db8::1", "d.example", at)
+
+	if p.Len() != 2 {
+		t.Fatalf("Expected 2 entries, got %d", p.Len())
+	}
+	if _, ok := p.Lookup("vpn", "192.0.2.2"); ok {
+		t.Error("Expected the least recently updated entry to be evicted")
+	}
+	origin, ok := p.Lookup("vpn", "192.0.2.1")
+	if !ok || origin.Domain != "c.example" || !origin.AddedAt.Equal(at.Add(time.Minute)) {
+		t.Errorf("Expected the refreshed origin, got %+v", origin)
+	}
+	if _, ok := p.Lookup("vpn", "2001:db8::1"); ok {
+		t.Error("Provenance must be keyed by set name")
+	}
+}
@@ -0,0 +1,383 @@
+package ipset
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/crazytypewriter/dns-box/internal/config"
+)
+
+// Inspector — бэкенд умеет читать параметры существующего множества.
+type Inspector interface {
+	// DescribeSet возвращает параметры множества; exists=false, если его нет.
+	DescribeSet(name string) (opts SetOptions, exists bool, err error)
+}
+
+// optionsFilter — бэкенд поддерживает не все параметры SetOptions или не
+// может прочитать их обратно. Сверка сравнивает только то, что он оставил,
+// иначе множество пересоздавалось бы при каждом запуске.
+type optionsFilter interface {
+	comparableOptions(opts SetOptions) SetOptions
+}
+
+// Swapper — бэкенд умеет обменивать два множества одного типа и семейства
+// (ipset swap): правила, ссылающиеся на имя, продолжают работать.
+type Swapper interface {
+	SwapSets(a, b string) error
+}
+
+// DesiredSets строит множества по спискам конфига. Net-списки без ASN, стран и
+// подписок состоят только из статических CIDR, поэтому лишнее из них удаляется.
+func DesiredSets(lists []config.IPSetListConfig, netLists []config.NetListConfig) []DesiredSet {
+	var sets []DesiredSet
+	for _, list := range lists {
+		sets = append(sets, DesiredSet{Name: list.Name, Options: ListSetOptions(list, false)})
+		if list.EnableIPv6 {
+			sets = append(sets, DesiredSet{Name: list.Name + "6", Options: ListSetOptions(list, true)})
+		}
+	}
+	for _, list := range netLists {
+		static := list.ASN == "" && len(list.Countries) == 0 && len(list.Sources) == 0
+		opts := SetOptions{Type: TypeHashNet, Timeout: timeoutOrDefault(list.Timeout)}
+		sets = append(sets, DesiredSet{Name: list.Name, Options: opts, Entries: list.CIDRs, Prune: static})
+		if list.EnableIPv6 {
+			opts.IPv6 = true
+			sets = append(sets, DesiredSet{Name: list.Name + "6", Options: opts, Entries: list.CIDRs, Prune: static})
+		}
+	}
+	return sets
+}
+
+// ListSetOptions возвращает параметры IPv4- или IPv6-множества списка. С
+// ipv6_prefix меньше 128 IPv6-множество хранит подсети.
+func ListSetOptions(list config.IPSetListConfig, ipv6 bool) SetOptions {
+	opts := SetOptions{
+		Type:     TypeHashIP,
+		IPv6:     ipv6,
+		Timeout:  timeoutOrDefault(list.Timeout),
+		HashSize: list.HashSize,
+		MaxElem:  list.MaxElem,
+		Counters: list.Counters,
+		Comment:  list.Comment,
+	}
+	if ipv6 && AggregatesIPv6(list) {
+		opts.Type = TypeHashNet
+	}
+	return opts
+}
+
+// AggregatesIPv6 сообщает, добавляет ли список IPv6-адреса подсетями.
+func AggregatesIPv6(list config.IPSetListConfig) bool {
+	return list.IPv6Prefix > 0 && list.IPv6Prefix < 128
+}
+
+func timeoutOrDefault(timeout uint32) uint32 {
+	if timeout == 0 {
+		return DefaultTimeout
+	}
+	return timeout
+}
+
+// DesiredSet — множество, которое должно существовать по конфигу.
+type DesiredSet struct {
+	Name    string
+	Options SetOptions
+	// Entries — полный состав множества; учитывается, только если Prune.
+	Entries []string
+	// Prune удаляет элементы, которых нет в Entries (net-списки со
+	// статическими CIDR).
+	Prune bool
+}
+
+// Действия в отчёте Reconcile.
+const (
+	ActionCreated   = "created"
+	ActionUnchanged = "unchanged"
+	ActionSwapped   = "swapped"   // параметры изменены через временное множество и swap
+	ActionRecreated = "recreated" // тип или семейство изменились, множество создано заново
+	ActionPruned    = "pruned"
+	ActionDestroyed = "destroyed"
+	ActionFailed    = "failed"
+)
+
+// Change — одно действие сверки.
+type Change struct {
+	Set    string `json:"set"`
+	Action string `json:"action"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Report — результат Reconcile.
+type Report struct {
+	Changes []Change `json:"changes"`
+	// Unusable — множества из конфига, которые не удалось создать или
+	// привести к нужным параметрам.
+	Unusable []string `json:"unusable,omitempty"`
+}
+
+func (r *Report) add(set, action, detail string) {
+	r.Changes = append(r.Changes, Change{Set: set, Action: action, Detail: detail})
+}
+
+// Reconcile приводит множества в ядре к конфигу: создаёт недостающие,
+// пересоздаёт или меняет через swap множества с другими параметрами (например,
+// оставшиеся от прошлой версии конфига), чистит net-множества от лишних CIDR и
+// удаляет множества removed. Ошибки одного множества не прерывают сверку
+// остальных и попадают в отчёт с действием ActionFailed.
+func Reconcile(backend Backend, desired []DesiredSet, removed []string) Report {
+	var report Report
+	for _, set := range desired {
+		if !reconcileSet(backend, set, &report) {
+			report.Unusable = append(report.Unusable, set.Name)
+			continue
+		}
+		if set.Prune {
+			pruneSet(backend, set, &report)
+		}
+	}
+
+	for _, name := range removed {
+		if err := backend.DestroySet(name); err != nil {
+			report.add(name, ActionFailed, fmt.Sprintf("destroy removed set: %v", err))
+			continue
+		}
+		report.add(name, ActionDestroyed, "list removed from config")
+	}
+	return report
+}
+
+// reconcileSet создаёт или исправляет множество; false — множество непригодно.
+func reconcileSet(backend Backend, set DesiredSet, report *Report) bool {
+	inspector, ok := backend.(Inspector)
+	if !ok {
+		if err := backend.CreateSet(set.Name, set.Options); err != nil {
+			report.add(set.Name, ActionFailed, err.Error())
+			return false
+		}
+		report.add(set.Name, ActionCreated, "")
+		return true
+	}
+
+	want := set.Options
+	if filter, ok := backend.(optionsFilter); ok {
+		want = filter.comparableOptions(want)
+	}
+	current, exists, err := inspector.DescribeSet(set.Name)
+	switch {
+	case err != nil:
+		report.add(set.Name, ActionFailed, fmt.Sprintf("inspect: %v", err))
+		return false
+	case !exists:
+		if err := backend.CreateSet(set.Name, set.Options); err != nil {
+			report.add(set.Name, ActionFailed, err.Error())
+			return false
+		}
+		report.add(set.Name, ActionCreated, describeOptions(set.Options))
+		return true
+	case sameOptions(current, want):
+		report.add(set.Name, ActionUnchanged, "")
+		return true
+	}
+
+	diff := fmt.Sprintf("%s -> %s", describeOptions(current), describeOptions(want))
+	if swapper, ok := backend.(Swapper); ok && current.Type == set.Options.Type && current.IPv6 == set.Options.IPv6 {
+		if err := swapOptions(backend, swapper, set); err != nil {
+			report.add(set.Name, ActionFailed, fmt.Sprintf("%s: %v", diff, err))
+			return false
+		}
+		report.add(set.Name, ActionSwapped, diff)
+		return true
+	}
+
+	if err := backend.DestroySet(set.Name); err != nil {
+		report.add(set.Name, ActionFailed, fmt.Sprintf("%s: cannot destroy the old set, is it referenced by firewall rules? %v", diff, err))
+		return false
+	}
+	if err := backend.CreateSet(set.Name, set.Options); err != nil {
+		report.add(set.Name, ActionFailed, fmt.Sprintf("%s: %v", diff, err))
+		return false
+	}
+	report.add(set.Name, ActionRecreated, diff)
+	return true
+}
+
+// sameOptions сравнивает параметры множества в ядре с желаемыми. Нулевые
+// HashSize и MaxElem означают значения ядра по умолчанию и не сравниваются;
+// hashsize ядро округляет вверх и увеличивает по мере заполнения.
+func sameOptions(current, want SetOptions) bool {
+	if want.HashSize != 0 && current.HashSize < want.HashSize {
+		return false
+	}
+	if want.MaxElem != 0 && current.MaxElem != want.MaxElem {
+		return false
+	}
+	current.HashSize, want.HashSize = 0, 0
+	current.MaxElem, want.MaxElem = 0, 0
+	return current == want
+}
+
+// swapOptions создаёт временное множество с новыми параметрами, переносит в
+// него элементы с их оставшимися таймаутами и меняет множества местами.
+func swapOptions(backend Backend, swapper Swapper, set DesiredSet) error {
+	entries, err := backend.List(set.Name)
+	if err != nil {
+		return err
+	}
+	tmp := swapSetName(set.Name)
+	if err := backend.DestroySet(tmp); err != nil {
+		return err
+	}
+	if err := backend.CreateSet(tmp, set.Options); err != nil {
+		return err
+	}
+	if !set.Options.Comment {
+		for i := range entries {
+			entries[i].Comment = ""
+		}
+	}
+	// Элементы, не поместившиеся в уменьшенный maxelem, пропадают: адреса из
+	// DNS-ответов вернутся при следующих запросах.
+	if err := copyEntries(backend, tmp, entries); err != nil && !errors.Is(err, ErrSetFull) {
+		backend.DestroySet(tmp)
+		return err
+	}
+	if err := swapper.SwapSets(tmp, set.Name); err != nil {
+		backend.DestroySet(tmp)
+		return err
+	}
+	return backend.DestroySet(tmp)
+}
+
+// copyEntries добавляет элементы с их таймаутами и комментариями.
+func copyEntries(backend Backend, setName string, entries []Entry) error {
+	if batcher, ok := backend.(BatchAdder); ok {
+		for start := 0; start < len(entries); start += writerBatchSize {
+			if err := batcher.AddElements(setName, entries[start:min(start+writerBatchSize, len(entries))]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, e := range entries {
+		if err := backend.AddElement(setName, e.Value, e.Timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pruneSet(backend Backend, set DesiredSet, report *Report) {
+	want := make(map[netip.Prefix]bool, len(set.Entries))
+	for _, entry := range set.Entries {
+		if p, err := parseEntry(entry); err == nil {
+			want[p] = true
+		}
+	}
+	live, err := backend.List(set.Name)
+	if err != nil {
+		report.add(set.Name, ActionFailed, fmt.Sprintf("list: %v", err))
+		return
+	}
+
+	pruned := 0
+	for _, e := range live {
+		if p, err := parseEntry(e.Value); err == nil && want[p] {
+			continue
+		}
+		if err := backend.RemoveElement(set.Name, e.Value); err != nil {
+			report.add(set.Name, ActionFailed, fmt.Sprintf("remove %s: %v", e.Value, err))
+			continue
+		}
+		pruned++
+	}
+	if pruned > 0 {
+		report.add(set.Name, ActionPruned, fmt.Sprintf("%d entries no longer in config", pruned))
+	}
+}
+
+func describeOptions(opts SetOptions) string {
+	family := "inet"
+	if opts.IPv6 {
+		family = "inet6"
+	}
+	desc := fmt.Sprintf("%s family %s timeout %d", opts.Type, family, opts.Timeout)
+	if opts.HashSize != 0 {
+		desc += fmt.Sprintf(" hashsize %d", opts.HashSize)
+	}
+	if opts.MaxElem != 0 {
+		desc += fmt.Sprintf(" maxelem %d", opts.MaxElem)
+	}
+	if opts.Counters {
+		desc += " counters"
+	}
+	if opts.Comment {
+		desc += " comment"
+	}
+	return desc
+}
+
+// ManagedSets — имена множеств, созданных dns-box при прошлом запуске. По ним
+// находятся множества удалённых из конфига списков: ipset общий для всей
+// системы, и без этого файла нельзя отличить свои множества от чужих.
+type ManagedSets struct {
+	Sets []string `json:"sets"`
+}
+
+// LoadManagedSets читает файл состояния; отсутствующий файл — пустой список.
+func LoadManagedSets(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state ManagedSets
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("invalid managed sets file %s: %w", path, err)
+	}
+	return state.Sets, nil
+}
+
+// SaveManagedSets атомарно записывает файл состояния.
+func SaveManagedSets(path string, sets []string) error {
+	sorted := append([]string(nil), sets...)
+	sort.Strings(sorted)
+	data, err := json.MarshalIndent(ManagedSets{Sets: sorted}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".sets-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// RemovedSets возвращает множества из previous, которых нет в desired.
+func RemovedSets(previous []string, desired []DesiredSet) []string {
+	keep := make(map[string]bool, len(desired))
+	for _, set := range desired {
+		keep[set.Name] = true
+	}
+	var removed []string
+	for _, name := range previous {
+		if !keep[name] {
+			removed = append(removed, name)
+		}
+	}
+	return removed
+}
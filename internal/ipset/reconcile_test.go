@@ -0,0 +1,190 @@
+package ipset
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/crazytypewriter/dns-box/internal/config"
+)
+
+func TestReconcile(t *testing.T) {
+	m := NewMemory()
+	mustCreate := func(name string, opts SetOptions) {
+		t.Helper()
+		if err := m.CreateSet(name, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Состояние от прошлой версии конфига.
+	mustCreate("vpn", SetOptions{Type: TypeHashIP, Timeout: 7200})
+	mustCreate("media", SetOptions{Type: TypeHashIP, Timeout: 3600})
+	mustCreate("tg", SetOptions{Type: TypeHashIP, Timeout: 7200})
+	mustCreate("static", SetOptions{Type: TypeHashNet, Timeout: 7200})
+	mustCreate("old", SetOptions{Type: TypeHashIP, Timeout: 7200})
+	if err := m.AddElement("media", "192.0.2.1", 600); err != nil {
+		t.Fatal(err)
+	}
+	for _, cidr := range []string{"10.0.0.0/8", "192.0.2.0/24"} {
+		if err := m.AddElement("static", cidr, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	desired := DesiredSets(
+		[]config.IPSetListConfig{
+			{Name: "vpn", EnableIPv6: true},
+			{Name: "media", Timeout: 86400},
+		},
+		[]config.NetListConfig{
+			{Name: "tg", ASN: "62041"},
+			{Name: "static", CIDRs: []string{"10.0.0.0/8"}},
+		},
+	)
+	report := Reconcile(m, desired, RemovedSets([]string{"vpn", "old", "gone"}, desired))
+
+	actions := make(map[string][]string)
+	for _, c := range report.Changes {
+		actions[c.Set] = append(actions[c.Set], c.Action)
+	}
+	want := map[string][]string{
+		"vpn":    {ActionUnchanged},
+		"vpn6":   {ActionCreated},
+		"media":  {ActionSwapped},
+		"tg":     {ActionRecreated},
+		"static": {ActionUnchanged, ActionPruned},
+		"old":    {ActionDestroyed},
+		"gone":   {ActionDestroyed},
+	}
+	if !reflect.DeepEqual(actions, want) {
+		t.Errorf("Actions = %v, want %v", actions, want)
+	}
+	if len(report.Unusable) != 0 {
+		t.Errorf("Unexpected unusable sets: %v", report.Unusable)
+	}
+
+	// Swap сохраняет элементы с их оставшимся таймаутом.
+	if opts, _, _ := m.DescribeSet("media"); opts.Timeout != 86400 {
+		t.Errorf("media timeout = %d, want 86400", opts.Timeout)
+	}
+	if entries, _ := m.List("media"); len(entries) != 1 || entries[0].Value != "192.0.2.1" || entries[0].Timeout > 600 {
+		t.Errorf("media entries = %v, want 192.0.2.1 with its old timeout", entries)
+	}
+	if _, exists, _ := m.DescribeSet(swapSetName("media")); exists {
+		t.Error("Temporary swap set must be destroyed")
+	}
+	if opts, _, _ := m.DescribeSet("tg"); opts.Type != TypeHashNet {
+		t.Errorf("tg type = %s, want %s", opts.Type, TypeHashNet)
+	}
+	if entries, _ := m.List("static"); len(entries) != 1 || entries[0].Value != "10.0.0.0/8" {
+		t.Errorf("static entries = %v, want only 10.0.0.0/8", entries)
+	}
+	if _, exists, _ := m.DescribeSet("old"); exists {
+		t.Error("Removed list set must be destroyed")
+	}
+}
+
+func TestReconcileListOptions(t *testing.T) {
+	m := NewMemory()
+	// hashsize в ядре вырос по мере заполнения.
+	m.CreateSet("cdn", SetOptions{Type: TypeHashIP, Timeout: 7200, HashSize: 4096, MaxElem: 65536})
+	m.CreateSet("big", SetOptions{Type: TypeHashIP, Timeout: 7200, Comment: true})
+	m.CreateSet("video6", SetOptions{Type: TypeHashIP, IPv6: true, Timeout: 7200})
+	m.AddElements("big", []Entry{
+		{Value: "192.0.2.1", Timeout: 600, Comment: "a.example"},
+		{Value: "192.0.2.2", Timeout: 600, Comment: "b.example"},
+		{Value: "192.0.2.3", Timeout: 600, Comment: "c.example"},
+	})
+
+	desired := DesiredSets([]config.IPSetListConfig{
+		{Name: "cdn", HashSize: 1024, MaxElem: 65536},
+		{Name: "big", MaxElem: 2, Comment: true},
+		{Name: "video", EnableIPv6: true, IPv6Prefix: 64},
+	}, nil)
+	report := Reconcile(m, desired, nil)
+
+	actions := make(map[string]string)
+	for _, c := range report.Changes {
+		actions[c.Set] = c.Action
+	}
+	want := map[string]string{
+		"cdn":    ActionUnchanged,
+		"big":    ActionSwapped,
+		"video":  ActionCreated,
+		"video6": ActionRecreated,
+	}
+	if !reflect.DeepEqual(actions, want) {
+		t.Errorf("Actions = %v, want %v", actions, want)
+	}
+
+	// В уменьшенный maxelem переносится столько элементов, сколько помещается.
+	entries, _ := m.List("big")
+	if len(entries) != 2 || entries[0].Comment != "a.example" {
+		t.Errorf("big entries = %v, want two entries with comments", entries)
+	}
+	if opts, _, _ := m.DescribeSet("video6"); opts.Type != TypeHashNet {
+		t.Errorf("video6 type = %s, want %s for ipv6_prefix", opts.Type, TypeHashNet)
+	}
+}
+
+// noSwap — бэкенд без Swapper, как nftables; множества busy заняты правилами.
+type noSwap struct {
+	Backend
+	Inspector
+	busy map[string]bool
+}
+
+func (n noSwap) DestroySet(name string) error {
+	if n.busy[name] {
+		return errors.New("device or resource busy")
+	}
+	return n.Backend.DestroySet(name)
+}
+
+func TestReconcileReportsBusySets(t *testing.T) {
+	m := NewMemory()
+	backend := noSwap{Backend: m, Inspector: m, busy: map[string]bool{"vpn": true}}
+	if err := backend.CreateSet("vpn", SetOptions{Type: TypeHashIP, Timeout: 3600}); err != nil {
+		t.Fatal(err)
+	}
+
+	report := Reconcile(backend, []DesiredSet{{Name: "vpn", Options: SetOptions{Type: TypeHashIP, Timeout: 7200}}}, nil)
+	if !reflect.DeepEqual(report.Unusable, []string{"vpn"}) || len(report.Changes) != 1 || report.Changes[0].Action != ActionFailed {
+		t.Errorf("Expected vpn to be reported as failed, got %+v", report)
+	}
+}
+
+func TestManagedSetsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sets.json")
+	if sets, err := LoadManagedSets(path); err != nil || sets != nil {
+		t.Fatalf("Missing file must be an empty list, got %v, %v", sets, err)
+	}
+	if err := SaveManagedSets(path, []string{"vpn6", "vpn"}); err != nil {
+		t.Fatal(err)
+	}
+	sets, err := LoadManagedSets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"vpn", "vpn6"}; !reflect.DeepEqual(sets, want) {
+		t.Errorf("Managed sets = %v, want %v", sets, want)
+	}
+}
+
+func TestSwapSetName(t *testing.T) {
+	if got := swapSetName("media"); got != "media_swp" {
+		t.Errorf("Expected media_swp, got %s", got)
+	}
+	// Длинные имена с общим префиксом не должны делить временное множество.
+	a := swapSetName("streaming_services_europe_main")
+	b := swapSetName("streaming_services_europe_backup")
+	if a == b {
+		t.Errorf("Expected distinct swap names, both are %s", a)
+	}
+	for _, name := range []string{a, b} {
+		if len(name) > maxSetNameLen {
+			t.Errorf("Swap name %s is longer than %d", name, maxSetNameLen)
+		}
+	}
+}
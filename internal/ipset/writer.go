@@ -0,0 +1,444 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Параметры Writer.
+const (
+	// writerQueueSize — сколько элементов может ждать записи. Сверх этого
+	// асинхронные добавления отбрасываются, чтобы не держать память и не
+	// тормозить DNS; синхронные принимаются всегда.
+	writerQueueSize = 65536
+	// writerBatchSize — элементов в одном сообщении BatchAdder.
+	writerBatchSize = 512
+	// writerRefreshPercent — элемент не переписывается, пока его оставшийся
+	// таймаут не меньше этой доли нового: иначе каждый ответ с TTL 3600
+	// продлевал бы таймаут на секунды ценой записи в ядро.
+	writerRefreshPercent = 90
+	writerPruneInterval  = time.Minute
+	// writerFullWindow — сколько после последнего отказа по maxelem
+	// множество считается переполненным в статистике.
+	writerFullWindow = 5 * time.Minute
+)
+
+var (
+	// ErrQueueFull — очередь Writer переполнена, элемент не будет записан.
+	ErrQueueFull = errors.New("ipset writer queue is full")
+	// ErrWaitTimeout — элемент не записан за отведённое время.
+	ErrWaitTimeout = errors.New("timed out waiting for ipset write")
+)
+
+// Writer записывает адреса из DNS-ответов в фоне. Добавления копятся, пока
+// идёт предыдущая запись, и уходят пачками по множествам; повтор элемента,
+// который уже ждёт в очереди, только увеличивает его таймаут. Остальные
+// методы Backend вызываются напрямую, но удаление элементов и множеств
+// отменяет ожидающие добавления и сбрасывает сведения о записанном.
+type Writer struct {
+	Backend
+	logger *log.Logger
+	now    func() time.Time
+
+	mu      sync.Mutex
+	pending map[string]map[string]*Pending // множество → элемент
+	queued  int
+	// written — когда истечёт таймаут, с которым элемент был записан.
+	written map[string]map[string]time.Time
+	// inflight — очередь, которую сейчас записывает flush. Удаление элемента
+	// из неё помечает Pending.removed, чтобы запись не вернула его в множество.
+	inflight map[string]map[string]*Pending
+	stats    WriterStats
+	full     map[string]*FullSet
+	wake     chan struct{}
+}
+
+// WriterStats — счётчики Writer для API.
+type WriterStats struct {
+	Queued        int    `json:"queued"`         // элементов ждут записи сейчас
+	MaxQueued     int    `json:"max_queued"`     // наибольшая длина очереди
+	QueueCapacity int    `json:"queue_capacity"` // после неё асинхронные добавления отбрасываются
+	Enqueued      uint64 `json:"enqueued"`
+	Merged        uint64 `json:"merged"`  // объединены с элементом, уже ждущим в очереди
+	Skipped       uint64 `json:"skipped"` // уже записаны с достаточным таймаутом
+	Dropped       uint64 `json:"dropped"` // отброшены из-за переполнения очереди
+	Written       uint64 `json:"written"`
+	Failed        uint64 `json:"failed"`
+	SetFull       uint64 `json:"set_full"` // из них не добавлены из-за maxelem
+	Batches       uint64 `json:"batches"`
+	LastBatchSize int    `json:"last_batch_size"`
+	// LastFlushMillis — длительность последней записи очереди.
+	LastFlushMillis int64 `json:"last_flush_ms"`
+	// FullSets — множества, отказавшие по maxelem за последние 5 минут.
+	FullSets []FullSet `json:"full_sets,omitempty"`
+	Warnings []string  `json:"warnings,omitempty"`
+}
+
+// FullSet — множество, в которое не помещаются новые элементы.
+type FullSet struct {
+	Set      string    `json:"set"`
+	Rejected uint64    `json:"rejected"` // элементов не добавлено с начала работы
+	LastAt   time.Time `json:"last_at"`
+}
+
+// Pending — добавление, поставленное в очередь.
+type Pending struct {
+	// timeout только растёт при объединении и читается без w.mu через Timeout.
+	timeout atomic.Uint32
+	comment string
+	done    chan struct{}
+	err     error
+	// removed — элемент удалён, пока его пачка записывалась. Под w.mu.
+	removed bool
+}
+
+// completed — результат добавления, которое не нужно записывать.
+func completed(err error) *Pending {
+	p := &Pending{done: make(chan struct{}), err: err}
+	close(p.done)
+	return p
+}
+
+// Timeout возвращает таймаут в секундах, с которым элемент записан или будет
+// записан: для пропущенного элемента — оставшийся таймаут уже записанного,
+// для отброшенного — 0. Его и нужно запоминать как срок жизни адреса.
+func (p *Pending) Timeout() uint32 {
+	return p.timeout.Load()
+}
+
+// Wait ждёт записи элемента не дольше timeout.
+func (p *Pending) Wait(timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-p.done:
+		return p.err
+	case <-timer.C:
+		return ErrWaitTimeout
+	}
+}
+
+func NewWriter(backend Backend, logger *log.Logger) *Writer {
+	return &Writer{
+		Backend: backend,
+		logger:  logger,
+		now:     time.Now,
+		pending: make(map[string]map[string]*Pending),
+		written: make(map[string]map[string]time.Time),
+		stats:   WriterStats{QueueCapacity: writerQueueSize},
+		full:    make(map[string]*FullSet),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Start запускает запись очереди. После отмены ctx оставшиеся элементы
+// записываются, и запись останавливается.
+func (w *Writer) Start(ctx context.Context) {
+	go w.run(ctx)
+}
+
+func (w *Writer) run(ctx context.Context) {
+	prune := time.NewTicker(writerPruneInterval)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			w.flush()
+			return
+		case <-w.wake:
+			w.flush()
+		case <-prune.C:
+			w.pruneWritten()
+		}
+	}
+}
+
+// Add ставит элемент с таймаутом entry.Timeout в очередь; entry.Comment
+// передаётся, только если множество создано с Comment. Для wait=false при
+// переполненной очереди элемент отбрасывается (Pending с ErrQueueFull);
+// wait=true означает, что вызывающий дождётся записи, и такие элементы
+// принимаются всегда.
+func (w *Writer) Add(setName string, entry Entry, wait bool) *Pending {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	timeout := entry.Timeout
+	if p := w.pending[setName][entry.Value]; p != nil {
+		p.timeout.Store(max(p.timeout.Load(), timeout))
+		if entry.Comment != "" {
+			p.comment = entry.Comment
+		}
+		w.stats.Merged++
+		return p
+	}
+	if timeout > 0 {
+		remaining := w.written[setName][entry.Value].Sub(w.now())
+		if remaining*100 >= time.Duration(timeout)*time.Second*writerRefreshPercent {
+			w.stats.Skipped++
+			p := completed(nil)
+			p.timeout.Store(uint32((remaining + time.Second - 1) / time.Second))
+			return p
+		}
+	}
+	if !wait && w.queued >= writerQueueSize {
+		w.stats.Dropped++
+		return completed(ErrQueueFull)
+	}
+
+	p := &Pending{comment: entry.Comment, done: make(chan struct{})}
+	p.timeout.Store(timeout)
+	if w.pending[setName] == nil {
+		w.pending[setName] = make(map[string]*Pending)
+	}
+	w.pending[setName][entry.Value] = p
+	w.queued++
+	w.stats.Enqueued++
+	w.stats.MaxQueued = max(w.stats.MaxQueued, w.queued)
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return p
+}
+
+// Drain ждёт записи всего, что стоит в очереди или записывается на момент
+// вызова.
+func (w *Writer) Drain() {
+	w.mu.Lock()
+	var waits []*Pending
+	for _, queue := range []map[string]map[string]*Pending{w.pending, w.inflight} {
+		for _, entries := range queue {
+			for _, p := range entries {
+				waits = append(waits, p)
+			}
+		}
+	}
+	w.mu.Unlock()
+
+	for _, p := range waits {
+		<-p.done
+	}
+}
+
+// Stats возвращает снимок счётчиков.
+func (w *Writer) Stats() WriterStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	stats := w.stats
+	stats.Queued = w.queued
+	since := w.now().Add(-writerFullWindow)
+	for _, full := range w.full {
+		if full.LastAt.After(since) {
+			stats.FullSets = append(stats.FullSets, *full)
+		}
+	}
+	sort.Slice(stats.FullSets, func(i, j int) bool { return stats.FullSets[i].Set < stats.FullSets[j].Set })
+	for _, full := range stats.FullSets {
+		stats.Warnings = append(stats.Warnings, fmt.Sprintf("set %s is full, %d entries were not added: increase maxelem of the list", full.Set, full.Rejected))
+	}
+	return stats
+}
+
+func (w *Writer) RemoveElement(setName, entry string) error {
+	w.mu.Lock()
+	w.cancel(setName, entry)
+	if p := w.inflight[setName][entry]; p != nil {
+		p.removed = true
+	}
+	delete(w.written[setName], entry)
+	w.mu.Unlock()
+
+	return w.Backend.RemoveElement(setName, entry)
+}
+
+func (w *Writer) Flush(setName string) error {
+	w.forgetSet(setName)
+	return w.Backend.Flush(setName)
+}
+
+func (w *Writer) DestroySet(name string) error {
+	w.forgetSet(name)
+	return w.Backend.DestroySet(name)
+}
+
+func (w *Writer) forgetSet(setName string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for entry := range w.pending[setName] {
+		w.cancel(setName, entry)
+	}
+	for _, p := range w.inflight[setName] {
+		p.removed = true
+	}
+	delete(w.written, setName)
+	delete(w.full, setName)
+}
+
+// cancel снимает ожидающее добавление: ожидающие его считают элемент
+// записанным, так как удаление пришло позже. Вызывается под w.mu.
+func (w *Writer) cancel(setName, entry string) {
+	p := w.pending[setName][entry]
+	if p == nil {
+		return
+	}
+	delete(w.pending[setName], entry)
+	w.queued--
+	close(p.done)
+}
+
+// flush забирает очередь целиком и записывает её по множествам.
+func (w *Writer) flush() {
+	w.mu.Lock()
+	batch := w.pending
+	w.pending = make(map[string]map[string]*Pending)
+	w.inflight = batch
+	w.queued = 0
+	w.mu.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+	started := w.now()
+	for setName, entries := range batch {
+		w.writeSet(setName, entries)
+	}
+	w.mu.Lock()
+	w.inflight = nil
+	w.stats.LastFlushMillis = w.now().Sub(started).Milliseconds()
+	w.mu.Unlock()
+}
+
+// writeSet записывает элементы одного множества пачками. Элементы, удалённые
+// до записи их пачки, пропускаются; удалённые во время записи удаляются
+// повторно, так как запись могла прийти в ядро уже после удаления.
+func (w *Writer) writeSet(setName string, pending map[string]*Pending) {
+	values := make([]string, 0, len(pending))
+	for value := range pending {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	for start := 0; start < len(values); start += writerBatchSize {
+		w.mu.Lock()
+		chunk := make([]Entry, 0, writerBatchSize)
+		for _, value := range values[start:min(start+writerBatchSize, len(values))] {
+			if p := pending[value]; p.removed {
+				close(p.done)
+			} else {
+				chunk = append(chunk, Entry{Value: value, Timeout: p.Timeout(), Comment: p.comment})
+			}
+		}
+		w.mu.Unlock()
+		if len(chunk) == 0 {
+			continue
+		}
+		errs := w.write(setName, chunk)
+
+		var removed []string
+		w.mu.Lock()
+		w.stats.Batches++
+		w.stats.LastBatchSize = len(chunk)
+		now := w.now()
+		for i, e := range chunk {
+			p := pending[e.Value]
+			if p.err = errs[i]; errors.Is(p.err, ErrSetFull) {
+				w.stats.Failed++
+				w.setFull(setName, e.Value, now)
+			} else if p.err != nil {
+				w.stats.Failed++
+				w.logger.Errorf("Failed to add %s to ipset %s: %v", e.Value, setName, p.err)
+			} else if p.removed {
+				removed = append(removed, e.Value)
+			} else {
+				w.stats.Written++
+				if e.Timeout > 0 {
+					if w.written[setName] == nil {
+						w.written[setName] = make(map[string]time.Time)
+					}
+					w.written[setName][e.Value] = now.Add(time.Duration(e.Timeout) * time.Second)
+				}
+			}
+			close(p.done)
+		}
+		w.mu.Unlock()
+
+		for _, value := range removed {
+			// Если удаление пришло в ядро позже записи, элемента уже нет.
+			if err := w.Backend.RemoveElement(setName, value); err != nil {
+				w.logger.Debugf("Failed to remove %s from ipset %s after a concurrent removal: %v", value, setName, err)
+			}
+		}
+	}
+}
+
+// setFull учитывает отказ по maxelem. Предупреждение пишется при первом
+// отказе после writerFullWindow, остальные — только в debug, иначе каждый
+// DNS-ответ давал бы строку в журнале. Вызывается под w.mu.
+func (w *Writer) setFull(setName, value string, now time.Time) {
+	w.stats.SetFull++
+	full := w.full[setName]
+	if full == nil {
+		full = &FullSet{Set: setName}
+		w.full[setName] = full
+	}
+	if full.LastAt.Before(now.Add(-writerFullWindow)) {
+		w.logger.Warnf("Set %s is full, new entries are not added: increase maxelem of the list", setName)
+	} else {
+		w.logger.Debugf("Set %s is full, %s is not added", setName, value)
+	}
+	full.Rejected++
+	full.LastAt = now
+}
+
+// write добавляет элементы одной пачкой, если бэкенд это умеет. Пачка с
+// ошибкой повторяется поэлементно, чтобы найти виновный элемент и записать
+// остальные.
+func (w *Writer) write(setName string, entries []Entry) []error {
+	errs := make([]error, len(entries))
+	batcher, ok := w.Backend.(BatchAdder)
+	if ok {
+		err := batcher.AddElements(setName, entries)
+		if err == nil {
+			return errs
+		}
+		w.logger.Debugf("Batch add of %d entries to ipset %s failed, retrying one by one: %v", len(entries), setName, err)
+	}
+	for i, e := range entries {
+		if ok {
+			// Пачка из одного элемента сохраняет комментарий.
+			errs[i] = batcher.AddElements(setName, entries[i:i+1])
+		} else {
+			errs[i] = w.Backend.AddElement(setName, e.Value, e.Timeout)
+		}
+	}
+	return errs
+}
+
+// pruneWritten забывает элементы с истёкшим таймаутом.
+func (w *Writer) pruneWritten() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := w.now()
+	for setName, entries := range w.written {
+		for entry, expires := range entries {
+			if !expires.After(now) {
+				delete(entries, entry)
+			}
+		}
+		if len(entries) == 0 {
+			delete(w.written, setName)
+		}
+	}
+}
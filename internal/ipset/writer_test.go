@@ -0,0 +1,269 @@
+package ipset
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// countingBatcher считает пачки, дошедшие до бэкенда.
+type countingBatcher struct {
+	*Memory
+	batches [][]Entry
+}
+
+func (c *countingBatcher) AddElements(setName string, entries []Entry) error {
+	c.batches = append(c.batches, append([]Entry(nil), entries...))
+	return c.Memory.AddElements(setName, entries)
+}
+
+func newTestWriter(t *testing.T, backend Backend) *Writer {
+	t.Helper()
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	return NewWriter(backend, logger)
+}
+
+func startTestWriter(t *testing.T, w *Writer) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	w.Start(ctx)
+}
+
+func TestWriterBatchesAndMerges(t *testing.T) {
+	backend := &countingBatcher{Memory: NewMemory()}
+	now := time.Unix(1700000000, 0)
+	backend.now = func() time.Time { return now }
+	if err := backend.CreateSet("vpn", SetOptions{Type: TypeHashIP}); err != nil {
+		t.Fatal(err)
+	}
+	w := newTestWriter(t, backend)
+
+	// До Start очередь только копится.
+	first := w.Add("vpn", Entry{Value: "192.0.2.1", Timeout: 300}, false)
+	w.Add("vpn", Entry{Value: "192.0.2.2", Timeout: 300}, false)
+	if merged := w.Add("vpn", Entry{Value: "192.0.2.1", Timeout: 900}, true); merged != first {
+		t.Fatal("Expected a repeated entry to join the pending add")
+	}
+	if stats := w.Stats(); stats.Queued != 2 || stats.Merged != 1 {
+		t.Fatalf("Unexpected stats before start: %+v", stats)
+	}
+
+	startTestWriter(t, w)
+	if err := first.Wait(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	w.Drain()
+
+	if len(backend.batches) != 1 || len(backend.batches[0]) != 2 {
+		t.Fatalf("Expected one batch of two entries, got %v", backend.batches)
+	}
+	entries, _ := backend.List("vpn")
+	if len(entries) != 2 || entries[0].Value != "192.0.2.1" || entries[0].Timeout != 900 {
+		t.Errorf("Expected the merged entry with the longer timeout, got %v", entries)
+	}
+	if stats := w.Stats(); stats.Queued != 0 || stats.Written != 2 || stats.Batches != 1 {
+		t.Errorf("Unexpected stats after write: %+v", stats)
+	}
+}
+
+func TestWriterSkipsFreshEntries(t *testing.T) {
+	// Часы читает и горутина Writer.
+	var clock atomic.Int64
+	clock.Store(1700000000)
+	advance := func(seconds int64) { clock.Add(seconds) }
+
+	backend := NewMemory()
+	backend.CreateSet("vpn", SetOptions{Type: TypeHashIP})
+	w := newTestWriter(t, backend)
+	w.now = func() time.Time { return time.Unix(clock.Load(), 0) }
+	startTestWriter(t, w)
+
+	if err := w.Add("vpn", Entry{Value: "192.0.2.1", Timeout: 1000}, true).Wait(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	advance(50)
+	w.Add("vpn", Entry{Value: "192.0.2.1", Timeout: 1000}, false)
+	// Пропущенный элемент сообщает таймаут, с которым он остался в ядре.
+	if skipped := w.Add("vpn", Entry{Value: "192.0.2.1", Timeout: 500}, false); skipped.Timeout() != 950 {
+		t.Errorf("Expected the remaining timeout 950 for a skipped entry, got %d", skipped.Timeout())
+	}
+	if stats := w.Stats(); stats.Skipped != 2 || stats.Enqueued != 1 {
+		t.Fatalf("Expected entries with a longer remaining timeout to be skipped, got %+v", stats)
+	}
+
+	// Осталось 850 из 1000 — меньше 90%, таймаут нужно продлить.
+	advance(100)
+	if err := w.Add("vpn", Entry{Value: "192.0.2.1", Timeout: 1000}, true).Wait(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if stats := w.Stats(); stats.Enqueued != 2 {
+		t.Errorf("Expected the entry to be rewritten, got %+v", stats)
+	}
+
+	// После удаления элемент снова записывается, хотя таймаут не истёк.
+	if err := w.RemoveElement("vpn", "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add("vpn", Entry{Value: "192.0.2.1", Timeout: 1000}, true).Wait(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := backend.List("vpn"); len(entries) != 1 {
+		t.Errorf("Expected the removed entry to be added again, got %v", entries)
+	}
+}
+
+func TestWriterRemoveCancelsPendingAdd(t *testing.T) {
+	backend := NewMemory()
+	backend.CreateSet("vpn", SetOptions{Type: TypeHashIP})
+	w := newTestWriter(t, backend)
+
+	pending := w.Add("vpn", Entry{Value: "192.0.2.1", Timeout: 300}, false)
+	w.Add("vpn", Entry{Value: "192.0.2.2", Timeout: 300}, false)
+	if err := w.RemoveElement("vpn", "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := pending.Wait(time.Second); err != nil {
+		t.Fatalf("Expected a cancelled add to complete, got %v", err)
+	}
+	if err := w.Flush("vpn"); err != nil {
+		t.Fatal(err)
+	}
+
+	startTestWriter(t, w)
+	w.Drain()
+	if entries, _ := backend.List("vpn"); len(entries) != 0 {
+		t.Errorf("Expected no entries after remove and flush, got %v", entries)
+	}
+	if stats := w.Stats(); stats.Queued != 0 {
+		t.Errorf("Expected an empty queue, got %+v", stats)
+	}
+}
+
+// blockingBatcher задерживает запись пачки, пока не закрыт release.
+type blockingBatcher struct {
+	*Memory
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBatcher) AddElements(setName string, entries []Entry) error {
+	close(b.started)
+	<-b.release
+	return b.Memory.AddElements(setName, entries)
+}
+
+func TestWriterRemoveDuringWrite(t *testing.T) {
+	backend := &blockingBatcher{Memory: NewMemory(), started: make(chan struct{}), release: make(chan struct{})}
+	backend.CreateSet("vpn", SetOptions{Type: TypeHashIP})
+	w := newTestWriter(t, backend)
+
+	pending := w.Add("vpn", Entry{Value: "192.0.2.1", Timeout: 300}, false)
+	startTestWriter(t, w)
+	<-backend.started
+
+	// Пачка уже ушла в запись: Drain должен дождаться её, а удаление —
+	// не дать записи вернуть элемент.
+	drained := make(chan struct{})
+	go func() {
+		w.Drain()
+		close(drained)
+	}()
+	if err := w.RemoveElement("vpn", "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-drained:
+		t.Fatal("Expected Drain to wait for the batch being written")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(backend.release)
+	<-drained
+	if err := pending.Wait(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := backend.List("vpn"); len(entries) != 0 {
+		t.Errorf("Expected the entry removed during the write to stay removed, got %v", entries)
+	}
+	if stats := w.Stats(); stats.Written != 0 {
+		t.Errorf("Expected the removed entry not to count as written, got %+v", stats)
+	}
+}
+
+func TestWriterRetriesFailedBatchOneByOne(t *testing.T) {
+	backend := &countingBatcher{Memory: NewMemory()}
+	backend.CreateSet("vpn", SetOptions{Type: TypeHashIP})
+	w := newTestWriter(t, backend)
+
+	bad := w.Add("vpn", Entry{Value: "192.0.2.0/24", Timeout: 300}, true) // hash:ip не принимает подсети
+	good := w.Add("vpn", Entry{Value: "198.51.100.1", Timeout: 300}, true)
+	startTestWriter(t, w)
+
+	if err := bad.Wait(time.Second); err == nil {
+		t.Error("Expected an error for the rejected entry")
+	}
+	if err := good.Wait(time.Second); err != nil {
+		t.Errorf("Expected the valid entry to be written, got %v", err)
+	}
+	if entries, _ := backend.List("vpn"); len(entries) != 1 || entries[0].Value != "198.51.100.1" {
+		t.Errorf("Unexpected set contents: %v", entries)
+	}
+	if stats := w.Stats(); stats.Written != 1 || stats.Failed != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestWriterDropsAsyncAddsWhenFull(t *testing.T) {
+	w := newTestWriter(t, NewMemory())
+	w.queued = writerQueueSize
+
+	dropped := w.Add("vpn", Entry{Value: "192.0.2.1", Timeout: 300}, false)
+	if err := dropped.Wait(time.Second); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+	if dropped.Timeout() != 0 {
+		t.Errorf("Expected no timeout for a dropped entry, got %d", dropped.Timeout())
+	}
+	w.Add("vpn", Entry{Value: "192.0.2.2", Timeout: 300}, true)
+	if stats := w.Stats(); stats.Dropped != 1 || stats.Enqueued != 1 {
+		t.Errorf("Expected synchronous adds to bypass the limit, got %+v", stats)
+	}
+}
+
+func TestWriterReportsFullSets(t *testing.T) {
+	backend := NewMemory()
+	backend.CreateSet("vpn", SetOptions{Type: TypeHashIP, MaxElem: 1, Comment: true})
+	w := newTestWriter(t, backend)
+	startTestWriter(t, w)
+
+	if err := w.Add("vpn", Entry{Value: "192.0.2.1", Timeout: 300, Comment: "a.example"}, true).Wait(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add("vpn", Entry{Value: "192.0.2.2", Timeout: 300}, true).Wait(time.Second); !errors.Is(err, ErrSetFull) {
+		t.Fatalf("Expected ErrSetFull, got %v", err)
+	}
+
+	stats := w.Stats()
+	if stats.SetFull != 1 || len(stats.FullSets) != 1 || stats.FullSets[0].Set != "vpn" || len(stats.Warnings) != 1 {
+		t.Errorf("Expected vpn to be reported as full, got %+v", stats)
+	}
+	if entries, _ := backend.List("vpn"); len(entries) != 1 || entries[0].Comment != "a.example" {
+		t.Errorf("Expected the comment to be written, got %v", entries)
+	}
+
+	// После очистки множество больше не считается полным.
+	if err := w.Flush("vpn"); err != nil {
+		t.Fatal(err)
+	}
+	if stats := w.Stats(); len(stats.FullSets) != 0 {
+		t.Errorf("Expected no full sets after flush, got %+v", stats.FullSets)
+	}
+}
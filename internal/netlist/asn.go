@@ -0,0 +1,145 @@
+package netlist
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ASNDatabase хранит подсети запрошенных автономных систем. Чтобы не держать
+// в памяти весь дамп (сотни тысяч диапазонов), при загрузке сохраняются только
+// ASN из конфига; при появлении новых ASN база перечитывается.
+type ASNDatabase struct {
+	prefixes map[uint32][]netip.Prefix
+}
+
+// Covers сообщает, загружались ли подсети для всех указанных ASN.
+func (db *ASNDatabase) Covers(asns []uint32) bool {
+	for _, asn := range asns {
+		if _, ok := db.prefixes[asn]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Prefixes возвращает подсети автономной системы.
+func (db *ASNDatabase) Prefixes(asn uint32) []netip.Prefix {
+	return db.prefixes[asn]
+}
+
+// ParseASNs разбирает поле net_lists[].asn: один или несколько номеров через
+// запятую или пробел, с префиксом "AS" или без.
+func ParseASNs(value string) ([]uint32, error) {
+	var asns []uint32
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' || r == ';' }) {
+		field = strings.TrimPrefix(strings.ToUpper(field), "AS")
+		n, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ASN %q", field)
+		}
+		asns = append(asns, uint32(n))
+	}
+	return asns, nil
+}
+
+// LoadASNDatabase читает базу из файла (.gz распаковывается) и оставляет
+// только подсети указанных ASN.
+func LoadASNDatabase(path string, asns []uint32) (*ASNDatabase, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open gzip %s: %w", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return parseASNDatabase(r, asns)
+}
+
+// parseASNDatabase понимает построчные форматы:
+//
+//	1.0.0.0	1.0.0.255	13335	US	CLOUDFLARENET   - IPtoASN (ip2asn-v4/v6/combined.tsv)
+//	1.0.0.0	24	13335                               - CAIDA RouteViews pfx2as
+//	1.0.0.0/24 13335                                - подсеть и ASN
+//
+// Номера MOAS-записей pfx2as ("13335_209242", "13335,209242") учитываются все.
+func parseASNDatabase(r io.Reader, asns []uint32) (*ASNDatabase, error) {
+	db := &ASNDatabase{prefixes: make(map[uint32][]netip.Prefix, len(asns))}
+	wanted := make(map[uint32]bool, len(asns))
+	for _, asn := range asns {
+		wanted[asn] = true
+		db.prefixes[asn] = nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		var prefixes []netip.Prefix
+		var asnField string
+		if p, err := netip.ParsePrefix(fields[0]); err == nil {
+			prefixes, asnField = []netip.Prefix{p}, fields[1]
+		} else if len(fields) >= 3 {
+			start, err := netip.ParseAddr(fields[0])
+			if err != nil {
+				continue
+			}
+			if end, err := netip.ParseAddr(fields[1]); err == nil {
+				asnField = fields[2]
+				if !anyWanted(asnField, wanted) {
+					continue
+				}
+				prefixes = RangeToPrefixes(start, end)
+			} else if bits, err := strconv.Atoi(fields[1]); err == nil {
+				prefixes, asnField = []netip.Prefix{netip.PrefixFrom(start, bits)}, fields[2]
+			}
+		}
+
+		for _, field := range strings.FieldsFunc(asnField, func(r rune) bool { return r == '_' || r == ',' }) {
+			n, err := strconv.ParseUint(field, 10, 32)
+			if err != nil || !wanted[uint32(n)] {
+				continue
+			}
+			for _, p := range prefixes {
+				if p.IsValid() {
+					db.prefixes[uint32(n)] = append(db.prefixes[uint32(n)], p.Masked())
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// anyWanted позволяет не разбивать на подсети диапазоны чужих ASN.
+func anyWanted(asnField string, wanted map[uint32]bool) bool {
+	for _, field := range strings.FieldsFunc(asnField, func(r rune) bool { return r == '_' || r == ',' }) {
+		if n, err := strconv.ParseUint(field, 10, 32); err == nil && wanted[uint32(n)] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package netlist
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseASNs(t *testing.T) {
+	got, err := ParseASNs("AS13335, 209242;as15169 32934")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{13335, 209242, 15169, 32934}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseASNs = %v, want %v", got, want)
+	}
+
+	if _, err := ParseASNs("AS13335,cloudflare"); err == nil {
+		t.Error("Expected an error for a non-numeric ASN")
+	}
+}
+
+func TestParseASNDatabaseFormats(t *testing.T) {
+	const data = `# comment
+1.0.0.0	1.0.0.255	13335	US	CLOUDFLARENET
+1.0.4.0	1.0.7.255	38803	AU	GTELECOM
+2606:4700::	2606:4700:ffff:ffff:ffff:ffff:ffff:ffff	13335	US	CLOUDFLARENET
+104.16.0.0	13	13335
+8.8.8.0	24	15169
+198.41.128.0	17	13335_209242
+162.158.0.0/15 13335
+172.64.0.0/13 209242,13335
+`
+	db, err := parseASNDatabase(strings.NewReader(data), []uint32{13335, 209242, 64500})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := prefixes("1.0.0.0/24", "2606:4700::/32", "104.16.0.0/13", "198.41.128.0/17", "162.158.0.0/15", "172.64.0.0/13")
+	if got := db.Prefixes(13335); !reflect.DeepEqual(got, want) {
+		t.Errorf("AS13335 prefixes = %v, want %v", got, want)
+	}
+	if got, want := db.Prefixes(209242), prefixes("198.41.128.0/17", "172.64.0.0/13"); !reflect.DeepEqual(got, want) {
+		t.Errorf("AS209242 prefixes = %v, want %v", got, want)
+	}
+	if got := db.Prefixes(15169); got != nil {
+		t.Errorf("Unrequested AS15169 must not be kept, got %v", got)
+	}
+
+	if !db.Covers([]uint32{13335, 64500}) {
+		t.Error("Requested ASN without prefixes must still be covered")
+	}
+	if db.Covers([]uint32{15169}) {
+		t.Error("Unrequested ASN must not be covered")
+	}
+}
+
+func TestLoadASNDatabaseGzip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip2asn-v4.tsv.gz")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(f)
+	if _, err := zw.Write([]byte("1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db, err := LoadASNDatabase(path, []uint32{13335})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := db.Prefixes(13335), prefixes("1.0.0.0/24"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Prefixes = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,133 @@
+package netlist
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// singBoxGeoIPType — database_type файла geoip.db из sing-box: вместо записи
+// MaxMind в нём хранится строка с кодом страны.
+const singBoxGeoIPType = "sing-geoip"
+
+// GeoIPDatabase хранит агрегированные подсети запрошенных стран. Как и для
+// ASN, из базы сохраняются только страны из конфига.
+type GeoIPDatabase struct {
+	prefixes map[string][]netip.Prefix
+}
+
+// Covers сообщает, загружались ли подсети для всех указанных стран.
+func (db *GeoIPDatabase) Covers(countries []string) bool {
+	for _, country := range countries {
+		if _, ok := db.prefixes[NormalizeCountry(country)]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Prefixes возвращает подсети страны.
+func (db *GeoIPDatabase) Prefixes(country string) []netip.Prefix {
+	return db.prefixes[NormalizeCountry(country)]
+}
+
+// NormalizeCountry приводит код страны к виду "RU".
+func NormalizeCountry(country string) string {
+	return strings.ToUpper(strings.TrimSpace(country))
+}
+
+// geoIPRecord — часть записи GeoIP2/GeoLite2 Country и DB-IP Country, нужная для
+// определения страны. registered_country используется, если country нет.
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// LoadGeoIPDatabase читает MMDB (MaxMind, DB-IP или sing-box geoip.db; .gz
+// распаковывается) и оставляет подсети указанных стран.
+func LoadGeoIPDatabase(path string, countries []string) (*GeoIPDatabase, error) {
+	reader, err := openMMDB(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	db := &GeoIPDatabase{prefixes: make(map[string][]netip.Prefix, len(countries))}
+	for _, country := range countries {
+		db.prefixes[NormalizeCountry(country)] = nil
+	}
+	singBox := reader.Metadata.DatabaseType == singBoxGeoIPType
+
+	// Многие подсети ссылаются на одну запись, поэтому код страны
+	// декодируется один раз на смещение.
+	codes := make(map[uintptr]string)
+	for result := range reader.Networks() {
+		if err := result.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		code, ok := codes[result.Offset()]
+		if !ok {
+			code, err = countryCode(result, singBox)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+			}
+			code = NormalizeCountry(code)
+			codes[result.Offset()] = code
+		}
+		if _, wanted := db.prefixes[code]; wanted {
+			db.prefixes[code] = append(db.prefixes[code], result.Prefix())
+		}
+	}
+
+	for code, prefixes := range db.prefixes {
+		db.prefixes[code] = Aggregate(prefixes)
+	}
+	return db, nil
+}
+
+func countryCode(result maxminddb.Result, singBox bool) (string, error) {
+	if singBox {
+		var code string
+		err := result.Decode(&code)
+		return code, err
+	}
+	var record geoIPRecord
+	if err := result.Decode(&record); err != nil {
+		return "", err
+	}
+	if record.Country.ISOCode != "" {
+		return record.Country.ISOCode, nil
+	}
+	return record.RegisteredCountry.ISOCode, nil
+}
+
+func openMMDB(path string) (*maxminddb.Reader, error) {
+	if !strings.HasSuffix(path, ".gz") {
+		return maxminddb.Open(path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open gzip %s: %w", path, err)
+	}
+	defer gz.Close()
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return maxminddb.OpenBytes(data)
+}
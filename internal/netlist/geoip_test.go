@@ -0,0 +1,173 @@
+package netlist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// mmdbNetwork — подсеть тестовой базы и закодированная запись для неё.
+type mmdbNetwork struct {
+	prefix string
+	data   []byte
+}
+
+type mmdbNode struct {
+	child [2]*mmdbNode
+	data  [2]int // индекс записи + 1, 0 — пусто
+}
+
+// writeTestMMDB собирает минимальную IPv6-базу MaxMind DB (record size 32):
+// дерево поиска, раздел данных и метаданные.
+func writeTestMMDB(t *testing.T, databaseType string, networks []mmdbNetwork) string {
+	t.Helper()
+
+	root := &mmdbNode{}
+	var records [][]byte
+	for _, n := range networks {
+		p := netip.MustParsePrefix(n.prefix)
+		bits := p.Bits()
+		var addr [16]byte
+		if p.Addr().Is4() {
+			// IPv4-поддерево IPv6-базы находится в ::/96.
+			v4 := p.Addr().As4()
+			copy(addr[12:], v4[:])
+			bits += 96
+		} else {
+			addr = p.Addr().As16()
+		}
+		node := root
+		for i := 0; i < bits-1; i++ {
+			b := addr[i/8] >> (7 - i%8) & 1
+			if node.child[b] == nil {
+				node.child[b] = &mmdbNode{}
+			}
+			node = node.child[b]
+		}
+		records = append(records, n.data)
+		node.data[addr[(bits-1)/8]>>(7-(bits-1)%8)&1] = len(records)
+	}
+
+	var nodes []*mmdbNode
+	index := map[*mmdbNode]int{}
+	for queue := []*mmdbNode{root}; len(queue) > 0; queue = queue[1:] {
+		index[queue[0]] = len(nodes)
+		nodes = append(nodes, queue[0])
+		for _, c := range queue[0].child {
+			if c != nil {
+				queue = append(queue, c)
+			}
+		}
+	}
+
+	var data bytes.Buffer
+	offsets := make([]int, len(records))
+	for i, r := range records {
+		offsets[i] = data.Len()
+		data.Write(r)
+	}
+
+	var out bytes.Buffer
+	nodeCount := uint32(len(nodes))
+	for _, n := range nodes {
+		for side := 0; side < 2; side++ {
+			value := nodeCount
+			if n.child[side] != nil {
+				value = uint32(index[n.child[side]])
+			} else if n.data[side] > 0 {
+				value = nodeCount + 16 + uint32(offsets[n.data[side]-1])
+			}
+			binary.Write(&out, binary.BigEndian, value)
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+	out.WriteString("\xab\xcd\xefMaxMind.com")
+	out.Write(mmdbMap(
+		"binary_format_major_version", mmdbUint16(2),
+		"binary_format_minor_version", mmdbUint16(0),
+		"build_epoch", mmdbUint64(1700000000),
+		"database_type", mmdbString(databaseType),
+		"description", mmdbMap(),
+		"ip_version", mmdbUint16(6),
+		"languages", mmdbArray(),
+		"node_count", mmdbUint32(nodeCount),
+		"record_size", mmdbUint16(32),
+	))
+
+	path := filepath.Join(t.TempDir(), "geoip.mmdb")
+	if err := os.WriteFile(path, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func mmdbString(s string) []byte { return append([]byte{0x40 | byte(len(s))}, s...) }
+
+func mmdbUint16(v uint16) []byte { return []byte{0xa2, byte(v >> 8), byte(v)} }
+
+func mmdbUint32(v uint32) []byte { return binary.BigEndian.AppendUint32([]byte{0xc4}, v) }
+
+func mmdbUint64(v uint64) []byte { return binary.BigEndian.AppendUint64([]byte{0x08, 0x02}, v) }
+
+func mmdbArray(items ...[]byte) []byte {
+	return bytes.Join(append([][]byte{{byte(len(items)), 0x04}}, items...), nil)
+}
+
+// mmdbMap принимает чередующиеся ключи (string) и закодированные значения ([]byte).
+func mmdbMap(kv ...any) []byte {
+	out := []byte{0xe0 | byte(len(kv)/2)}
+	for i := 0; i < len(kv); i += 2 {
+		out = append(out, mmdbString(kv[i].(string))...)
+		out = append(out, kv[i+1].([]byte)...)
+	}
+	return out
+}
+
+func maxMindCountry(code string) []byte {
+	return mmdbMap("country", mmdbMap("iso_code", mmdbString(code)))
+}
+
+func TestLoadGeoIPDatabaseMaxMind(t *testing.T) {
+	path := writeTestMMDB(t, "GeoLite2-Country", []mmdbNetwork{
+		{"1.0.0.0/24", maxMindCountry("AU")},
+		{"5.8.0.0/24", maxMindCountry("RU")},
+		{"5.8.1.0/24", maxMindCountry("RU")},
+		{"2a00:1fa0::/29", maxMindCountry("RU")},
+		{"8.8.8.0/24", maxMindCountry("US")},
+		{"77.88.0.0/18", mmdbMap("registered_country", mmdbMap("iso_code", mmdbString("RU")))},
+	})
+
+	db, err := LoadGeoIPDatabase(path, []string{"ru", "NL"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := db.Prefixes("RU"), prefixes("5.8.0.0/23", "77.88.0.0/18", "2a00:1fa0::/29"); !reflect.DeepEqual(got, want) {
+		t.Errorf("RU prefixes = %v, want %v", got, want)
+	}
+	if db.Prefixes("US") != nil {
+		t.Error("Unrequested country must not be kept")
+	}
+	if !db.Covers([]string{" nl ", "RU"}) {
+		t.Error("Requested countries must be covered, even without prefixes")
+	}
+}
+
+func TestLoadGeoIPDatabaseSingBox(t *testing.T) {
+	path := writeTestMMDB(t, singBoxGeoIPType, []mmdbNetwork{
+		{"5.8.0.0/24", mmdbString("ru")},
+		{"8.8.8.0/24", mmdbString("us")},
+	})
+
+	db, err := LoadGeoIPDatabase(path, []string{"RU"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := db.Prefixes("ru"), prefixes("5.8.0.0/24"); !reflect.DeepEqual(got, want) {
+		t.Errorf("RU prefixes = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,675 @@
+package netlist
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crazytypewriter/dns-box/internal/config"
+	"github.com/crazytypewriter/dns-box/internal/ipset"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultNetListTimeout = 7200
+
+// Manager поддерживает содержимое hash:net множеств net_lists: статические CIDR
+// из конфига, подсети ASN и стран из локальных баз и подсети из подписок по URL.
+// Подсети агрегируются, к живому множеству применяется разница — новые
+// добавляются, лишние удаляются, у оставшихся продлевается таймаут, пока он не
+// истёк. Крупные изменения (например, после обновления GeoIP-базы) применяются
+// атомарной заменой множества, если бэкенд её поддерживает (ipset.Replacer).
+// Так же поддерживаются static_ips ipset-списков.
+type Manager struct {
+	cfg        *config.Config
+	backend    ipset.Backend
+	logger     *log.Logger
+	httpClient *http.Client
+
+	mu      sync.Mutex // сериализует синхронизацию и перезагрузку баз
+	asnDB   *ASNDatabase
+	geoDB   *GeoIPDatabase
+	sources map[string]*sourceState // по sourceKey
+	now     func() time.Time
+
+	pendingMu sync.Mutex
+	pending   map[string]bool // net-списки, которые просили синхронизировать через SyncList
+	wake      chan struct{}
+}
+
+// sourceState — последний удачно загруженный список подписки.
+type sourceState struct {
+	prefixes  []netip.Prefix
+	fetchedAt time.Time // нулевое — ни одной удачной загрузки
+	failed    bool      // последняя попытка неудачна, повторить при следующей синхронизации
+}
+
+func NewManager(cfg *config.Config, backend ipset.Backend, logger *log.Logger) *Manager {
+	return &Manager{
+		cfg:        cfg,
+		backend:    backend,
+		logger:     logger,
+		httpClient: &http.Client{Timeout: 5 * time.Minute},
+		sources:    make(map[string]*sourceState),
+		now:        time.Now,
+		pending:    make(map[string]bool),
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// Start синхронно загружает локальные базы и заполняет множества, затем
+// в фоне скачивает подписки, обновляет базы по URL и продлевает таймауты
+// элементов. Подписки не загружаются синхронно: их домены может разрешать сам
+// dns-box, который ещё не запущен.
+func (m *Manager) Start(ctx context.Context) {
+	m.Sync()
+	go m.run(ctx)
+}
+
+func (m *Manager) run(ctx context.Context) {
+	asnDownloaded := m.downloadASNDatabase(ctx, false)
+	geoDownloaded := m.downloadGeoIPDatabase(ctx, false)
+	if asnDownloaded || geoDownloaded {
+		m.reloadDatabases(asnDownloaded, geoDownloaded)
+	}
+	m.refreshSources(ctx)
+	m.Sync()
+
+	asnTicker := time.NewTicker(refreshInterval(m.cfg.IPSet.ASNDatabase))
+	defer asnTicker.Stop()
+	geoTicker := time.NewTicker(refreshInterval(m.cfg.IPSet.GeoIPDatabase))
+	defer geoTicker.Stop()
+	syncTimer := time.NewTimer(m.syncInterval())
+	defer syncTimer.Stop()
+
+	for {
+		select {
+		case <-asnTicker.C:
+			if m.downloadASNDatabase(ctx, true) {
+				m.reloadDatabases(true, false)
+				m.Sync()
+			}
+		case <-geoTicker.C:
+			if m.downloadGeoIPDatabase(ctx, true) {
+				m.reloadDatabases(false, true)
+				m.Sync()
+			}
+		case <-syncTimer.C:
+			m.refreshSources(ctx)
+			m.Sync()
+			syncTimer.Reset(m.syncInterval())
+		case <-m.wake:
+			m.syncPending(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refreshInterval — период обновления базы по URL.
+func refreshInterval(db *config.PrefixDatabaseConfig) time.Duration {
+	if db == nil {
+		return refreshHours(0)
+	}
+	return refreshHours(db.RefreshHours)
+}
+
+// refreshHours переводит refresh_hours в интервал, по умолчанию сутки.
+func refreshHours(hours int) time.Duration {
+	if hours > 0 {
+		return time.Duration(hours) * time.Hour
+	}
+	return 24 * time.Hour
+}
+
+// syncInterval — половина минимального таймаута net-списков, чтобы элементы
+// продлевались раньше, чем ядро их удалит.
+func (m *Manager) syncInterval() time.Duration {
+	interval := time.Hour
+	for _, list := range m.cfg.GetNetLists() {
+		if half := time.Duration(listTimeout(list)) * time.Second / 2; half < interval {
+			interval = half
+		}
+	}
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	return interval
+}
+
+// Sync приводит все net-множества к желаемому состоянию.
+func (m *Manager) Sync() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	lists := m.cfg.GetNetLists()
+	if m.needsASNReload(lists) {
+		m.loadASNDatabaseLocked(lists)
+	}
+	if m.needsGeoIPReload(lists) {
+		m.loadGeoIPDatabaseLocked(lists)
+	}
+	for _, list := range lists {
+		if err := m.syncList(list); err != nil {
+			m.logger.Errorf("Net list %s sync failed: %v", list.Name, err)
+		}
+	}
+	for _, list := range m.cfg.GetIPSetLists() {
+		if len(list.StaticIPs) > 0 {
+			m.syncStaticIPs(list)
+		}
+	}
+}
+
+// SyncList планирует синхронизацию net-списка, созданного или изменённого
+// через API: его подписки скачиваются и множества заполняются, не дожидаясь
+// очередной периодической синхронизации. Не блокирует вызывающего.
+func (m *Manager) SyncList(name string) {
+	m.pendingMu.Lock()
+	m.pending[name] = true
+	m.pendingMu.Unlock()
+
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// syncPending синхронизирует списки, запрошенные через SyncList. Скачиваются
+// только подписки, которые пора обновить, то есть в первую очередь новые.
+func (m *Manager) syncPending(ctx context.Context) {
+	m.pendingMu.Lock()
+	names := m.pending
+	m.pending = make(map[string]bool)
+	m.pendingMu.Unlock()
+	if len(names) == 0 {
+		return
+	}
+
+	m.refreshSources(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lists := m.cfg.GetNetLists()
+	if m.needsASNReload(lists) {
+		m.loadASNDatabaseLocked(lists)
+	}
+	if m.needsGeoIPReload(lists) {
+		m.loadGeoIPDatabaseLocked(lists)
+	}
+	for _, list := range lists {
+		if !names[list.Name] {
+			continue
+		}
+		if err := m.syncList(list); err != nil {
+			m.logger.Errorf("Net list %s sync failed: %v", list.Name, err)
+		}
+	}
+}
+
+// staticIPRefreshBefore — за сколько секунд до истечения переписывается
+// статический адрес с таймаутом: записанный прежней версией с таймаутом
+// списка или в nftables, где бессрочных элементов нет.
+const staticIPRefreshBefore = 24 * 3600
+
+// syncStaticIPs добавляет static_ips ipset-списка в его множества без таймаута,
+// чтобы они не пропали, если синхронизация не удалась или запоздала. Остальное
+// содержимое этих множеств пишет DNS, поэтому лишнее не удаляется: адрес,
+// убранный из static_ips, удаляет API.
+func (m *Manager) syncStaticIPs(list config.IPSetListConfig) {
+	bySet := make(map[string][]string)
+	for _, value := range list.StaticIPs {
+		addr, err := netip.ParseAddr(value)
+		if err != nil {
+			m.logger.Warnf("Invalid static IP %s in list %s: %v", value, list.Name, err)
+			continue
+		}
+		addr = addr.Unmap()
+		setName := list.Name
+		if addr.Is6() {
+			if !list.EnableIPv6 {
+				m.logger.Warnf("Static IP %s in list %s is skipped: the list has no IPv6 set", value, list.Name)
+				continue
+			}
+			setName += "6"
+		}
+		bySet[setName] = append(bySet[setName], addr.String())
+	}
+
+	for setName, addrs := range bySet {
+		live, err := m.backend.List(setName)
+		if err != nil {
+			m.logger.Errorf("Failed to list set %s: %v", setName, err)
+			continue
+		}
+		remaining := make(map[string]uint32, len(live))
+		for _, e := range live {
+			remaining[normalizeEntry(e.Value)] = e.Timeout
+		}
+
+		added := 0
+		for _, addr := range addrs {
+			if left, ok := remaining[normalizeEntry(addr)]; ok && (left == 0 || left > staticIPRefreshBefore) {
+				continue
+			}
+			if err := m.backend.AddElement(setName, addr, 0); err != nil {
+				m.logger.Errorf("Error adding static IP %s to set %s: %v", addr, setName, err)
+				continue
+			}
+			added++
+		}
+		if added > 0 {
+			m.logger.Infof("Set %s: %d static IPs added or refreshed", setName, added)
+		}
+	}
+}
+
+func (m *Manager) syncList(list config.NetListConfig) error {
+	desired, complete := m.desiredPrefixes(list)
+
+	var v4, v6 []netip.Prefix
+	for _, p := range desired {
+		if p.Addr().Is4() {
+			v4 = append(v4, p)
+		} else {
+			v6 = append(v6, p)
+		}
+	}
+
+	opts := ipset.SetOptions{Type: ipset.TypeHashNet, Timeout: listTimeout(list)}
+	if err := m.apply(list.Name, opts, v4, complete); err != nil {
+		return err
+	}
+	if list.EnableIPv6 {
+		opts.IPv6 = true
+		return m.apply(list.Name+"6", opts, v6, complete)
+	}
+	return nil
+}
+
+// desiredPrefixes собирает статические CIDR, подсети ASN и стран. complete=false,
+// если часть подсетей неизвестна (база не загружена): тогда лишнее не удаляется,
+// чтобы временная ошибка базы не опустошила множество.
+func (m *Manager) desiredPrefixes(list config.NetListConfig) ([]netip.Prefix, bool) {
+	var prefixes []netip.Prefix
+	for _, cidr := range list.CIDRs {
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			m.logger.Warnf("Invalid CIDR %s in net list %s: %v", cidr, list.Name, err)
+			continue
+		}
+		prefixes = append(prefixes, p)
+	}
+
+	complete := true
+	if list.ASN != "" {
+		asns, err := ParseASNs(list.ASN)
+		switch {
+		case err != nil:
+			m.logger.Warnf("Net list %s: %v", list.Name, err)
+			complete = false
+		case m.asnDB == nil || !m.asnDB.Covers(asns):
+			m.logger.Warnf("Net list %s: ASN database is not loaded, ASN prefixes are not applied", list.Name)
+			complete = false
+		default:
+			for _, asn := range asns {
+				prefixes = append(prefixes, m.asnDB.Prefixes(asn)...)
+			}
+		}
+	}
+	if len(list.Countries) > 0 {
+		if m.geoDB == nil || !m.geoDB.Covers(list.Countries) {
+			m.logger.Warnf("Net list %s: GeoIP database is not loaded, country prefixes are not applied", list.Name)
+			complete = false
+		} else {
+			for _, country := range list.Countries {
+				prefixes = append(prefixes, m.geoDB.Prefixes(country)...)
+			}
+		}
+	}
+	for _, src := range list.Sources {
+		// Пока подписка ни разу не загрузилась, лишнее не удаляется: живое
+		// множество переживает перезапуск и служит последним удачным списком.
+		st := m.sources[sourceKey(src)]
+		if st == nil || st.fetchedAt.IsZero() {
+			complete = false
+			continue
+		}
+		prefixes = append(prefixes, st.prefixes...)
+	}
+	return Aggregate(prefixes), complete
+}
+
+// replaceRatio — доля изменившихся подсетей, начиная с которой множество
+// заменяется атомарно, а не поэлементно.
+const replaceRatio = 10
+
+// apply приводит множество к desired: недостающие подсети добавляются (и
+// продлеваются те, у которых осталось меньше половины таймаута), лишние
+// удаляются, только если desired полный. Если изменилось больше 1/replaceRatio
+// подсетей и бэкенд умеет атомарную замену, множество подменяется целиком.
+func (m *Manager) apply(setName string, opts ipset.SetOptions, desired []netip.Prefix, complete bool) error {
+	live, err := m.backend.List(setName)
+	if err != nil {
+		return fmt.Errorf("failed to list set %s: %w", setName, err)
+	}
+	liveTimeouts := make(map[string]uint32, len(live))
+	for _, e := range live {
+		liveTimeouts[normalizeEntry(e.Value)] = e.Timeout
+	}
+
+	want := make(map[string]bool, len(desired))
+	var missing, refresh, extra []string
+	for _, p := range desired {
+		key := p.String()
+		want[key] = true
+		remaining, ok := liveTimeouts[key]
+		switch {
+		case !ok:
+			missing = append(missing, key)
+		case remaining != 0 && remaining <= opts.Timeout/2:
+			refresh = append(refresh, key)
+		}
+	}
+	if complete {
+		for _, e := range live {
+			if !want[normalizeEntry(e.Value)] {
+				extra = append(extra, e.Value)
+			}
+		}
+	}
+
+	changes := len(missing) + len(extra)
+	if replacer, ok := m.backend.(ipset.Replacer); ok && complete && changes > 0 && changes*replaceRatio >= len(desired) {
+		entries := make([]string, len(desired))
+		for i, p := range desired {
+			entries[i] = p.String()
+		}
+		if err := replacer.ReplaceSet(setName, opts, entries); err != nil {
+			return fmt.Errorf("failed to replace set %s: %w", setName, err)
+		}
+		m.logger.Infof("Net set %s replaced: %d prefixes, %d added, %d removed", setName, len(desired), len(missing), len(extra))
+		return nil
+	}
+
+	added, removed := 0, 0
+	for _, key := range append(missing, refresh...) {
+		if err := m.backend.AddElement(setName, key, opts.Timeout); err != nil {
+			m.logger.Errorf("Error adding CIDR %s to net set %s: %v", key, setName, err)
+			continue
+		}
+		added++
+	}
+	for _, value := range extra {
+		if err := m.backend.RemoveElement(setName, value); err != nil {
+			m.logger.Errorf("Error removing CIDR %s from net set %s: %v", value, setName, err)
+			continue
+		}
+		removed++
+	}
+
+	if added > 0 || removed > 0 {
+		m.logger.Infof("Net set %s synced: %d prefixes, %d added or refreshed, %d removed", setName, len(desired), added, removed)
+	}
+	return nil
+}
+
+// normalizeEntry приводит элемент множества к виду netip.Prefix.String().
+func normalizeEntry(value string) string {
+	if p, err := netip.ParsePrefix(value); err == nil {
+		return p.Masked().String()
+	}
+	if a, err := netip.ParseAddr(value); err == nil {
+		return netip.PrefixFrom(a, a.BitLen()).String()
+	}
+	return value
+}
+
+func listTimeout(list config.NetListConfig) uint32 {
+	if list.Timeout == 0 {
+		return defaultNetListTimeout
+	}
+	return list.Timeout
+}
+
+// wantedASNs собирает ASN всех net-списков.
+func wantedASNs(lists []config.NetListConfig) []uint32 {
+	var all []uint32
+	for _, list := range lists {
+		if asns, err := ParseASNs(list.ASN); err == nil {
+			all = append(all, asns...)
+		}
+	}
+	return all
+}
+
+// wantedCountries собирает страны всех net-списков.
+func wantedCountries(lists []config.NetListConfig) []string {
+	var all []string
+	for _, list := range lists {
+		all = append(all, list.Countries...)
+	}
+	return all
+}
+
+// needsASNReload сообщает, что в конфиге появились ASN, которых нет в загруженной базе.
+// Вызывается под m.mu.
+func (m *Manager) needsASNReload(lists []config.NetListConfig) bool {
+	asns := wantedASNs(lists)
+	if len(asns) == 0 || m.cfg.IPSet.ASNDatabase == nil {
+		return false
+	}
+	return m.asnDB == nil || !m.asnDB.Covers(asns)
+}
+
+// needsGeoIPReload — то же для стран. Вызывается под m.mu.
+func (m *Manager) needsGeoIPReload(lists []config.NetListConfig) bool {
+	countries := wantedCountries(lists)
+	if len(countries) == 0 || m.cfg.IPSet.GeoIPDatabase == nil {
+		return false
+	}
+	return m.geoDB == nil || !m.geoDB.Covers(countries)
+}
+
+func (m *Manager) reloadDatabases(asn, geoip bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	lists := m.cfg.GetNetLists()
+	if asn {
+		m.loadASNDatabaseLocked(lists)
+	}
+	if geoip {
+		m.loadGeoIPDatabaseLocked(lists)
+	}
+}
+
+// loadASNDatabaseLocked читает базу ASN с диска. Вызывается под m.mu.
+func (m *Manager) loadASNDatabaseLocked(lists []config.NetListConfig) {
+	dbCfg := m.cfg.IPSet.ASNDatabase
+	asns := wantedASNs(lists)
+	if dbCfg == nil || len(asns) == 0 {
+		return
+	}
+
+	path := databasePath(dbCfg)
+	db, err := LoadASNDatabase(path, asns)
+	if err != nil {
+		m.logger.Warnf("Failed to load ASN database: %v", err)
+		return
+	}
+	m.asnDB = db
+	m.logger.Infof("ASN database loaded from %s for %d ASNs", path, len(asns))
+}
+
+// loadGeoIPDatabaseLocked читает GeoIP-базу с диска. Вызывается под m.mu.
+func (m *Manager) loadGeoIPDatabaseLocked(lists []config.NetListConfig) {
+	dbCfg := m.cfg.IPSet.GeoIPDatabase
+	countries := wantedCountries(lists)
+	if dbCfg == nil || len(countries) == 0 {
+		return
+	}
+
+	path := databasePath(dbCfg)
+	db, err := LoadGeoIPDatabase(path, countries)
+	if err != nil {
+		m.logger.Warnf("Failed to load GeoIP database: %v", err)
+		return
+	}
+	m.geoDB = db
+	m.logger.Infof("GeoIP database loaded from %s for %d countries", path, len(countries))
+}
+
+// databasePath возвращает путь к файлу базы; без path файл хранится во временном каталоге.
+func databasePath(dbCfg *config.PrefixDatabaseConfig) string {
+	if dbCfg.Path != "" {
+		return dbCfg.Path
+	}
+	return filepath.Join(os.TempDir(), "dns-box-"+filepath.Base(dbCfg.URL))
+}
+
+func (m *Manager) downloadASNDatabase(ctx context.Context, force bool) bool {
+	if len(wantedASNs(m.cfg.GetNetLists())) == 0 {
+		return false
+	}
+	return m.downloadDatabase(ctx, "ASN", m.cfg.IPSet.ASNDatabase, force)
+}
+
+func (m *Manager) downloadGeoIPDatabase(ctx context.Context, force bool) bool {
+	if len(wantedCountries(m.cfg.GetNetLists())) == 0 {
+		return false
+	}
+	return m.downloadDatabase(ctx, "GeoIP", m.cfg.IPSet.GeoIPDatabase, force)
+}
+
+// downloadDatabase скачивает базу по URL во временный файл и атомарно
+// заменяет им локальный. Без force существующий файл не перекачивается.
+// Возвращает true, если файл обновился.
+func (m *Manager) downloadDatabase(ctx context.Context, kind string, dbCfg *config.PrefixDatabaseConfig, force bool) bool {
+	if dbCfg == nil || dbCfg.URL == "" {
+		return false
+	}
+	path := databasePath(dbCfg)
+	if _, err := os.Stat(path); err == nil && !force {
+		return false
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dbCfg.URL, nil)
+	if err != nil {
+		m.logger.Warnf("%s database download failed: %v", kind, err)
+		return false
+	}
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		m.logger.Warnf("%s database download failed: %v", kind, err)
+		return false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		m.logger.Warnf("%s database download failed: unexpected status code %d", kind, resp.StatusCode)
+		return false
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".netlist-*")
+	if err != nil {
+		m.logger.Warnf("%s database download failed: %v", kind, err)
+		return false
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, resp.Body); err != nil {
+		tmp.Close()
+		m.logger.Warnf("%s database download failed: %v", kind, err)
+		return false
+	}
+	if err := tmp.Close(); err != nil {
+		m.logger.Warnf("%s database download failed: %v", kind, err)
+		return false
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		m.logger.Warnf("Failed to replace %s database %s: %v", kind, path, err)
+		return false
+	}
+	m.logger.Infof("%s database downloaded from %s", kind, dbCfg.URL)
+	return true
+}
+
+// maxSourceSize ограничивает размер ответа подписки.
+const maxSourceSize = 32 << 20
+
+// sourceKey идентифицирует подписку: один URL с разными фильтрами — разные подписки.
+func sourceKey(src config.NetListSource) string {
+	return strings.Join([]string{src.URL, src.Format, strings.Join(src.Services, ","), strings.Join(src.Regions, ",")}, "|")
+}
+
+// refreshSources скачивает подписки, у которых истёк период обновления или
+// не удалась прошлая попытка. При ошибке остаётся последний удачный список.
+func (m *Manager) refreshSources(ctx context.Context) {
+	m.mu.Lock()
+	now := m.now()
+	due := make(map[string]config.NetListSource)
+	active := make(map[string]bool)
+	for _, list := range m.cfg.GetNetLists() {
+		for _, src := range list.Sources {
+			key := sourceKey(src)
+			active[key] = true
+			st := m.sources[key]
+			if st == nil || st.failed || now.Sub(st.fetchedAt) >= refreshHours(src.RefreshHours) {
+				due[key] = src
+			}
+		}
+	}
+	for key := range m.sources {
+		if !active[key] {
+			delete(m.sources, key)
+		}
+	}
+	m.mu.Unlock()
+
+	for key, src := range due {
+		prefixes, err := m.fetchSource(ctx, src)
+
+		m.mu.Lock()
+		st := m.sources[key]
+		if st == nil {
+			st = &sourceState{}
+			m.sources[key] = st
+		}
+		if err != nil {
+			st.failed = true
+			if st.fetchedAt.IsZero() {
+				m.logger.Warnf("Net list source %s failed: %v", src.URL, err)
+			} else {
+				m.logger.Warnf("Net list source %s failed, keeping the list fetched at %s: %v", src.URL, st.fetchedAt.Format(time.RFC3339), err)
+			}
+		} else {
+			st.prefixes, st.fetchedAt, st.failed = prefixes, m.now(), false
+			m.logger.Debugf("Net list source %s fetched: %d prefixes", src.URL, len(prefixes))
+		}
+		m.mu.Unlock()
+	}
+}
+
+func (m *Manager) fetchSource(ctx context.Context, src config.NetListSource) ([]netip.Prefix, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSourceSize))
+	if err != nil {
+		return nil, err
+	}
+	return ParseSource(src, body)
+}
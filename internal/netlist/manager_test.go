@@ -0,0 +1,284 @@
+package netlist
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/crazytypewriter/dns-box/internal/config"
+	"github.com/crazytypewriter/dns-box/internal/ipset"
+	log "github.com/sirupsen/logrus"
+)
+
+// diffOnlyBackend скрывает ipset.Replacer, чтобы проверить применение разницы.
+type diffOnlyBackend struct {
+	ipset.Backend
+}
+
+func newTestManager(t *testing.T, cfg *config.Config, backend ipset.Backend) *Manager {
+	t.Helper()
+	for _, list := range cfg.IPSet.NetLists {
+		if err := backend.CreateSet(list.Name, ipset.SetOptions{Type: ipset.TypeHashNet, Timeout: list.Timeout}); err != nil {
+			t.Fatal(err)
+		}
+		if list.EnableIPv6 {
+			if err := backend.CreateSet(list.Name+"6", ipset.SetOptions{Type: ipset.TypeHashNet, IPv6: true, Timeout: list.Timeout}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	return NewManager(cfg, backend, logger)
+}
+
+func asnConfig(dbPath string, list config.NetListConfig) *config.Config {
+	return &config.Config{IPSet: config.IPSetConfig{
+		NetLists:    []config.NetListConfig{list},
+		ASNDatabase: &config.PrefixDatabaseConfig{Path: dbPath},
+	}}
+}
+
+func setValues(t *testing.T, backend ipset.Backend, name string) []string {
+	t.Helper()
+	entries, err := backend.List(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make([]string, 0, len(entries))
+	for _, e := range entries {
+		values = append(values, e.Value)
+	}
+	sort.Strings(values)
+	return values
+}
+
+func TestManagerSync(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		backend ipset.Backend
+	}{
+		{"replace", ipset.NewMemory()},
+		{"diff", diffOnlyBackend{ipset.NewMemory()}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "pfx2as.txt")
+			if err := os.WriteFile(dbPath, []byte("1.0.0.0\t24\t13335\n1.0.1.0\t24\t13335\n8.8.8.0\t24\t15169\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			backend := tc.backend
+			m := newTestManager(t, asnConfig(dbPath, config.NetListConfig{
+				Name:    "cf",
+				Timeout: 3600,
+				ASN:     "AS13335",
+				CIDRs:   []string{"10.0.0.0/24", "10.0.1.0/24"},
+			}), backend)
+
+			// Чужой элемент должен быть удалён при синхронизации.
+			if err := backend.AddElement("cf", "192.0.2.0/24", 3600); err != nil {
+				t.Fatal(err)
+			}
+			m.Sync()
+			if got, want := setValues(t, backend, "cf"), []string{"1.0.0.0/23", "10.0.0.0/23"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("After first sync set = %v, want %v", got, want)
+			}
+
+			// Обновлённая база: подсеть исчезла, появилась новая.
+			if err := os.WriteFile(dbPath, []byte("1.0.0.0\t24\t13335\n104.16.0.0\t13\t13335\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			m.reloadDatabases(true, false)
+			m.Sync()
+			if got, want := setValues(t, backend, "cf"), []string{"1.0.0.0/24", "10.0.0.0/23", "104.16.0.0/13"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("After refresh set = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestManagerKeepsEntriesWithoutDatabase(t *testing.T) {
+	backend := ipset.NewMemory()
+	m := newTestManager(t, asnConfig(filepath.Join(t.TempDir(), "missing.tsv"), config.NetListConfig{
+		Name:    "cf",
+		Timeout: 3600,
+		ASN:     "13335",
+		CIDRs:   []string{"10.0.0.0/24"},
+	}), backend)
+	if err := backend.AddElement("cf", "1.0.0.0/24", 3600); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Sync()
+	if got, want := setValues(t, backend, "cf"), []string{"1.0.0.0/24", "10.0.0.0/24"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Set = %v, want %v: entries must not be removed while the ASN database is unavailable", got, want)
+	}
+}
+
+func TestManagerSyncsStaticIPs(t *testing.T) {
+	backend := ipset.NewMemory()
+	list := config.IPSetListConfig{Name: "vpn", EnableIPv6: true, Timeout: 3600, StaticIPs: []string{"192.0.2.1", "192.0.2.2", "2001:db8::1", "bogus"}}
+	for _, set := range ipset.DesiredSets([]config.IPSetListConfig{list}, nil) {
+		if err := backend.CreateSet(set.Name, set.Options); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 192.0.2.2 записан прежней версией с таймаутом и скоро истечёт,
+	// 198.51.100.1 записан из DNS-ответа.
+	for value, timeout := range map[string]uint32{"192.0.2.2": 60, "198.51.100.1": 300} {
+		if err := backend.AddElement("vpn", value, timeout); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := newTestManager(t, &config.Config{IPSet: config.IPSetConfig{Lists: []config.IPSetListConfig{list}}}, backend)
+
+	m.Sync()
+	entries, err := backend.List("vpn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeouts := make(map[string]uint32)
+	for _, e := range entries {
+		timeouts[e.Value] = e.Timeout
+	}
+	// Статические адреса записываются без таймаута.
+	want := map[string]uint32{"192.0.2.1": 0, "192.0.2.2": 0, "198.51.100.1": 300}
+	if !reflect.DeepEqual(timeouts, want) {
+		t.Errorf("Set vpn = %v, want %v", timeouts, want)
+	}
+	if got := setValues(t, backend, "vpn6"); !reflect.DeepEqual(got, []string{"2001:db8::1"}) {
+		t.Errorf("Set vpn6 = %v, want the static IPv6 address", got)
+	}
+	if interval := m.syncInterval(); interval != time.Hour {
+		t.Errorf("Expected static IPs not to shorten the sync interval, got %v", interval)
+	}
+}
+
+func TestManagerSourcesKeepLastGood(t *testing.T) {
+	var body string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	backend := ipset.NewMemory()
+	cfg := &config.Config{IPSet: config.IPSetConfig{NetLists: []config.NetListConfig{{
+		Name:    "tg",
+		Timeout: 3600,
+		Sources: []config.NetListSource{{URL: server.URL, RefreshHours: 1}},
+	}}}}
+	m := newTestManager(t, cfg, backend)
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	// До первой загрузки подписки живое множество не трогается.
+	if err := backend.AddElement("tg", "91.108.4.0/22", 3600); err != nil {
+		t.Fatal(err)
+	}
+	m.Sync()
+	if got, want := setValues(t, backend, "tg"), []string{"91.108.4.0/22"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Before the first fetch set = %v, want %v", got, want)
+	}
+
+	body = "91.108.56.0/22\n149.154.160.0/20\n"
+	m.refreshSources(context.Background())
+	m.Sync()
+	want := []string{"149.154.160.0/20", "91.108.56.0/22"}
+	if got := setValues(t, backend, "tg"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("After fetch set = %v, want %v", got, want)
+	}
+
+	// Ответ-заглушка и ошибка сервера не опустошают множество.
+	now = now.Add(2 * time.Hour)
+	body = "<html>maintenance</html>"
+	m.refreshSources(context.Background())
+	m.Sync()
+	status = http.StatusBadGateway
+	m.refreshSources(context.Background())
+	m.Sync()
+	if got := setValues(t, backend, "tg"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("After failed fetches set = %v, want last good %v", got, want)
+	}
+
+	// Неудачная попытка повторяется при следующей синхронизации.
+	status, body = http.StatusOK, "149.154.160.0/20\n"
+	m.refreshSources(context.Background())
+	m.Sync()
+	if got, want := setValues(t, backend, "tg"), []string{"149.154.160.0/20"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("After recovery set = %v, want %v", got, want)
+	}
+}
+
+func TestManagerSyncList(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "91.108.56.0/22\n")
+	}))
+	defer server.Close()
+
+	backend := ipset.NewMemory()
+	cfg := &config.Config{IPSet: config.IPSetConfig{NetLists: []config.NetListConfig{
+		{Name: "tg", Timeout: 3600, Sources: []config.NetListSource{{URL: server.URL}}},
+		{Name: "corp", Timeout: 3600, CIDRs: []string{"10.0.0.0/8"}},
+	}}}
+	m := newTestManager(t, cfg, backend)
+
+	// Список, созданный через API, заполняется сразу, остальные ждут
+	// периодической синхронизации.
+	m.SyncList("tg")
+	m.SyncList("tg")
+	<-m.wake
+	m.syncPending(context.Background())
+	if got, want := setValues(t, backend, "tg"), []string{"91.108.56.0/22"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tg = %v, want %v", got, want)
+	}
+	if got := setValues(t, backend, "corp"); len(got) != 0 {
+		t.Errorf("corp = %v, want it untouched", got)
+	}
+	if len(m.pending) != 0 {
+		t.Errorf("pending = %v after sync", m.pending)
+	}
+}
+
+// countingReplacer считает атомарные замены.
+type countingReplacer struct {
+	*ipset.Memory
+	replaced int
+}
+
+func (c *countingReplacer) ReplaceSet(name string, opts ipset.SetOptions, entries []string) error {
+	c.replaced++
+	return c.Memory.ReplaceSet(name, opts, entries)
+}
+
+func TestManagerReplacesOnlyLargeChanges(t *testing.T) {
+	cidrs := make([]string, 0, 40)
+	for i := 0; i < 40; i++ {
+		cidrs = append(cidrs, fmt.Sprintf("10.%d.0.0/16", i*2))
+	}
+	backend := &countingReplacer{Memory: ipset.NewMemory()}
+	cfg := &config.Config{IPSet: config.IPSetConfig{NetLists: []config.NetListConfig{{Name: "static", Timeout: 3600, CIDRs: cidrs}}}}
+	m := newTestManager(t, cfg, backend)
+
+	m.Sync()
+	if backend.replaced != 1 || len(setValues(t, backend, "static")) != 40 {
+		t.Fatalf("Initial fill must be one atomic replace, got %d replaces", backend.replaced)
+	}
+
+	cfg.IPSet.NetLists[0].CIDRs = append(cidrs[1:], "192.0.2.0/24")
+	m.Sync()
+	if backend.replaced != 1 {
+		t.Errorf("Small change must be applied element by element, got %d replaces", backend.replaced)
+	}
+	if got := setValues(t, backend, "static"); len(got) != 40 || got[0] != "10.10.0.0/16" || got[39] != "192.0.2.0/24" {
+		t.Errorf("Unexpected set after a small change: %v", got)
+	}
+}
@@ -0,0 +1,79 @@
+package netlist
+
+import (
+	"net/netip"
+	"sort"
+)
+
+// Aggregate убирает дубликаты и вложенные подсети и объединяет соседние
+// подсети одной длины в общую родительскую. Результат отсортирован.
+func Aggregate(prefixes []netip.Prefix) []netip.Prefix {
+	sorted := make([]netip.Prefix, 0, len(prefixes))
+	for _, p := range prefixes {
+		if p.IsValid() {
+			sorted = append(sorted, p.Masked())
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if c := sorted[i].Addr().Compare(sorted[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return sorted[i].Bits() < sorted[j].Bits()
+	})
+
+	var out []netip.Prefix
+	for _, p := range sorted {
+		if n := len(out); n > 0 && out[n-1].Overlaps(p) {
+			continue // p лежит внутри предыдущей, более короткой подсети
+		}
+		out = append(out, p)
+		for len(out) >= 2 {
+			a, b := out[len(out)-2], out[len(out)-1]
+			if a.Bits() != b.Bits() || a.Bits() == 0 || a.Addr().Is4() != b.Addr().Is4() {
+				break
+			}
+			parent := netip.PrefixFrom(a.Addr(), a.Bits()-1).Masked()
+			if parent.Addr() != a.Addr() || !parent.Contains(b.Addr()) {
+				break
+			}
+			out = append(out[:len(out)-2], parent)
+		}
+	}
+	return out
+}
+
+// RangeToPrefixes разбивает диапазон адресов [start, end] на минимальный набор подсетей.
+func RangeToPrefixes(start, end netip.Addr) []netip.Prefix {
+	if !start.IsValid() || !end.IsValid() || start.Is4() != end.Is4() || end.Less(start) {
+		return nil
+	}
+
+	var out []netip.Prefix
+	for {
+		bits := 0
+		for ; bits < start.BitLen(); bits++ {
+			p := netip.PrefixFrom(start, bits)
+			if p.Masked().Addr() == start && !end.Less(lastAddr(p)) {
+				break
+			}
+		}
+		p := netip.PrefixFrom(start, bits)
+		out = append(out, p)
+
+		last := lastAddr(p)
+		if last == end {
+			return out
+		}
+		start = last.Next()
+	}
+}
+
+// lastAddr возвращает последний адрес подсети.
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
@@ -0,0 +1,56 @@
+package netlist
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func prefixes(values ...string) []netip.Prefix {
+	out := make([]netip.Prefix, 0, len(values))
+	for _, v := range values {
+		out = append(out, netip.MustParsePrefix(v))
+	}
+	return out
+}
+
+func TestAggregate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   []netip.Prefix
+		want []netip.Prefix
+	}{
+		{"empty", nil, nil},
+		{"duplicates", prefixes("10.0.0.0/24", "10.0.0.0/24"), prefixes("10.0.0.0/24")},
+		{"contained", prefixes("10.0.0.0/16", "10.0.5.0/24", "10.0.0.1/32"), prefixes("10.0.0.0/16")},
+		{"siblings", prefixes("10.0.1.0/24", "10.0.0.0/24"), prefixes("10.0.0.0/23")},
+		{"cascade", prefixes("10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/23"), prefixes("10.0.0.0/22")},
+		{"not aligned", prefixes("10.0.1.0/24", "10.0.2.0/24"), prefixes("10.0.1.0/24", "10.0.2.0/24")},
+		{"unmasked", prefixes("192.0.2.77/24"), prefixes("192.0.2.0/24")},
+		{"mixed families", prefixes("2001:db8:1::/48", "192.0.2.0/24", "2001:db8::/48"), prefixes("192.0.2.0/24", "2001:db8::/47")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Aggregate(tc.in); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Aggregate(%v) = %v, want %v", tc.in, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRangeToPrefixes(t *testing.T) {
+	for _, tc := range []struct {
+		start, end string
+		want       []netip.Prefix
+	}{
+		{"1.0.0.0", "1.0.0.255", prefixes("1.0.0.0/24")},
+		{"1.0.0.1", "1.0.0.1", prefixes("1.0.0.1/32")},
+		{"1.0.0.1", "1.0.0.6", prefixes("1.0.0.1/32", "1.0.0.2/31", "1.0.0.4/31", "1.0.0.6/32")},
+		{"0.0.0.0", "255.255.255.255", prefixes("0.0.0.0/0")},
+		{"2001:db8::", "2001:db8::ffff", prefixes("2001:db8::/112")},
+	} {
+		got := RangeToPrefixes(netip.MustParseAddr(tc.start), netip.MustParseAddr(tc.end))
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("RangeToPrefixes(%s, %s) = %v, want %v", tc.start, tc.end, got, tc.want)
+		}
+	}
+}
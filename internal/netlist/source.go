@@ -0,0 +1,178 @@
+package netlist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/crazytypewriter/dns-box/internal/config"
+)
+
+// Форматы net_lists[].sources[].format.
+const (
+	FormatText       = "text"       // CIDR или IP в строке: Cloudflare ips-v4/ips-v6, Telegram cidr.txt
+	FormatAWS        = "aws"        // https://ip-ranges.amazonaws.com/ip-ranges.json
+	FormatGCP        = "gcp"        // https://www.gstatic.com/ipranges/cloud.json, goog.json
+	FormatCloudflare = "cloudflare" // https://api.cloudflare.com/client/v4/ips
+)
+
+var errNoPrefixes = errors.New("no prefixes found")
+
+// ParseSource разбирает ответ источника. Фильтры services и regions не
+// учитывают регистр; пустой фильтр пропускает всё. Ответ без единой подсети
+// считается ошибкой: скорее всего, вместо списка пришла страница ошибки.
+func ParseSource(source config.NetListSource, body []byte) ([]netip.Prefix, error) {
+	switch source.Format {
+	case "", FormatText:
+		return parseTextSource(body)
+	case FormatAWS:
+		return parseAWSSource(body, source.Services, source.Regions)
+	case FormatGCP:
+		return parseGCPSource(body, source.Services, source.Regions)
+	case FormatCloudflare:
+		return parseCloudflareSource(body)
+	default:
+		return nil, fmt.Errorf("unknown source format %q", source.Format)
+	}
+}
+
+// parseTextSource читает по подсети или адресу в строке; комментарии (# и ;)
+// и нераспознанные строки пропускаются.
+func parseTextSource(body []byte) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if p, err := netip.ParsePrefix(fields[0]); err == nil {
+			prefixes = append(prefixes, p.Masked())
+		} else if a, err := netip.ParseAddr(fields[0]); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(a, a.BitLen()))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(prefixes) == 0 {
+		return nil, errNoPrefixes
+	}
+	return prefixes, nil
+}
+
+func parseAWSSource(body []byte, services, regions []string) ([]netip.Prefix, error) {
+	var ranges struct {
+		Prefixes []struct {
+			Prefix  string `json:"ip_prefix"`
+			Region  string `json:"region"`
+			Service string `json:"service"`
+		} `json:"prefixes"`
+		IPv6Prefixes []struct {
+			Prefix  string `json:"ipv6_prefix"`
+			Region  string `json:"region"`
+			Service string `json:"service"`
+		} `json:"ipv6_prefixes"`
+	}
+	if err := json.Unmarshal(body, &ranges); err != nil {
+		return nil, fmt.Errorf("invalid AWS ip-ranges: %w", err)
+	}
+	if len(ranges.Prefixes)+len(ranges.IPv6Prefixes) == 0 {
+		return nil, errNoPrefixes
+	}
+
+	var prefixes []netip.Prefix
+	add := func(prefix, service, region string) {
+		if !matchFilter(services, service) || !matchFilter(regions, region) {
+			return
+		}
+		if p, err := netip.ParsePrefix(prefix); err == nil {
+			prefixes = append(prefixes, p.Masked())
+		}
+	}
+	for _, p := range ranges.Prefixes {
+		add(p.Prefix, p.Service, p.Region)
+	}
+	for _, p := range ranges.IPv6Prefixes {
+		add(p.Prefix, p.Service, p.Region)
+	}
+	return prefixes, nil
+}
+
+// parseGCPSource — фильтр regions сравнивается с полем scope ("europe-west1").
+func parseGCPSource(body []byte, services, regions []string) ([]netip.Prefix, error) {
+	var ranges struct {
+		Prefixes []struct {
+			IPv4Prefix string `json:"ipv4Prefix"`
+			IPv6Prefix string `json:"ipv6Prefix"`
+			Service    string `json:"service"`
+			Scope      string `json:"scope"`
+		} `json:"prefixes"`
+	}
+	if err := json.Unmarshal(body, &ranges); err != nil {
+		return nil, fmt.Errorf("invalid GCP ip ranges: %w", err)
+	}
+	if len(ranges.Prefixes) == 0 {
+		return nil, errNoPrefixes
+	}
+
+	var prefixes []netip.Prefix
+	for _, r := range ranges.Prefixes {
+		if !matchFilter(services, r.Service) || !matchFilter(regions, r.Scope) {
+			continue
+		}
+		for _, prefix := range []string{r.IPv4Prefix, r.IPv6Prefix} {
+			if p, err := netip.ParsePrefix(prefix); err == nil {
+				prefixes = append(prefixes, p.Masked())
+			}
+		}
+	}
+	return prefixes, nil
+}
+
+func parseCloudflareSource(body []byte) ([]netip.Prefix, error) {
+	var resp struct {
+		Success bool `json:"success"`
+		Result  struct {
+			IPv4 []string `json:"ipv4_cidrs"`
+			IPv6 []string `json:"ipv6_cidrs"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("invalid Cloudflare ips response: %w", err)
+	}
+	if !resp.Success {
+		return nil, errors.New("cloudflare API returned success=false")
+	}
+
+	var prefixes []netip.Prefix
+	for _, cidr := range append(resp.Result.IPv4, resp.Result.IPv6...) {
+		if p, err := netip.ParsePrefix(cidr); err == nil {
+			prefixes = append(prefixes, p.Masked())
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil, errNoPrefixes
+	}
+	return prefixes, nil
+}
+
+func matchFilter(filter []string, value string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, f := range filter {
+		if strings.EqualFold(f, value) {
+			return true
+		}
+	}
+	return false
+}
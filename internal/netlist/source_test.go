@@ -0,0 +1,71 @@
+package netlist
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/crazytypewriter/dns-box/internal/config"
+)
+
+func TestParseSource(t *testing.T) {
+	const aws = `{
+  "syncToken": "1700000000",
+  "prefixes": [
+    {"ip_prefix": "3.5.140.0/22", "region": "ap-northeast-2", "service": "AMAZON"},
+    {"ip_prefix": "13.34.37.64/27", "region": "ap-southeast-4", "service": "CLOUDFRONT"},
+    {"ip_prefix": "52.94.76.0/22", "region": "eu-central-1", "service": "CLOUDFRONT"}
+  ],
+  "ipv6_prefixes": [
+    {"ipv6_prefix": "2600:9000:3000::/36", "region": "GLOBAL", "service": "CLOUDFRONT"}
+  ]
+}`
+	const gcp = `{
+  "prefixes": [
+    {"ipv4Prefix": "34.1.208.0/20", "service": "Google Cloud", "scope": "africa-south1"},
+    {"ipv6Prefix": "2600:1900:8000::/44", "service": "Google Cloud", "scope": "europe-west1"},
+    {"ipv4Prefix": "34.22.112.0/20", "service": "Google Cloud", "scope": "europe-west1"}
+  ]
+}`
+	const cloudflare = `{"result": {"ipv4_cidrs": ["173.245.48.0/20"], "ipv6_cidrs": ["2400:cb00::/32"], "etag": "x"}, "success": true, "errors": [], "messages": []}`
+
+	for _, tc := range []struct {
+		name   string
+		source config.NetListSource
+		body   string
+		want   []string
+	}{
+		{"text", config.NetListSource{}, "# Telegram\n91.108.56.0/22\n149.154.167.99 ; single address\n\n2001:b28:f23d::/48\nnot a cidr\n", []string{"91.108.56.0/22", "149.154.167.99/32", "2001:b28:f23d::/48"}},
+		{"aws service", config.NetListSource{Format: FormatAWS, Services: []string{"cloudfront"}}, aws, []string{"13.34.37.64/27", "52.94.76.0/22", "2600:9000:3000::/36"}},
+		{"aws service and region", config.NetListSource{Format: FormatAWS, Services: []string{"CLOUDFRONT"}, Regions: []string{"eu-central-1"}}, aws, []string{"52.94.76.0/22"}},
+		{"gcp scope", config.NetListSource{Format: FormatGCP, Regions: []string{"europe-west1"}}, gcp, []string{"2600:1900:8000::/44", "34.22.112.0/20"}},
+		{"cloudflare", config.NetListSource{Format: FormatCloudflare}, cloudflare, []string{"173.245.48.0/20", "2400:cb00::/32"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseSource(tc.source, []byte(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := prefixes(tc.want...); !reflect.DeepEqual(got, want) {
+				t.Errorf("ParseSource = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseSourceRejectsGarbage(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		source config.NetListSource
+		body   string
+	}{
+		{"html page", config.NetListSource{}, "<html><body>502 Bad Gateway</body></html>"},
+		{"empty aws", config.NetListSource{Format: FormatAWS}, `{"prefixes": []}`},
+		{"invalid json", config.NetListSource{Format: FormatGCP}, `{"prefixes": [`},
+		{"cloudflare failure", config.NetListSource{Format: FormatCloudflare}, `{"success": false, "result": null}`},
+		{"unknown format", config.NetListSource{Format: "azure"}, `{}`},
+	} {
+		if _, err := ParseSource(tc.source, []byte(tc.body)); err == nil {
+			t.Errorf("%s: expected an error", tc.name)
+		}
+	}
+}
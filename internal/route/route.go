@@ -0,0 +1,189 @@
+// Package route ставит policy routing для списков с параметром route:
+// правила mangle помечают fwmark пакеты к адресам множеств, ip rule
+// отправляет помеченные пакеты в отдельную таблицу, а маршрут по умолчанию в
+// ней ведёт в интерфейс или через шлюз списка.
+package route
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/crazytypewriter/dns-box/internal/config"
+	"github.com/crazytypewriter/dns-box/internal/ipset"
+	log "github.com/sirupsen/logrus"
+)
+
+// Зарезервированные таблицы маршрутизации: default, main и local.
+const (
+	tableDefault = 253
+	tableMain    = 254
+	tableLocal   = 255
+)
+
+// Policy — маршрутизация одного списка.
+type Policy struct {
+	List      string
+	Sets      []ipset.MarkRule // множества списка и их fwmark
+	Mark      uint32
+	Table     int
+	Priority  int
+	Interface string
+	Gateway   netip.Addr // невалидный, если шлюз не задан
+}
+
+// hasIPv6 сообщает, есть ли у списка IPv6-множество.
+func (p Policy) hasIPv6() bool {
+	for _, set := range p.Sets {
+		if set.IPv6 {
+			return true
+		}
+	}
+	return false
+}
+
+// Policies собирает и проверяет параметры route списков и net-списков.
+func Policies(cfg *config.Config) ([]Policy, error) {
+	var policies []Policy
+	tables := make(map[int]Policy)
+	marks := make(map[uint32]int)
+
+	add := func(name string, ipv6 bool, route *config.RouteConfig) error {
+		if route == nil {
+			return nil
+		}
+		p, err := newPolicy(name, ipv6, route)
+		if err != nil {
+			return fmt.Errorf("list %s: %w", name, err)
+		}
+		if table, ok := marks[p.Mark]; ok && table != p.Table {
+			return fmt.Errorf("list %s: fwmark %#x is already routed to table %d", name, p.Mark, table)
+		}
+		if other, ok := tables[p.Table]; ok && (other.Interface != p.Interface || other.Gateway != p.Gateway) {
+			return fmt.Errorf("list %s: table %d is already used by list %s with another interface or gateway", name, p.Table, other.List)
+		}
+		marks[p.Mark] = p.Table
+		tables[p.Table] = p
+		policies = append(policies, p)
+		return nil
+	}
+
+	for _, list := range cfg.GetIPSetLists() {
+		if err := add(list.Name, list.EnableIPv6, list.Route); err != nil {
+			return nil, err
+		}
+	}
+	for _, list := range cfg.GetNetLists() {
+		if err := add(list.Name, list.EnableIPv6, list.Route); err != nil {
+			return nil, err
+		}
+	}
+	return policies, nil
+}
+
+func newPolicy(name string, ipv6 bool, route *config.RouteConfig) (Policy, error) {
+	p := Policy{
+		List:      name,
+		Mark:      route.FWMark,
+		Table:     route.Table,
+		Priority:  route.Priority,
+		Interface: route.Interface,
+	}
+	switch {
+	case route.FWMark == 0:
+		return Policy{}, fmt.Errorf("route.fwmark must not be 0")
+	case route.Table <= 0 || route.Table == tableDefault || route.Table == tableMain || route.Table == tableLocal:
+		return Policy{}, fmt.Errorf("route.table must be a positive number other than 253, 254 and 255")
+	case route.Interface == "" && route.Gateway == "":
+		return Policy{}, fmt.Errorf("route needs an interface or a gateway")
+	}
+	if route.Gateway != "" {
+		gw, err := netip.ParseAddr(route.Gateway)
+		if err != nil {
+			return Policy{}, fmt.Errorf("invalid route.gateway %q", route.Gateway)
+		}
+		p.Gateway = gw.Unmap()
+	}
+	// Шлюз одного семейства не годится для маршрута другого.
+	if route.Interface == "" && (p.Gateway.Is6() || ipv6) {
+		return Policy{}, fmt.Errorf("route needs an interface when the gateway does not match every address family of the list")
+	}
+
+	p.Sets = []ipset.MarkRule{{Set: name, Mark: route.FWMark}}
+	if ipv6 {
+		p.Sets = append(p.Sets, ipset.MarkRule{Set: name + "6", IPv6: true, Mark: route.FWMark})
+	}
+	return p, nil
+}
+
+// Manager ставит правила и маршруты при старте и убирает их при остановке.
+type Manager struct {
+	cfg     *config.Config
+	backend ipset.Backend
+	logger  *log.Logger
+}
+
+func NewManager(cfg *config.Config, backend ipset.Backend, logger *log.Logger) *Manager {
+	return &Manager{cfg: cfg, backend: backend, logger: logger}
+}
+
+// Apply убирает правила и маршруты, оставшиеся от прошлого запуска, и ставит
+// их по текущему конфигу. Множества должны уже существовать.
+func (m *Manager) Apply() error {
+	policies, err := Policies(m.cfg)
+	if err != nil {
+		return err
+	}
+	if len(policies) == 0 {
+		// Остатки прошлого запуска убираем, но без policy routing его
+		// ошибки (например, ядро без nf_tables) не мешают старту.
+		if err := m.Cleanup(); err != nil {
+			m.logger.Debugf("Policy routing cleanup: %v", err)
+		}
+		return nil
+	}
+
+	if err := removeRoutes(); err != nil {
+		return fmt.Errorf("failed to remove old policy routes: %w", err)
+	}
+	var rules []ipset.MarkRule
+	for _, p := range policies {
+		if err := installRoutes(p); err != nil {
+			return fmt.Errorf("list %s: %w", p.List, err)
+		}
+		rules = append(rules, p.Sets...)
+		m.logger.Infof("Policy routing for list %s: fwmark %#x -> table %d (%s)", p.List, p.Mark, p.Table, describeNextHop(p))
+	}
+
+	marker, ok := m.backend.(ipset.Marker)
+	if !ok {
+		m.logger.Warnf("ipset backend cannot install mark rules, add them to the firewall by hand")
+		return nil
+	}
+	if err := marker.SetMarkRules(rules); err != nil {
+		return fmt.Errorf("failed to install mark rules: %w", err)
+	}
+	return nil
+}
+
+// Cleanup убирает правила mangle, ip rule и маршруты dns-box.
+func (m *Manager) Cleanup() error {
+	var firstErr error
+	if marker, ok := m.backend.(ipset.Marker); ok {
+		firstErr = marker.SetMarkRules(nil)
+	}
+	if err := removeRoutes(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+func describeNextHop(p Policy) string {
+	switch {
+	case p.Interface != "" && p.Gateway.IsValid():
+		return fmt.Sprintf("via %s dev %s", p.Gateway, p.Interface)
+	case p.Gateway.IsValid():
+		return fmt.Sprintf("via %s", p.Gateway)
+	default:
+		return fmt.Sprintf("dev %s", p.Interface)
+	}
+}
@@ -0,0 +1,103 @@
+//go:build linux
+
+package route
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+)
+
+// routeProtocol помечает ip rule и маршруты dns-box (поле protocol, как
+// у маршрутов демонов маршрутизации), чтобы при старте и остановке найти и
+// удалить свои, не трогая чужие.
+const routeProtocol = 166
+
+// installRoutes ставит маршрут по умолчанию в таблицу списка и ip rule для
+// fwmark — для IPv4 и, если у списка есть IPv6-множество, для IPv6.
+func installRoutes(p Policy) error {
+	linkIndex := 0
+	if p.Interface != "" {
+		link, err := netlink.LinkByName(p.Interface)
+		if err != nil {
+			return fmt.Errorf("interface %s: %w", p.Interface, err)
+		}
+		linkIndex = link.Attrs().Index
+	}
+
+	families := []int{netlink.FAMILY_V4}
+	if p.hasIPv6() {
+		families = append(families, netlink.FAMILY_V6)
+	}
+	for _, family := range families {
+		route := &netlink.Route{
+			Family:    family,
+			Dst:       defaultDst(family),
+			Table:     p.Table,
+			LinkIndex: linkIndex,
+			Protocol:  routeProtocol,
+		}
+		if p.Gateway.IsValid() && p.Gateway.Is6() == (family == netlink.FAMILY_V6) {
+			route.Gw = p.Gateway.AsSlice()
+		}
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to add default route to table %d: %w", p.Table, err)
+		}
+
+		rule := netlink.NewRule()
+		rule.Family = family
+		rule.Mark = p.Mark
+		mask := uint32(0xffffffff)
+		rule.Mask = &mask
+		rule.Table = p.Table
+		rule.Protocol = routeProtocol
+		if p.Priority > 0 {
+			rule.Priority = p.Priority
+		}
+		// Списки с общими fwmark и таблицей ставят одно правило.
+		if err := netlink.RuleAdd(rule); err != nil && !errors.Is(err, syscall.EEXIST) {
+			return fmt.Errorf("failed to add rule fwmark %#x lookup %d: %w", p.Mark, p.Table, err)
+		}
+	}
+	return nil
+}
+
+// removeRoutes удаляет все ip rule и маршруты с протоколом dns-box.
+func removeRoutes() error {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules, err := netlink.RuleList(family)
+		if err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			if rule.Protocol != routeProtocol {
+				continue
+			}
+			if err := netlink.RuleDel(&rule); err != nil {
+				return fmt.Errorf("failed to delete rule fwmark %#x lookup %d: %w", rule.Mark, rule.Table, err)
+			}
+		}
+
+		// Table 0 с RT_FILTER_TABLE — маршруты всех таблиц.
+		routes, err := netlink.RouteListFiltered(family, &netlink.Route{Protocol: routeProtocol}, netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_TABLE)
+		if err != nil {
+			return err
+		}
+		for _, route := range routes {
+			if err := netlink.RouteDel(&route); err != nil {
+				return fmt.Errorf("failed to delete route from table %d: %w", route.Table, err)
+			}
+		}
+	}
+	return nil
+}
+
+func defaultDst(family int) *net.IPNet {
+	if family == netlink.FAMILY_V6 {
+		return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+	}
+	return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+}
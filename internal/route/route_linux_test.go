@@ -0,0 +1,132 @@
+//go:build linux
+
+package route
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/crazytypewriter/dns-box/internal/config"
+	"github.com/crazytypewriter/dns-box/internal/ipset"
+	log "github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// enterTestNetns переводит поток теста в новое сетевое пространство имён и
+// возвращает его обратно по окончании теста.
+func enterTestNetns(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("Network namespaces require root")
+	}
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		t.Skipf("Failed to get the current netns: %v", err)
+	}
+	ns, err := netns.New()
+	if err != nil {
+		origin.Close()
+		runtime.UnlockOSThread()
+		t.Skipf("Failed to create a netns: %v", err)
+	}
+	t.Cleanup(func() {
+		netns.Set(origin)
+		ns.Close()
+		origin.Close()
+		runtime.UnlockOSThread()
+	})
+
+	lo, err := netlink.LinkByName("lo")
+	if err == nil {
+		err = netlink.LinkSetUp(lo)
+	}
+	if err != nil {
+		t.Skipf("Failed to bring lo up: %v", err)
+	}
+	// Ядро без CONFIG_IP_MULTIPLE_TABLES не поддерживает ip rule.
+	probe := netlink.NewRule()
+	probe.Table = 4242
+	if err := netlink.RuleAdd(probe); err != nil {
+		t.Skipf("Policy routing is not supported by the kernel: %v", err)
+	}
+	netlink.RuleDel(probe)
+}
+
+func TestManagerInstallsAndRemovesRoutes(t *testing.T) {
+	enterTestNetns(t)
+
+	cfg := &config.Config{IPSet: config.IPSetConfig{Lists: []config.IPSetListConfig{
+		{Name: "vpn", EnableIPv6: true, Route: &config.RouteConfig{Interface: "lo", FWMark: 0x10, Table: 100, Priority: 1000}},
+	}}}
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	// Memory не ставит правила mangle, проверяются только ip rule и маршруты.
+	m := NewManager(cfg, ipset.NewMemory(), logger)
+
+	if err := m.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	// Повторный запуск заменяет правила прошлого, а не дублирует их.
+	if err := m.Apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules := ownRules(t, family)
+		if len(rules) != 1 {
+			t.Fatalf("Expected one rule for family %d, got %+v", family, rules)
+		}
+		if rules[0].Mark != 0x10 || rules[0].Table != 100 || rules[0].Priority != 1000 {
+			t.Errorf("Unexpected rule: %+v", rules[0])
+		}
+
+		routes := ownRoutes(t, family)
+		if len(routes) != 1 {
+			t.Fatalf("Expected one route for family %d, got %+v", family, routes)
+		}
+		if routes[0].Table != 100 || routes[0].LinkIndex == 0 {
+			t.Errorf("Unexpected route: %+v", routes[0])
+		}
+	}
+
+	if err := m.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		if rules := ownRules(t, family); len(rules) != 0 {
+			t.Errorf("Expected rules to be removed, got %+v", rules)
+		}
+		if routes := ownRoutes(t, family); len(routes) != 0 {
+			t.Errorf("Expected routes to be removed, got %+v", routes)
+		}
+	}
+}
+
+func ownRules(t *testing.T, family int) []netlink.Rule {
+	t.Helper()
+	rules, err := netlink.RuleList(family)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var own []netlink.Rule
+	for _, rule := range rules {
+		if rule.Protocol == routeProtocol {
+			own = append(own, rule)
+		}
+	}
+	return own
+}
+
+func ownRoutes(t *testing.T, family int) []netlink.Route {
+	t.Helper()
+	routes, err := netlink.RouteListFiltered(family, &netlink.Route{Protocol: routeProtocol}, netlink.RT_FILTER_PROTOCOL|netlink.RT_FILTER_TABLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return routes
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package route
+
+import "errors"
+
+func installRoutes(p Policy) error {
+	return errors.New("policy routing is only supported on linux")
+}
+
+func removeRoutes() error {
+	return nil
+}
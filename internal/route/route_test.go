@@ -0,0 +1,122 @@
+package route
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/crazytypewriter/dns-box/internal/config"
+	"github.com/crazytypewriter/dns-box/internal/ipset"
+)
+
+func TestPolicies(t *testing.T) {
+	cfg := &config.Config{IPSet: config.IPSetConfig{
+		Lists: []config.IPSetListConfig{
+			{Name: "vpn", EnableIPv6: true, Route: &config.RouteConfig{Interface: "wg0", FWMark: 0x10, Table: 100, Priority: 1000}},
+			{Name: "direct"},
+		},
+		NetLists: []config.NetListConfig{
+			{Name: "corp", Route: &config.RouteConfig{Gateway: "192.0.2.1", FWMark: 0x20, Table: 200}},
+		},
+	}}
+
+	policies, err := Policies(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Policy{
+		{
+			List: "vpn",
+			Sets: []ipset.MarkRule{
+				{Set: "vpn", Mark: 0x10},
+				{Set: "vpn6", IPv6: true, Mark: 0x10},
+			},
+			Mark: 0x10, Table: 100, Priority: 1000, Interface: "wg0",
+		},
+		{
+			List:    "corp",
+			Sets:    []ipset.MarkRule{{Set: "corp", Mark: 0x20}},
+			Mark:    0x20,
+			Table:   200,
+			Gateway: netip.MustParseAddr("192.0.2.1"),
+		},
+	}
+	if !reflect.DeepEqual(policies, want) {
+		t.Errorf("Unexpected policies:\n got %+v\nwant %+v", policies, want)
+	}
+}
+
+func TestPoliciesRejectsInvalidRoutes(t *testing.T) {
+	tests := []struct {
+		name  string
+		lists []config.IPSetListConfig
+		err   string
+	}{
+		{
+			name:  "no fwmark",
+			lists: []config.IPSetListConfig{{Name: "vpn", Route: &config.RouteConfig{Interface: "wg0", Table: 100}}},
+			err:   "fwmark",
+		},
+		{
+			name:  "main table",
+			lists: []config.IPSetListConfig{{Name: "vpn", Route: &config.RouteConfig{Interface: "wg0", FWMark: 1, Table: 254}}},
+			err:   "route.table",
+		},
+		{
+			name:  "no next hop",
+			lists: []config.IPSetListConfig{{Name: "vpn", Route: &config.RouteConfig{FWMark: 1, Table: 100}}},
+			err:   "interface or a gateway",
+		},
+		{
+			name:  "bad gateway",
+			lists: []config.IPSetListConfig{{Name: "vpn", Route: &config.RouteConfig{Gateway: "wg0", FWMark: 1, Table: 100}}},
+			err:   "route.gateway",
+		},
+		{
+			name:  "ipv4 gateway for ipv6 list",
+			lists: []config.IPSetListConfig{{Name: "vpn", EnableIPv6: true, Route: &config.RouteConfig{Gateway: "192.0.2.1", FWMark: 1, Table: 100}}},
+			err:   "needs an interface",
+		},
+		{
+			name: "fwmark in two tables",
+			lists: []config.IPSetListConfig{
+				{Name: "vpn", Route: &config.RouteConfig{Interface: "wg0", FWMark: 1, Table: 100}},
+				{Name: "work", Route: &config.RouteConfig{Interface: "wg0", FWMark: 1, Table: 101}},
+			},
+			err: "already routed",
+		},
+		{
+			name: "table with two interfaces",
+			lists: []config.IPSetListConfig{
+				{Name: "vpn", Route: &config.RouteConfig{Interface: "wg0", FWMark: 1, Table: 100}},
+				{Name: "work", Route: &config.RouteConfig{Interface: "wg1", FWMark: 2, Table: 100}},
+			},
+			err: "already used by list vpn",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{IPSet: config.IPSetConfig{Lists: tt.lists}}
+			_, err := Policies(cfg)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestPoliciesShareTable(t *testing.T) {
+	route := &config.RouteConfig{Interface: "wg0", FWMark: 1, Table: 100}
+	cfg := &config.Config{IPSet: config.IPSetConfig{
+		Lists:    []config.IPSetListConfig{{Name: "vpn", Route: route}},
+		NetLists: []config.NetListConfig{{Name: "vpn_nets", Route: route}},
+	}}
+	policies, err := Policies(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 2 {
+		t.Errorf("Expected lists with the same route to share it, got %+v", policies)
+	}
+}